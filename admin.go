@@ -0,0 +1,258 @@
+package testingrelay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// requireAdmin guards an admin endpoint. Callers authenticate with the
+// ADMIN_TOKEN bearer token or with a NIP-98 signed request from one of the
+// admin pubkeys. Admin endpoints are disabled entirely when neither is
+// configured. Both are read from the live configuration on every request, so
+// reloaded admins take effect at once.
+func requireAdmin(live *LiveConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := live.Load()
+		admins := cfg.admins()
+		if cfg.AdminToken == "" && len(admins) == 0 {
+			http.Error(w, "admin API disabled, set RELAY_ADMIN_TOKEN or RELAY_ADMIN_PUBKEYS to enable it", http.StatusForbidden)
+			return
+		}
+
+		if strings.HasPrefix(r.Header.Get("Authorization"), "Nostr ") {
+			pubkey, err := verifyHTTPAuth(r, cfg.ServiceURL)
+			if err != nil {
+				http.Error(w, "invalid NIP-98 authorization: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if !contains(admins, pubkey) {
+				http.Error(w, "unauthorized: pubkey is not a relay admin", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleChaos reads (GET) or changes (PUT/POST) the fault-injection settings.
+// Updates are merged onto the current settings, so partial bodies like
+// {"drop_ok_rate": 0.5} are fine.
+func handleChaos(chaos *Chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, chaos.Settings())
+
+		case http.MethodPut, http.MethodPost:
+			settings := chaos.Settings()
+			if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+				http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := chaos.Update(settings); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, http.StatusOK, settings)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleScenario reads (GET), replaces (PUT/POST) or clears (DELETE) the
+// running scenario. Loading a scenario resets its nth counters, so harnesses
+// can load the same script again before each test.
+func handleScenario(scenarios *ScenarioEngine, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, scenarios.Scenario())
+
+		case http.MethodPut, http.MethodPost:
+			var scenario Scenario
+			if err := json.NewDecoder(r.Body).Decode(&scenario); err != nil {
+				http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := scenario.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			scenarios.Load(scenario)
+			logger.Info("Scenario loaded via admin API with %d rules", len(scenario.Rules))
+			writeJSON(w, http.StatusOK, scenario)
+
+		case http.MethodDelete:
+			scenarios.Load(Scenario{})
+			logger.Info("Scenario cleared via admin API")
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleConfig reads (GET) or changes (PATCH/PUT) the runtime tunables.
+// Updates are merged onto the current values.
+func handleConfig(live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, live.Load().Tunables())
+
+		case http.MethodPatch, http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "failed to read body", http.StatusBadRequest)
+				return
+			}
+
+			updated, err := patchTunables(live, body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			logger.Info("Configuration updated via admin API: %+v", updated)
+			writeJSON(w, http.StatusOK, updated)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// patchTunables merges the JSON object patch onto the current tunables.
+func patchTunables(live *LiveConfig, patch []byte) (Tunables, error) {
+	var updated Tunables
+	err := live.Update(func(cfg *RelayConfig) error {
+		updated = cfg.Tunables()
+		if err := json.Unmarshal(patch, &updated); err != nil {
+			return fmt.Errorf("invalid JSON body: %w", err)
+		}
+		var err error
+		if updated.WhitelistPubkeys, err = parsePubkeys(updated.WhitelistPubkeys); err != nil {
+			return err
+		}
+		if err := updated.Validate(); err != nil {
+			return err
+		}
+		cfg.SetTunables(updated)
+		return nil
+	})
+	return updated, err
+}
+
+// handleWhitelistEntry adds (PUT) or removes (DELETE) the pubkey in the path,
+// given as hex or npub. Removing the last one is refused, as an empty
+// whitelist lets everyone in: clear it through /admin/config instead.
+func handleWhitelistEntry(live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey, err := parsePubkey(r.PathValue("pubkey"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var update func(cfg *RelayConfig) error
+		switch r.Method {
+		case http.MethodPut:
+			update = func(cfg *RelayConfig) error {
+				if !contains(cfg.WhitelistPubkeys, pubkey) {
+					cfg.WhitelistPubkeys = append(slices.Clone(cfg.WhitelistPubkeys), pubkey)
+				}
+				return nil
+			}
+		case http.MethodDelete:
+			update = func(cfg *RelayConfig) error {
+				if len(cfg.WhitelistPubkeys) == 1 && cfg.WhitelistPubkeys[0] == pubkey {
+					return errors.New("refusing to remove the last whitelisted pubkey, which would let everyone in; clear whitelist_pubkeys through /admin/config for that")
+				}
+				cfg.WhitelistPubkeys = slices.DeleteFunc(slices.Clone(cfg.WhitelistPubkeys), func(pk string) bool {
+					return pk == pubkey
+				})
+				return nil
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := live.Update(update); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Info("Whitelist updated via admin API: %s %s", r.Method, pubkey)
+		writeJSON(w, http.StatusOK, live.Load().WhitelistPubkeys)
+	}
+}
+
+// handleKindEntry adds (PUT) or removes (DELETE) the kind in the path from the
+// allowed kinds. Removing the last one is refused, as no allowed kinds means
+// any kind: clear them through /admin/config instead.
+func handleKindEntry(live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kind, err := strconv.Atoi(r.PathValue("kind"))
+		if err != nil || kind < 0 {
+			http.Error(w, "invalid kind", http.StatusBadRequest)
+			return
+		}
+
+		var update func(cfg *RelayConfig) error
+		switch r.Method {
+		case http.MethodPut:
+			update = func(cfg *RelayConfig) error {
+				if !contains(cfg.AllowedKinds, kind) {
+					cfg.AllowedKinds = append(slices.Clone(cfg.AllowedKinds), kind)
+				}
+				return nil
+			}
+		case http.MethodDelete:
+			update = func(cfg *RelayConfig) error {
+				if len(cfg.AllowedKinds) == 1 && cfg.AllowedKinds[0] == kind {
+					return errors.New("refusing to remove the last allowed kind, which would allow any kind; clear allowed_kinds through /admin/config for that")
+				}
+				cfg.AllowedKinds = slices.DeleteFunc(slices.Clone(cfg.AllowedKinds), func(k int) bool {
+					return k == kind
+				})
+				return nil
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := live.Update(update); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		logger.Info("Allowed kinds updated via admin API: %s %d", r.Method, kind)
+		writeJSON(w, http.StatusOK, live.Load().AllowedKinds)
+	}
+}
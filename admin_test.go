@@ -0,0 +1,46 @@
+package testingrelay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestAdminListEntries(t *testing.T) {
+	pk1, pk2 := "1111111111111111111111111111111111111111111111111111111111111111", "2222222222222222222222222222222222222222222222222222222222222222"
+	tests := []struct {
+		name   string
+		method string
+		pubkey string
+		status int
+		want   []string
+	}{
+		{name: "add", method: http.MethodPut, pubkey: pk2, status: http.StatusOK, want: []string{pk1, pk2}},
+		{name: "remove", method: http.MethodDelete, pubkey: pk2, status: http.StatusOK, want: []string{pk1}},
+		// an empty whitelist would let everyone in
+		{name: "remove the last", method: http.MethodDelete, pubkey: pk1, status: http.StatusConflict, want: []string{pk1}},
+	}
+
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the rows run in order against the same whitelist
+	live := NewLiveConfig(RelayConfig{WhitelistPubkeys: []string{pk1}})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/whitelist/{pubkey}", handleWhitelistEntry(live, logger))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest(tt.method, "/admin/whitelist/"+tt.pubkey, nil))
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if got := live.Load().WhitelistPubkeys; !slices.Equal(got, tt.want) {
+				t.Fatalf("whitelist is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
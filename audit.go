@@ -0,0 +1,282 @@
+package testingrelay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// AuditSettings configure the rejection audit log (AUDIT_*): every event a
+// policy rejects is recorded with the policy, its reason and the client's
+// address in an SQLite file of its own, so it works with every storage
+// backend, and can be searched on /admin/rejections. Entries older than
+// Retention are deleted, none when it is 0. An empty Path turns it off.
+type AuditSettings struct {
+	Path      string        `envconfig:"PATH" default:"./audit.db"`
+	Retention time.Duration `envconfig:"RETENTION" default:"168h"`
+}
+
+func (s AuditSettings) Validate() error {
+	if s.Retention < 0 {
+		return fmt.Errorf("AUDIT_RETENTION must not be negative")
+	}
+	return nil
+}
+
+const (
+	// auditQueueSize bounds how many rejections may wait to be written; more
+	// are dropped, so a flood of spam can't slow the policies down.
+	auditQueueSize = 4096
+
+	auditDefaultLimit = 100
+	auditMaxLimit     = 1000
+)
+
+// Rejection is an entry of the audit log.
+type Rejection struct {
+	EventID    string    `json:"event_id"`
+	PubKey     string    `json:"pubkey"`
+	Kind       int       `json:"kind"`
+	Reason     string    `json:"reason"`
+	Policy     string    `json:"policy"`
+	RemoteAddr string    `json:"remote_addr"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+// Audit is the rejection audit log.
+type Audit struct {
+	db       *sql.DB
+	settings AuditSettings
+	logger   *Logger
+	queue    chan Rejection
+	done     chan struct{}
+	stop     sync.Once
+}
+
+// OpenAudit opens the audit log at settings.Path, keeps it in memory only if
+// the path is ":memory:", and returns nil if it is empty.
+func OpenAudit(settings AuditSettings, logger *Logger) (*Audit, error) {
+	if settings.Path == "" {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite3", settings.Path)
+	if err != nil {
+		return nil, err
+	}
+	// an in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS rejections (
+		event_id TEXT NOT NULL,
+		pubkey TEXT NOT NULL,
+		kind INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		policy TEXT NOT NULL,
+		remote_addr TEXT NOT NULL,
+		rejected_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS rejections_rejected_at ON rejections (rejected_at);
+	CREATE INDEX IF NOT EXISTS rejections_pubkey ON rejections (pubkey, rejected_at);
+	CREATE INDEX IF NOT EXISTS rejections_event_id ON rejections (event_id)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating rejections table in %s: %w", settings.Path, err)
+	}
+
+	a := &Audit{
+		db:       db,
+		settings: settings,
+		logger:   logger,
+		queue:    make(chan Rejection, auditQueueSize),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return a, nil
+}
+
+// Close writes the rejections still queued and closes the file.
+func (a *Audit) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.stop.Do(func() { close(a.queue) })
+	<-a.done
+	return a.db.Close()
+}
+
+// Attach records the rejections of every RejectEvent policy installed so
+// far, named by policies, see policyNames.
+func (a *Audit) Attach(relay *khatru.Relay, policies []string) {
+	if a == nil {
+		return
+	}
+	for i, reject := range relay.RejectEvent {
+		policy := policies[i]
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, event)
+			if rejected {
+				a.record(Rejection{
+					EventID:    event.ID,
+					PubKey:     event.PubKey,
+					Kind:       event.Kind,
+					Reason:     msg,
+					Policy:     policy,
+					RemoteAddr: khatru.GetIP(ctx),
+					RejectedAt: time.Now(),
+				})
+			}
+			return rejected, msg
+		}
+	}
+}
+
+func (a *Audit) record(rejection Rejection) {
+	select {
+	case a.queue <- rejection:
+	default:
+		a.logger.Debug("Audit queue full, dropping the rejection of %s", rejection.EventID)
+	}
+}
+
+// run writes queued rejections and deletes expired ones hourly.
+func (a *Audit) run() {
+	defer close(a.done)
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	a.prune()
+	for {
+		select {
+		case rejection, ok := <-a.queue:
+			if !ok {
+				return
+			}
+			_, err := a.db.Exec(`INSERT INTO rejections (event_id, pubkey, kind, reason, policy, remote_addr, rejected_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				rejection.EventID, rejection.PubKey, rejection.Kind, rejection.Reason, rejection.Policy,
+				rejection.RemoteAddr, rejection.RejectedAt.UnixMilli())
+			if err != nil {
+				a.logger.Error("Failed to record the rejection of %s: %v", rejection.EventID, err)
+			}
+		case <-prune.C:
+			a.prune()
+		}
+	}
+}
+
+func (a *Audit) prune() {
+	if a.settings.Retention == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-a.settings.Retention).UnixMilli()
+	if _, err := a.db.Exec(`DELETE FROM rejections WHERE rejected_at < ?`, cutoff); err != nil {
+		a.logger.Error("Failed to prune the audit log: %v", err)
+	}
+}
+
+// handleRejections lists the newest rejections matching the query: id,
+// pubkey and kind (comma-separated or repeated), ip, reason (a prefix, such
+// as "blocked"), policy, since and until (unix timestamps) and limit.
+func handleRejections(audit *Audit) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if audit == nil {
+			http.Error(w, "audit log disabled, set RELAY_AUDIT_PATH to enable it", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filter, err := exportFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := auditDefaultLimit
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", value), http.StatusBadRequest)
+				return
+			}
+			limit = min(limit, auditMaxLimit)
+		}
+
+		var where []string
+		var args []any
+		in := func(column string, values []string) {
+			if len(values) == 0 {
+				return
+			}
+			where = append(where, column+" IN ("+strings.TrimSuffix(strings.Repeat("?,", len(values)), ",")+")")
+			for _, v := range values {
+				args = append(args, v)
+			}
+		}
+		in("event_id", splitParams(query["id"]))
+		in("pubkey", filter.Authors)
+		in("remote_addr", splitParams(query["ip"]))
+		in("policy", splitParams(query["policy"]))
+		if len(filter.Kinds) > 0 {
+			kinds := make([]string, len(filter.Kinds))
+			for i, kind := range filter.Kinds {
+				kinds[i] = strconv.Itoa(kind)
+			}
+			in("kind", kinds)
+		}
+		if reason := query.Get("reason"); reason != "" {
+			where = append(where, "substr(reason, 1, ?) = ?")
+			args = append(args, len(reason), reason)
+		}
+		if filter.Since != nil {
+			where = append(where, "rejected_at >= ?")
+			args = append(args, int64(*filter.Since)*1000)
+		}
+		if filter.Until != nil {
+			where = append(where, "rejected_at <= ?")
+			args = append(args, int64(*filter.Until)*1000+999)
+		}
+
+		stmt := `SELECT event_id, pubkey, kind, reason, policy, remote_addr, rejected_at FROM rejections`
+		if len(where) > 0 {
+			stmt += " WHERE " + strings.Join(where, " AND ")
+		}
+		stmt += " ORDER BY rejected_at DESC LIMIT ?"
+		args = append(args, limit)
+
+		rows, err := audit.db.QueryContext(r.Context(), stmt, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		rejections := []Rejection{}
+		for rows.Next() {
+			var rejection Rejection
+			var rejectedAt int64
+			if err := rows.Scan(&rejection.EventID, &rejection.PubKey, &rejection.Kind, &rejection.Reason,
+				&rejection.Policy, &rejection.RemoteAddr, &rejectedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rejection.RejectedAt = time.UnixMilli(rejectedAt)
+			rejections = append(rejections, rejection)
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, rejections)
+	}
+}
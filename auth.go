@@ -0,0 +1,50 @@
+package testingrelay
+
+import (
+	"context"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// authRequired reports whether any NIP-42 enforcement is enabled.
+func (cfg *RelayConfig) authRequired() bool {
+	return cfg.AuthRequiredWrite || cfg.AuthRequiredRead
+}
+
+// RejectUnauthedEvent refuses EVENTs from connections that haven't completed
+// NIP-42 AUTH when AUTH_REQUIRED_WRITE is set. The auth-required prefix makes
+// khatru send a fresh AUTH challenge along with the OK.
+func (cfg *RelayConfig) RejectUnauthedEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if cfg.AuthRequiredWrite && khatru.GetAuthed(ctx) == "" {
+		return true, "auth-required: publishing to this relay requires authentication"
+	}
+	return false, ""
+}
+
+// RejectUnauthedFilter refuses REQs and COUNTs from unauthenticated connections
+// when AUTH_REQUIRED_READ is set.
+func (cfg *RelayConfig) RejectUnauthedFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if cfg.AuthRequiredRead && khatru.GetAuthed(ctx) == "" {
+		return true, "auth-required: reading from this relay requires authentication"
+	}
+	return false, ""
+}
+
+// setupAuth installs the NIP-42 enforcement hooks. When enforcement is on the
+// challenge is sent right after connecting, so clients don't have to guess.
+func setupAuth(relay *khatru.Relay, cfg *RelayConfig, logger *Logger) {
+	if !cfg.authRequired() {
+		return
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, cfg.RejectUnauthedEvent)
+	relay.RejectFilter = append(relay.RejectFilter, cfg.RejectUnauthedFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, cfg.RejectUnauthedFilter)
+
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		khatru.RequestAuth(ctx)
+	})
+
+	logger.Info("NIP-42 auth required - write: %v, read: %v", cfg.AuthRequiredWrite, cfg.AuthRequiredRead)
+}
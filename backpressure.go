@@ -0,0 +1,83 @@
+package testingrelay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SlowReader bounds the outbound queue of each websocket (SLOW_READER_*) and
+// sets what happens when a client reads too slowly to keep it from filling
+// up: drop-oldest discards the oldest queued message to make room,
+// drop-newest discards the message being sent, disconnect sends a NOTICE and
+// closes the connection, and block makes the relay wait for the client, which
+// holds up whatever is writing to it.
+type SlowReader struct {
+	QueueSize int    `envconfig:"QUEUE_SIZE" default:"1024"`
+	Policy    string `envconfig:"POLICY" default:"disconnect"`
+}
+
+var slowReaderPolicies = []string{"drop-oldest", "drop-newest", "disconnect", "block"}
+
+func (s SlowReader) Validate() error {
+	if s.QueueSize < 1 {
+		return fmt.Errorf("SLOW_READER_QUEUE_SIZE must be at least 1")
+	}
+	if !contains(slowReaderPolicies, s.Policy) {
+		return fmt.Errorf("invalid SLOW_READER_POLICY %q, expected one of %v", s.Policy, slowReaderPolicies)
+	}
+	return nil
+}
+
+const slowReaderNotice = "error: connection closed, reading too slowly"
+
+// overflow applies the slow reader policy to a data message that found the
+// queue full. It reports whether the message should be queued anyway,
+// waiting for room.
+func (c *wireConn) overflow(msg *wireMessage) bool {
+	c.server.overflows.Add(1)
+
+	switch c.server.slowReader.Policy {
+	case "drop-oldest":
+		select {
+		case <-c.queue:
+		default:
+		}
+		select {
+		case c.queue <- msg:
+		default:
+		}
+		return false
+
+	case "drop-newest":
+		return false
+
+	case "disconnect":
+		for len(c.queue) > 0 {
+			select {
+			case <-c.queue:
+			default:
+			}
+		}
+		notice, _ := json.Marshal(nostr.NoticeEnvelope(slowReaderNotice))
+		for _, last := range []*wireMessage{
+			{opcode: opText, payload: notice},
+			{opcode: opClose, payload: binary.BigEndian.AppendUint16(nil, closePolicyViolation)},
+		} {
+			select {
+			case c.queue <- last:
+			default:
+			}
+		}
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// QueueDepth returns how many messages are waiting for the writer.
+func (c *wireConn) QueueDepth() int {
+	return len(c.queue) + len(c.urgent)
+}
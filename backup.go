@@ -0,0 +1,366 @@
+package testingrelay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+)
+
+// BackupSettings schedule online backups of the sqlite3 database
+// (BACKUP_*): every Interval the database is copied with VACUUM INTO to a
+// timestamped file in Dir, and uploaded to S3 when a bucket is set. Only the
+// latest Keep backups are kept, locally and in the bucket, 0 keeps them all.
+// An Interval of 0 turns the schedule off; POST /admin/backup still works.
+type BackupSettings struct {
+	Interval time.Duration `envconfig:"INTERVAL"`
+	Dir      string        `envconfig:"DIR" default:"./backups"`
+	Keep     int           `envconfig:"KEEP" default:"7"`
+	S3       S3Settings    `envconfig:"S3"`
+}
+
+// S3Settings locate a bucket of S3 or a compatible store like MinIO or R2,
+// addressed by path (https://endpoint/bucket/key). Prefix is prepended to
+// the keys of the uploaded files.
+type S3Settings struct {
+	Endpoint  string `envconfig:"ENDPOINT"`
+	Bucket    string `envconfig:"BUCKET"`
+	Region    string `envconfig:"REGION" default:"us-east-1"`
+	AccessKey string `envconfig:"ACCESS_KEY"`
+	SecretKey string `envconfig:"SECRET_KEY"`
+	Prefix    string `envconfig:"PREFIX"`
+}
+
+func (s BackupSettings) Validate(backend string, shards Shards) error {
+	if s.Interval < 0 || s.Keep < 0 {
+		return fmt.Errorf("BACKUP_INTERVAL and BACKUP_KEEP must not be negative")
+	}
+	if s.Interval > 0 && backend != "sqlite3" {
+		return fmt.Errorf("scheduled backups need DB_BACKEND=sqlite3, use snapshots for other backends")
+	}
+	if s.Interval > 0 && len(shards) > 0 {
+		return fmt.Errorf("scheduled backups copy a single database and can't be combined with shards, use snapshots")
+	}
+	if s.S3.Bucket != "" {
+		if s.S3.Endpoint == "" || s.S3.AccessKey == "" || s.S3.SecretKey == "" {
+			return fmt.Errorf("BACKUP_S3_BUCKET needs BACKUP_S3_ENDPOINT, BACKUP_S3_ACCESS_KEY and BACKUP_S3_SECRET_KEY")
+		}
+		if _, err := url.Parse(s.S3.Endpoint); err != nil {
+			return fmt.Errorf("invalid BACKUP_S3_ENDPOINT: %w", err)
+		}
+	}
+	return nil
+}
+
+// backupResult is what a backup wrote.
+type backupResult struct {
+	File       string `json:"file"`
+	Size       int64  `json:"size"`
+	Uploaded   string `json:"uploaded,omitempty"`
+	Removed    int    `json:"removed"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// backups takes the backups of one sqlite3 database, one at a time.
+type backups struct {
+	settings BackupSettings
+	backend  *sqlite3.SQLite3Backend
+	logger   *Logger
+
+	mu sync.Mutex
+}
+
+// setupBackups starts the schedule, returning the function stopping it and
+// the backups for /admin/backup, nil with other backends and with shards.
+func setupBackups(store eventstore.Store, settings BackupSettings, logger *Logger) (*backups, func() error) {
+	stop := func() error { return nil }
+	backend, ok := store.(*sqlite3.SQLite3Backend)
+	if !ok {
+		return nil, stop
+	}
+	b := &backups{settings: settings, backend: backend, logger: logger}
+	if settings.Interval <= 0 {
+		return b, stop
+	}
+
+	ticker := time.NewTicker(settings.Interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if result, err := b.run(context.Background()); err != nil {
+					logger.Error("Backup failed: %v", err)
+				} else {
+					logger.Info("Backed up the database to %s (%d bytes)", result.File, result.Size)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	logger.Info("Backing up the database to %s every %s, keeping %d", settings.Dir, settings.Interval, settings.Keep)
+	return b, func() error {
+		ticker.Stop()
+		close(done)
+		return nil
+	}
+}
+
+// run takes a backup, uploads it and rotates the old ones.
+func (b *backups) run(ctx context.Context) (backupResult, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := time.Now()
+	if err := os.MkdirAll(b.settings.Dir, 0o755); err != nil {
+		return backupResult{}, err
+	}
+	name := b.prefix() + start.UTC().Format("20060102T150405Z") + ".db"
+	path := filepath.Join(b.settings.Dir, name)
+	// VACUUM INTO reads a consistent copy without holding writers back
+	if _, err := b.backend.DB.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return backupResult{}, fmt.Errorf("VACUUM INTO %s: %w", path, err)
+	}
+	result := backupResult{File: path, Size: fileSize(path)}
+
+	if b.settings.S3.Bucket != "" {
+		key := b.settings.S3.Prefix + name
+		if err := b.settings.S3.upload(ctx, key, path); err != nil {
+			return result, fmt.Errorf("uploading %s: %w", path, err)
+		}
+		result.Uploaded = key
+		removed, err := b.settings.S3.rotate(ctx, b.settings.S3.Prefix+b.prefix(), b.settings.Keep)
+		result.Removed += removed
+		if err != nil {
+			return result, fmt.Errorf("rotating the uploaded backups: %w", err)
+		}
+	}
+
+	removed, err := b.rotate()
+	result.Removed += removed
+	result.DurationMS = time.Since(start).Milliseconds()
+	return result, err
+}
+
+// prefix starts the names of the backups, after the database file.
+func (b *backups) prefix() string {
+	base := filepath.Base(b.backend.DatabaseURL)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + "-"
+}
+
+// rotate deletes the local backups beyond the latest Keep.
+func (b *backups) rotate() (int, error) {
+	if b.settings.Keep == 0 {
+		return 0, nil
+	}
+	names, err := filepath.Glob(filepath.Join(b.settings.Dir, b.prefix()+"*.db"))
+	if err != nil {
+		return 0, err
+	}
+	// the timestamps sort by name
+	sort.Strings(names)
+	removed := 0
+	for len(names) > b.settings.Keep {
+		if err := os.Remove(names[0]); err != nil {
+			return removed, err
+		}
+		names = names[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+// upload PUTs the file at path to key.
+func (s S3Settings) upload(ctx context.Context, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := s.request(ctx, http.MethodPut, key, nil, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	_, err = s.do(req)
+	return err
+}
+
+// rotate deletes the objects under prefix beyond the latest keep.
+func (s S3Settings) rotate(ctx context.Context, prefix string, keep int) (int, error) {
+	if keep == 0 {
+		return 0, nil
+	}
+	req, err := s.request(ctx, http.MethodGet, "", url.Values{"list-type": {"2"}, "prefix": {prefix}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	body, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	var list struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+	}
+	if err := xml.Unmarshal(body, &list); err != nil {
+		return 0, fmt.Errorf("invalid object list: %w", err)
+	}
+
+	keys := make([]string, 0, len(list.Contents))
+	for _, object := range list.Contents {
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	removed := 0
+	for len(keys) > keep {
+		req, err := s.request(ctx, http.MethodDelete, keys[0], nil, nil)
+		if err != nil {
+			return removed, err
+		}
+		if _, err := s.do(req); err != nil {
+			return removed, err
+		}
+		keys = keys[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+// request builds a request for key in the bucket, signed with AWS
+// signature version 4. The payload isn't hashed, so files are streamed.
+func (s S3Settings) request(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket + "/" + key
+	u.RawPath = awsEscape(u.Path, true)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + s.Region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	canonical := strings.Join([]string{
+		method,
+		u.RawPath,
+		u.RawQuery,
+		"host:" + u.Host + "\nx-amz-content-sha256:UNSIGNED-PAYLOAD\nx-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	signingKey := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="+signature)
+	return req, nil
+}
+
+func (s S3Settings) do(req *http.Request) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// canonicalQuery encodes query sorted by key, with awsEscape.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and
+// slashes when keepSlash is set, as signature version 4 requires.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// handleBackup takes a backup now (POST), whatever the schedule.
+func handleBackup(b *backups, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if b == nil {
+			http.Error(w, "backups are only available with the sqlite3 backend and no shards", http.StatusNotImplemented)
+			return
+		}
+		result, err := b.run(r.Context())
+		if err != nil {
+			logger.Error("Backup failed: %v", err)
+			http.Error(w, "backup failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Backed up the database to %s via admin API", result.File)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
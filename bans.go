@@ -0,0 +1,315 @@
+package testingrelay
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Ban types.
+const (
+	banPubkey = "pubkey"
+	banShadow = "shadow" // pubkey whose events are answered OK true but dropped
+	banEvent  = "event"
+	banIP     = "ip"
+	banWord   = "word"  // case-insensitive substring of the content
+	banRegexp = "regex" // Go regular expression matched against the content
+)
+
+// BanSettings configure where bans are kept and what banned events are told.
+type BanSettings struct {
+	Path           string `envconfig:"PATH" default:"./bans.db"`
+	PubkeyMessage  string `envconfig:"PUBKEY_MESSAGE" default:"blocked: pubkey is banned"`
+	EventMessage   string `envconfig:"EVENT_MESSAGE" default:"blocked: event is banned"`
+	ContentMessage string `envconfig:"CONTENT_MESSAGE" default:"blocked: content not allowed"`
+}
+
+// Ban is one entry of the ban list.
+type Ban struct {
+	Type      string    `json:"type"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Bans is the persistent ban list, kept in an SQLite file of its own so it
+// works with every storage backend, and cached in memory for the hooks.
+type Bans struct {
+	db        *sql.DB
+	settings  BanSettings
+	blackhole *blackhole
+
+	mu       sync.RWMutex
+	entries  map[string]map[string]Ban // type -> value -> ban
+	patterns map[string]*regexp.Regexp
+}
+
+// OpenBans loads the ban list from settings.Path, or keeps it in memory only
+// if the path is ":memory:".
+func OpenBans(settings BanSettings) (*Bans, error) {
+	db, err := sql.Open("sqlite3", settings.Path)
+	if err != nil {
+		return nil, err
+	}
+	// an in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS bans (
+		type TEXT NOT NULL,
+		value TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (type, value)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating bans table in %s: %w", settings.Path, err)
+	}
+
+	b := &Bans{
+		db:       db,
+		settings: settings,
+		entries:  make(map[string]map[string]Ban),
+		patterns: make(map[string]*regexp.Regexp),
+	}
+
+	rows, err := db.Query(`SELECT type, value, reason, created_at FROM bans`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ban Ban
+		var createdAt int64
+		if err := rows.Scan(&ban.Type, &ban.Value, &ban.Reason, &createdAt); err != nil {
+			db.Close()
+			return nil, err
+		}
+		ban.CreatedAt = time.Unix(createdAt, 0)
+		if err := b.cache(ban); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Bans) Close() error {
+	return b.db.Close()
+}
+
+// normalizeBan checks the value for the ban type and puts it in canonical form.
+func normalizeBan(banType, value string) (string, error) {
+	switch banType {
+	case banPubkey, banShadow:
+		return parsePubkey(value)
+	case banEvent:
+		if value = strings.ToLower(value); !isHexKey(value) {
+			return "", fmt.Errorf("invalid event id %q", value)
+		}
+		return value, nil
+	case banIP:
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return "", fmt.Errorf("invalid IP %q", value)
+		}
+		return ip.String(), nil
+	case banWord:
+		if value = strings.ToLower(strings.TrimSpace(value)); value == "" {
+			return "", fmt.Errorf("empty word")
+		}
+		return value, nil
+	case banRegexp:
+		if _, err := regexp.Compile(value); err != nil {
+			return "", fmt.Errorf("invalid regex: %w", err)
+		}
+		return value, nil
+	default:
+		return "", fmt.Errorf("unknown ban type %q, expected pubkey, shadow, event, ip, word or regex", banType)
+	}
+}
+
+// Add bans value, replacing the reason of an existing ban.
+func (b *Bans) Add(banType, value, reason string) (Ban, error) {
+	value, err := normalizeBan(banType, value)
+	if err != nil {
+		return Ban{}, err
+	}
+
+	ban := Ban{Type: banType, Value: value, Reason: reason, CreatedAt: time.Now().Truncate(time.Second)}
+	_, err = b.db.Exec(`INSERT INTO bans (type, value, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (type, value) DO UPDATE SET reason = excluded.reason`,
+		ban.Type, ban.Value, ban.Reason, ban.CreatedAt.Unix())
+	if err != nil {
+		return Ban{}, err
+	}
+	return ban, b.cache(ban)
+}
+
+// Remove lifts a ban. Removing something that isn't banned is not an error.
+func (b *Bans) Remove(banType, value string) error {
+	value, err := normalizeBan(banType, value)
+	if err != nil {
+		return err
+	}
+	if _, err := b.db.Exec(`DELETE FROM bans WHERE type = ? AND value = ?`, banType, value); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.entries[banType], value)
+	if banType == banRegexp {
+		delete(b.patterns, value)
+	}
+	return nil
+}
+
+func (b *Bans) cache(ban Ban) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ban.Type == banRegexp {
+		pattern, err := regexp.Compile(ban.Value)
+		if err != nil {
+			return fmt.Errorf("stored regex %q: %w", ban.Value, err)
+		}
+		b.patterns[ban.Value] = pattern
+	}
+	if b.entries[ban.Type] == nil {
+		b.entries[ban.Type] = make(map[string]Ban)
+	}
+	b.entries[ban.Type][ban.Value] = ban
+	return nil
+}
+
+// Get returns the ban on value, if there is one.
+func (b *Bans) Get(banType, value string) (Ban, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ban, ok := b.entries[banType][value]
+	return ban, ok
+}
+
+// List returns the bans of one type, or all of them if banType is empty,
+// sorted by type and value.
+func (b *Bans) List(banType string) []Ban {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	list := []Ban{}
+	for t, entries := range b.entries {
+		if banType != "" && t != banType {
+			continue
+		}
+		for _, ban := range entries {
+			list = append(list, ban)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].Value < list[j].Value
+	})
+	return list
+}
+
+// Attach installs the hooks enforcing the bans. Banned IPs can't connect.
+// The events of shadow-banned pubkeys are swallowed by blackhole, so they
+// are never stored or broadcast.
+func (b *Bans) Attach(relay *khatru.Relay, blackhole *blackhole) {
+	b.blackhole = blackhole
+	relay.RejectEvent = append(relay.RejectEvent, b.RejectEvent)
+	relay.RejectConnection = append(relay.RejectConnection, b.RejectConnection)
+}
+
+func (b *Bans) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if _, banned := b.entries[banPubkey][event.PubKey]; banned {
+		return true, b.settings.PubkeyMessage
+	}
+	if _, banned := b.entries[banShadow][event.PubKey]; banned {
+		b.blackhole.swallow(event.ID)
+		return false, ""
+	}
+	if _, banned := b.entries[banEvent][event.ID]; banned {
+		return true, b.settings.EventMessage
+	}
+
+	if len(b.entries[banWord]) > 0 {
+		content := strings.ToLower(event.Content)
+		for word := range b.entries[banWord] {
+			if strings.Contains(content, word) {
+				return true, b.settings.ContentMessage
+			}
+		}
+	}
+	for _, pattern := range b.patterns {
+		if pattern.MatchString(event.Content) {
+			return true, b.settings.ContentMessage
+		}
+	}
+	return false, ""
+}
+
+func (b *Bans) RejectConnection(r *http.Request) bool {
+	_, banned := b.Get(banIP, khatru.GetIPFromRequest(r))
+	return banned
+}
+
+// handleBans lists (GET, optionally ?type=), adds (POST, a JSON Ban) or
+// removes (DELETE, ?type=&value=) bans.
+func handleBans(bans *Bans, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, bans.List(r.URL.Query().Get("type")))
+
+		case http.MethodPost:
+			var ban Ban
+			if err := json.NewDecoder(r.Body).Decode(&ban); err != nil {
+				http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			ban, err := bans.Add(ban.Type, ban.Value, ban.Reason)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("Banned %s %s via admin API: %s", ban.Type, ban.Value, ban.Reason)
+			writeJSON(w, http.StatusOK, ban)
+
+		case http.MethodDelete:
+			banType, value := r.URL.Query().Get("type"), r.URL.Query().Get("value")
+			if err := bans.Remove(banType, value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("Unbanned %s %s via admin API", banType, value)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
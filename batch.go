@@ -0,0 +1,308 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// WriteBatch configures batched writes to sqlite3. Size is how many events
+// are committed in one transaction, 0 keeps one transaction per event, and
+// Interval how long the first event of a batch waits for others. Durability
+// is sync (the default) to acknowledge events once their batch is committed,
+// or async to acknowledge them as soon as they are queued: faster, but a
+// crash loses the queue and events show up in queries only once committed.
+type WriteBatch struct {
+	Size       int           `envconfig:"SIZE"`
+	Interval   time.Duration `envconfig:"INTERVAL" default:"10ms"`
+	Durability string        `envconfig:"DURABILITY" default:"sync"`
+}
+
+func (s WriteBatch) Validate() error {
+	if s.Size < 0 {
+		return fmt.Errorf("WRITE_BATCH_SIZE must not be negative")
+	}
+	if s.Size > 0 && s.Interval <= 0 {
+		return fmt.Errorf("WRITE_BATCH_INTERVAL must be positive")
+	}
+	switch s.Durability {
+	case "sync", "async":
+		return nil
+	default:
+		return fmt.Errorf("invalid WRITE_BATCH_DURABILITY %q, expected sync or async", s.Durability)
+	}
+}
+
+// batchingStore queues the events saved to an sqlite3 backend and inserts them
+// in batched transactions from a single goroutine. Replacements and deletions
+// commit the queue first, so writes keep their order, and replaceable events
+// are acknowledged only once committed whatever the durability. Events
+// already queued or stored are refused as duplicates before they are queued,
+// so async writes don't acknowledge and broadcast them again.
+type batchingStore struct {
+	eventstore.Store
+	backend  *sqlite3.SQLite3Backend
+	settings WriteBatch
+	logger   *Logger
+
+	queue   chan *queuedWrite
+	flushes chan chan struct{}
+	done    chan struct{}
+	closing sync.Once
+
+	mu     sync.Mutex
+	queued map[string]bool // ids queued and not committed yet
+}
+
+// queuedWrite is an event waiting for its batch. result is nil for async
+// writes, whose errors are only logged.
+type queuedWrite struct {
+	event  *nostr.Event
+	result chan error
+}
+
+// newBatchingStore batches the writes to store when it is sqlite3 and
+// WRITE_BATCH_SIZE is set, and returns it unchanged otherwise.
+func newBatchingStore(store eventstore.Store, settings WriteBatch, logger *Logger) eventstore.Store {
+	backend, ok := store.(*sqlite3.SQLite3Backend)
+	if !ok || settings.Size <= 0 {
+		return store
+	}
+
+	s := &batchingStore{
+		Store:    store,
+		backend:  backend,
+		settings: settings,
+		logger:   logger,
+		queue:    make(chan *queuedWrite, settings.Size),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+		queued:   make(map[string]bool),
+	}
+	go s.run()
+	logger.Info("Batching writes by %d events or %s, %s durability", settings.Size, settings.Interval, settings.Durability)
+	return s
+}
+
+func (s *batchingStore) run() {
+	defer close(s.done)
+
+	var batch []*queuedWrite
+	var deadline <-chan time.Time
+	commit := func() {
+		s.commit(batch)
+		batch, deadline = nil, nil
+	}
+	for {
+		select {
+		case w, ok := <-s.queue:
+			if !ok {
+				commit()
+				return
+			}
+			batch = append(batch, w)
+			if len(batch) == 1 {
+				deadline = time.After(s.settings.Interval)
+			}
+			if len(batch) >= s.settings.Size {
+				commit()
+			}
+		case <-deadline:
+			commit()
+		case flushed := <-s.flushes:
+			// the writes queued before the flush may not be taken yet
+			batch = s.drain(batch)
+			commit()
+			close(flushed)
+		}
+	}
+}
+
+// drain appends the writes waiting in the queue to batch.
+func (s *batchingStore) drain(batch []*queuedWrite) []*queuedWrite {
+	for {
+		select {
+		case w, ok := <-s.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, w)
+		default:
+			return batch
+		}
+	}
+}
+
+// commit inserts a batch in one transaction and reports the outcome of each
+// write: a duplicate only fails its own event, any other error the batch.
+func (s *batchingStore) commit(batch []*queuedWrite) {
+	if len(batch) == 0 {
+		return
+	}
+
+	results := make([]error, len(batch))
+	if err := s.insert(batch, results); err != nil {
+		for i := range results {
+			results[i] = err
+		}
+	}
+	s.mu.Lock()
+	for _, w := range batch {
+		delete(s.queued, w.event.ID)
+	}
+	s.mu.Unlock()
+
+	for i, w := range batch {
+		if w.result != nil {
+			w.result <- results[i]
+		} else if err := results[i]; err != nil && !errors.Is(err, eventstore.ErrDupEvent) {
+			s.logger.Error("Failed to write event %s: %v", w.event.ID, err)
+		}
+	}
+}
+
+func (s *batchingStore) insert(batch []*queuedWrite, results []error) error {
+	s.backend.Lock()
+	defer s.backend.Unlock()
+
+	tx, err := s.backend.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+        INSERT OR IGNORE INTO event (id, pubkey, created_at, kind, tags, content, sig)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, w := range batch {
+		evt := w.event
+		tagsj, _ := json.Marshal(evt.Tags)
+		res, err := stmt.Exec(evt.ID, evt.PubKey, evt.CreatedAt, evt.Kind, tagsj, evt.Content, evt.Sig)
+		if err != nil {
+			return err
+		}
+		nr, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if nr == 0 {
+			results[i] = eventstore.ErrDupEvent
+		}
+	}
+	return tx.Commit()
+}
+
+// flusher is a store holding writes back until they are flushed, like
+// batchingStore and a shardedStore of them.
+type flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush commits the queued events.
+func (s *batchingStore) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case s.flushes <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *batchingStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.reserve(event.ID); err != nil {
+		return err
+	}
+
+	w := &queuedWrite{event: event}
+	// replacingStore looks for the previous version before saving one, so
+	// replaceable events must be committed when acknowledged to be found
+	if s.settings.Durability == "sync" || isReplaceable(event.Kind) {
+		w.result = make(chan error, 1)
+	}
+	select {
+	case s.queue <- w:
+	case <-ctx.Done():
+		s.mu.Lock()
+		delete(s.queued, event.ID)
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+	if w.result == nil {
+		return nil
+	}
+
+	select {
+	case err := <-w.result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve marks id as queued, or returns eventstore.ErrDupEvent when it
+// already is or the event is stored.
+func (s *batchingStore) reserve(id string) error {
+	s.mu.Lock()
+	if s.queued[id] {
+		s.mu.Unlock()
+		return eventstore.ErrDupEvent
+	}
+	s.queued[id] = true
+	s.mu.Unlock()
+
+	var stored int
+	err := s.backend.DB.QueryRow(`SELECT count(*) FROM event WHERE id = $1`, id).Scan(&stored)
+	if err == nil && stored == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	delete(s.queued, id)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return eventstore.ErrDupEvent
+}
+
+func (s *batchingStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	return s.Store.ReplaceEvent(ctx, event)
+}
+
+func (s *batchingStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	return s.Store.DeleteEvent(ctx, event)
+}
+
+// Close commits what is queued and closes the backend. The gatedStore in
+// front guarantees no write runs anymore.
+func (s *batchingStore) Close() {
+	s.closing.Do(func() {
+		close(s.queue)
+		<-s.done
+		s.Store.Close()
+	})
+}
@@ -0,0 +1,131 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestBatchingStore opens an sqlite3 database in a temporary directory
+// behind a batchingStore with settings, closed when the test ends.
+func newTestBatchingStore(t *testing.T, settings WriteBatch) (*batchingStore, *sqlite3.SQLite3Backend) {
+	t.Helper()
+
+	backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "events.db"), QueryLimit: scanQueryLimit}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, ok := newBatchingStore(backend, settings, logger).(*batchingStore)
+	if !ok {
+		t.Fatalf("sqlite3 with %+v isn't batched", settings)
+	}
+	t.Cleanup(store.Close)
+	return store, backend
+}
+
+func TestBatchingStoreWrites(t *testing.T) {
+	tests := []struct {
+		durability string
+		interval   time.Duration
+		// whether the backend has the event once SaveEvent returns
+		committed bool
+	}{
+		{durability: "sync", interval: 20 * time.Millisecond, committed: true},
+		{durability: "async", interval: time.Hour, committed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.durability, func(t *testing.T) {
+			ctx := context.Background()
+			store, backend := newTestBatchingStore(t, WriteBatch{Size: 10, Interval: tt.interval, Durability: tt.durability})
+
+			note := signedEvent(t, "", nostr.KindTextNote, tt.durability, nil)
+			if err := store.SaveEvent(ctx, note); err != nil {
+				t.Fatal(err)
+			}
+			filter := nostr.Filter{IDs: []string{note.ID}}
+			if ids := storedIDs(t, backend, filter); (len(ids) == 1) != tt.committed {
+				t.Fatalf("backend has %v right after saving, want committed %v", ids, tt.committed)
+			}
+			// refused whether it is still queued or committed already
+			if err := store.SaveEvent(ctx, note); !errors.Is(err, eventstore.ErrDupEvent) {
+				t.Fatalf("saving it again got %v, want ErrDupEvent", err)
+			}
+
+			if err := store.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if ids := storedIDs(t, backend, filter); len(ids) != 1 {
+				t.Fatalf("backend has %v after flushing, want %s", ids, note.ID)
+			}
+			if err := store.SaveEvent(ctx, note); !errors.Is(err, eventstore.ErrDupEvent) {
+				t.Fatalf("saving it after the commit got %v, want ErrDupEvent", err)
+			}
+		})
+	}
+}
+
+func TestBatchingStoreAsyncReplaceable(t *testing.T) {
+	ctx := context.Background()
+	batched, _ := newTestBatchingStore(t, WriteBatch{Size: 10, Interval: 20 * time.Millisecond, Durability: "async"})
+	store := &replacingStore{Store: batched}
+
+	sk := nostr.GeneratePrivateKey()
+	older := signedAt(t, sk, nostr.KindProfileMetadata, 1000, "older", nil)
+	newer := signedAt(t, sk, nostr.KindProfileMetadata, 2000, "newer", nil)
+	for _, event := range []*nostr.Event{older, newer} {
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatalf("saving %s: %v", event.Content, err)
+		}
+	}
+
+	// the newer version saw the older one committed and replaced it
+	if ids := storedIDs(t, store, addressFilter(newer)); len(ids) != 1 || ids[0] != newer.ID {
+		t.Fatalf("stored %v, want only %s", ids, newer.ID)
+	}
+}
+
+func TestHoldFlushesShards(t *testing.T) {
+	ctx := context.Background()
+	settings := WriteBatch{Size: 10, Interval: time.Hour, Durability: "async"}
+	primary, primaryBackend := newTestBatchingStore(t, settings)
+	shard, shardBackend := newTestBatchingStore(t, settings)
+	store := &gatedStore{Store: &shardedStore{
+		primary: primary,
+		shards:  []storeShard{{Store: shard, ranges: []kindRange{{1000, 1999}}}},
+	}}
+
+	note := signedEvent(t, "", nostr.KindTextNote, "primary", nil)
+	file := signedEvent(t, "", nostr.KindFileMetadata, "shard", nil)
+	for _, event := range []*nostr.Event{note, file} {
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what is read under Hold has every acknowledged write, whatever its shard
+	err := store.Hold(ctx, func() error {
+		for _, stored := range []struct {
+			backend *sqlite3.SQLite3Backend
+			event   *nostr.Event
+		}{{primaryBackend, note}, {shardBackend, file}} {
+			if ids := storedIDs(t, stored.backend, nostr.Filter{IDs: []string{stored.event.ID}}); len(ids) != 1 {
+				t.Errorf("backend has %v under Hold, want %s", ids, stored.event.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
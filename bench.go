@@ -0,0 +1,303 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// benchOptions are the flags of the bench command.
+type benchOptions struct {
+	url         string
+	publishers  int
+	subscribers int
+	rate        float64
+	duration    time.Duration
+	size        int
+	kind        int
+	unsigned    bool
+}
+
+// benchResult is what bench reports. Latencies are in milliseconds.
+type benchResult struct {
+	URL        string       `json:"url"`
+	Duration   float64      `json:"duration_seconds"`
+	Published  int          `json:"published"`
+	Rejected   int          `json:"rejected"`
+	Failed     int          `json:"failed"`
+	Throughput float64      `json:"events_per_second"`
+	Publish    benchLatency `json:"publish_latency_ms"`
+	Delivered  int          `json:"delivered"`
+	Delivery   benchLatency `json:"delivery_latency_ms"`
+	Errors     []string     `json:"errors,omitempty"`
+	published  []time.Duration
+	delivered  []time.Duration
+}
+
+type benchLatency struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// maxBenchErrors bounds how many distinct errors are reported.
+const maxBenchErrors = 10
+
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	var opts benchOptions
+	flags.StringVar(&opts.url, "url", "", "relay to load, an in-process relay configured like serve if empty")
+	configPath := flags.String("config", "", "YAML config file of the in-process relay, overridden by RELAY_* env vars")
+	flags.IntVar(&opts.publishers, "publishers", 10, "concurrent clients publishing events")
+	flags.IntVar(&opts.subscribers, "subscribers", 10, "concurrent clients subscribed to the published events")
+	flags.Float64Var(&opts.rate, "rate", 10, "events per second each publisher sends, 0 for as fast as the relay answers")
+	flags.DurationVar(&opts.duration, "duration", 10*time.Second, "how long to publish")
+	flags.IntVar(&opts.size, "size", 100, "content bytes per event")
+	flags.IntVar(&opts.kind, "kind", nostr.KindTextNote, "kind of the published events")
+	flags.BoolVar(&opts.unsigned, "unsigned", false, "send events without a signature, for relays with SIG_VERIFY_SKIP")
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s bench [flags]\n\nPublishes signed events from -publishers clients while -subscribers clients\nreceive them, then reports throughput and latency percentiles. Publish latency\nruns until the OK, delivery latency until a subscriber gets the event.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if opts.publishers < 1 || opts.subscribers < 0 || opts.rate < 0 || opts.duration <= 0 || opts.size < 0 {
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	if opts.url == "" {
+		cfg, extra, _, err := loadCommandConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+			return 1
+		}
+		cfg.Port, cfg.GRPCPort = 0, 0
+		cfg.Listen = Listeners{Public: true}
+		logger, err := NewLogger(os.Stderr, cfg.LogFormat, "error")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to configure logging: %v\n", err)
+			return 1
+		}
+		relay, err := newRelay(cfg, extra, logger)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := relay.Start(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to listen: %v\n", err)
+			relay.close()
+			return 1
+		}
+		defer relay.Shutdown(context.Background())
+		opts.url = relay.URL()
+	}
+
+	result, err := bench(ctx, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	} else {
+		result.print()
+	}
+	if result.Published == 0 {
+		return 1
+	}
+	return 0
+}
+
+// bench connects the clients, publishes for opts.duration and waits a moment
+// for the last deliveries.
+func bench(ctx context.Context, opts benchOptions) (*benchResult, error) {
+	// the run id tags the events so subscribers only count this run's
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+	result := &benchResult{URL: opts.url}
+	var mu sync.Mutex
+	// note keeps the first distinct errors, with mu held
+	note := func(err error) {
+		if len(result.Errors) < maxBenchErrors && !slices.Contains(result.Errors, err.Error()) {
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+
+	subCtx, stopSubs := context.WithCancel(ctx)
+	defer stopSubs()
+	var subs sync.WaitGroup
+	since := nostr.Now()
+	for range opts.subscribers {
+		conn, err := nostr.RelayConnect(ctx, opts.url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect a subscriber to %s: %w", opts.url, err)
+		}
+		defer conn.Close()
+		sub, err := conn.Subscribe(subCtx, nostr.Filters{{
+			Kinds: []int{opts.kind},
+			Tags:  nostr.TagMap{"t": []string{"bench-" + run}},
+			Since: &since,
+		}})
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe: %w", err)
+		}
+
+		subs.Add(1)
+		go func() {
+			defer subs.Done()
+			for event := range sub.Events {
+				sent, _, _ := strings.Cut(event.Content, " ")
+				nanos, err := strconv.ParseInt(sent, 10, 64)
+				if err != nil {
+					continue
+				}
+				latency := time.Since(time.Unix(0, nanos))
+				mu.Lock()
+				result.delivered = append(result.delivered, latency)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	pubCtx, stopPubs := context.WithTimeout(ctx, opts.duration)
+	defer stopPubs()
+	var pubs sync.WaitGroup
+	padding := strings.Repeat("x", opts.size)
+	started := time.Now()
+	for range opts.publishers {
+		conn, err := nostr.RelayConnect(ctx, opts.url)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect a publisher to %s: %w", opts.url, err)
+		}
+		defer conn.Close()
+		secret := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(secret)
+
+		pubs.Add(1)
+		go func() {
+			defer pubs.Done()
+			var tick <-chan time.Time
+			if opts.rate > 0 {
+				ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+			for {
+				if tick != nil {
+					select {
+					case <-pubCtx.Done():
+						return
+					case <-tick:
+					}
+				} else if pubCtx.Err() != nil {
+					return
+				}
+
+				sent := time.Now()
+				event := nostr.Event{
+					CreatedAt: nostr.Now(),
+					Kind:      opts.kind,
+					Tags:      nostr.Tags{{"t", "bench-" + run}},
+					Content:   strconv.FormatInt(sent.UnixNano(), 10) + " " + padding,
+				}
+				if opts.unsigned {
+					event.PubKey = pubkey
+					event.ID = event.GetID()
+				} else if err := event.Sign(secret); err != nil {
+					return
+				}
+				// a publish still waiting for its OK when the run ends
+				// finishes, so it gets ctx rather than pubCtx
+				err := conn.Publish(ctx, event)
+				latency := time.Since(sent)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					result.Published++
+					result.published = append(result.published, latency)
+				case strings.HasPrefix(err.Error(), "msg: "):
+					// go-nostr reports OK false as "msg: <reason>"
+					result.Rejected++
+					note(err)
+				default:
+					result.Failed++
+					note(err)
+				}
+				mu.Unlock()
+				if err != nil && !conn.IsConnected() {
+					return
+				}
+			}
+		}()
+	}
+	pubs.Wait()
+	elapsed := time.Since(started)
+
+	// give the subscribers a moment for the events still on their way
+	if opts.subscribers > 0 {
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
+	}
+	stopSubs()
+	subs.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	result.Duration = elapsed.Seconds()
+	result.Throughput = float64(result.Published) / elapsed.Seconds()
+	result.Publish = latencies(result.published)
+	result.Delivered = len(result.delivered)
+	result.Delivery = latencies(result.delivered)
+	return result, nil
+}
+
+// latencies summarizes durations as percentiles in milliseconds.
+func latencies(durations []time.Duration) benchLatency {
+	if len(durations) == 0 {
+		return benchLatency{}
+	}
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	at := func(p float64) float64 {
+		i := min(len(sorted)-1, int(p*float64(len(sorted))))
+		return float64(sorted[i].Microseconds()) / 1000
+	}
+	return benchLatency{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: at(1)}
+}
+
+func (r *benchResult) print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "relay\t%s\n", r.URL)
+	fmt.Fprintf(w, "duration\t%.1fs\n", r.Duration)
+	fmt.Fprintf(w, "published\t%d (%d rejected, %d failed)\n", r.Published, r.Rejected, r.Failed)
+	fmt.Fprintf(w, "throughput\t%.1f events/s\n", r.Throughput)
+	fmt.Fprintf(w, "publish latency\tp50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms\n", r.Publish.P50, r.Publish.P90, r.Publish.P99, r.Publish.Max)
+	fmt.Fprintf(w, "delivered\t%d\n", r.Delivered)
+	if r.Delivered > 0 {
+		fmt.Fprintf(w, "delivery latency\tp50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms\n", r.Delivery.P50, r.Delivery.P90, r.Delivery.P99, r.Delivery.Max)
+	}
+	w.Flush()
+	for _, msg := range r.Errors {
+		fmt.Fprintf(os.Stderr, "error: %s\n", msg)
+	}
+}
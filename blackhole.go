@@ -0,0 +1,345 @@
+package testingrelay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// blackholeModes are the ways the relay can lie about accepted events: drop
+// answers OK true without storing them, hide stores them but never serves
+// them. Neither broadcasts them, ephemeral ones included.
+var blackholeModes = []string{"", "drop", "hide"}
+
+func validateBlackhole(mode string) error {
+	if !contains(blackholeModes, mode) {
+		return fmt.Errorf("invalid BLACKHOLE %q, expected drop, hide or empty", mode)
+	}
+	return nil
+}
+
+// swallowedTTL is how long the events that were never stored are remembered,
+// long enough to keep them out of the broadcast that follows their OK. Hidden
+// events are checked against the store as often, and forgotten once they are
+// no longer stored.
+const swallowedTTL = 10 * time.Minute
+
+// blackhole remembers the events it swallowed, so they are kept out of
+// queries and broadcasts even after the mode is turned off. Hidden events
+// are kept in an SQLite file of their own (BLACKHOLE_PATH), so they stay
+// hidden across restarts, until they are replaced or deleted; the others are
+// only remembered for swallowedTTL, as there is nothing stored to keep out.
+type blackhole struct {
+	live   *LiveConfig
+	store  eventstore.Store
+	db     *sql.DB
+	logger *Logger
+
+	mu        sync.RWMutex
+	swallowed map[string]time.Time // never stored, by id, until when
+	hidden    map[string]time.Time // stored, by id, since when
+	pruned    time.Time
+}
+
+// setupBlackhole loads the hidden events from path, kept in memory only if it
+// is ":memory:", and forgets those store no longer holds until ctx is done.
+func setupBlackhole(ctx context.Context, relay *khatru.Relay, live *LiveConfig, store eventstore.Store, path string, logger *Logger) (*blackhole, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// an in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS hidden (
+		id TEXT PRIMARY KEY,
+		hidden_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating hidden table in %s: %w", path, err)
+	}
+
+	b := &blackhole{
+		live:      live,
+		store:     store,
+		db:        db,
+		logger:    logger,
+		swallowed: make(map[string]time.Time),
+		hidden:    make(map[string]time.Time),
+		pruned:    time.Now(),
+	}
+	if err := b.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("loading hidden events from %s: %w", path, err)
+	}
+	go b.forgetDeleted(ctx)
+
+	relay.PreventBroadcast = append(relay.PreventBroadcast, b.preventBroadcast)
+	if mode := live.Load().Blackhole; mode != "" {
+		logger.Info("Blackhole mode %s enabled, accepted events are never served", mode)
+	}
+	if len(b.hidden) > 0 {
+		logger.Info("Blackhole: %d hidden events stay hidden", len(b.hidden))
+	}
+	return b, nil
+}
+
+func (b *blackhole) load() error {
+	rows, err := b.db.Query(`SELECT id, hidden_at FROM hidden`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var hiddenAt int64
+		if err := rows.Scan(&id, &hiddenAt); err != nil {
+			return err
+		}
+		b.hidden[id] = time.Unix(hiddenAt, 0)
+	}
+	return rows.Err()
+}
+
+func (b *blackhole) Close() error {
+	return b.db.Close()
+}
+
+// swallow remembers an event accepted without being stored.
+func (b *blackhole) swallow(id string) {
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.pruned) > swallowedTTL {
+		for id, until := range b.swallowed {
+			if now.After(until) {
+				delete(b.swallowed, id)
+			}
+		}
+		b.pruned = now
+	}
+	b.swallowed[id] = now.Add(swallowedTTL)
+}
+
+// hide remembers a stored event until it is no longer stored.
+func (b *blackhole) hide(id string) {
+	now := time.Now()
+	if _, err := b.db.Exec(`INSERT OR IGNORE INTO hidden (id, hidden_at) VALUES (?, ?)`, id, now.Unix()); err != nil {
+		b.logger.Error("Blackhole: failed to record hidden event %s: %v", id, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.hidden[id]; !ok {
+		b.hidden[id] = now
+	}
+}
+
+func (b *blackhole) isSwallowed(id string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if _, ok := b.hidden[id]; ok {
+		return true
+	}
+	until, ok := b.swallowed[id]
+	return ok && time.Now().Before(until)
+}
+
+// forgetDeleted checks the hidden events against the store every
+// swallowedTTL and forgets those it no longer holds. Events hidden less than
+// swallowedTTL ago are left alone, as batched writes may not have reached
+// the store yet.
+func (b *blackhole) forgetDeleted(ctx context.Context) {
+	ticker := time.NewTicker(swallowedTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cutoff := time.Now().Add(-swallowedTTL)
+		var ids []string
+		b.mu.RLock()
+		for id, since := range b.hidden {
+			if since.Before(cutoff) {
+				ids = append(ids, id)
+			}
+		}
+		b.mu.RUnlock()
+
+		for chunk := range slices.Chunk(ids, 500) {
+			gone, err := b.unstored(ctx, chunk)
+			if err != nil {
+				b.logger.Error("Blackhole: failed to check hidden events: %v", err)
+				break
+			}
+			for _, id := range gone {
+				b.forget(id)
+			}
+		}
+	}
+}
+
+// unstored returns the ids the store doesn't hold.
+func (b *blackhole) unstored(ctx context.Context, ids []string) ([]string, error) {
+	ch, err := b.store.QueryEvents(ctx, nostr.Filter{IDs: ids, Limit: len(ids)})
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]bool, len(ids))
+	for event := range ch {
+		stored[event.ID] = true
+	}
+	return slices.DeleteFunc(slices.Clone(ids), func(id string) bool { return stored[id] }), nil
+}
+
+func (b *blackhole) forget(id string) {
+	if _, err := b.db.Exec(`DELETE FROM hidden WHERE id = ?`, id); err != nil {
+		b.logger.Error("Blackhole: failed to forget hidden event %s: %v", id, err)
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hidden, id)
+}
+
+func (b *blackhole) preventBroadcast(ws *khatru.WebSocket, event *nostr.Event) bool {
+	if nostr.IsEphemeralKind(event.Kind) {
+		return b.live.Load().Blackhole != "" || b.isSwallowed(event.ID)
+	}
+	return b.isSwallowed(event.ID)
+}
+
+// Store wraps the store the relay serves from.
+func (b *blackhole) Store(store eventstore.Store) eventstore.Store {
+	return &blackholeStore{Store: store, blackhole: b}
+}
+
+type blackholeStore struct {
+	eventstore.Store
+	blackhole *blackhole
+}
+
+func (s *blackholeStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	return s.save(event, func() error { return s.Store.SaveEvent(ctx, event) })
+}
+
+func (s *blackholeStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	return s.save(event, func() error { return s.Store.ReplaceEvent(ctx, event) })
+}
+
+func (s *blackholeStore) save(event *nostr.Event, store func() error) error {
+	// swallowed before it got here, e.g. shadow-accepted spam
+	if s.blackhole.isSwallowed(event.ID) {
+		return nil
+	}
+	switch s.blackhole.live.Load().Blackhole {
+	case "drop":
+		s.blackhole.swallow(event.ID)
+		s.blackhole.logger.Debug("Blackhole: dropped event %s", event.ID)
+		return nil
+	case "hide":
+		if err := store(); err != nil {
+			return err
+		}
+		s.blackhole.hide(event.ID)
+		s.blackhole.logger.Debug("Blackhole: hid event %s", event.ID)
+		return nil
+	}
+	return store()
+}
+
+func (b *blackhole) empty() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.swallowed) == 0 && len(b.hidden) == 0
+}
+
+// QueryEvents leaves out the events that were swallowed. The store applies
+// the filter's limit before they are left out, so it is asked for further
+// pages, older than the last event it returned, until the limit is met or it
+// runs out of events.
+func (s *blackholeStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil || s.blackhole.empty() {
+		return ch, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		page := filter
+		served := 0
+		seen := make(map[string]bool)
+		for {
+			var fetched, fresh int
+			var oldest nostr.Timestamp
+			for event := range ch {
+				fetched++
+				if seen[event.ID] {
+					continue
+				}
+				seen[event.ID] = true
+				fresh++
+				if oldest == 0 || event.CreatedAt < oldest {
+					oldest = event.CreatedAt
+				}
+				if s.blackhole.isSwallowed(event.ID) || filter.Limit > 0 && served == filter.Limit {
+					continue
+				}
+				select {
+				case out <- event:
+					served++
+				case <-ctx.Done():
+					// drain so the store's goroutine isn't left blocked
+					for range ch {
+					}
+					return
+				}
+			}
+
+			// a page that brought nothing new means events sharing a
+			// timestamp fill it, so paging stops there
+			if filter.Limit == 0 || served == filter.Limit || fetched < page.Limit || fresh == 0 {
+				return
+			}
+			until := oldest
+			page.Until = &until
+			next, err := s.Store.QueryEvents(ctx, page)
+			if err != nil {
+				s.blackhole.logger.Error("Blackhole: failed to query the next page: %v", err)
+				return
+			}
+			ch = next
+		}
+	}()
+	return out, nil
+}
+
+// CountEvents counts what QueryEvents serves once something was swallowed.
+func (s *blackholeStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	if s.blackhole.empty() {
+		return count.Wrapper{Store: s.Store}.CountEvents(ctx, filter)
+	}
+	ch, err := s.QueryEvents(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for range ch {
+		n++
+	}
+	return n, nil
+}
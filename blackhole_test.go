@@ -0,0 +1,78 @@
+package testingrelay
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestBlackholeHide(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slicestore.SliceStore{}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "blackhole.db")
+	live := NewLiveConfig(RelayConfig{})
+
+	open := func() *blackholeStore {
+		t.Helper()
+		b, err := setupBlackhole(ctx, khatru.NewRelay(), live, store, path, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { b.Close() })
+		return b.Store(store).(*blackholeStore)
+	}
+	setMode := func(mode string) {
+		live.Update(func(cfg *RelayConfig) error {
+			cfg.Blackhole = mode
+			return nil
+		})
+	}
+
+	// three served events, older than the five hidden ones after them
+	sk := nostr.GeneratePrivateKey()
+	served := open()
+	var want []string
+	for i, mode := range []string{"", "", "", "hide", "hide", "hide", "hide", "hide"} {
+		setMode(mode)
+		event := signedAt(t, sk, nostr.KindTextNote, nostr.Timestamp(1000+i), "", nil)
+		if err := served.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		if mode == "" {
+			want = append([]string{event.ID}, want...)
+		}
+	}
+	setMode("")
+
+	check := func(s *blackholeStore) {
+		t.Helper()
+		ch, err := s.QueryEvents(ctx, nostr.Filter{Limit: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for event := range ch {
+			ids = append(ids, event.ID)
+		}
+		if !slices.Equal(ids, want) {
+			t.Fatalf("served %v, want %v", ids, want)
+		}
+	}
+	check(served)
+	// the hidden events stay hidden once the relay is restarted
+	check(open())
+}
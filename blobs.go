@@ -0,0 +1,236 @@
+package testingrelay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var (
+	errBlobTooLarge = errors.New("blob is too large")
+	errNotBlobOwner = errors.New("blob was uploaded by someone else")
+)
+
+// blobMeta is kept next to each blob, as <sha256>.json.
+type blobMeta struct {
+	Type     string   `json:"type"`
+	Size     int64    `json:"size"`
+	Uploaded int64    `json:"uploaded"`
+	Owners   []string `json:"owners"`
+	Caption  string   `json:"caption,omitempty"`
+	Alt      string   `json:"alt,omitempty"`
+}
+
+// storedBlob is a blob found by blobStore.list.
+type storedBlob struct {
+	hash string
+	meta *blobMeta
+}
+
+// blobStore keeps blobs as files in dir named by their sha256, for the
+// Blossom and NIP-96 media servers alike. A blob is deleted once none of
+// the pubkeys that uploaded it still want it.
+type blobStore struct {
+	dir     string
+	maxSize int64
+	// guards the metadata files
+	mu sync.Mutex
+}
+
+func newBlobStore(dir string, maxSize int64) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &blobStore{dir: dir, maxSize: maxSize}, nil
+}
+
+// parseBlobPath reads the hash out of <sha256>[.ext].
+func parseBlobPath(name string) (string, bool) {
+	hash, _, _ := strings.Cut(name, ".")
+	if len(hash) != 64 || strings.ToLower(hash) != hash || !nostr.IsValid32ByteHex(hash) {
+		return "", false
+	}
+	return hash, true
+}
+
+// httpBaseURL is the base URL of the server r came to, over HTTP even when
+// SERVICE_URL is a websocket one.
+func httpBaseURL(serviceURL string, r *http.Request) string {
+	base := requestBaseURL(serviceURL, r)
+	base = strings.Replace(strings.Replace(base, "wss://", "https://", 1), "ws://", "http://", 1)
+	return strings.TrimSuffix(base, "/")
+}
+
+// blobURL is where the blob hash of type contentType is served, on the
+// server r came to.
+func blobURL(serviceURL string, r *http.Request, hash, contentType string) string {
+	url := httpBaseURL(serviceURL, r) + "/" + hash
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		url += exts[0]
+	}
+	return url
+}
+
+func (s *blobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash)
+}
+
+func (s *blobStore) loadMeta(hash string) (*blobMeta, error) {
+	data, err := os.ReadFile(s.path(hash) + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var meta blobMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *blobStore) saveMeta(hash string, meta *blobMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path(hash)+".json", data, 0o644)
+}
+
+// pendingBlob is an upload received but not stored yet, so it can be
+// authorized against its hash first.
+type pendingBlob struct {
+	file *os.File
+	hash string
+	size int64
+}
+
+// Close drops the upload unless it was stored.
+func (p *pendingBlob) Close() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// sniff guesses the content type of the upload.
+func (p *pendingBlob) sniff() string {
+	head := make([]byte, 512)
+	n, _ := p.file.ReadAt(head, 0)
+	return http.DetectContentType(head[:n])
+}
+
+// receive hashes body on its way to a temporary file, failing with
+// errBlobTooLarge past the size limit.
+func (s *blobStore) receive(body io.Reader) (*pendingBlob, error) {
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingBlob{file: tmp}
+
+	hasher := sha256.New()
+	if p.size, err = io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(body, s.maxSize+1)); err != nil {
+		p.Close()
+		return nil, err
+	}
+	if p.size > s.maxSize {
+		p.Close()
+		return nil, errBlobTooLarge
+	}
+	p.hash = hex.EncodeToString(hasher.Sum(nil))
+	return p, nil
+}
+
+// store keeps the upload, described by meta if it is new, and records owner
+// as one of its uploaders unless empty. created is false for a blob that was
+// already stored.
+func (s *blobStore) store(p *pendingBlob, meta blobMeta, owner string) (_ *blobMeta, created bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.loadMeta(p.hash)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.Rename(p.file.Name(), s.path(p.hash)); err != nil {
+			return nil, false, err
+		}
+		meta.Size, meta.Uploaded, meta.Owners = p.size, time.Now().Unix(), []string{}
+		stored, created = &meta, true
+	} else if err != nil {
+		return nil, false, err
+	}
+	if owner != "" && !slices.Contains(stored.Owners, owner) {
+		stored.Owners = append(stored.Owners, owner)
+	}
+	return stored, created, s.saveMeta(p.hash, stored)
+}
+
+// open opens the blob hash, failing with os.ErrNotExist if there is none.
+func (s *blobStore) open(hash string) (*os.File, *blobMeta, error) {
+	s.mu.Lock()
+	meta, err := s.loadMeta(hash)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(s.path(hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, meta, nil
+}
+
+// disown drops owner from the uploaders of the blob hash, failing with
+// errNotBlobOwner if it isn't one, and deletes the blob once it has none
+// left. An empty owner deletes it outright.
+func (s *blobStore) disown(hash, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.loadMeta(hash)
+	if err != nil {
+		return err
+	}
+	if owner != "" {
+		if !slices.Contains(meta.Owners, owner) {
+			return errNotBlobOwner
+		}
+		meta.Owners = slices.DeleteFunc(meta.Owners, func(o string) bool { return o == owner })
+		if len(meta.Owners) > 0 {
+			return s.saveMeta(hash, meta)
+		}
+	}
+	os.Remove(s.path(hash))
+	return os.Remove(s.path(hash) + ".json")
+}
+
+// list finds the blobs matching match, newest first.
+func (s *blobStore) list(match func(meta *blobMeta) bool) ([]storedBlob, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var blobs []storedBlob
+	for _, path := range paths {
+		hash, ok := parseBlobPath(filepath.Base(path))
+		if !ok {
+			continue
+		}
+		if meta, err := s.loadMeta(hash); err == nil && match(meta) {
+			blobs = append(blobs, storedBlob{hash: hash, meta: meta})
+		}
+	}
+	slices.SortFunc(blobs, func(a, b storedBlob) int { return int(b.meta.Uploaded - a.meta.Uploaded) })
+	return blobs, nil
+}
@@ -0,0 +1,283 @@
+package testingrelay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BlossomSettings configure the Blossom media server (BLOSSOM_*, BUD-01 and
+// BUD-02), so clients pairing a relay with a media server can be tested
+// against one process. Blobs are uploaded with PUT /upload, fetched with GET
+// or HEAD /<sha256>[.ext], listed by uploader on /list/<pubkey> and deleted
+// with DELETE /<sha256>, and kept as files in Dir. Uploads and deletions need
+// a kind 24242 authorization event unless Auth is off, and uploads are
+// limited to MaxSize bytes. With NIP96 the same blobs are also served over
+// NIP-96. An empty Dir turns it off.
+type BlossomSettings struct {
+	Dir     string `envconfig:"DIR"`
+	MaxSize int64  `envconfig:"MAX_SIZE" default:"104857600"`
+	Auth    bool   `envconfig:"AUTH" default:"true"`
+	NIP96   bool   `envconfig:"NIP96"`
+}
+
+func (s BlossomSettings) Validate() error {
+	if s.MaxSize < 1 {
+		return fmt.Errorf("BLOSSOM_MAX_SIZE must be at least 1")
+	}
+	return nil
+}
+
+// blossomAuthKind is the kind of Blossom authorization events.
+const blossomAuthKind = 24242
+
+// BlobDescriptor describes a stored blob, as BUD-02 answers uploads and
+// lists.
+type BlobDescriptor struct {
+	URL      string `json:"url"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+// blossom serves the blobs of a blobStore.
+type blossom struct {
+	blobs      *blobStore
+	auth       bool
+	serviceURL string
+	logger     *Logger
+}
+
+// setupBlossom routes the Blossom endpoints, and the NIP-96 ones if asked
+// to, if enabled. Paths that aren't a blob's go on to fallback.
+func setupBlossom(mux *http.ServeMux, fallback http.Handler, settings BlossomSettings, serviceURL string, logger *Logger) error {
+	if settings.Dir == "" {
+		return nil
+	}
+	blobs, err := newBlobStore(settings.Dir, settings.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	b := &blossom{blobs: blobs, auth: settings.Auth, serviceURL: serviceURL, logger: logger}
+	mux.Handle("/upload", blossomCORS(b.handleUpload))
+	mux.Handle("/list/{pubkey}", blossomCORS(b.handleList))
+	mux.Handle("/{blob}", blossomCORS(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := parseBlobPath(r.PathValue("blob")); !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		b.handleBlob(w, r)
+	}))
+	if settings.NIP96 {
+		setupNIP96(mux, blobs, settings, serviceURL, logger)
+	}
+
+	logger.Info("Blossom media server enabled, storing blobs in %s", settings.Dir)
+	return nil
+}
+
+// blossomCORS allows every origin, as BUD-01 requires, and answers
+// preflight requests.
+func blossomCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, *")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, PUT, DELETE")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// blossomError answers with the reason in X-Reason, where Blossom clients
+// look for it.
+func blossomError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("X-Reason", reason)
+	http.Error(w, reason, status)
+}
+
+// verifyBlossomAuth checks the kind 24242 event authorizing verb, and that it
+// names hash in an x tag when hash isn't empty. For uploads the x tags are
+// optional. It returns the pubkey that signed the event.
+func verifyBlossomAuth(r *http.Request, verb, hash string) (string, error) {
+	evt, err := authEvent(r)
+	if err != nil {
+		return "", err
+	}
+
+	if evt.Kind != blossomAuthKind {
+		return "", fmt.Errorf("auth event must be of kind %d", blossomAuthKind)
+	}
+	now := nostr.Now()
+	if evt.CreatedAt > now+nip98Window {
+		return "", errors.New("auth event is in the future")
+	}
+	expiration := evt.Tags.GetFirst([]string{"expiration", ""})
+	if expiration == nil {
+		return "", errors.New("auth event has no expiration")
+	}
+	if ts, err := strconv.ParseInt((*expiration)[1], 10, 64); err != nil || nostr.Timestamp(ts) <= now {
+		return "", errors.New("auth event has expired")
+	}
+	if t := evt.Tags.GetFirst([]string{"t", ""}); t == nil || (*t)[1] != verb {
+		return "", fmt.Errorf("auth event must have a t tag of %q", verb)
+	}
+
+	if hash != "" {
+		hashes := evt.Tags.GetAll([]string{"x", ""})
+		if len(hashes) > 0 || verb != "upload" {
+			if !slices.ContainsFunc(hashes, func(tag nostr.Tag) bool { return tag[1] == hash }) {
+				return "", fmt.Errorf("auth event has no x tag for %s", hash)
+			}
+		}
+	}
+	return evt.PubKey, nil
+}
+
+// descriptor describes the blob hash, with its URL on the server r came to.
+func (b *blossom) descriptor(r *http.Request, hash string, meta *blobMeta) BlobDescriptor {
+	return BlobDescriptor{
+		URL:      blobURL(b.serviceURL, r, hash, meta.Type),
+		SHA256:   hash,
+		Size:     meta.Size,
+		Type:     meta.Type,
+		Uploaded: meta.Uploaded,
+	}
+}
+
+// handleUpload stores the blob in the body, checking the authorization
+// against its hash.
+func (b *blossom) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		blossomError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if r.ContentLength > b.blobs.maxSize {
+		blossomError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs are limited to %d bytes", b.blobs.maxSize))
+		return
+	}
+
+	upload, err := b.blobs.receive(r.Body)
+	if errors.Is(err, errBlobTooLarge) {
+		blossomError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("blobs are limited to %d bytes", b.blobs.maxSize))
+		return
+	} else if err != nil {
+		blossomError(w, http.StatusBadRequest, "failed to read the blob")
+		return
+	}
+	defer upload.Close()
+
+	var pubkey string
+	if b.auth {
+		if pubkey, err = verifyBlossomAuth(r, "upload", upload.hash); err != nil {
+			blossomError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = upload.sniff()
+	}
+	meta, _, err := b.blobs.store(upload, blobMeta{Type: contentType}, pubkey)
+	if err != nil {
+		b.logger.Error("Blossom: failed to store %s: %v", upload.hash, err)
+		blossomError(w, http.StatusInternalServerError, "failed to store the blob")
+		return
+	}
+
+	b.logger.Debug("Blossom: stored %s (%d bytes, %s)", upload.hash, meta.Size, meta.Type)
+	writeJSON(w, http.StatusOK, b.descriptor(r, upload.hash, meta))
+}
+
+// serveBlob serves the blob hash, with ranges.
+func serveBlob(w http.ResponseWriter, r *http.Request, blobs *blobStore, hash string) {
+	file, meta, err := blobs.open(hash)
+	if err != nil {
+		blossomError(w, http.StatusNotFound, "blob not found")
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", meta.Type)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Unix(meta.Uploaded, 0), file)
+}
+
+// handleBlob serves the blob in the path on GET and HEAD, and deletes it on
+// DELETE once no uploader still has it.
+func (b *blossom) handleBlob(w http.ResponseWriter, r *http.Request) {
+	hash, _ := parseBlobPath(r.PathValue("blob"))
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		serveBlob(w, r, b.blobs, hash)
+
+	case http.MethodDelete:
+		var pubkey string
+		if b.auth {
+			var err error
+			if pubkey, err = verifyBlossomAuth(r, "delete", hash); err != nil {
+				blossomError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+		}
+
+		err := b.blobs.disown(hash, pubkey)
+		if errors.Is(err, os.ErrNotExist) {
+			blossomError(w, http.StatusNotFound, "blob not found")
+			return
+		} else if errors.Is(err, errNotBlobOwner) {
+			blossomError(w, http.StatusForbidden, "blob was not uploaded by "+pubkey)
+			return
+		} else if err != nil {
+			blossomError(w, http.StatusInternalServerError, "failed to delete the blob")
+			return
+		}
+		b.logger.Debug("Blossom: deleted %s for %s", hash, pubkey)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		blossomError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleList lists the blobs uploaded by the pubkey in the path, newest
+// first, optionally between the since and until unix timestamps.
+func (b *blossom) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		blossomError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	pubkey, err := parsePubkey(r.PathValue("pubkey"))
+	if err != nil {
+		blossomError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	since, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	until, _ := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+
+	found, err := b.blobs.list(func(meta *blobMeta) bool {
+		return slices.Contains(meta.Owners, pubkey) &&
+			(since == 0 || meta.Uploaded >= since) && (until == 0 || meta.Uploaded <= until)
+	})
+	if err != nil {
+		blossomError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	descriptors := make([]BlobDescriptor, len(found))
+	for i, blob := range found {
+		descriptors[i] = b.descriptor(r, blob.hash, blob.meta)
+	}
+	writeJSON(w, http.StatusOK, descriptors)
+}
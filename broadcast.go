@@ -0,0 +1,192 @@
+package testingrelay
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Downstreams configures forwarding to other relays (DOWNSTREAM_*). Failed
+// publishes are retried up to Retries times, waiting Backoff and then twice as
+// long after each attempt.
+type Downstreams struct {
+	Relays  []string      `envconfig:"RELAYS"`
+	Retries int           `envconfig:"RETRIES" default:"5"`
+	Backoff time.Duration `envconfig:"BACKOFF" default:"1s"`
+}
+
+const (
+	// downstreamQueueSize bounds how many events may wait for each downstream
+	// relay; more are dropped.
+	downstreamQueueSize = 1024
+
+	downstreamMaxBackoff = time.Minute
+
+	// downstreamTimeout bounds how long a publish waits for the OK.
+	downstreamTimeout = 10 * time.Second
+)
+
+// broadcaster forwards accepted events to the downstream relays, one queue and
+// worker per relay so a slow one doesn't hold up the others.
+type broadcaster struct {
+	settings Downstreams
+	pool     *nostr.SimplePool
+	metrics  *Metrics
+	logger   *Logger
+	queues   map[string]chan *nostr.Event
+
+	// ids forwarded recently, so events bouncing between relays that forward
+	// to each other (ephemeral ones are never stored) are sent once
+	mu     sync.Mutex
+	recent map[string]time.Time
+}
+
+func setupBroadcast(ctx context.Context, relay *khatru.Relay, settings Downstreams, metrics *Metrics, logger *Logger) {
+	if len(settings.Relays) == 0 {
+		return
+	}
+
+	b := &broadcaster{
+		settings: settings,
+		pool:     nostr.NewSimplePool(ctx),
+		metrics:  metrics,
+		logger:   logger,
+		queues:   make(map[string]chan *nostr.Event),
+		recent:   make(map[string]time.Time),
+	}
+	for _, url := range settings.Relays {
+		queue := make(chan *nostr.Event, downstreamQueueSize)
+		b.queues[url] = queue
+		go b.forwardLoop(ctx, url, queue)
+	}
+	go b.pruneLoop(ctx)
+
+	relay.OnEventSaved = append(relay.OnEventSaved, b.enqueue)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, b.enqueue)
+
+	logger.Info("Forwarding accepted events to %v", settings.Relays)
+}
+
+func (b *broadcaster) enqueue(ctx context.Context, event *nostr.Event) {
+	if b.forwarded(event.ID) {
+		return
+	}
+
+	for url, queue := range b.queues {
+		select {
+		case queue <- event:
+		default:
+			b.metrics.DownstreamPublish(url, "dropped")
+			b.logger.Error("Downstream queue for %s is full, dropping event %s", url, event.ID)
+		}
+	}
+}
+
+// forwarded reports whether id was already forwarded, remembering it if not.
+func (b *broadcaster) forwarded(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.recent[id]; ok {
+		return true
+	}
+	b.recent[id] = time.Now()
+	return false
+}
+
+func (b *broadcaster) pruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		b.mu.Lock()
+		for id, at := range b.recent {
+			if time.Since(at) >= time.Minute {
+				delete(b.recent, id)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func (b *broadcaster) forwardLoop(ctx context.Context, url string, queue chan *nostr.Event) {
+	for {
+		var event *nostr.Event
+		select {
+		case event = <-queue:
+		case <-ctx.Done():
+			return
+		}
+
+		result, err := b.publish(ctx, url, event)
+		if ctx.Err() != nil {
+			return
+		}
+		b.metrics.DownstreamPublish(url, result)
+		if err != nil {
+			b.logger.Error("Failed to forward event %s to %s (%s): %v", event.ID, url, result, err)
+		}
+	}
+}
+
+// publish sends event to url, retrying with exponential backoff while the
+// relay can't be reached, asks to slow down or fails on its side.
+func (b *broadcaster) publish(ctx context.Context, url string, event *nostr.Event) (string, error) {
+	backoff := b.settings.Backoff
+	for attempt := 0; ; attempt++ {
+		err := b.send(ctx, url, event)
+		result, retry := publishResult(err)
+		if !retry || attempt >= b.settings.Retries {
+			if result == "duplicate" {
+				err = nil
+			}
+			return result, err
+		}
+
+		b.logger.Debug("Forwarding event %s to %s failed, retrying in %s: %v", event.ID, url, backoff, err)
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, downstreamMaxBackoff)
+	}
+}
+
+func (b *broadcaster) send(ctx context.Context, url string, event *nostr.Event) error {
+	relay, err := b.pool.EnsureRelay(url)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, downstreamTimeout)
+	defer cancel()
+	return relay.Publish(ctx, *event)
+}
+
+// publishResult classifies a publish error for the metrics and tells whether
+// it is worth retrying. go-nostr reports OK false answers as "msg: <reason>".
+func publishResult(err error) (result string, retry bool) {
+	if err == nil {
+		return "ok", false
+	}
+
+	reason, answered := strings.CutPrefix(err.Error(), "msg: ")
+	switch {
+	case !answered, strings.HasPrefix(reason, "rate-limited:"), strings.HasPrefix(reason, "error:"):
+		return "failed", true
+	case strings.HasPrefix(reason, "duplicate:"):
+		return "duplicate", false
+	default:
+		return "rejected", false
+	}
+}
@@ -0,0 +1,222 @@
+package testingrelay
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// maxCachedResults keeps queries returning more events out of the cache.
+const maxCachedResults = 1000
+
+// QueryCache configures the cache of query results. Size is how many filters
+// are kept, 0 disables the cache, and TTL how long a result is served.
+type QueryCache struct {
+	Size int           `envconfig:"SIZE"`
+	TTL  time.Duration `envconfig:"TTL" default:"30s"`
+}
+
+// cachingStore serves repeated queries from memory, for the many test
+// clients that subscribe with the same filters. Results are kept per filter
+// in an LRU and dropped when an event the filter matches is written, or when
+// one of the events in them is deleted or replaced.
+type cachingStore struct {
+	eventstore.Store
+	settings QueryCache
+	metrics  *Metrics
+
+	mu       sync.Mutex
+	lru      *list.List               // of *cacheEntry, most recent first
+	entries  map[string]*list.Element // by filter
+	inflight map[*cacheQuery]struct{}
+}
+
+type cacheEntry struct {
+	key     string
+	filter  nostr.Filter
+	events  []*nostr.Event
+	expires time.Time
+}
+
+// cacheQuery is a query running against the store, whose result is only
+// cached if nothing invalidated it in the meantime.
+type cacheQuery struct {
+	filter nostr.Filter
+	stale  bool
+}
+
+func newCachingStore(store eventstore.Store, settings QueryCache, metrics *Metrics) eventstore.Store {
+	if settings.Size <= 0 {
+		return store
+	}
+	return &cachingStore{
+		Store:    store,
+		settings: settings,
+		metrics:  metrics,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[*cacheQuery]struct{}),
+	}
+}
+
+func (c *cachingStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	key := filter.String()
+	if events, ok := c.lookup(key); ok {
+		c.metrics.CacheLookup(true)
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for _, event := range events {
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+	c.metrics.CacheLookup(false)
+
+	query := &cacheQuery{filter: filter}
+	c.mu.Lock()
+	c.inflight[query] = struct{}{}
+	c.mu.Unlock()
+
+	ch, err := c.Store.QueryEvents(ctx, filter)
+	if err != nil || ch == nil {
+		c.finish(query, key, nil, false)
+		return ch, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		var events []*nostr.Event
+		complete := true
+		for event := range ch {
+			if len(events) <= maxCachedResults {
+				events = append(events, event)
+			}
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				complete = false
+			}
+			if !complete {
+				break
+			}
+		}
+		c.finish(query, key, events, complete && len(events) <= maxCachedResults)
+	}()
+	return out, nil
+}
+
+func (c *cachingStore) lookup(key string) ([]*nostr.Event, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.events, true
+}
+
+// finish caches the result of a query that read everything and wasn't
+// invalidated while it ran.
+func (c *cachingStore) finish(query *cacheQuery, key string, events []*nostr.Event, complete bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.inflight, query)
+	if !complete || query.stale {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &cacheEntry{key: key, filter: query.filter, events: events, expires: time.Now().Add(c.settings.TTL)}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.settings.Size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cachingStore) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+// invalidate drops the results event changes: those of the filters it
+// matches and, when it replaces or deletes events, every result holding one
+// of them.
+func (c *cachingStore) invalidate(event *nostr.Event, removes bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*cacheEntry)
+		if entry.filter.Matches(event) || (removes && holdsVersionOf(entry.events, event)) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+	for query := range c.inflight {
+		// what a running query already read can't be checked
+		if removes || query.filter.Matches(event) {
+			query.stale = true
+		}
+	}
+}
+
+// holdsVersionOf reports whether events hold event or, for replaceable kinds,
+// another version of it.
+func holdsVersionOf(events []*nostr.Event, event *nostr.Event) bool {
+	for _, held := range events {
+		if held.ID == event.ID || (isReplaceable(event.Kind) && address(held) == address(event)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cachingStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	return count.Wrapper{Store: c.Store}.CountEvents(ctx, filter)
+}
+
+func (c *cachingStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	err := c.Store.SaveEvent(ctx, event)
+	if err == nil {
+		c.invalidate(event, false)
+	}
+	return err
+}
+
+func (c *cachingStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	err := c.Store.ReplaceEvent(ctx, event)
+	if err == nil {
+		c.invalidate(event, true)
+	}
+	return err
+}
+
+func (c *cachingStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := c.Store.DeleteEvent(ctx, event)
+	if err == nil {
+		c.invalidate(event, true)
+	}
+	return err
+}
@@ -0,0 +1,323 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Duration is a time.Duration that reads and writes as "1.5s" in both env
+// vars and JSON, so the admin API speaks the same language as the config.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// ChaosSettings configure fault injection. Rates are probabilities from 0 to 1
+// evaluated independently for every matching message. Besides faults a real
+// relay runs into, some rates make it break the protocol the way a buggy one
+// would: frames cut off mid-JSON, OKs for the wrong event id, EVENTs for
+// subscriptions that were never opened, a second EOSE and messages that
+// aren't JSON arrays. DuplicateRate redelivers EVENTs and a ReorderWindow
+// holds EVENTs back for up to that long, sending them shuffled once it ends
+// or another message goes out, to exercise client deduplication and
+// ordering. SaveErrorRate fails saves with OK false and an error: prefix,
+// while SaveLossRate answers OK true without storing anything, to exercise
+// publish confirmation and redundancy across relays. NoEOSERate never ends
+// stored events with EOSE, and subscriptions whose id starts with one of
+// EOSEDelaySubs or NoEOSESubs always get theirs late or never, so a test can
+// pick which of its subscriptions hit the client's EOSE timeout.
+type ChaosSettings struct {
+	Enabled        bool     `envconfig:"ENABLED" default:"false" json:"enabled"`
+	DropOKRate     float64  `envconfig:"DROP_OK_RATE" json:"drop_ok_rate"`
+	EOSEDelayRate  float64  `envconfig:"EOSE_DELAY_RATE" json:"eose_delay_rate"`
+	EOSEDelay      Duration `envconfig:"EOSE_DELAY" default:"5s" json:"eose_delay"`
+	NoEOSERate     float64  `envconfig:"NO_EOSE_RATE" json:"no_eose_rate"`
+	EOSEDelaySubs  []string `envconfig:"EOSE_DELAY_SUBS" json:"eose_delay_subs"`
+	NoEOSESubs     []string `envconfig:"NO_EOSE_SUBS" json:"no_eose_subs"`
+	CloseRate      float64  `envconfig:"CLOSE_RATE" json:"close_rate"`
+	NoticeRate     float64  `envconfig:"NOTICE_RATE" json:"notice_rate"`
+	TruncateRate   float64  `envconfig:"TRUNCATE_RATE" json:"truncate_rate"`
+	WrongOKIDRate  float64  `envconfig:"WRONG_OK_ID_RATE" json:"wrong_ok_id_rate"`
+	UnknownSubRate float64  `envconfig:"UNKNOWN_SUB_RATE" json:"unknown_sub_rate"`
+	DupEOSERate    float64  `envconfig:"DUPLICATE_EOSE_RATE" json:"duplicate_eose_rate"`
+	NonArrayRate   float64  `envconfig:"NON_ARRAY_RATE" json:"non_array_rate"`
+	DuplicateRate  float64  `envconfig:"DUPLICATE_RATE" json:"duplicate_rate"`
+	ReorderWindow  Duration `envconfig:"REORDER_WINDOW" json:"reorder_window"`
+	SaveErrorRate  float64  `envconfig:"SAVE_ERROR_RATE" json:"save_error_rate"`
+	SaveLossRate   float64  `envconfig:"SAVE_LOSS_RATE" json:"save_loss_rate"`
+}
+
+// Validate checks that all rates are valid probabilities.
+func (s ChaosSettings) Validate() error {
+	rates := map[string]float64{
+		"drop_ok_rate":        s.DropOKRate,
+		"eose_delay_rate":     s.EOSEDelayRate,
+		"no_eose_rate":        s.NoEOSERate,
+		"close_rate":          s.CloseRate,
+		"notice_rate":         s.NoticeRate,
+		"truncate_rate":       s.TruncateRate,
+		"wrong_ok_id_rate":    s.WrongOKIDRate,
+		"unknown_sub_rate":    s.UnknownSubRate,
+		"duplicate_eose_rate": s.DupEOSERate,
+		"non_array_rate":      s.NonArrayRate,
+		"duplicate_rate":      s.DuplicateRate,
+		"save_error_rate":     s.SaveErrorRate,
+		"save_loss_rate":      s.SaveLossRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+	if s.EOSEDelay < 0 || s.ReorderWindow < 0 {
+		return fmt.Errorf("eose_delay and reorder_window must not be negative")
+	}
+	return nil
+}
+
+// Chaos injects faults into outbound websocket traffic so clients can be
+// tested against misbehaving relays. Settings can be changed at runtime.
+type Chaos struct {
+	mu       sync.RWMutex
+	settings ChaosSettings
+	logger   *Logger
+
+	heldMu sync.Mutex
+	held   map[*wireConn]*heldEvents
+}
+
+// heldEvents are the EVENTs a connection's reorder window holds back.
+type heldEvents struct {
+	payloads [][]byte
+	timer    *time.Timer
+}
+
+func NewChaos(settings ChaosSettings, logger *Logger) *Chaos {
+	return &Chaos{settings: settings, logger: logger, held: make(map[*wireConn]*heldEvents)}
+}
+
+func (c *Chaos) Settings() ChaosSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.settings
+}
+
+func (c *Chaos) Update(settings ChaosSettings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.settings = settings
+	c.mu.Unlock()
+	c.logger.Info("Chaos settings updated: %+v", settings)
+	return nil
+}
+
+// Hook is the outbound hook applying the current settings.
+func (c *Chaos) Hook(conn *wireConn, msg *wireMessage) {
+	s := c.Settings()
+	if !s.Enabled {
+		return
+	}
+
+	label := msg.Label()
+	if label != "" && label != "EVENT" {
+		// nothing held back may end up behind an EOSE or OK
+		for _, payload := range c.release(conn) {
+			conn.Inject(payload)
+		}
+	}
+
+	duplicate := false
+	switch label {
+	case "OK":
+		if roll(s.DropOKRate) {
+			c.logger.Debug("Chaos: dropping OK to %s", conn.RemoteAddr())
+			msg.drop = true
+		} else if env := msg.Envelope(); len(env) > 1 && roll(s.WrongOKIDRate) {
+			c.logger.Debug("Chaos: sending OK with a wrong event id to %s", conn.RemoteAddr())
+			env[1], _ = json.Marshal(nostr.GeneratePrivateKey())
+			payload, _ := json.Marshal(env)
+			msg.SetPayload(payload)
+		}
+	case "EOSE":
+		sub := ""
+		if env := msg.Envelope(); len(env) > 1 {
+			json.Unmarshal(env[1], &sub)
+		}
+		if hasAnyPrefix(sub, s.NoEOSESubs) || roll(s.NoEOSERate) {
+			c.logger.Debug("Chaos: never sending EOSE for %s to %s", sub, conn.RemoteAddr())
+			msg.drop = true
+			return
+		}
+		if hasAnyPrefix(sub, s.EOSEDelaySubs) || roll(s.EOSEDelayRate) {
+			c.logger.Debug("Chaos: delaying EOSE to %s by %s", conn.RemoteAddr(), time.Duration(s.EOSEDelay))
+			msg.delay += time.Duration(s.EOSEDelay)
+		}
+		if roll(s.DupEOSERate) {
+			c.logger.Debug("Chaos: sending a duplicate EOSE to %s", conn.RemoteAddr())
+			conn.Inject(msg.payload)
+		}
+	case "EVENT":
+		if roll(s.CloseRate) {
+			c.logger.Debug("Chaos: closing connection to %s mid-subscription", conn.RemoteAddr())
+			msg.drop = true
+			conn.Abort()
+			return
+		}
+		if env := msg.Envelope(); len(env) > 2 && roll(s.UnknownSubRate) {
+			c.logger.Debug("Chaos: sending an EVENT for an unknown subscription to %s", conn.RemoteAddr())
+			stray, _ := json.Marshal([]json.RawMessage{env[0], json.RawMessage(`"chaos-unknown-subscription"`), env[2]})
+			conn.Inject(stray)
+		}
+		duplicate = roll(s.DuplicateRate)
+	}
+
+	if roll(s.NoticeRate) {
+		notice, _ := json.Marshal(nostr.NoticeEnvelope("chaos: this is a spurious notice"))
+		conn.Inject(notice)
+	}
+	if roll(s.NonArrayRate) {
+		conn.Inject([]byte(`{"chaos":"this message is not an array"}`))
+	}
+	if !msg.drop && msg.Label() != "" && roll(s.TruncateRate) {
+		c.logger.Debug("Chaos: truncating a %s to %s", msg.Label(), conn.RemoteAddr())
+		msg.SetPayload(truncateJSON(msg.payload))
+	}
+
+	if duplicate {
+		c.logger.Debug("Chaos: redelivering an EVENT to %s", conn.RemoteAddr())
+	}
+	switch {
+	case label == "EVENT" && s.ReorderWindow > 0:
+		c.hold(conn, msg.payload, duplicate, time.Duration(s.ReorderWindow))
+		msg.drop = true
+	case duplicate:
+		conn.Inject(msg.payload)
+	}
+}
+
+// hasAnyPrefix reports whether s starts with one of prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// errChaosSave is what a save failed by SaveErrorRate returns, which khatru
+// sends on in the OK.
+var errChaosSave = errors.New("error: chaos: failed to save the event")
+
+// Store wraps the store the relay saves to, failing or losing saves at the
+// configured rates.
+func (c *Chaos) Store(store eventstore.Store) eventstore.Store {
+	return &chaosStore{Store: store, chaos: c}
+}
+
+type chaosStore struct {
+	eventstore.Store
+	chaos *Chaos
+}
+
+func (s *chaosStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	return s.save(event, func() error { return s.Store.SaveEvent(ctx, event) })
+}
+
+func (s *chaosStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	return s.save(event, func() error { return s.Store.ReplaceEvent(ctx, event) })
+}
+
+func (s *chaosStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	return count.Wrapper{Store: s.Store}.CountEvents(ctx, filter)
+}
+
+func (s *chaosStore) save(event *nostr.Event, store func() error) error {
+	settings := s.chaos.Settings()
+	if settings.Enabled {
+		if roll(settings.SaveErrorRate) {
+			s.chaos.logger.Debug("Chaos: failing to save event %s", event.ID)
+			return errChaosSave
+		}
+		if roll(settings.SaveLossRate) {
+			s.chaos.logger.Debug("Chaos: losing event %s after accepting it", event.ID)
+			return nil
+		}
+	}
+	return store()
+}
+
+// hold keeps an EVENT back until the connection's window ends.
+func (c *Chaos) hold(conn *wireConn, payload []byte, duplicate bool, window time.Duration) {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+
+	held, ok := c.held[conn]
+	if !ok {
+		held = &heldEvents{}
+		held.timer = time.AfterFunc(window, func() {
+			for _, payload := range c.release(conn) {
+				conn.Send(payload)
+			}
+		})
+		c.held[conn] = held
+	}
+	held.payloads = append(held.payloads, payload)
+	if duplicate {
+		held.payloads = append(held.payloads, payload)
+	}
+}
+
+// release returns the EVENTs held back for the connection, shuffled.
+func (c *Chaos) release(conn *wireConn) [][]byte {
+	c.heldMu.Lock()
+	defer c.heldMu.Unlock()
+
+	held, ok := c.held[conn]
+	if !ok {
+		return nil
+	}
+	delete(c.held, conn)
+	held.timer.Stop()
+	rand.Shuffle(len(held.payloads), func(i, j int) {
+		held.payloads[i], held.payloads[j] = held.payloads[j], held.payloads[i]
+	})
+	return held.payloads
+}
+
+// truncateJSON cuts payload in half, keeping it valid UTF-8 as text frames
+// must be, so only the JSON is broken.
+func truncateJSON(payload []byte) []byte {
+	cut := len(payload) / 2
+	for cut > 0 && !utf8.RuneStart(payload[cut]) {
+		cut--
+	}
+	return payload[:cut]
+}
+
+func roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
@@ -0,0 +1,431 @@
+package testingrelay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/joho/godotenv"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// command is a subcommand of the relay binary. The ones working on a store
+// open it directly, so they don't need the relay to run; lmdb and badger
+// lock their database, so with those the relay must be stopped first.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "run the relay, the default without a command", runServe},
+	{"export", "write stored events to stdout or a file as JSONL", runExport},
+	{"import", "load JSONL events from stdin or files into the store", runImport},
+	{"stats", "summarize what the store holds", runStats},
+	{"config", "check the configuration: config validate", runConfig},
+	{"wipe", "delete every stored event", runWipe},
+	{"compact", "delete outdated versions of replaceable events and stored ephemeral events", runCompact},
+	{"purge", "delete the stored events matching a filter", runPurge},
+	{"snapshot", "write the stored events and tunables to a tarball", runSnapshot},
+	{"restore", "replace the stored events with a snapshot's", runRestore},
+	{"replay", "replay a recorded session against a relay", runReplay},
+	{"bench", "load a relay, or one started in-process, and report latencies", runBench},
+}
+
+func runCommand(name string, args []string) int {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	}
+	printUsage()
+	if name == "help" {
+		return 0
+	}
+	return 2
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+// loadCommandConfig reads .env, the config file at path if any, and the
+// environment.
+func loadCommandConfig(path string) (RelayConfig, fileOnly, *ConfigFile, error) {
+	godotenv.Load()
+
+	var configFile *ConfigFile
+	if path != "" {
+		configFile = NewConfigFile(path)
+	}
+	cfg, extra, err := loadConfig(configFile)
+	return cfg, extra, configFile, err
+}
+
+// storeFlags are the flags of the commands that work on a relay's store.
+type storeFlags struct {
+	config *string
+	relay  *string
+}
+
+func addStoreFlags(flags *flag.FlagSet) storeFlags {
+	return storeFlags{
+		config: flags.String("config", "", "YAML config file, overridden by RELAY_* env vars"),
+		relay:  flags.String("relay", "", "id of a relay from the config file's relays list, the root relay if empty"),
+	}
+}
+
+// open opens and initializes the store of the selected relay.
+func (f storeFlags) open() (eventstore.Store, RelayConfig, error) {
+	cfg, extra, _, err := loadCommandConfig(*f.config)
+	if err != nil {
+		return nil, cfg, fmt.Errorf("failed to load configuration: %w", err)
+	}
+	if *f.relay != "" {
+		_, configs, err := relayConfigs(cfg, extra)
+		if err != nil {
+			return nil, cfg, fmt.Errorf("invalid relays: %w", err)
+		}
+		var ok bool
+		if cfg, ok = configs[*f.relay]; !ok {
+			return nil, cfg, fmt.Errorf("no relay %q in the config file", *f.relay)
+		}
+	}
+	if cfg.Ephemeral || cfg.DBBackend == "memory" {
+		return nil, cfg, fmt.Errorf("the relay keeps its events in memory, there is no store to open")
+	}
+
+	db, err := NewStore(&cfg)
+	if err != nil {
+		return nil, cfg, fmt.Errorf("failed to configure database: %w", err)
+	}
+	if err := db.Init(); err != nil {
+		return nil, cfg, fmt.Errorf("failed to open %s database %s: %w", cfg.DBBackend, storeLocation(cfg), err)
+	}
+	return db, cfg, nil
+}
+
+// storeLocation is DB_PATH, without the password of a postgres URL.
+func storeLocation(cfg RelayConfig) string {
+	if cfg.DBBackend == "postgres" {
+		return redactURL(cfg.DBPath)
+	}
+	return cfg.DBPath
+}
+
+// commandContext is canceled by SIGINT or SIGTERM.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// addFilterFlags adds the parameters of exportFilter as flags, collecting
+// them in the returned values.
+func addFilterFlags(flags *flag.FlagSet) url.Values {
+	query := url.Values{}
+	for _, name := range []string{"kind", "pubkey", "id"} {
+		flags.Func(name, "only events with this "+name+", repeatable or comma-separated", func(value string) error {
+			query.Add(name, value)
+			return nil
+		})
+	}
+	for _, name := range []string{"since", "until"} {
+		flags.Func(name, "only events created "+name+" this unix timestamp", func(value string) error {
+			query.Set(name, value)
+			return nil
+		})
+	}
+	return query
+}
+
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	output := flags.String("o", "", "file to write, stdout if empty")
+	query := addFilterFlags(flags)
+	flags.Parse(args)
+
+	filter, err := exportFilter(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	db, _, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	if err := exportEvents(ctx, db, filter, w); err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s import [flags] [events.jsonl ...]\n\nReads stdin without files. Events are checked and saved like POST /import does.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	db, _, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	replacing := &replacingStore{Store: db}
+	verifier := newSigVerifier(SigVerify{}, nil)
+	defer verifier.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	failed := false
+	for _, path := range inputs {
+		var in io.Reader = os.Stdin
+		name := "stdin"
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer file.Close()
+			in, name = file, path
+		}
+
+		result, err := importEvents(ctx, replacing, in, verifier)
+		for _, msg := range result.Errors {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+		}
+		fmt.Printf("%s: imported %d events (%d duplicates, %d invalid, %d ephemeral skipped)\n", name, result.Imported, result.Duplicates, result.Invalid, result.Ephemeral)
+		if err != nil {
+			return 1
+		}
+		failed = failed || result.Invalid > 0
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// storeStats is what stats reports.
+type storeStats struct {
+	Backend   string      `json:"backend"`
+	Path      string      `json:"path"`
+	SizeBytes int64       `json:"size_bytes,omitempty"`
+	Events    int64       `json:"events"`
+	Authors   int         `json:"authors"`
+	Oldest    int64       `json:"oldest,omitempty"`
+	Newest    int64       `json:"newest,omitempty"`
+	Kinds     map[int]int `json:"kinds"`
+}
+
+func runStats(args []string) int {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	asJSON := flags.Bool("json", false, "print JSON")
+	flags.Parse(args)
+
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	stats := storeStats{Backend: cfg.DBBackend, Path: storeLocation(cfg), Kinds: make(map[int]int)}
+	if cfg.DBBackend != "postgres" {
+		stats.SizeBytes = fileSize(cfg.DBPath)
+	}
+	if stats.Events, err = (count.Wrapper{Store: db}).CountEvents(ctx, nostr.Filter{}); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to count events: %v\n", err)
+		return 1
+	}
+	authors := make(map[string]bool)
+	err = scanEvents(ctx, db, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			stats.Kinds[event.Kind]++
+			authors[event.PubKey] = true
+			if created := int64(event.CreatedAt); stats.Newest == 0 || created > stats.Newest {
+				stats.Newest = created
+			}
+			if created := int64(event.CreatedAt); stats.Oldest == 0 || created < stats.Oldest {
+				stats.Oldest = created
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read events: %v\n", err)
+		return 1
+	}
+	stats.Authors = len(authors)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "backend\t%s\n", stats.Backend)
+	if stats.Path != "" {
+		fmt.Fprintf(w, "path\t%s\n", stats.Path)
+	}
+	if stats.SizeBytes > 0 {
+		fmt.Fprintf(w, "size\t%d bytes\n", stats.SizeBytes)
+	}
+	fmt.Fprintf(w, "events\t%d\n", stats.Events)
+	fmt.Fprintf(w, "authors\t%d\n", stats.Authors)
+	if stats.Events > 0 {
+		fmt.Fprintf(w, "oldest\t%s\n", time.Unix(stats.Oldest, 0).UTC().Format(time.RFC3339))
+		fmt.Fprintf(w, "newest\t%s\n", time.Unix(stats.Newest, 0).UTC().Format(time.RFC3339))
+	}
+	kinds := make([]int, 0, len(stats.Kinds))
+	for kind := range stats.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "kind %d\t%d\n", kind, stats.Kinds[kind])
+	}
+	w.Flush()
+	return 0
+}
+
+func runConfig(args []string) int {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file, overridden by RELAY_* env vars")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s config validate [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "validate" {
+		flags.Usage()
+		return 2
+	}
+	flags.Parse(args[1:])
+
+	cfg, extra, _, err := loadCommandConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
+	}
+	virtuals, _, err := checkConfig(cfg, extra)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(virtuals) > 0 {
+		fmt.Printf("Configuration is valid: the root relay and %d virtual relays\n", len(virtuals))
+	} else {
+		fmt.Println("Configuration is valid")
+	}
+	return 0
+}
+
+func runCompact(args []string) int {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	flags.Parse(args)
+
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	outdated, ephemeral, err := compactEvents(ctx, db)
+	fmt.Printf("Deleted %d outdated versions of replaceable events and %d ephemeral events from %s\n", outdated, ephemeral, storeLocation(cfg))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Compact failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runWipe(args []string) int {
+	flags := flag.NewFlagSet("wipe", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	yes := flags.Bool("yes", false, "confirm deleting every stored event")
+	flags.Parse(args)
+
+	if !*yes {
+		fmt.Fprintln(os.Stderr, "wipe deletes every stored event, run it with -yes to confirm")
+		return 2
+	}
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	deleted, err := wipeEvents(ctx, db)
+	fmt.Printf("Deleted %d events from %s\n", deleted, storeLocation(cfg))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Wipe failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
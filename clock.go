@@ -0,0 +1,64 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// The created_at window of the created_at check when MAX_FUTURE_SECONDS and
+// MAX_PAST_SECONDS aren't set.
+const (
+	defaultMaxFuture = 15 * time.Minute
+	defaultMaxPast   = 365 * 24 * time.Hour
+)
+
+// now is the relay's clock: the system clock shifted by CLOCK_OFFSET_SECONDS.
+// It judges created_at and expiration tags and dates HTTP responses, so
+// clients can be tested against a relay whose time is off.
+func (cfg *RelayConfig) now() time.Time {
+	return time.Now().Add(time.Duration(cfg.ClockOffset) * time.Second)
+}
+
+// createdAtWindow bounds how far created_at may be from the relay's clock.
+// Zero bounds don't apply.
+type createdAtWindow struct {
+	now    func() time.Time
+	future time.Duration
+	past   time.Duration
+}
+
+// createdAtWindow returns the MAX_FUTURE_SECONDS and MAX_PAST_SECONDS window,
+// with the defaults filled in when the created_at check is on.
+func (cfg *RelayConfig) createdAtWindow(check bool) createdAtWindow {
+	w := createdAtWindow{
+		now:    cfg.now,
+		future: time.Duration(cfg.MaxFutureSeconds) * time.Second,
+		past:   time.Duration(cfg.MaxPastSeconds) * time.Second,
+	}
+	if check && w.future == 0 {
+		w.future = defaultMaxFuture
+	}
+	if check && w.past == 0 {
+		w.past = defaultMaxPast
+	}
+	return w
+}
+
+func (w createdAtWindow) enabled() bool {
+	return w.future > 0 || w.past > 0
+}
+
+func (w createdAtWindow) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	now := w.now()
+	skew := event.CreatedAt.Time().Sub(now.Truncate(time.Second))
+	if w.future > 0 && skew > w.future {
+		return true, fmt.Sprintf("invalid: created_at is %s ahead of the relay's clock (%d), the maximum is %s", skew, now.Unix(), w.future)
+	}
+	if w.past > 0 && -skew > w.past {
+		return true, fmt.Sprintf("invalid: created_at is %s behind the relay's clock (%d), the maximum is %s", -skew, now.Unix(), w.past)
+	}
+	return false, ""
+}
@@ -0,0 +1,197 @@
+package testingrelay
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ClusterSettings run the relay as one node of a cluster sharing a postgres
+// database (CLUSTER_*), like a load-balanced deployment. With Bus set to
+// postgres every event a node accepts is announced with NOTIFY on Channel,
+// and the other nodes deliver it to their subscribers. Node names the node
+// in logs, a random id by default. The query cache can't see the other
+// nodes' writes, so it has to stay off, and in-memory counts like quotas
+// and /stats only cover the node's own writes.
+type ClusterSettings struct {
+	Bus     string `envconfig:"BUS"`
+	Channel string `envconfig:"CHANNEL" default:"relay_events"`
+	Node    string `envconfig:"NODE"`
+}
+
+func (s ClusterSettings) Validate(backend string, cacheSize int) error {
+	switch s.Bus {
+	case "":
+		return nil
+	case "postgres":
+	default:
+		return fmt.Errorf("invalid CLUSTER_BUS %q, expected postgres or empty", s.Bus)
+	}
+	if backend != "postgres" {
+		return fmt.Errorf("CLUSTER_BUS=postgres needs DB_BACKEND=postgres, the nodes share the database")
+	}
+	if cacheSize > 0 {
+		return fmt.Errorf("QUERY_CACHE_SIZE must be 0 in a cluster, the cache can't see the other nodes' writes")
+	}
+	if s.Channel == "" {
+		return fmt.Errorf("CLUSTER_CHANNEL must not be empty")
+	}
+	return nil
+}
+
+// clusterPayloadLimit keeps NOTIFY payloads under postgres' 8000 bytes.
+// Bigger events are announced by id and read from the database.
+const clusterPayloadLimit = 7900
+
+// clusterQueue is how many announcements may wait to be sent.
+const clusterQueue = 1024
+
+// clusterMessage is the payload of a notification.
+type clusterMessage struct {
+	Node  string       `json:"node"`
+	Event *nostr.Event `json:"event,omitempty"`
+	ID    string       `json:"id,omitempty"`
+}
+
+// cluster announces this node's events and delivers the other nodes' ones.
+type cluster struct {
+	settings  ClusterSettings
+	relay     *khatru.Relay
+	store     eventstore.Store
+	blackhole *blackhole
+	logger    *Logger
+
+	db       *sql.DB
+	listener *pq.Listener
+	outbox   chan clusterMessage
+	done     chan struct{}
+}
+
+// setupCluster joins the cluster on the database at url, returning the
+// function that leaves it.
+func setupCluster(relay *khatru.Relay, store eventstore.Store, blackhole *blackhole, settings ClusterSettings, url string, logger *Logger) (func() error, error) {
+	if settings.Bus == "" {
+		return func() error { return nil }, nil
+	}
+	if settings.Node == "" {
+		id := make([]byte, 4)
+		rand.Read(id)
+		settings.Node = hex.EncodeToString(id)
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	c := &cluster{
+		settings:  settings,
+		relay:     relay,
+		store:     store,
+		blackhole: blackhole,
+		logger:    logger,
+		db:        db,
+		outbox:    make(chan clusterMessage, clusterQueue),
+		done:      make(chan struct{}),
+	}
+	c.listener = pq.NewListener(url, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("Cluster: listener on %s: %v", settings.Channel, err)
+		}
+	})
+	if err := c.listener.Listen(settings.Channel); err != nil {
+		c.listener.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to listen on %s: %w", settings.Channel, err)
+	}
+
+	relay.OnEventSaved = append(relay.OnEventSaved, c.announce)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, c.announce)
+	go c.send()
+	go c.receive()
+
+	logger.Info("Cluster node %s, sharing events on postgres channel %s", settings.Node, settings.Channel)
+	return c.Close, nil
+}
+
+func (c *cluster) Close() error {
+	close(c.done)
+	c.listener.Close()
+	return c.db.Close()
+}
+
+// announce queues event for the other nodes, unless it is held back from
+// this node's subscribers too.
+func (c *cluster) announce(ctx context.Context, event *nostr.Event) {
+	if c.blackhole.preventBroadcast(nil, event) {
+		return
+	}
+	select {
+	case c.outbox <- clusterMessage{Node: c.settings.Node, Event: event}:
+	default:
+		c.logger.Error("Cluster: dropped event %s, %d announcements are already waiting", event.ID, clusterQueue)
+	}
+}
+
+func (c *cluster) send() {
+	for {
+		var msg clusterMessage
+		select {
+		case msg = <-c.outbox:
+		case <-c.done:
+			return
+		}
+		payload, _ := json.Marshal(msg)
+		if len(payload) > clusterPayloadLimit {
+			if nostr.IsEphemeralKind(msg.Event.Kind) {
+				c.logger.Error("Cluster: ephemeral event %s is too big to announce (%d bytes)", msg.Event.ID, len(payload))
+				continue
+			}
+			payload, _ = json.Marshal(clusterMessage{Node: msg.Node, ID: msg.Event.ID})
+		}
+		if _, err := c.db.Exec(`SELECT pg_notify($1, $2)`, c.settings.Channel, string(payload)); err != nil {
+			c.logger.Error("Cluster: failed to announce event %s: %v", msg.Event.ID, err)
+		}
+	}
+}
+
+func (c *cluster) receive() {
+	for notification := range c.listener.Notify {
+		// nil after a reconnection, what was sent meanwhile is lost
+		if notification == nil {
+			continue
+		}
+		var msg clusterMessage
+		if err := json.Unmarshal([]byte(notification.Extra), &msg); err != nil {
+			c.logger.Error("Cluster: invalid notification on %s: %v", c.settings.Channel, err)
+			continue
+		}
+		if msg.Node == c.settings.Node {
+			continue
+		}
+
+		event := msg.Event
+		if event == nil {
+			if ch, err := c.store.QueryEvents(context.Background(), nostr.Filter{IDs: []string{msg.ID}}); err == nil {
+				for stored := range ch {
+					event = stored
+				}
+			}
+			if event == nil {
+				c.logger.Debug("Cluster: event %s announced by %s not found", msg.ID, msg.Node)
+				continue
+			}
+		}
+		c.logger.Debug("Cluster: delivering event %s from node %s", event.ID, msg.Node)
+		c.relay.BroadcastEvent(event)
+	}
+}
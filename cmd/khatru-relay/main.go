@@ -0,0 +1,13 @@
+// Command khatru-relay serves the relay of the testingrelay package and
+// manages its store; run it with help for the commands.
+package main
+
+import (
+	"os"
+
+	testingrelay "github.com/gzuuus/testing-relay"
+)
+
+func main() {
+	os.Exit(testingrelay.Main(os.Args[1:]))
+}
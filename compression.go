@@ -0,0 +1,90 @@
+package testingrelay
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// permessageDeflate is the extension response sent to clients offering
+// permessage-deflate (RFC 7692). Both sides reset their compression context
+// for every message, so each message can be handled on its own.
+const permessageDeflate = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+
+// rsv1 marks the first frame of a compressed message.
+const rsv1 byte = 0x40
+
+// deflateTail ends every compressed message; senders strip it and receivers
+// append it back. deflateFinal is an empty final block that lets the reader
+// finish cleanly.
+var (
+	deflateTail  = []byte{0x00, 0x00, 0xff, 0xff}
+	deflateFinal = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// offersDeflate reports whether the upgrade request offers permessage-deflate
+// in a form permessageDeflate answers. Offers limiting the server's window
+// are declined, since flate always uses the largest one.
+func offersDeflate(header http.Header) bool {
+	for _, value := range header.Values("Sec-WebSocket-Extensions") {
+		for _, offer := range strings.Split(value, ",") {
+			params := strings.Split(offer, ";")
+			if strings.TrimSpace(params[0]) != "permessage-deflate" {
+				continue
+			}
+			accepted := true
+			for _, param := range params[1:] {
+				if strings.HasPrefix(strings.TrimSpace(param), "server_max_window_bits") {
+					accepted = false
+				}
+			}
+			if accepted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func deflateMessage(payload []byte) []byte {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&buf)
+	w.Write(payload)
+	w.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), deflateTail)
+}
+
+// errMessageTooBig is the error of messages over MaxMessageSize.
+var errMessageTooBig = errors.New("message too big")
+
+// inflateMessage decompresses a message, failing with errMessageTooBig if it
+// inflates past limit bytes (no limit if 0).
+func inflateMessage(data []byte, limit int64) ([]byte, error) {
+	r := flate.NewReader(io.MultiReader(bytes.NewReader(data), bytes.NewReader(deflateTail), bytes.NewReader(deflateFinal)))
+	defer r.Close()
+
+	if limit > 0 {
+		r = io.NopCloser(io.LimitReader(r, limit+1))
+	}
+	message, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed message: %w", err)
+	}
+	if limit > 0 && int64(len(message)) > limit {
+		return nil, fmt.Errorf("%w: inflates past %d bytes", errMessageTooBig, limit)
+	}
+	return message, nil
+}
@@ -0,0 +1,313 @@
+package testingrelay
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v3"
+)
+
+// KindLimit is the policy for one event kind. Its size limits replace the
+// global ones when set, and EventsPerMin adds a rate limit for the kind alone.
+type KindLimit struct {
+	MaxContentLength int `json:"max_content_length" yaml:"max_content_length"`
+	MaxEventTags     int `json:"max_event_tags" yaml:"max_event_tags"`
+	EventsPerMin     int `json:"events_per_min" yaml:"events_per_min"`
+}
+
+// KindLimits maps event kinds to their policies.
+type KindLimits map[int]KindLimit
+
+// Decode parses KIND_POLICY, a comma-separated list of
+// kind:max_content_length[:max_event_tags[:events_per_min]] entries where
+// empty fields are unset, e.g. "1:10000,30023:100000,7:500::30".
+func (l *KindLimits) Decode(value string) error {
+	limits := make(KindLimits)
+	for _, entry := range splitParams([]string{value}) {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 4 {
+			return fmt.Errorf("invalid kind policy %q, expected kind:max_content_length[:max_event_tags[:events_per_min]]", entry)
+		}
+
+		var values [4]int
+		for i, field := range fields {
+			if field == "" && i > 0 {
+				continue
+			}
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid kind policy %q: %q is not a number", entry, field)
+			}
+			values[i] = n
+		}
+		limits[values[0]] = KindLimit{MaxContentLength: values[1], MaxEventTags: values[2], EventsPerMin: values[3]}
+	}
+	*l = limits
+	return nil
+}
+
+// ConfigFile is the optional YAML file given with -config. It holds the same
+// settings as the RELAY_* env vars, named like them without the prefix and
+// lowercased, with the nested ones (CHAOS_*, RATE_LIMIT_*) as sections. It
+// can also hold settings env vars can't express:
+//
+//	db_backend: lmdb
+//	allowed_kinds: [0, 1, 7]
+//	max_content_length: 10000
+//	chaos:
+//	  enabled: true
+//	  drop_ok_rate: 0.1
+//	kind_limits:
+//	  1: {max_content_length: 280, max_event_tags: 20, events_per_min: 30}
+//	prune_kinds:
+//	  7: {max_age: 24h, max_per_pubkey: 500}
+//	shards:
+//	  - {kinds: [30023], backend: lmdb, path: ./articles}
+//	relays:
+//	  - path: /relay-b
+//	    allowed_kinds: [1]
+//
+// The relays list adds relays served by the same process, see VirtualRelay,
+// and shards keep some kinds in stores of their own, see Shard.
+// File values are exported as env vars that aren't already set, so the
+// environment (and .env) overrides the file.
+type ConfigFile struct {
+	path string
+
+	// env vars set from the file, which a reload may change or remove
+	applied map[string]bool
+}
+
+// fileOnly holds the settings that only exist in the config file.
+type fileOnly struct {
+	KindLimits KindLimits `yaml:"kind_limits"`
+	PruneKinds PruneRules `yaml:"prune_kinds"`
+	Shards     Shards     `yaml:"shards"`
+
+	Relays []map[string]any `yaml:"relays"`
+}
+
+func NewConfigFile(path string) *ConfigFile {
+	return &ConfigFile{path: path, applied: make(map[string]bool)}
+}
+
+// loadConfig reads the configuration from the environment and, if file isn't
+// nil, the config file underneath it. It also returns the file only settings,
+// which hold the relays list.
+func loadConfig(file *ConfigFile) (RelayConfig, fileOnly, error) {
+	extra, err := file.export()
+	if err != nil {
+		return RelayConfig{}, extra, err
+	}
+	cfg, err := processEnv(extra)
+	return cfg, extra, err
+}
+
+// Validate checks the settings of one relay, as far as that is possible
+// without opening its files and database.
+func (cfg *RelayConfig) Validate() error {
+	checks := []struct {
+		what string
+		err  error
+	}{
+		{"configuration", cfg.Tunables().Validate()},
+		{"sqlite settings", cfg.SQLite.Validate()},
+		{"backup settings", cfg.Backup.Validate(cfg.DBBackend, cfg.Shards)},
+		{"postgres settings", cfg.Postgres.Validate()},
+		{"write batch settings", cfg.WriteBatch.Validate()},
+		{"validation settings", cfg.Validation.Validate()},
+		{"whitelist settings", cfg.Whitelist.Validate()},
+		{"web of trust settings", cfg.WoT.Validate()},
+		{"gossip settings", cfg.Gossip.Validate(cfg.ServiceURL)},
+		{"payment settings", cfg.Payment.Validate()},
+		{"filter rules", cfg.FilterRules.Validate()},
+		{"replication settings", cfg.Replica.Validate()},
+		{"cluster settings", cfg.Cluster.Validate(cfg.DBBackend, cfg.QueryCache.Size)},
+		{"dispatch settings", cfg.Dispatch.Validate()},
+		{"DVM settings", cfg.DVM.Validate()},
+		{"IP policy", cfg.IP.Validate()},
+		{"IP allowlist", validateAllowlist(cfg.AllowedIPs, cfg.AllowedCIDRs)},
+		{"spam settings", cfg.Spam.Validate()},
+		{"chaos settings", cfg.Chaos.Validate()},
+		{"webhook settings", cfg.Webhooks.Validate()},
+		{"audit settings", cfg.Audit.Validate()},
+		{"blossom settings", cfg.Blossom.Validate()},
+		{"gift wrap settings", cfg.GiftWrap.Validate()},
+		{"websocket settings", cfg.WebSocket.Validate()},
+		{"signature verification settings", cfg.SigVerify.Validate()},
+		{"slow reader settings", cfg.SlowReader.Validate()},
+		{"throttle settings", cfg.Throttle.Validate()},
+		{"shards", cfg.Shards.Validate()},
+		{"prefix overrides", cfg.Prefixes.Validate()},
+	}
+	for _, check := range checks {
+		if check.err != nil {
+			return fmt.Errorf("invalid %s: %w", check.what, check.err)
+		}
+	}
+	return nil
+}
+
+// checkConfig validates everything serve needs, the process-wide settings
+// and every relay, and returns the virtual relays and their configurations.
+func checkConfig(cfg RelayConfig, extra fileOnly) ([]VirtualRelay, map[string]RelayConfig, error) {
+	if err := cfg.TLS.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid TLS settings: %w", err)
+	}
+	if err := cfg.Listen.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid listeners: %w", err)
+	}
+	if err := cfg.Pprof.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid debug endpoint settings: %w", err)
+	}
+	if _, err := parseIPRanges(cfg.TrustedProxies); err != nil {
+		return nil, nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, nil, err
+	}
+	virtuals, configs, err := relayConfigs(cfg, extra)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid relays: %w", err)
+	}
+	for _, v := range virtuals {
+		vcfg := configs[v.ID()]
+		if err := vcfg.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("relay %s: %w", v.ID(), err)
+		}
+	}
+	return virtuals, configs, nil
+}
+
+func processEnv(extra fileOnly) (RelayConfig, error) {
+	var cfg RelayConfig
+	if err := envconfig.Process("RELAY", &cfg); err != nil {
+		return cfg, err
+	}
+
+	// KIND_POLICY entries win over kind_limits ones
+	limits := make(KindLimits)
+	for kind, limit := range extra.KindLimits {
+		limits[kind] = limit
+	}
+	for kind, limit := range cfg.KindLimits {
+		limits[kind] = limit
+	}
+	cfg.KindLimits = limits
+
+	// and PRUNE_KINDS ones over prune_kinds
+	rules := make(PruneRules)
+	for kind, rule := range extra.PruneKinds {
+		rules[kind] = rule
+	}
+	for kind, rule := range cfg.Prune.Kinds {
+		rules[kind] = rule
+	}
+	cfg.Prune.Kinds = rules
+	cfg.Shards = extra.Shards
+
+	// DATABASE_URL is the usual way to point at postgres
+	if cfg.DBBackend == "postgres" && cfg.DatabaseURL != "" {
+		cfg.DBPath = cfg.DatabaseURL
+	}
+
+	var err error
+	if cfg.WhitelistPubkeys, err = parsePubkeys(cfg.WhitelistPubkeys); err != nil {
+		return cfg, fmt.Errorf("WHITELIST_PUBKEYS: %w", err)
+	}
+	if cfg.Whitelist.FollowsOf, err = parsePubkeys(cfg.Whitelist.FollowsOf); err != nil {
+		return cfg, fmt.Errorf("WHITELIST_FOLLOWS_OF: %w", err)
+	}
+	if cfg.WoT.Seeds, err = parsePubkeys(cfg.WoT.Seeds); err != nil {
+		return cfg, fmt.Errorf("WOT_SEEDS: %w", err)
+	}
+	return cfg, nil
+}
+
+// export reads the file and sets the env vars it defines, returning the
+// settings that have no env var. A nil file exports nothing.
+func (f *ConfigFile) export() (fileOnly, error) {
+	var extra fileOnly
+	if f == nil {
+		return extra, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return extra, err
+	}
+
+	var tree map[string]any
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return extra, fmt.Errorf("config file %s: %w", f.path, err)
+	}
+	if err := yaml.Unmarshal(data, &extra); err != nil {
+		return extra, fmt.Errorf("config file %s: %w", f.path, err)
+	}
+	if _, ok := tree["retention"]; ok {
+		return extra, fmt.Errorf("config file %s: retention is gone, set prune (PRUNE_*) and prune_kinds instead", f.path)
+	}
+	delete(tree, "kind_limits")
+	delete(tree, "prune_kinds")
+	delete(tree, "shards")
+	delete(tree, "relays")
+
+	vars := make(map[string]string)
+	if err := flattenConfig("RELAY", tree, vars); err != nil {
+		return extra, fmt.Errorf("config file %s: %w", f.path, err)
+	}
+
+	for name := range f.applied {
+		if _, ok := vars[name]; !ok {
+			os.Unsetenv(name)
+			delete(f.applied, name)
+		}
+	}
+	for name, value := range vars {
+		if _, set := os.LookupEnv(name); set && !f.applied[name] {
+			continue
+		}
+		os.Setenv(name, value)
+		f.applied[name] = true
+	}
+
+	return extra, nil
+}
+
+// flattenConfig turns nested keys into env var names and values into the
+// strings envconfig parses, with lists comma-separated.
+func flattenConfig(prefix string, tree map[string]any, vars map[string]string) error {
+	keys := make([]string, 0, len(tree))
+	for key := range tree {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := prefix + "_" + strings.ToUpper(key)
+		switch value := tree[key].(type) {
+		case map[string]any:
+			if err := flattenConfig(name, value, vars); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				if _, nested := item.(map[string]any); nested {
+					return fmt.Errorf("%s: lists of sections are not supported", key)
+				}
+				items[i] = fmt.Sprint(item)
+			}
+			vars[name] = strings.Join(items, ",")
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+const (
+	countExact = "exact"
+	countHLL   = "hll"
+)
+
+// countSketchLimit caps how many HyperLogLog sketches are kept. Past it one
+// is dropped, to be built again the next time it is needed.
+const countSketchLimit = 10000
+
+// setupCount serves NIP-45 COUNT requests. In exact mode counts come from
+// the store. In hll mode filters on kinds alone are HyperLogLog estimates of
+// the distinct ids, and so are follower and reaction counts, the responses
+// being marked approximate; other filters are counted by the store. Sketches
+// never take deleted or replaced events out, so replaceable kinds are always
+// counted by the store. Either way the filters NIP-45 defines HyperLogLog for
+// get the registers too, so clients can merge counts from several relays. It
+// must run after attachStore.
+func setupCount(relay *khatru.Relay, wire *wireServer, sketches *countSketches, mode string) error {
+	exact := relay.CountEvents
+	countExactly := func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		var total int64
+		for _, count := range exact {
+			n, err := count(ctx, filter)
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+		return total, nil
+	}
+
+	switch mode {
+	case countExact:
+	case countHLL:
+		relay.CountEvents = []func(ctx context.Context, filter nostr.Filter) (int64, error){
+			func(ctx context.Context, filter nostr.Filter) (int64, error) {
+				if !sketchable(filter) {
+					return countExactly(ctx, filter)
+				}
+				return sketches.countKinds(ctx, filter.Kinds)
+			},
+		}
+		approximate := &approximateCounts{pending: make(map[*wireConn]map[string]bool)}
+		wire.inbound = append(wire.inbound, approximate.inbound)
+		wire.outbound = append(wire.outbound, approximate.outbound)
+		relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+			if conn := getWireConn(khatru.GetConnection(ctx)); conn != nil {
+				approximate.forget(conn)
+			}
+		})
+	default:
+		return fmt.Errorf("unknown count mode %q, expected %s or %s", mode, countExact, countHLL)
+	}
+
+	// khatru sends the filters eligible for HyperLogLog only to these hooks,
+	// so without one they would always count zero
+	relay.CountEventsHLL = append(relay.CountEventsHLL,
+		func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+			hll, err := sketches.pubkeys(ctx, filter, offset)
+			if err != nil {
+				return 0, nil, err
+			}
+			if mode == countHLL {
+				return int64(hll.Count()), hll, nil
+			}
+			total, err := countExactly(ctx, filter)
+			return total, hll, err
+		},
+	)
+	return nil
+}
+
+// sketchable reports whether filter selects events by kinds and nothing else,
+// none of them replaceable, so the sketch of their ids counts them.
+func sketchable(filter nostr.Filter) bool {
+	return len(filter.Kinds) > 0 && len(filter.IDs) == 0 && len(filter.Authors) == 0 && len(filter.Tags) == 0 &&
+		filter.Since == nil && filter.Until == nil && filter.Search == "" &&
+		!slices.ContainsFunc(filter.Kinds, isReplaceable)
+}
+
+// countSketches keeps the HyperLogLog sketches COUNTs are answered from: the
+// ids of every kind, and the pubkeys NIP-45 counts for one tag value. A
+// sketch is built from the store the first time it is needed and updated as
+// events are saved after that. Adding is idempotent, so events saved while a
+// sketch is built are counted once; deleted events aren't taken out.
+type countSketches struct {
+	store eventstore.Store
+
+	mu       sync.Mutex
+	sketches map[string]*countSketch
+}
+
+type countSketch struct {
+	hll    *hyperloglog.HyperLogLog
+	offset int
+	built  chan struct{}
+	err    error
+}
+
+func newCountSketches() *countSketches {
+	return &countSketches{sketches: make(map[string]*countSketch)}
+}
+
+// countKinds estimates how many distinct events of kinds are stored.
+func (c *countSketches) countKinds(ctx context.Context, kinds []int) (int64, error) {
+	merged := hyperloglog.New(0)
+	for _, kind := range kinds {
+		hll, err := c.sketch(ctx, strconv.Itoa(kind), 0, nostr.Filter{Kinds: []int{kind}}, eventID)
+		if err != nil {
+			return 0, err
+		}
+		merged.Merge(hll)
+	}
+	return int64(merged.Count()), nil
+}
+
+// pubkeys returns the sketch of the pubkeys filter counts, a NIP-45 follower
+// or reaction count.
+func (c *countSketches) pubkeys(ctx context.Context, filter nostr.Filter, offset int) (*hyperloglog.HyperLogLog, error) {
+	var ref string
+	for _, values := range filter.Tags {
+		ref = values[0]
+	}
+	// the filter matches any of the tags, NIP-45 counts the ones it names
+	return c.sketch(ctx, pubkeysKey(filter.Kinds[0], ref), offset, filter, func(event *nostr.Event) string {
+		for counted := range nip45.HyperLogLogEventPubkeyOffsetsAndReferencesForEvent(event) {
+			if counted == ref {
+				return event.PubKey
+			}
+		}
+		return ""
+	})
+}
+
+func eventID(event *nostr.Event) string { return event.ID }
+
+func pubkeysKey(kind int, ref string) string {
+	return strconv.Itoa(kind) + ":" + ref
+}
+
+// sketch returns a copy of the sketch under key, building it from the value
+// of every event matching filter if there is none. Empty values are skipped.
+func (c *countSketches) sketch(ctx context.Context, key string, offset int, filter nostr.Filter, value func(*nostr.Event) string) (*hyperloglog.HyperLogLog, error) {
+	c.mu.Lock()
+	sketch, ok := c.sketches[key]
+	if !ok {
+		if len(c.sketches) >= countSketchLimit {
+			for old := range c.sketches {
+				delete(c.sketches, old)
+				break
+			}
+		}
+		sketch = &countSketch{hll: hyperloglog.New(offset), offset: offset, built: make(chan struct{})}
+		c.sketches[key] = sketch
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		sketch.err = scanEvents(ctx, c.store, filter, func(events []*nostr.Event) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for _, event := range events {
+				if v := value(event); v != "" {
+					sketch.hll.Add(v)
+				}
+			}
+			return nil
+		})
+		if sketch.err != nil {
+			c.mu.Lock()
+			delete(c.sketches, key)
+			c.mu.Unlock()
+		}
+		close(sketch.built)
+	}
+
+	select {
+	case <-sketch.built:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if sketch.err != nil {
+		return nil, sketch.err
+	}
+
+	// khatru merges other hooks' sketches into the one returned
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return hyperloglog.NewWithRegisters(append([]byte(nil), sketch.hll.GetRegisters()...), sketch.offset), nil
+}
+
+// add counts a saved event in the sketches that were built.
+func (c *countSketches) add(event *nostr.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sketch, ok := c.sketches[strconv.Itoa(event.Kind)]; ok {
+		sketch.hll.Add(event.ID)
+	}
+	for ref := range nip45.HyperLogLogEventPubkeyOffsetsAndReferencesForEvent(event) {
+		if sketch, ok := c.sketches[pubkeysKey(event.Kind, ref)]; ok {
+			sketch.hll.Add(event.PubKey)
+		}
+	}
+}
+
+// Store wraps the store the sketches are built from, so saved events update
+// them.
+func (c *countSketches) Store(store eventstore.Store) eventstore.Store {
+	c.store = store
+	return &sketchingStore{Store: store, sketches: c}
+}
+
+type sketchingStore struct {
+	eventstore.Store
+	sketches *countSketches
+}
+
+func (s *sketchingStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.SaveEvent(ctx, event)
+	if err == nil {
+		s.sketches.add(event)
+	}
+	return err
+}
+
+func (s *sketchingStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.ReplaceEvent(ctx, event)
+	if err == nil {
+		s.sketches.add(event)
+	}
+	return err
+}
+
+// approximateCounts flags the COUNT responses estimated from a sketch in hll
+// mode, which go-nostr has no field for. The requests are remembered by
+// connection and subscription id until their response is sent.
+type approximateCounts struct {
+	mu      sync.Mutex
+	pending map[*wireConn]map[string]bool
+}
+
+func (a *approximateCounts) inbound(conn *wireConn, msg *wireMessage) {
+	env := msg.Envelope()
+	if msg.Label() != "COUNT" || len(env) < 3 {
+		return
+	}
+	var id string
+	var filter nostr.Filter
+	if json.Unmarshal(env[1], &id) != nil || json.Unmarshal(env[2], &filter) != nil {
+		return
+	}
+	if !sketchable(filter) && nip45.HyperLogLogEventPubkeyOffsetForFilter(filter) == -1 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending[conn] == nil {
+		a.pending[conn] = make(map[string]bool)
+	}
+	a.pending[conn][id] = true
+}
+
+func (a *approximateCounts) outbound(conn *wireConn, msg *wireMessage) {
+	env := msg.Envelope()
+	label := msg.Label()
+	if (label != "COUNT" && label != "CLOSED") || len(env) < 2 {
+		return
+	}
+	var id string
+	json.Unmarshal(env[1], &id)
+
+	a.mu.Lock()
+	approximate := a.pending[conn][id]
+	delete(a.pending[conn], id)
+	a.mu.Unlock()
+	if !approximate || label != "COUNT" || len(env) != 3 {
+		return
+	}
+
+	var result map[string]json.RawMessage
+	if json.Unmarshal(env[2], &result) != nil {
+		return
+	}
+	result["approximate"] = json.RawMessage("true")
+	env[2], _ = json.Marshal(result)
+
+	payload, _ := json.Marshal(env)
+	msg.SetPayload(payload)
+}
+
+func (a *approximateCounts) forget(conn *wireConn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, conn)
+}
@@ -0,0 +1,38 @@
+package testingrelay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApproximateCounts(t *testing.T) {
+	pubkey := strings.Repeat("a", 64)
+	tests := []struct {
+		name        string
+		filter      string
+		approximate bool
+	}{
+		{name: "kinds", filter: `{"kinds":[1,7]}`, approximate: true},
+		{name: "followers", filter: `{"kinds":[3],"#p":["` + pubkey + `"]}`, approximate: true},
+		// counted by the store
+		{name: "kinds and authors", filter: `{"kinds":[1],"authors":["` + pubkey + `"]}`},
+		{name: "replaceable kinds", filter: `{"kinds":[1,0]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			approximate := &approximateCounts{pending: make(map[*wireConn]map[string]bool)}
+			conn := &wireConn{}
+
+			approximate.inbound(conn, &wireMessage{opcode: opText, payload: []byte(`["COUNT","c",` + tt.filter + `]`)})
+			response := &wireMessage{opcode: opText, payload: []byte(`["COUNT","c",{"count":3}]`)}
+			approximate.outbound(conn, response)
+
+			if marked := strings.Contains(string(response.payload), `"approximate":true`); marked != tt.approximate {
+				t.Fatalf("response %s marked approximate: %v, want %v", response.payload, marked, tt.approximate)
+			}
+			if len(approximate.pending[conn]) != 0 {
+				t.Fatalf("still pending after the response: %v", approximate.pending[conn])
+			}
+		})
+	}
+}
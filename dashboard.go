@@ -0,0 +1,63 @@
+package testingrelay
+
+import (
+	_ "embed"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// dashboardHTML is the page served on /dashboard. It polls /dashboard/state
+// with the admin token and follows new events over a websocket to the relay
+// itself, like any client would.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+type dashboardState struct {
+	Connections []dashboardConn  `json:"connections"`
+	Rejections  map[string]int64 `json:"rejections"`
+	Config      Tunables         `json:"config"`
+	Chaos       ChaosSettings    `json:"chaos"`
+}
+
+type dashboardConn struct {
+	ID            uint64             `json:"id"`
+	RemoteAddr    string             `json:"remote_addr"`
+	ConnectedAt   time.Time          `json:"connected_at"`
+	Subscriptions []wireSubscription `json:"subscriptions"`
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+func handleDashboardState(wire *wireServer, metrics *Metrics, live *LiveConfig, chaos *Chaos) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		state := dashboardState{
+			Connections: []dashboardConn{},
+			Rejections:  metrics.Rejections(),
+			Config:      live.Load().Tunables(),
+			Chaos:       chaos.Settings(),
+		}
+		for _, conn := range wire.Conns() {
+			state.Connections = append(state.Connections, dashboardConn{
+				ID:            conn.ID(),
+				RemoteAddr:    conn.request.RemoteAddr,
+				ConnectedAt:   conn.connectedAt,
+				Subscriptions: conn.Subscriptions(),
+			})
+		}
+		sort.Slice(state.Connections, func(i, j int) bool {
+			return state.Connections[i].ID < state.Connections[j].ID
+		})
+
+		writeJSON(w, http.StatusOK, state)
+	}
+}
@@ -0,0 +1,110 @@
+package testingrelay
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// PprofSettings expose the Go runtime debug endpoints: /debug/pprof/*,
+// /debug/vars and /debug/goroutines. Enabled serves them on the relay's port
+// behind the admin token. Addr serves them on a separate listener instead,
+// without the token, so it has to be a loopback address.
+type PprofSettings struct {
+	Enabled bool   `envconfig:"ENABLED"`
+	Addr    string `envconfig:"ADDR"`
+}
+
+func (s PprofSettings) Validate() error {
+	if s.Addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid PPROF_ADDR: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("PPROF_ADDR must listen on localhost, the endpoints aren't authenticated there")
+	}
+	return nil
+}
+
+var (
+	// debugConnections is the relay_connections var, the connections open
+	// to every Relay of the process by the order they were created in. It is
+	// published once since expvar panics on a name published twice, and not
+	// at all when the embedding program already took the name.
+	debugConnections *expvar.Map
+	debugVarsOnce    sync.Once
+	debugRelays      atomic.Int64
+)
+
+// debugHandler serves the debug endpoints, returning the function that takes
+// wire's connections out of /debug/vars. CPU profiles and traces longer than
+// the relay's HTTP timeout only work on the separate listener.
+func debugHandler(wire *wireServer) (http.Handler, func()) {
+	debugVarsOnce.Do(func() {
+		if expvar.Get("relay_connections") == nil {
+			debugConnections = expvar.NewMap("relay_connections")
+		}
+	})
+	unpublish := func() {}
+	if debugConnections != nil {
+		key := strconv.FormatInt(debugRelays.Add(1), 10)
+		debugConnections.Set(key, expvar.Func(func() any {
+			return len(wire.Conns())
+		}))
+		unpublish = func() { debugConnections.Delete(key) }
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	return mux, unpublish
+}
+
+// setupDebug mounts the debug endpoints on mux or starts their own listener,
+// returning the function that stops serving them.
+func setupDebug(mux *http.ServeMux, live *LiveConfig, wire *wireServer, logger *Logger) func() error {
+	cfg := live.Load()
+	if !cfg.Pprof.Enabled && cfg.Pprof.Addr == "" {
+		return func() error { return nil }
+	}
+	handler, unpublish := debugHandler(wire)
+
+	if cfg.Pprof.Addr == "" {
+		mux.Handle("/debug/", requireAdmin(live, handler.ServeHTTP))
+		logger.Info("Debug endpoints enabled at /debug/ behind the admin token")
+		return func() error {
+			unpublish()
+			return nil
+		}
+	}
+
+	server := &http.Server{Addr: cfg.Pprof.Addr, Handler: handler}
+	go func() {
+		logger.Info("Serving debug endpoints on %s", cfg.Pprof.Addr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Debug server failed: %v", err)
+		}
+	}()
+	return func() error {
+		unpublish()
+		return server.Close()
+	}
+}
@@ -0,0 +1,155 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// setupDeletions completes khatru's NIP-09 handling. khatru deletes the events
+// a kind 5 request targets before any policy runs, and neither stores the
+// request nor remembers it, so deleted events can simply be sent again. Here
+// deletion requests are published like other events instead (see wireEvents
+// and publishEvent): the policies run first, the request is stored and, with
+// rejectDeleted, serves as the record used to refuse resubmitted events.
+func setupDeletions(relay *khatru.Relay, store eventstore.Store, rejectDeleted bool) {
+	if rejectDeleted {
+		relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			return rejectDeletedEvent(ctx, store, event)
+		})
+	}
+}
+
+// rejectDeletedEvent refuses events their author has asked to delete, by id or,
+// for replaceable and addressable events, by address up to the request's date.
+func rejectDeletedEvent(ctx context.Context, store eventstore.Store, event *nostr.Event) (reject bool, msg string) {
+	if event.Kind == 5 {
+		return false, ""
+	}
+
+	byID := nostr.Filter{
+		Kinds:   []int{5},
+		Authors: []string{event.PubKey},
+		Tags:    nostr.TagMap{"e": []string{event.ID}},
+		Limit:   1,
+	}
+	if hasEvents(ctx, store, byID) {
+		return true, "blocked: this event was deleted by its author"
+	}
+
+	var address string
+	switch {
+	case nostr.IsAddressableKind(event.Kind):
+		address = fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+	case nostr.IsReplaceableKind(event.Kind):
+		address = fmt.Sprintf("%d:%s:", event.Kind, event.PubKey)
+	default:
+		return false, ""
+	}
+
+	byAddress := nostr.Filter{
+		Kinds:   []int{5},
+		Authors: []string{event.PubKey},
+		Tags:    nostr.TagMap{"a": []string{address}},
+		Since:   &event.CreatedAt,
+		Limit:   1,
+	}
+	if hasEvents(ctx, store, byAddress) {
+		return true, "blocked: this address was deleted by its author after this event was created"
+	}
+
+	return false, ""
+}
+
+func hasEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter) bool {
+	ch, err := store.QueryEvents(ctx, filter)
+	if err != nil {
+		return false
+	}
+
+	found := false
+	for range ch {
+		found = true
+	}
+	return found
+}
+
+// deletionTargets finds the events a NIP-09 deletion request points to, the
+// way khatru does for kind 5 EVENTs. Each one must have been sent by the
+// request's author or be allowed by OverwriteDeletionOutcome, and the first
+// one refused fails the request before publishEvent stores it.
+func deletionTargets(ctx context.Context, relay *khatru.Relay, event *nostr.Event) ([]*nostr.Event, error) {
+	var targets []*nostr.Event
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		var filter nostr.Filter
+		switch tag[0] {
+		case "e":
+			filter = nostr.Filter{IDs: []string{tag[1]}}
+		case "a":
+			spl := strings.SplitN(tag[1], ":", 3)
+			if len(spl) != 3 {
+				continue
+			}
+			kind, err := strconv.Atoi(spl[0])
+			if err != nil {
+				continue
+			}
+			filter = nostr.Filter{
+				Kinds:   []int{kind},
+				Authors: []string{spl[1]},
+				Until:   &event.CreatedAt,
+			}
+			// plain replaceable events have no d tag to match
+			if nostr.IsAddressableKind(kind) {
+				filter.Tags = nostr.TagMap{"d": []string{spl[2]}}
+			}
+		default:
+			continue
+		}
+
+		for _, query := range relay.QueryEvents {
+			ch, err := query(ctx, filter)
+			if err != nil {
+				continue
+			}
+			target := <-ch
+			for range ch {
+			}
+			if target == nil {
+				continue
+			}
+
+			accept, msg := target.PubKey == event.PubKey, "you are not the author of this event"
+			for _, overwrite := range relay.OverwriteDeletionOutcome {
+				accept, msg = overwrite(ctx, target, event)
+			}
+			if !accept {
+				return nil, fmt.Errorf("blocked: %s", msg)
+			}
+			targets = append(targets, target)
+			break
+		}
+	}
+	return targets, nil
+}
+
+// deleteTargets deletes the events of an accepted deletion request.
+func deleteTargets(ctx context.Context, relay *khatru.Relay, targets []*nostr.Event) error {
+	for _, target := range targets {
+		for _, del := range relay.DeleteEvent {
+			if err := del(ctx, target); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package testingrelay
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestWebsocketDeletions(t *testing.T) {
+	tests := []struct {
+		name     string
+		kind     int
+		byOther  bool // the deletion request comes from another key
+		address  bool // the request points to the note's address, not its id
+		readOnly bool
+		refusal  string
+	}{
+		{name: "accepted", kind: nostr.KindTextNote},
+		{name: "replaceable address", kind: nostr.KindProfileMetadata, address: true},
+		{name: "refused by a policy", kind: nostr.KindTextNote, readOnly: true, refusal: "blocked: relay is read-only"},
+		{name: "not the author", kind: nostr.KindTextNote, byOther: true, refusal: "blocked: you are not the author of this event"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, url := serveTestRelay(t, nil)
+			conn := connect(t, url)
+
+			sk := nostr.GeneratePrivateKey()
+			note := signedEvent(t, sk, tt.kind, "to delete", nil)
+			if refusal := publish(t, conn, note); refusal != "" {
+				t.Fatalf("publishing the note: %s", refusal)
+			}
+			if tt.readOnly {
+				relay.instances[0].live.Update(func(cfg *RelayConfig) error {
+					cfg.ReadOnly = true
+					return nil
+				})
+			}
+
+			tag := nostr.Tag{"e", note.ID}
+			if tt.address {
+				tag = nostr.Tag{"a", fmt.Sprintf("%d:%s:", note.Kind, note.PubKey)}
+			}
+			if tt.byOther {
+				sk = nostr.GeneratePrivateKey()
+			}
+			deletion := signedEvent(t, sk, nostr.KindDeletion, "", nostr.Tags{tag})
+			if refusal := publish(t, conn, deletion); refusal != tt.refusal {
+				t.Fatalf("got refusal %q, want %q", refusal, tt.refusal)
+			}
+
+			// an accepted request deletes the note and is stored in its place,
+			// a refused one is not stored at all
+			want := []string{note.ID}
+			if tt.refusal == "" {
+				want = []string{deletion.ID}
+			}
+			ids := queryIDs(t, conn, nostr.Filter{IDs: []string{note.ID, deletion.ID}})
+			if !slices.Equal(ids, want) {
+				t.Fatalf("stored %v, want %v", ids, want)
+			}
+		})
+	}
+}
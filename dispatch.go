@@ -0,0 +1,228 @@
+package testingrelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// DispatchSettings hand events of some kinds to external handlers
+// (DISPATCH_*), so the relay can stand in for the relay side of NIP-90 data
+// vending machine flows. Routes map kinds to handlers. Every accepted event
+// of a routed kind is POSTed as JSON to an http(s) handler, or written to
+// the stdin of an exec: command run for it. The handler answers with signed
+// events, a JSON array or one per line, like job results and feedback, which
+// are stored and delivered to subscribers. With Store off routed events go
+// to their handler only, accepted but never stored or served. A handler
+// taking longer than Timeout is given up on.
+type DispatchSettings struct {
+	Routes  DispatchRoutes `envconfig:"ROUTES"`
+	Store   bool           `envconfig:"STORE" default:"true"`
+	Timeout time.Duration  `envconfig:"TIMEOUT" default:"30s"`
+}
+
+func (s DispatchSettings) Validate() error {
+	if len(s.Routes) > 0 && s.Timeout <= 0 {
+		return fmt.Errorf("DISPATCH_TIMEOUT must be positive")
+	}
+	return nil
+}
+
+// DispatchRoute sends kinds From to To to Handler.
+type DispatchRoute struct {
+	From, To int
+	Handler  string
+}
+
+// DispatchRoutes are decoded from comma separated kinds=handler entries,
+// kinds being a kind or a range like 5000-5999:
+//
+//	5000-5999=http://localhost:8080/jobs,5300=exec:./discovery.sh --verbose
+type DispatchRoutes []DispatchRoute
+
+func (r *DispatchRoutes) Decode(value string) error {
+	var routes DispatchRoutes
+	for _, entry := range splitParams([]string{value}) {
+		kinds, handler, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(handler) == "" {
+			return fmt.Errorf("invalid dispatch route %q, expected kinds=handler", entry)
+		}
+		handler = strings.TrimSpace(handler)
+		if !isHTTPURL(handler) && (!strings.HasPrefix(handler, "exec:") || strings.TrimSpace(handler[len("exec:"):]) == "") {
+			return fmt.Errorf("invalid dispatch route %q: handler must be an http(s) URL or exec:command", entry)
+		}
+
+		from, to, isRange := strings.Cut(strings.TrimSpace(kinds), "-")
+		if !isRange {
+			to = from
+		}
+		route := DispatchRoute{Handler: handler}
+		var err1, err2 error
+		route.From, err1 = strconv.Atoi(from)
+		route.To, err2 = strconv.Atoi(to)
+		if err1 != nil || err2 != nil || route.From < 0 || route.To < route.From {
+			return fmt.Errorf("invalid dispatch route %q: %q is not a kind or kind range", entry, kinds)
+		}
+		routes = append(routes, route)
+	}
+	*r = routes
+	return nil
+}
+
+// handler returns the handler of kind, the first route matching it.
+func (r DispatchRoutes) handler(kind int) string {
+	for _, route := range r {
+		if kind >= route.From && kind <= route.To {
+			return route.Handler
+		}
+	}
+	return ""
+}
+
+// dispatchReplyLimit bounds what a handler may answer.
+const dispatchReplyLimit = 16 << 20
+
+// dispatcher hands routed events to their handlers.
+type dispatcher struct {
+	settings  DispatchSettings
+	relay     *khatru.Relay
+	store     eventstore.Store
+	blackhole *blackhole
+	logger    *Logger
+}
+
+func setupDispatch(relay *khatru.Relay, store eventstore.Store, blackhole *blackhole, settings DispatchSettings, logger *Logger) {
+	if len(settings.Routes) == 0 {
+		return
+	}
+
+	d := &dispatcher{settings: settings, relay: relay, store: store, blackhole: blackhole, logger: logger}
+	if !settings.Store {
+		relay.RejectEvent = append(relay.RejectEvent, d.RejectEvent)
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, d.dispatch)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, d.dispatch)
+
+	for _, route := range settings.Routes {
+		logger.Info("Dispatching kinds %d-%d to %s", route.From, route.To, route.Handler)
+	}
+}
+
+// RejectEvent accepts routed events without storing them.
+func (d *dispatcher) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if d.settings.Routes.handler(event.Kind) != "" {
+		d.blackhole.swallow(event.ID)
+	}
+	return false, ""
+}
+
+func (d *dispatcher) dispatch(ctx context.Context, event *nostr.Event) {
+	handler := d.settings.Routes.handler(event.Kind)
+	if handler == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), d.settings.Timeout)
+		defer cancel()
+
+		start := time.Now()
+		replies, err := d.call(ctx, handler, event)
+		if err != nil {
+			d.logger.Error("Dispatch of event %s (kind %d) to %s failed: %v", event.ID, event.Kind, handler, err)
+			return
+		}
+		stored := 0
+		for _, reply := range replies {
+			if ok, _ := reply.CheckSignature(); !ok {
+				d.logger.Error("Dispatch: %s answered event %s with badly signed event %s", handler, event.ID, reply.ID)
+				continue
+			}
+			if storeRemoteEvent(ctx, d.relay, d.store, reply, handler, d.logger) {
+				stored++
+			}
+		}
+		d.logger.Debug("Dispatched event %s (kind %d) to %s in %s, %d events back", event.ID, event.Kind, handler, time.Since(start).Round(time.Millisecond), stored)
+	}()
+}
+
+// call hands event to handler and returns the events it answered with.
+func (d *dispatcher) call(ctx context.Context, handler string, event *nostr.Event) ([]*nostr.Event, error) {
+	body, _ := json.Marshal(event)
+
+	var reply []byte
+	if command, ok := strings.CutPrefix(handler, "exec:"); ok {
+		args := strings.Fields(command)
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("%w: %s", err, msg)
+			}
+			return nil, err
+		}
+		reply = out
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, handler, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, fmt.Errorf("%s returned %s", handler, resp.Status)
+		}
+		if reply, err = io.ReadAll(io.LimitReader(resp.Body, dispatchReplyLimit)); err != nil {
+			return nil, err
+		}
+	}
+	return parseDispatchReply(reply)
+}
+
+// parseDispatchReply reads the events of a handler's answer: nothing, a
+// JSON array, or events one per line.
+func parseDispatchReply(reply []byte) ([]*nostr.Event, error) {
+	reply = bytes.TrimSpace(reply)
+	if len(reply) == 0 {
+		return nil, nil
+	}
+	var events []*nostr.Event
+	if reply[0] == '[' {
+		if err := json.Unmarshal(reply, &events); err != nil {
+			return nil, fmt.Errorf("invalid answer: %w", err)
+		}
+		return events, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(reply))
+	scanner.Buffer(nil, dispatchReplyLimit)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		event := new(nostr.Event)
+		if err := json.Unmarshal(line, event); err != nil {
+			return nil, fmt.Errorf("invalid answer line: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package testingrelay
+
+import (
+	"encoding/json"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// privateKinds are the direct message kinds: NIP-04 messages and NIP-59 gift
+// wraps, which carry NIP-17 messages.
+var privateKinds = []int{nostr.KindEncryptedDirectMessage, nostr.KindGiftWrap}
+
+// setupDMPrivacy delivers direct messages only to the connections
+// authenticated as their author or one of their p-tagged recipients, when
+// PRIVATE_DMS is set and AUTH is required. It works on the wire, so stored
+// and live events are held back alike; the REQ is still answered with EOSE.
+func setupDMPrivacy(wire *wireServer, cfg *RelayConfig, logger *Logger) {
+	if !cfg.privateDMs() {
+		return
+	}
+
+	wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+		if msg.Label() != "EVENT" {
+			return
+		}
+		env := msg.Envelope()
+		if len(env) < 3 {
+			return
+		}
+		var event struct {
+			Kind   int        `json:"kind"`
+			PubKey string     `json:"pubkey"`
+			Tags   nostr.Tags `json:"tags"`
+		}
+		if json.Unmarshal(env[2], &event) != nil {
+			return
+		}
+		msg.drop = !dmVisible(conn.Authed(), event.Kind, event.PubKey, event.Tags)
+	})
+
+	logger.Info("Direct messages are only delivered to their authenticated author and recipients")
+}
+
+func (cfg *RelayConfig) privateDMs() bool {
+	return cfg.PrivateDMs && cfg.authRequired()
+}
+
+// dmVisible reports whether an event may be delivered to a client
+// authenticated as authed, empty when it isn't: anything but a direct message,
+// or one authed sent or received.
+func dmVisible(authed string, kind int, pubkey string, tags nostr.Tags) bool {
+	if !contains(privateKinds, kind) {
+		return true
+	}
+	return authed != "" && (authed == pubkey || tags.ContainsAny("p", []string{authed}))
+}
@@ -0,0 +1,204 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// DVMSettings run a simulated NIP-90 data vending machine inside the relay
+// (DVM_*), a predictable counterparty for DVM clients. When Enabled it takes
+// every job request of Kinds (all of 5000-5999 by default) not addressed to
+// another provider, and after each Delay sends a kind 7000 feedback per
+// Feedback status and then the job result, of the request kind plus 1000.
+// Result is the result content, with {input}, {kind} and {id} replaced by
+// the first input, the request kind and id; Amount, in millisats, asks for
+// payment on it. With Error set the job fails with that message instead.
+// Everything is signed by Key, a hex or nsec secret key, or a new key each
+// start.
+type DVMSettings struct {
+	Enabled  bool          `envconfig:"ENABLED"`
+	Key      string        `envconfig:"KEY"`
+	Kinds    []int         `envconfig:"KINDS"`
+	Delay    time.Duration `envconfig:"DELAY" default:"1s"`
+	Feedback []string      `envconfig:"FEEDBACK" default:"processing"`
+	Result   string        `envconfig:"RESULT" default:"result of job {id} for {input}"`
+	Amount   int64         `envconfig:"AMOUNT"`
+	Error    string        `envconfig:"ERROR"`
+}
+
+func (s DVMSettings) Validate() error {
+	if _, err := s.secret(); err != nil {
+		return err
+	}
+	for _, kind := range s.Kinds {
+		if !isJobRequestKind(kind) {
+			return fmt.Errorf("invalid DVM_KINDS entry %d, job requests are kinds 5000-5999", kind)
+		}
+	}
+	for _, status := range s.Feedback {
+		switch status {
+		case "payment-required", "processing", "partial", "success", "error":
+		default:
+			return fmt.Errorf("invalid DVM_FEEDBACK status %q, expected payment-required, processing, partial, success or error", status)
+		}
+	}
+	if s.Delay < 0 {
+		return fmt.Errorf("DVM_DELAY must not be negative")
+	}
+	if s.Amount < 0 {
+		return fmt.Errorf("DVM_AMOUNT must not be negative")
+	}
+	return nil
+}
+
+// secret returns the hex secret key, "" when a new one is to be made.
+func (s DVMSettings) secret() (string, error) {
+	if strings.HasPrefix(s.Key, "nsec") {
+		prefix, value, err := nip19.Decode(s.Key)
+		if err != nil || prefix != "nsec" {
+			return "", fmt.Errorf("invalid DVM_KEY, expected 64 hex characters or an nsec")
+		}
+		return value.(string), nil
+	}
+	if s.Key != "" && !isHexKey(strings.ToLower(s.Key)) {
+		return "", fmt.Errorf("invalid DVM_KEY, expected 64 hex characters or an nsec")
+	}
+	return strings.ToLower(s.Key), nil
+}
+
+// kindJobFeedback is the kind of NIP-90 job feedback.
+const kindJobFeedback = 7000
+
+func isJobRequestKind(kind int) bool {
+	return kind >= 5000 && kind <= 5999
+}
+
+// dvm answers job requests.
+type dvm struct {
+	settings DVMSettings
+	secret   string
+	pubkey   string
+	relay    *khatru.Relay
+	store    eventstore.Store
+	logger   *Logger
+	ctx      context.Context
+}
+
+// setupDVM starts the simulated DVM, until the returned function is called.
+func setupDVM(relay *khatru.Relay, store eventstore.Store, settings DVMSettings, logger *Logger) func() error {
+	if !settings.Enabled {
+		return func() error { return nil }
+	}
+	// checked by Validate
+	secret, _ := settings.secret()
+	if secret == "" {
+		secret = nostr.GeneratePrivateKey()
+	}
+	pubkey, _ := nostr.GetPublicKey(secret)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &dvm{settings: settings, secret: secret, pubkey: pubkey, relay: relay, store: store, logger: logger, ctx: ctx}
+	relay.OnEventSaved = append(relay.OnEventSaved, d.take)
+
+	logger.Info("Simulated DVM %s answering job requests after %s", pubkey, settings.Delay)
+	return func() error {
+		cancel()
+		return nil
+	}
+}
+
+// take starts a job for event if it is a request for this DVM.
+func (d *dvm) take(ctx context.Context, event *nostr.Event) {
+	if !isJobRequestKind(event.Kind) {
+		return
+	}
+	if len(d.settings.Kinds) > 0 && !contains(d.settings.Kinds, event.Kind) {
+		return
+	}
+	// requests naming their providers are for them only
+	if providers := event.Tags.GetAll([]string{"p", ""}); len(providers) > 0 && !event.Tags.ContainsAny("p", []string{d.pubkey}) {
+		return
+	}
+	go d.run(*event)
+}
+
+func (d *dvm) run(request nostr.Event) {
+	d.logger.Debug("DVM: job %s (kind %d) from %s", request.ID, request.Kind, request.PubKey)
+
+	if request.Tags.GetFirst([]string{"encrypted"}) != nil {
+		d.emit(d.feedback(request, "error", "encrypted job requests are not supported"))
+		return
+	}
+	for _, status := range d.settings.Feedback {
+		if !d.wait() {
+			return
+		}
+		d.emit(d.feedback(request, status, ""))
+	}
+	if !d.wait() {
+		return
+	}
+	if d.settings.Error != "" {
+		d.emit(d.feedback(request, "error", d.settings.Error))
+		return
+	}
+	d.emit(d.result(request))
+}
+
+// wait sleeps Delay, reporting false if the DVM was stopped meanwhile.
+func (d *dvm) wait() bool {
+	select {
+	case <-d.ctx.Done():
+		return false
+	case <-time.After(d.settings.Delay):
+		return true
+	}
+}
+
+func (d *dvm) feedback(request nostr.Event, status, extra string) *nostr.Event {
+	statusTag := nostr.Tag{"status", status}
+	if extra != "" {
+		statusTag = append(statusTag, extra)
+	}
+	tags := nostr.Tags{statusTag, {"e", request.ID}, {"p", request.PubKey}}
+	if status == "payment-required" && d.settings.Amount > 0 {
+		tags = append(tags, nostr.Tag{"amount", strconv.FormatInt(d.settings.Amount, 10)})
+	}
+	return &nostr.Event{Kind: kindJobFeedback, Tags: tags}
+}
+
+func (d *dvm) result(request nostr.Event) *nostr.Event {
+	raw, _ := json.Marshal(request)
+	tags := nostr.Tags{{"request", string(raw)}, {"e", request.ID}, {"p", request.PubKey}}
+	input := ""
+	for _, tag := range request.Tags.GetAll([]string{"i", ""}) {
+		if input == "" {
+			input = tag[1]
+		}
+		tags = append(tags, tag)
+	}
+	if d.settings.Amount > 0 {
+		tags = append(tags, nostr.Tag{"amount", strconv.FormatInt(d.settings.Amount, 10)})
+	}
+	content := strings.NewReplacer("{input}", input, "{kind}", strconv.Itoa(request.Kind), "{id}", request.ID).Replace(d.settings.Result)
+	return &nostr.Event{Kind: request.Kind + 1000, Tags: tags, Content: content}
+}
+
+// emit signs, stores and delivers event.
+func (d *dvm) emit(event *nostr.Event) {
+	event.CreatedAt = nostr.Now()
+	if err := event.Sign(d.secret); err != nil {
+		d.logger.Error("DVM: failed to sign a kind %d event: %v", event.Kind, err)
+		return
+	}
+	storeRemoteEvent(d.ctx, d.relay, d.store, event, "the DVM", d.logger)
+}
@@ -0,0 +1,190 @@
+package testingrelay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip40"
+)
+
+// isExpired reports whether the event has a NIP-40 expiration tag in the past.
+func isExpired(event *nostr.Event, now nostr.Timestamp) bool {
+	expiresAt := nip40.GetExpiration(event.Tags)
+	return expiresAt != -1 && expiresAt <= now
+}
+
+// expirations keeps the stored events that have a NIP-40 expiration tag, so
+// the sweeper finds the expired ones without scanning the store. Like Stats it
+// reads the store once at startup and is kept up to date through Store.
+type expirations struct {
+	mu     sync.Mutex
+	events map[string]*nostr.Event
+}
+
+func newExpirations() *expirations {
+	return &expirations{events: make(map[string]*nostr.Event)}
+}
+
+// Load keeps the expiring events already in store.
+func (e *expirations) Load(ctx context.Context, store eventstore.Store) error {
+	return scanEvents(ctx, store, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			e.add(event)
+		}
+		return nil
+	})
+}
+
+func (e *expirations) add(event *nostr.Event) {
+	if nip40.GetExpiration(event.Tags) == -1 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events[event.ID] = event
+}
+
+func (e *expirations) forget(id string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.events, id)
+}
+
+// expired returns the events kept that have expired by now.
+func (e *expirations) expired(now nostr.Timestamp) []*nostr.Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var expired []*nostr.Event
+	for _, event := range e.events {
+		if isExpired(event, now) {
+			expired = append(expired, event)
+		}
+	}
+	return expired
+}
+
+// Store wraps an eventstore so writes and deletions update the events kept.
+// Versions taken over by a replacement stay until swept, as the sweeper
+// only deletes what is still stored.
+func (e *expirations) Store(store eventstore.Store) eventstore.Store {
+	return &expiringStore{Store: store, expirations: e}
+}
+
+type expiringStore struct {
+	eventstore.Store
+	expirations *expirations
+}
+
+func (s *expiringStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.SaveEvent(ctx, event)
+	if err == nil {
+		s.expirations.add(event)
+	}
+	return err
+}
+
+func (s *expiringStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.ReplaceEvent(ctx, event)
+	if err == nil {
+		s.expirations.add(event)
+	}
+	return err
+}
+
+func (s *expiringStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.DeleteEvent(ctx, event)
+	if err == nil {
+		s.expirations.forget(event.ID)
+	}
+	return err
+}
+
+// setupExpiration enforces NIP-40: expired events are rejected and left out of
+// query results, and a sweeper deletes them from the store every interval.
+// khatru's own expiration manager only runs hourly, which is too slow to test
+// against. Expiry is judged by the relay's clock, now. It wraps the existing
+// QueryEvents hooks, so it must run after attachStore.
+func setupExpiration(ctx context.Context, relay *khatru.Relay, store eventstore.Store, expiring *expirations, interval time.Duration, now func() time.Time, logger *Logger) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if isExpired(event, nostr.Timestamp(now().Unix())) {
+			return true, "invalid: event has expired"
+		}
+		return false, ""
+	})
+
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = skipExpired(query, now)
+	}
+
+	if interval > 0 {
+		go sweepExpired(ctx, store, expiring, interval, now, logger)
+	}
+}
+
+// skipExpired drops events that have expired but weren't swept yet.
+func skipExpired(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), clock func() time.Time) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || ch == nil {
+			return ch, err
+		}
+
+		now := nostr.Timestamp(clock().Unix())
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for event := range ch {
+				if isExpired(event, now) {
+					continue
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					// drain so the store's goroutine isn't left blocked
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// sweepExpired deletes the expired events every interval until ctx is done.
+func sweepExpired(ctx context.Context, store eventstore.Store, expiring *expirations, interval time.Duration, clock func() time.Time, logger *Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		deleted := 0
+		for _, event := range expiring.expired(nostr.Timestamp(clock().Unix())) {
+			// a version replaced since is only forgotten
+			stored, err := storeHas(ctx, store, event.ID)
+			if err == nil && stored {
+				if err = store.DeleteEvent(ctx, event); err == nil {
+					deleted++
+				}
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger.Error("Expiration sweep failed: %v", err)
+				}
+				break
+			}
+			expiring.forget(event.ID)
+		}
+		if deleted > 0 {
+			logger.Debug("Expiration sweep deleted %d events", deleted)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package testingrelay
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSweepExpired(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sweeper deletes while the test reads, which a slicestore can't take
+	backend := &sqlite3.SQLite3Backend{DatabaseURL: filepath.Join(t.TempDir(), "events.db")}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(backend.Close)
+
+	sk := nostr.GeneratePrivateKey()
+	expired := signedAt(t, sk, nostr.KindTextNote, 900, "expired", nostr.Tags{{"expiration", "1000"}})
+	later := signedAt(t, sk, nostr.KindTextNote, 900, "later", nostr.Tags{{"expiration", "3000"}})
+	lasting := signedAt(t, sk, nostr.KindTextNote, 900, "lasting", nil)
+
+	// one event stored before startup, the others saved through the wrapper
+	if err := backend.SaveEvent(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	expiring := newExpirations()
+	if err := expiring.Load(ctx, backend); err != nil {
+		t.Fatal(err)
+	}
+	store := expiring.Store(backend)
+	for _, event := range []*nostr.Event{later, lasting} {
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go sweepExpired(ctx, store, expiring, 5*time.Millisecond, func() time.Time { return time.Unix(2000, 0) }, logger)
+
+	// the expired event is deleted and only the one still to expire is kept
+	want := []string{later.ID, lasting.ID}
+	slices.Sort(want)
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		ids := storedIDs(t, backend, nostr.Filter{})
+		slices.Sort(ids)
+		kept := expiring.expired(3000)
+		if slices.Equal(ids, want) && len(kept) == 1 && kept[0].ID == later.ID {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stored %v and kept %v after sweeping, want %v and %s", ids, kept, want, later.ID)
+		}
+	}
+}
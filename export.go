@@ -0,0 +1,210 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// handleExport streams the stored events matching the kind, pubkey, id, since
+// and until query parameters as JSONL, newest first. kind, pubkey and id can
+// be repeated or comma-separated.
+func handleExport(store eventstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, err := exportFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/jsonl")
+		exportEvents(r.Context(), store, filter, w)
+	}
+}
+
+// exportEvents writes the stored events matching filter to w as JSONL,
+// newest first.
+func exportEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return scanEvents(ctx, store, filter, func(events []*nostr.Event) error {
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// exportFilter reads the kind, pubkey, id, since and until parameters.
+func exportFilter(query url.Values) (nostr.Filter, error) {
+	filter := nostr.Filter{}
+
+	for _, value := range splitParams(query["kind"]) {
+		kind, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid kind %q", value)
+		}
+		filter.Kinds = append(filter.Kinds, kind)
+	}
+
+	for _, pubkey := range splitParams(query["pubkey"]) {
+		if !isHexKey(pubkey) {
+			return filter, fmt.Errorf("invalid pubkey %q, expected 64 hex characters", pubkey)
+		}
+		filter.Authors = append(filter.Authors, pubkey)
+	}
+
+	for _, id := range splitParams(query["id"]) {
+		if !isHexKey(id) {
+			return filter, fmt.Errorf("invalid id %q, expected 64 hex characters", id)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+
+	for name, dst := range map[string]**nostr.Timestamp{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return filter, fmt.Errorf("invalid %s %q, expected a unix timestamp", name, value)
+			}
+			t := nostr.Timestamp(ts)
+			*dst = &t
+		}
+	}
+
+	return filter, nil
+}
+
+func splitParams(values []string) []string {
+	var out []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+// importResult summarizes a bulk import.
+type importResult struct {
+	Imported   int      `json:"imported"`
+	Duplicates int      `json:"duplicates"`
+	Invalid    int      `json:"invalid"`
+	Ephemeral  int      `json:"ephemeral"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// handleImport bulk-loads a JSONL body of signed events straight into the
+// store, bypassing the relay policies. Events with bad ids or signatures are
+// skipped and reported, ephemeral ones are only counted.
+func handleImport(store eventstore.Store, verifier *sigVerifier, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := importEvents(r.Context(), store, r.Body, verifier)
+		if errors.Is(err, errMalformedImport) {
+			writeJSON(w, http.StatusBadRequest, result)
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, result)
+			return
+		}
+
+		logger.Info("Imported %d events (%d duplicates, %d invalid, %d ephemeral skipped)", result.Imported, result.Duplicates, result.Invalid, result.Ephemeral)
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+// errMalformedImport fails imports whose input isn't JSONL events.
+var errMalformedImport = errors.New("malformed input")
+
+// importBatch is how many events of an import are verified together.
+const importBatch = 256
+
+// importEvents saves the JSONL events read from r, with their signatures
+// verified by verifier a batch at a time (in the calling goroutine if nil).
+// It stops at the first event it can't decode or save, which is also listed
+// in the result's errors.
+func importEvents(ctx context.Context, store eventstore.Store, r io.Reader, verifier *sigVerifier) (importResult, error) {
+	var result importResult
+	dec := json.NewDecoder(r)
+	for line := 1; ; {
+		var batch []*nostr.Event
+		var decodeErr error
+		for len(batch) < importBatch {
+			event := new(nostr.Event)
+			if err := dec.Decode(event); err == io.EOF {
+				break
+			} else if err != nil {
+				decodeErr = err
+				break
+			}
+			batch = append(batch, event)
+		}
+
+		valid := verifier.verifyAll(batch)
+		for i, event := range batch {
+			if err := importEvent(ctx, store, event, valid[i], line, &result); err != nil {
+				return result, err
+			}
+			line++
+		}
+
+		if decodeErr != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("event %d: %v", line, decodeErr))
+			return result, fmt.Errorf("%w: event %d: %v", errMalformedImport, line, decodeErr)
+		}
+		if len(batch) < importBatch {
+			return result, nil
+		}
+	}
+}
+
+// importEvent saves the line-th event of an import, counting it in result.
+func importEvent(ctx context.Context, store eventstore.Store, event *nostr.Event, sigOK bool, line int, result *importResult) error {
+	if !event.CheckID() {
+		result.Invalid++
+		result.Errors = append(result.Errors, fmt.Sprintf("event %d: id does not match the content", line))
+		return nil
+	}
+	if !sigOK {
+		result.Invalid++
+		result.Errors = append(result.Errors, fmt.Sprintf("event %d: invalid signature", line))
+		return nil
+	}
+
+	if nostr.IsEphemeralKind(event.Kind) {
+		result.Ephemeral++
+		return nil
+	}
+
+	if err := store.SaveEvent(ctx, event); errors.Is(err, eventstore.ErrDupEvent) {
+		result.Duplicates++
+	} else if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("event %d: %v", line, err))
+		return fmt.Errorf("event %d: %w", line, err)
+	} else {
+		result.Imported++
+	}
+	return nil
+}
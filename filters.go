@@ -0,0 +1,76 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// FilterRules configure the read policies most public relays apply in some
+// form. RequireKinds refuses filters that don't list kinds, AuthKinds are the
+// kinds that can only be asked for after NIP-42 AUTH (like 4), CapLimit lowers
+// the limit of filters asking for more or for no limit, and DenyFirehose
+// refuses filters without ids, authors, kinds, tags or search, which would
+// stream everything the relay receives.
+type FilterRules struct {
+	RequireKinds bool  `envconfig:"REQUIRE_KINDS"`
+	AuthKinds    []int `envconfig:"AUTH_KINDS"`
+	CapLimit     int   `envconfig:"CAP_LIMIT"`
+	DenyFirehose bool  `envconfig:"DENY_FIREHOSE"`
+}
+
+func (r FilterRules) Validate() error {
+	if r.CapLimit < 0 {
+		return fmt.Errorf("FILTER_CAP_LIMIT must not be negative")
+	}
+	return nil
+}
+
+func (r FilterRules) enabled() bool {
+	return r.RequireKinds || len(r.AuthKinds) > 0 || r.CapLimit > 0 || r.DenyFirehose
+}
+
+// setupFilterRules installs the rules for REQs and COUNTs. Limits are capped
+// before any RejectFilter hook runs, so MAX_LIMIT sees the capped value.
+func setupFilterRules(relay *khatru.Relay, rules FilterRules, logger *Logger) {
+	if !rules.enabled() {
+		return
+	}
+
+	if max := rules.CapLimit; max > 0 {
+		relay.OverwriteFilter = append(relay.OverwriteFilter, func(ctx context.Context, filter *nostr.Filter) {
+			if !filter.LimitZero && (filter.Limit == 0 || filter.Limit > max) {
+				filter.Limit = max
+			}
+		})
+	}
+	relay.RejectFilter = append(relay.RejectFilter, rules.RejectFilter)
+	relay.RejectCountFilter = append(relay.RejectCountFilter, rules.RejectFilter)
+
+	logger.Info("Filter rules: %+v", rules)
+}
+
+func (r FilterRules) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if r.DenyFirehose && isFirehose(filter) {
+		return true, "blocked: filters must ask for ids, authors, kinds, tags or a search"
+	}
+	if r.RequireKinds && len(filter.Kinds) == 0 {
+		return true, "blocked: filters must ask for specific kinds"
+	}
+	if len(r.AuthKinds) > 0 && khatru.GetAuthed(ctx) == "" {
+		for _, kind := range filter.Kinds {
+			if contains(r.AuthKinds, kind) {
+				return true, fmt.Sprintf("auth-required: reading kind %d events requires authentication", kind)
+			}
+		}
+	}
+	return false, ""
+}
+
+// isFirehose reports whether filter matches every event in its time range.
+func isFirehose(filter nostr.Filter) bool {
+	return len(filter.IDs) == 0 && len(filter.Authors) == 0 && len(filter.Kinds) == 0 &&
+		len(filter.Tags) == 0 && filter.Search == ""
+}
@@ -0,0 +1,175 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// firehoseBuffer is how many events a firehose client may fall behind before
+// it is disconnected.
+const firehoseBuffer = 256
+
+// firehoseKeepAlive is how often an idle SSE stream gets a comment so proxies
+// and clients don't time it out.
+const firehoseKeepAlive = 15 * time.Second
+
+// Firehose fans out every accepted event, stored or ephemeral, to the HTTP
+// clients streaming /firehose.
+type Firehose struct {
+	mu       sync.Mutex
+	subs     map[chan *nostr.Event]nostr.Filter
+	excluded []int
+	closed   bool
+}
+
+func NewFirehose() *Firehose {
+	return &Firehose{subs: make(map[chan *nostr.Event]nostr.Filter)}
+}
+
+func (f *Firehose) Attach(relay *khatru.Relay) {
+	relay.OnEventSaved = append(relay.OnEventSaved, f.publish)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, f.publish)
+}
+
+// Exclude keeps the events of kinds out of every stream.
+func (f *Firehose) Exclude(kinds ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.excluded = append(f.excluded, kinds...)
+}
+
+func (f *Firehose) publish(ctx context.Context, event *nostr.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if contains(f.excluded, event.Kind) {
+		return
+	}
+	for ch, filter := range f.subs {
+		if !filter.Matches(event) {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// the client can't keep up; cut it off rather than hold up the relay
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of the events matching filter, or nil once the
+// firehose is closed. The channel is closed if the reader falls behind.
+func (f *Firehose) subscribe(filter nostr.Filter) chan *nostr.Event {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	ch := make(chan *nostr.Event, firehoseBuffer)
+	f.subs[ch] = filter
+	return ch
+}
+
+func (f *Firehose) unsubscribe(ch chan *nostr.Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// Close ends every stream, so they don't hold up the server's shutdown.
+func (f *Firehose) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// handleFirehose streams the events matching the kind and pubkey params as
+// they are accepted, as Server-Sent Events or, with jsonl, as JSON lines.
+func handleFirehose(firehose *Firehose, jsonl bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		filter, err := exportFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		events := firehose.subscribe(filter)
+		if events == nil {
+			http.Error(w, "relay is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer firehose.unsubscribe(events)
+
+		// the stream outlives the server's write timeout
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Time{})
+
+		var keepAlive <-chan time.Time
+		if jsonl {
+			w.Header().Set("Content-Type", "application/jsonl")
+		} else {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			ticker := time.NewTicker(firehoseKeepAlive)
+			defer ticker.Stop()
+			keepAlive = ticker.C
+		}
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				if jsonl {
+					_, err = fmt.Fprintf(w, "%s\n", data)
+				} else {
+					_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, data)
+				}
+				if err != nil {
+					return
+				}
+			case <-keepAlive:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
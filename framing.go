@@ -0,0 +1,84 @@
+package testingrelay
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// WireLimits shape websocket messages the way stricter relays do (WS_*).
+// Client messages over MaxMessageSize close the connection with 1009
+// (message too big), as khatru does at 512000 bytes. ReadBufferSize caps
+// how much is read from the socket at once, 0 for no cap. Fragment sets how
+// outbound messages are framed: empty keeps the websocket library's framing,
+// which splits messages bigger than its 1024-byte write buffer, off sends
+// every message as a single frame, and a byte size splits messages into
+// frames of at most that size.
+type WireLimits struct {
+	MaxMessageSize int64  `envconfig:"MAX_MESSAGE_SIZE" default:"512000"`
+	ReadBufferSize int    `envconfig:"READ_BUFFER_SIZE"`
+	Fragment       string `envconfig:"FRAGMENT"`
+}
+
+func (l WireLimits) Validate() error {
+	if l.MaxMessageSize < 1 {
+		return fmt.Errorf("WS_MAX_MESSAGE_SIZE must be at least 1")
+	}
+	if l.ReadBufferSize < 0 {
+		return fmt.Errorf("WS_READ_BUFFER_SIZE must not be negative")
+	}
+	if _, err := l.fragmentSize(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fragmentSize returns the frame size of Fragment: 0 to keep the library's
+// framing, -1 for a single frame per message.
+func (l WireLimits) fragmentSize() (int, error) {
+	switch l.Fragment {
+	case "":
+		return 0, nil
+	case "off":
+		return -1, nil
+	}
+	size, err := strconv.Atoi(l.Fragment)
+	if err != nil || size < 1 {
+		return 0, fmt.Errorf("invalid WS_FRAGMENT %q, expected off, a size in bytes or empty", l.Fragment)
+	}
+	return size, nil
+}
+
+func setupWireLimits(relay *khatru.Relay, wire *wireServer, limits WireLimits, logger *Logger) {
+	relay.MaxMessageSize = limits.MaxMessageSize
+	wire.readBuffer = limits.ReadBufferSize
+	// checked by Validate
+	wire.fragment, _ = limits.fragmentSize()
+
+	switch {
+	case wire.fragment > 0:
+		logger.Info("Splitting outbound websocket messages into frames of %d bytes", wire.fragment)
+	case wire.fragment < 0:
+		logger.Info("Sending every outbound websocket message as a single frame")
+	}
+	if limits.ReadBufferSize > 0 {
+		logger.Info("Reading websockets %d bytes at a time", limits.ReadBufferSize)
+	}
+}
+
+// fragmentFrames frames payload as frames of at most size bytes, the first
+// carrying opcode and rsv. A size of 0 or less makes a single frame.
+func fragmentFrames(opcode, rsv byte, payload []byte, size int) []byte {
+	if size <= 0 || len(payload) <= size {
+		return buildFrame(0x80|rsv|opcode, payload, false)
+	}
+	var frames []byte
+	first := rsv | opcode
+	for len(payload) > size {
+		frames = append(frames, buildFrame(first, payload[:size], false)...)
+		payload = payload[size:]
+		first = opContinuation
+	}
+	return append(frames, buildFrame(0x80|first, payload, false)...)
+}
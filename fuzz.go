@@ -0,0 +1,231 @@
+package testingrelay
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// fuzzCase shapes an event into something valid per NIP-01 but unusual, for
+// hardening client parsers.
+type fuzzCase struct {
+	name  string
+	shape func(rng *rand.Rand, event *nostr.Event, maxContent int)
+}
+
+// weirdStrings are valid UTF-8 that parsers and renderers tend to get wrong.
+var weirdStrings = []string{
+	"",
+	"\x00",
+	"\u200b\u200c\u200d\ufeff",
+	"\u202eevil\u202c",
+	"e\u0301\u0302\u0303\u0304\u0305\u0306\u0307",
+	"\U0001f469\u200d\U0001f469\u200d\U0001f467\u200d\U0001f466\U0001f3f3\ufe0f\u200d\U0001f308",
+	"\U0010ffff\U000e0001",
+	"\u2028\u2029",
+	`"quoted" \back\slash\ </script><img src=x>`,
+	"\t\r\n\x1b[31m",
+	"\U0001d573\U0001d58a\U0001d591\U0001d591\U0001d594",
+	"null",
+	`["EVENT","sub",{}]`,
+}
+
+// boundaryKinds sit on the edges of the NIP-01 kind ranges.
+var boundaryKinds = []int{0, 1, 2, 3, 999, 1000, 9999, 10000, 19999, 20000, 29999, 30000, 39999, 40000, 65535}
+
+var fuzzCases = []fuzzCase{
+	{"huge-tags", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		for i := range 2000 {
+			event.Tags = append(event.Tags, nostr.Tag{"t", "tag" + strconv.Itoa(i)})
+		}
+		event.Tags = append(event.Tags, nostr.Tag{"p", strings.Repeat("f", 64), strings.Repeat("x", 16384)})
+	}},
+	{"wide-tag", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		tag := nostr.Tag{"x"}
+		for i := range 1000 {
+			tag = append(tag, strconv.Itoa(i))
+		}
+		event.Tags = append(event.Tags, tag)
+	}},
+	{"odd-tags", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		event.Tags = append(event.Tags,
+			nostr.Tag{},
+			nostr.Tag{""},
+			nostr.Tag{"e"},
+			nostr.Tag{"e", ""},
+			nostr.Tag{"p", "not-a-pubkey"},
+			nostr.Tag{"d", "first"},
+			nostr.Tag{"d", "second"},
+			nostr.Tag{strings.Repeat("k", 256), "long name"},
+			nostr.Tag{weirdStrings[rng.IntN(len(weirdStrings))], weirdStrings[rng.IntN(len(weirdStrings))]},
+		)
+	}},
+	{"unicode", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		var content strings.Builder
+		for _, i := range rng.Perm(len(weirdStrings)) {
+			content.WriteString(weirdStrings[i])
+		}
+		event.Content = content.String()
+		event.Tags = append(event.Tags, nostr.Tag{"subject", weirdStrings[rng.IntN(len(weirdStrings))]})
+	}},
+	{"boundary-kind", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		event.Kind = boundaryKinds[rng.IntN(len(boundaryKinds))]
+		if nostr.IsAddressableKind(event.Kind) {
+			event.Tags = append(event.Tags, nostr.Tag{"d", ""})
+		}
+	}},
+	{"max-content", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		// multi-byte runes make byte and character counts disagree
+		event.Content = strings.Repeat("é", maxContent/2) + strings.Repeat("a", maxContent%2)
+	}},
+	{"timestamp", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		stamps := []nostr.Timestamp{0, 1, math.MaxInt32, math.MaxUint32, 1 << 53}
+		event.CreatedAt = stamps[rng.IntN(len(stamps))]
+	}},
+	{"empty", func(rng *rand.Rand, event *nostr.Event, maxContent int) {
+		event.Content = ""
+		event.Tags = nostr.Tags{}
+	}},
+}
+
+// fuzzEvent is one generated event, as reported.
+type fuzzEvent struct {
+	Case  string `json:"case"`
+	ID    string `json:"id"`
+	Kind  int    `json:"kind"`
+	Error string `json:"error,omitempty"`
+}
+
+// generateFuzzEvents makes count events signed by secret, cycling through
+// cases. The same seed shapes them the same way.
+func generateFuzzEvents(count int, seed uint64, cases []fuzzCase, secret string, maxContent int) ([]fuzzEvent, []*nostr.Event) {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	reports := make([]fuzzEvent, 0, count)
+	events := make([]*nostr.Event, 0, count)
+	for i := range count {
+		fc := cases[i%len(cases)]
+		event := &nostr.Event{
+			CreatedAt: nostr.Now(),
+			Kind:      nostr.KindTextNote,
+			Tags:      nostr.Tags{},
+			Content:   fc.name,
+		}
+		fc.shape(rng, event, maxContent)
+		if err := event.Sign(secret); err != nil {
+			reports = append(reports, fuzzEvent{Case: fc.name, Error: err.Error()})
+			continue
+		}
+		reports = append(reports, fuzzEvent{Case: fc.name, ID: event.ID, Kind: event.Kind})
+		events = append(events, event)
+	}
+	return reports, events
+}
+
+// handleFuzz lists the fuzz cases on GET. POST generates count events (10 by
+// default) of the cases given as case, all of them without, and stores them
+// for clients to fetch (mode=store, the default), sends them to the matching
+// subscriptions (mode=broadcast) or both (mode=both). They skip the relay's
+// policies, since most would reject them. seed makes a run repeatable.
+func handleFuzz(relay *khatru.Relay, store eventstore.Store, live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			names := make([]string, len(fuzzCases))
+			for i, fc := range fuzzCases {
+				names[i] = fc.name
+			}
+			writeJSON(w, http.StatusOK, names)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		count := 10
+		if value := query.Get("count"); value != "" {
+			var err error
+			if count, err = strconv.Atoi(value); err != nil || count < 1 || count > 1000 {
+				http.Error(w, fmt.Sprintf("invalid count %q, expected 1 to 1000", value), http.StatusBadRequest)
+				return
+			}
+		}
+		seed := uint64(time.Now().UnixNano())
+		if value := query.Get("seed"); value != "" {
+			var err error
+			if seed, err = strconv.ParseUint(value, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid seed %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		mode := query.Get("mode")
+		if mode == "" {
+			mode = "store"
+		}
+		if mode != "store" && mode != "broadcast" && mode != "both" {
+			http.Error(w, fmt.Sprintf("invalid mode %q, expected store, broadcast or both", mode), http.StatusBadRequest)
+			return
+		}
+
+		cases := fuzzCases
+		if names := splitParams(query["case"]); len(names) > 0 {
+			cases = nil
+			for _, name := range names {
+				found := false
+				for _, fc := range fuzzCases {
+					if fc.name == name {
+						cases = append(cases, fc)
+						found = true
+					}
+				}
+				if !found {
+					http.Error(w, fmt.Sprintf("unknown fuzz case %q", name), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		maxContent := live.Load().MaxContentLength
+		if maxContent <= 0 {
+			maxContent = 65536
+		}
+		secret := nostr.GeneratePrivateKey()
+		pubkey, _ := nostr.GetPublicKey(secret)
+		reports, events := generateFuzzEvents(count, seed, cases, secret, maxContent)
+
+		stored := 0
+		for _, event := range events {
+			if mode != "broadcast" {
+				if err := store.SaveEvent(r.Context(), event); err != nil {
+					for i := range reports {
+						if reports[i].ID == event.ID {
+							reports[i].Error = err.Error()
+						}
+					}
+					continue
+				}
+				stored++
+			}
+			if mode != "store" {
+				relay.BroadcastEvent(event)
+			}
+		}
+
+		logger.Info("Generated %d fuzz events by %s (seed %d, mode %s)", len(events), pubkey, seed, mode)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"pubkey": pubkey,
+			"seed":   seed,
+			"mode":   mode,
+			"stored": stored,
+			"events": reports,
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// GiftWrapSettings are the policies for NIP-59 gift wraps (GIFT_WRAP_*),
+// kinds 1059 and 1060. Wraps bigger than MaxSize bytes of JSON are rejected,
+// 0 for no limit. With LocalRecipients the p-tagged recipient must be a
+// local user: whitelisted, an admin or someone with events stored here.
+// With AuthRead wraps are only served to connections authenticated as their
+// recipient, whatever AUTH_REQUIRED_READ says. The firehose streams leave
+// wraps out unless Firehose is set.
+type GiftWrapSettings struct {
+	MaxSize         int  `envconfig:"MAX_SIZE"`
+	LocalRecipients bool `envconfig:"LOCAL_RECIPIENTS"`
+	AuthRead        bool `envconfig:"AUTH_READ"`
+	Firehose        bool `envconfig:"FIREHOSE"`
+}
+
+func (s GiftWrapSettings) Validate() error {
+	if s.MaxSize < 0 {
+		return fmt.Errorf("GIFT_WRAP_MAX_SIZE must not be negative")
+	}
+	return nil
+}
+
+// giftWrapKinds are the kinds of NIP-59 gift wraps.
+var giftWrapKinds = []int{nostr.KindGiftWrap, 1060}
+
+// giftWraps enforces GiftWrapSettings.
+type giftWraps struct {
+	settings  GiftWrapSettings
+	cfg       *RelayConfig
+	whitelist *Whitelist
+	stats     *Stats
+}
+
+func setupGiftWraps(relay *khatru.Relay, wire *wireServer, firehose *Firehose, whitelist *Whitelist, stats *Stats, cfg *RelayConfig, logger *Logger) {
+	g := &giftWraps{settings: cfg.GiftWrap, cfg: cfg, whitelist: whitelist, stats: stats}
+	if g.settings.MaxSize > 0 || g.settings.LocalRecipients {
+		relay.RejectEvent = append(relay.RejectEvent, g.RejectEvent)
+	}
+	if g.settings.AuthRead {
+		relay.RejectFilter = append(relay.RejectFilter, g.RejectFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, g.RejectFilter)
+		wire.outbound = append(wire.outbound, g.hideFromOthers)
+		logger.Info("Gift wraps are only delivered to their authenticated recipients")
+	}
+	if !g.settings.Firehose {
+		firehose.Exclude(giftWrapKinds...)
+	}
+}
+
+func (g *giftWraps) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if !slices.Contains(giftWrapKinds, event.Kind) {
+		return false, ""
+	}
+
+	if size := eventSize(event); g.settings.MaxSize > 0 && size > int64(g.settings.MaxSize) {
+		return true, fmt.Sprintf("invalid: gift wrap is %d bytes, the maximum is %d", size, g.settings.MaxSize)
+	}
+	if g.settings.LocalRecipients {
+		p := event.Tags.GetFirst([]string{"p", ""})
+		if p == nil {
+			return true, "invalid: gift wrap has no p-tagged recipient"
+		}
+		if !g.isLocal((*p)[1]) {
+			return true, "restricted: gift wrap recipient is not a user of this relay"
+		}
+	}
+	return false, ""
+}
+
+// isLocal reports whether pubkey is a user of this relay.
+func (g *giftWraps) isLocal(pubkey string) bool {
+	return g.stats.Stored(pubkey) || contains(g.cfg.admins(), pubkey) || (g.whitelist.Enabled() && g.whitelist.Allowed(pubkey))
+}
+
+// RejectFilter asks for AUTH before serving filters for gift wraps.
+func (g *giftWraps) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if khatru.GetAuthed(ctx) != "" {
+		return false, ""
+	}
+	for _, kind := range giftWrapKinds {
+		if slices.Contains(filter.Kinds, kind) {
+			return true, "auth-required: gift wraps are only served to their recipients"
+		}
+	}
+	return false, ""
+}
+
+// hideFromOthers drops the wraps a connection isn't authenticated as the
+// recipient of, whatever filter matched them, like setupDMPrivacy does.
+func (g *giftWraps) hideFromOthers(conn *wireConn, msg *wireMessage) {
+	if msg.Label() != "EVENT" {
+		return
+	}
+	env := msg.Envelope()
+	if len(env) < 3 {
+		return
+	}
+	var event struct {
+		Kind int        `json:"kind"`
+		Tags nostr.Tags `json:"tags"`
+	}
+	if json.Unmarshal(env[2], &event) != nil || !slices.Contains(giftWrapKinds, event.Kind) {
+		return
+	}
+	if authed := conn.Authed(); authed == "" || !event.Tags.ContainsAny("p", []string{authed}) {
+		msg.drop = true
+	}
+}
@@ -0,0 +1,150 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Gossip configures the outbox model support (GOSSIP_*). GET /relays/{pubkey}
+// always answers with the read and write relays of the pubkey's stored NIP-65
+// relay list (kind 10002). Strict makes the relay as picky as a gossip client:
+// events are rejected unless their author's relay list names this relay, one
+// of URLs or SERVICE_URL, as a write relay. Authors without a stored list are
+// let through unless RequireList is set too. Relay lists themselves are
+// checked against their own tags.
+type Gossip struct {
+	Strict      bool     `envconfig:"STRICT"`
+	RequireList bool     `envconfig:"REQUIRE_LIST"`
+	URLs        []string `envconfig:"URLS"`
+}
+
+// Validate checks the settings, given the SERVICE_URL the relay is also
+// known by.
+func (g Gossip) Validate(serviceURL string) error {
+	for _, u := range g.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "ws" && parsed.Scheme != "wss") {
+			return fmt.Errorf("invalid GOSSIP_URLS entry %q, expected a ws:// or wss:// URL", u)
+		}
+	}
+	if g.Strict && len(g.URLs) == 0 && serviceURL == "" {
+		return fmt.Errorf("GOSSIP_STRICT needs GOSSIP_URLS or SERVICE_URL to know this relay's address")
+	}
+	return nil
+}
+
+// RelayHints are the relays of a NIP-65 relay list.
+type RelayHints struct {
+	PubKey    string          `json:"pubkey"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+	Read      []string        `json:"read"`
+	Write     []string        `json:"write"`
+}
+
+// relayHints reads the relays out of a kind 10002 event. Entries without a
+// marker are both read and write relays.
+func relayHints(event *nostr.Event) RelayHints {
+	hints := RelayHints{PubKey: event.PubKey, CreatedAt: event.CreatedAt, Read: []string{}, Write: []string{}}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "r" {
+			continue
+		}
+		relay := nostr.NormalizeURL(tag[1])
+		if relay == "" {
+			continue
+		}
+		marker := ""
+		if len(tag) >= 3 {
+			marker = tag[2]
+		}
+		if marker != "write" {
+			hints.Read = append(hints.Read, relay)
+		}
+		if marker != "read" {
+			hints.Write = append(hints.Write, relay)
+		}
+	}
+	return hints
+}
+
+// lookupRelayList returns the stored relay list of pubkey, or nil.
+func lookupRelayList(ctx context.Context, store eventstore.Store, pubkey string) (*nostr.Event, error) {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{Kinds: []int{nostr.KindRelayListMetadata}, Authors: []string{pubkey}, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	var latest *nostr.Event
+	for event := range ch {
+		if latest == nil || event.CreatedAt > latest.CreatedAt {
+			latest = event
+		}
+	}
+	return latest, nil
+}
+
+// setupGossip installs the strict gossip policy if enabled.
+func setupGossip(relay *khatru.Relay, store eventstore.Store, settings Gossip, serviceURL string, logger *Logger) {
+	if !settings.Strict {
+		return
+	}
+
+	var self []string
+	for _, u := range append([]string{serviceURL}, settings.URLs...) {
+		if u != "" {
+			self = append(self, nostr.NormalizeURL(u))
+		}
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		list := event
+		if event.Kind != nostr.KindRelayListMetadata {
+			var err error
+			if list, err = lookupRelayList(ctx, store, event.PubKey); err != nil {
+				return true, "error: failed to look up the author's relay list"
+			}
+		}
+		if list == nil {
+			if settings.RequireList {
+				return true, "blocked: publish a relay list (kind 10002) naming this relay first"
+			}
+			return false, ""
+		}
+
+		for _, u := range relayHints(list).Write {
+			if contains(self, u) {
+				return false, ""
+			}
+		}
+		return true, "blocked: this relay is not one of the author's write relays (kind 10002)"
+	})
+
+	logger.Info("Strict gossip enabled, only accepting events from authors whose relay list names %v", self)
+}
+
+// handleRelayHints serves the relay list of the pubkey in the path, given as
+// hex or npub.
+func handleRelayHints(store eventstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey, err := parsePubkey(r.PathValue("pubkey"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		list, err := lookupRelayList(r.Context(), store, pubkey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if list == nil {
+			http.Error(w, "no relay list stored for "+pubkey, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, relayHints(list))
+	}
+}
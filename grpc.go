@@ -0,0 +1,336 @@
+package testingrelay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// rpcServiceName is the gRPC service served on GRPC_PORT. Its messages are
+// the JSON encodings of the Go types below, the same shapes the websocket and
+// admin API use, so clients call it with the json content-subtype (in Go,
+// grpc.CallContentSubtype("json")) instead of generated protobuf code:
+//
+//	Publish(PublishRequest) PublishResponse
+//	Query(QueryRequest) QueryResponse
+//	Firehose(FirehoseRequest) stream nostr.Event
+//	GetConfig(Empty) Tunables, UpdateConfig(partial Tunables) Tunables
+//	GetChaos(Empty) ChaosSettings, UpdateChaos(partial ChaosSettings) ChaosSettings
+//
+// The relay is picked with the "relay" metadata key, a relays entry id, and
+// is the root relay without it. Every method needs the relay's ADMIN_TOKEN as
+// "authorization: Bearer <token>" metadata, and the server listens on
+// localhost unless GRPC_HOST says otherwise.
+const rpcServiceName = "relay.Relay"
+
+type PublishRequest struct {
+	Event *nostr.Event `json:"event"`
+}
+
+type PublishResponse struct {
+	ID       string `json:"id"`
+	Accepted bool   `json:"accepted"`
+	Message  string `json:"message,omitempty"`
+}
+
+type QueryRequest struct {
+	Filter nostr.Filter `json:"filter"`
+}
+
+type QueryResponse struct {
+	Events []*nostr.Event `json:"events"`
+}
+
+type FirehoseRequest struct {
+	Filter nostr.Filter `json:"filter"`
+}
+
+type Empty struct{}
+
+// relayRPC is what the gRPC methods need of a relay instance.
+type relayRPC struct {
+	relay    *khatru.Relay
+	firehose *Firehose
+	live     *LiveConfig
+	chaos    *Chaos
+	checks   validationChecks
+	verifier *sigVerifier
+	logger   *Logger
+
+	// direct messages are withheld, as from unauthenticated websockets
+	privateDMs bool
+}
+
+// rpcServer serves the gRPC methods for every relay of the process.
+type rpcServer struct {
+	relays map[string]*relayRPC
+}
+
+// jsonCodec replaces protobuf as the gRPC message encoding.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+// startRPC serves the gRPC API of the instances on host and port.
+func startRPC(host string, port int, instances []*relayInstance, logger *Logger) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &rpcServer{relays: make(map[string]*relayRPC)}
+	for _, inst := range instances {
+		s.relays[inst.id] = inst.rpc
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	server.RegisterService(&rpcServiceDesc, s)
+
+	go func() {
+		if err := server.Serve(lis); err != nil && err != grpc.ErrServerStopped {
+			logger.Error("gRPC server failed: %v", err)
+		}
+	}()
+	logger.Info("Serving the gRPC API on %s", lis.Addr())
+	return server, nil
+}
+
+// relay returns the relay the call is for, once the admin token is checked.
+func (s *rpcServer) relay(ctx context.Context) (*relayRPC, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if ids := md.Get("relay"); len(ids) > 0 {
+		id = ids[0]
+	}
+	r, ok := s.relays[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no relay %q", id)
+	}
+
+	token := r.live.Load().AdminToken
+	if token == "" {
+		return nil, status.Error(codes.PermissionDenied, "admin API disabled, set RELAY_ADMIN_TOKEN to enable it")
+	}
+	var given string
+	if values := md.Get("authorization"); len(values) > 0 {
+		given = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "invalid admin token")
+	}
+	return r, nil
+}
+
+// Publish adds an event like an EVENT message from an unauthenticated
+// websocket client would, through the same policies. Deletion requests are
+// applied as khatru applies them.
+func (s *rpcServer) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	event := req.Event
+	if event == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing event")
+	}
+
+	resp := &PublishResponse{ID: event.ID}
+	if r.checks.ID && !event.CheckID() {
+		resp.Message = "invalid: id is computed incorrectly"
+		return resp, nil
+	}
+	if r.checks.Signature && !r.verifier.verify(event) {
+		resp.Message = "invalid: signature is invalid"
+		return resp, nil
+	}
+
+	if isProtected(event) {
+		resp.Message = "auth-required: must be published by event author"
+		return resp, nil
+	}
+
+	if err := publishEvent(ctx, r.relay, event); err != nil {
+		resp.Message = nostr.NormalizeOKMessage(err.Error(), "error")
+		return resp, nil
+	}
+	resp.Accepted = true
+	return resp, nil
+}
+
+// Query answers the filter like a REQ from an unauthenticated websocket
+// client, through the same filter policies and query hooks.
+func (s *rpcServer) Query(ctx context.Context, req *QueryRequest) (*QueryResponse, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := req.Filter
+	for _, overwrite := range r.relay.OverwriteFilter {
+		overwrite(ctx, &filter)
+	}
+	resp := &QueryResponse{Events: []*nostr.Event{}}
+	if filter.LimitZero {
+		return resp, nil
+	}
+	for _, reject := range r.relay.RejectFilter {
+		if rejected, msg := reject(ctx, filter); rejected {
+			return nil, status.Error(codes.PermissionDenied, nostr.NormalizeOKMessage(msg, "blocked"))
+		}
+	}
+
+	for _, query := range r.relay.QueryEvents {
+		ch, err := query(ctx, filter)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		for event := range ch {
+			for _, overwrite := range r.relay.OverwriteResponseEvent {
+				overwrite(ctx, event)
+			}
+			if r.visible(event) {
+				resp.Events = append(resp.Events, event)
+			}
+		}
+	}
+	return resp, nil
+}
+
+// visible reports whether event may be sent to a gRPC client.
+func (r *relayRPC) visible(event *nostr.Event) bool {
+	return !r.privateDMs || dmVisible("", event.Kind, event.PubKey, event.Tags)
+}
+
+// Firehose streams the accepted events matching the filter until the client
+// leaves, falls behind or the relay shuts down.
+func (s *rpcServer) Firehose(req *FirehoseRequest, stream grpc.ServerStream) error {
+	r, err := s.relay(stream.Context())
+	if err != nil {
+		return err
+	}
+	ch := r.firehose.subscribe(req.Filter)
+	if ch == nil {
+		return status.Error(codes.Unavailable, "relay is shutting down")
+	}
+	defer r.firehose.unsubscribe(ch)
+
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return status.Error(codes.Unavailable, "stream closed: fell behind or relay shutting down")
+			}
+			if !r.visible(event) {
+				continue
+			}
+			if err := stream.SendMsg(event); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *rpcServer) GetConfig(ctx context.Context, req *Empty) (*Tunables, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tunables := r.live.Load().Tunables()
+	return &tunables, nil
+}
+
+func (s *rpcServer) UpdateConfig(ctx context.Context, req *json.RawMessage) (*Tunables, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := patchTunables(r.live, *req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	r.logger.Info("Configuration updated via gRPC: %+v", updated)
+	return &updated, nil
+}
+
+func (s *rpcServer) GetChaos(ctx context.Context, req *Empty) (*ChaosSettings, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := r.chaos.Settings()
+	return &settings, nil
+}
+
+func (s *rpcServer) UpdateChaos(ctx context.Context, req *json.RawMessage) (*ChaosSettings, error) {
+	r, err := s.relay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	settings := r.chaos.Settings()
+	if err := json.Unmarshal(*req, &settings); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid JSON body: %v", err)
+	}
+	if err := r.chaos.Update(settings); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &settings, nil
+}
+
+// rpcServiceDesc stands in for the descriptor protoc would generate.
+var rpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: rpcServiceName,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		rpcMethod("Publish", (*rpcServer).Publish),
+		rpcMethod("Query", (*rpcServer).Query),
+		rpcMethod("GetConfig", (*rpcServer).GetConfig),
+		rpcMethod("UpdateConfig", (*rpcServer).UpdateConfig),
+		rpcMethod("GetChaos", (*rpcServer).GetChaos),
+		rpcMethod("UpdateChaos", (*rpcServer).UpdateChaos),
+	},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Firehose",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			var req FirehoseRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			return srv.(*rpcServer).Firehose(&req, stream)
+		},
+	}},
+}
+
+// rpcMethod adapts a unary method to the handler gRPC calls.
+func rpcMethod[Req, Resp any](name string, method func(*rpcServer, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			handler := func(ctx context.Context, req any) (any, error) {
+				return method(srv.(*rpcServer), ctx, req.(*Req))
+			}
+			if interceptor == nil {
+				return handler(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + rpcServiceName + "/" + name}
+			return interceptor(ctx, req, info, handler)
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package testingrelay
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const testAdminToken = "test-token"
+
+// newTestRPC serves the gRPC methods of a test relay, without a listener,
+// like startRPC does.
+func newTestRPC(t *testing.T, configure func(cfg *RelayConfig)) (*rpcServer, *Relay) {
+	t.Helper()
+
+	relay, _ := serveTestRelay(t, func(cfg *RelayConfig) {
+		cfg.AdminToken = testAdminToken
+		if configure != nil {
+			configure(cfg)
+		}
+	})
+	s := &rpcServer{relays: make(map[string]*relayRPC)}
+	for _, inst := range relay.instances {
+		s.relays[inst.id] = inst.rpc
+	}
+	return s, relay
+}
+
+// withToken is the context of a call carrying token as its bearer token.
+func withToken(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func rpcQueryIDs(t *testing.T, s *rpcServer, filter nostr.Filter) []string {
+	t.Helper()
+
+	resp, err := s.Query(withToken(testAdminToken), &QueryRequest{Filter: filter})
+	if err != nil {
+		t.Fatalf("querying %v: %v", filter, err)
+	}
+	ids := make([]string, 0, len(resp.Events))
+	for _, event := range resp.Events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestRPCAdminToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		ctx   context.Context
+		code  codes.Code
+	}{
+		{name: "disabled", token: "", ctx: withToken(""), code: codes.PermissionDenied},
+		{name: "missing", token: testAdminToken, ctx: context.Background(), code: codes.Unauthenticated},
+		{name: "wrong", token: testAdminToken, ctx: withToken("wrong"), code: codes.Unauthenticated},
+		{name: "valid", token: testAdminToken, ctx: withToken(testAdminToken), code: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestRPC(t, func(cfg *RelayConfig) { cfg.AdminToken = tt.token })
+			_, err := s.Query(tt.ctx, &QueryRequest{Filter: nostr.Filter{Limit: 1}})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("got %v (%v), want %v", code, err, tt.code)
+			}
+		})
+	}
+}
+
+func TestRPCPublishAndDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		readOnly bool
+		message  string
+	}{
+		{name: "accepted"},
+		{name: "refused by a policy", readOnly: true, message: "blocked: relay is read-only"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, relay := newTestRPC(t, nil)
+			ctx := withToken(testAdminToken)
+			sk := nostr.GeneratePrivateKey()
+
+			note := signedEvent(t, sk, nostr.KindTextNote, "over gRPC", nil)
+			resp, err := s.Publish(ctx, &PublishRequest{Event: note})
+			if err != nil || !resp.Accepted {
+				t.Fatalf("publishing the note: %+v, %v", resp, err)
+			}
+			if ids := rpcQueryIDs(t, s, nostr.Filter{IDs: []string{note.ID}}); len(ids) != 1 {
+				t.Fatalf("queried %v, want %s", ids, note.ID)
+			}
+			if tt.readOnly {
+				relay.instances[0].live.Update(func(cfg *RelayConfig) error {
+					cfg.ReadOnly = true
+					return nil
+				})
+			}
+
+			deletion := signedEvent(t, sk, nostr.KindDeletion, "", nostr.Tags{{"e", note.ID}})
+			resp, err = s.Publish(ctx, &PublishRequest{Event: deletion})
+			if err != nil || resp.Message != tt.message {
+				t.Fatalf("publishing the deletion: %+v, %v, want message %q", resp, err, tt.message)
+			}
+			deleted := len(rpcQueryIDs(t, s, nostr.Filter{IDs: []string{note.ID}})) == 0
+			if deleted != (tt.message == "") {
+				t.Fatalf("note deleted: %v, deletion message %q", deleted, tt.message)
+			}
+		})
+	}
+}
+
+func TestRPCPublishRefusals(t *testing.T) {
+	s, _ := newTestRPC(t, nil)
+	ctx := withToken(testAdminToken)
+
+	tests := []struct {
+		name    string
+		event   *nostr.Event
+		message string
+	}{
+		{
+			name:    "bad signature",
+			event:   forged(t, "", nostr.KindTextNote, nil),
+			message: "invalid: signature is invalid",
+		},
+		{
+			name:    "protected",
+			event:   signedEvent(t, "", nostr.KindTextNote, "protected", nostr.Tags{{"-"}}),
+			message: "auth-required: must be published by event author",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Publish(ctx, &PublishRequest{Event: tt.event})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Accepted || resp.Message != tt.message {
+				t.Fatalf("got %+v, want refused with %q", resp, tt.message)
+			}
+			if ids := rpcQueryIDs(t, s, nostr.Filter{IDs: []string{tt.event.ID}}); len(ids) != 0 {
+				t.Fatalf("refused event stored: %v", ids)
+			}
+		})
+	}
+}
+
+func TestRPCHidesDirectMessages(t *testing.T) {
+	s, relay := newTestRPC(t, func(cfg *RelayConfig) {
+		cfg.AuthRequiredWrite = true
+		cfg.PrivateDMs = true
+	})
+	ctx := context.Background()
+
+	// websocket clients would have to authenticate to publish them
+	dm := signedEvent(t, "", nostr.KindEncryptedDirectMessage, "secret", nostr.Tags{{"p", nostr.GeneratePrivateKey()}})
+	note := signedEvent(t, "", nostr.KindTextNote, "public", nil)
+	for _, event := range []*nostr.Event{dm, note} {
+		if err := relay.instances[0].writes.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids := rpcQueryIDs(t, s, nostr.Filter{IDs: []string{dm.ID, note.ID}})
+	if len(ids) != 1 || ids[0] != note.ID {
+		t.Fatalf("queried %v, want only the note %s", ids, note.ID)
+	}
+}
@@ -0,0 +1,142 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// readyTimeout bounds the checks behind /readyz.
+const readyTimeout = 5 * time.Second
+
+// startedAt is when the process started, for the reported uptime.
+var startedAt = time.Now()
+
+type healthStatus struct {
+	Status        string          `json:"status"`
+	Error         string          `json:"error,omitempty"`
+	Version       string          `json:"version"`
+	Uptime        string          `json:"uptime"`
+	UptimeSeconds int64           `json:"uptime_seconds"`
+	Connections   int             `json:"connections"`
+	Rejections    RejectionCounts `json:"rejections"`
+	Storage       *storageStatus  `json:"storage,omitempty"`
+}
+
+type storageStatus struct {
+	Backend     string `json:"backend"`
+	Events      int64  `json:"events"`
+	SizeBytes   int64  `json:"size_bytes,omitempty"`
+	RoundTripMs int64  `json:"round_trip_ms"`
+}
+
+func newHealthStatus(wire *wireServer, metrics *Metrics) healthStatus {
+	uptime := time.Since(startedAt).Truncate(time.Second)
+	return healthStatus{
+		Status:        "ok",
+		Version:       version,
+		Uptime:        uptime.String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Connections:   len(wire.Conns()),
+		Rejections:    metrics.RejectionCounts(),
+	}
+}
+
+// handleHealthz answers as long as the process serves HTTP, for liveness
+// probes. Like /readyz it reports the rejections counted so far, so test
+// harnesses can check why events were rejected without reading the logs.
+func handleHealthz(wire *wireServer, metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, newHealthStatus(wire, metrics))
+	}
+}
+
+// handleReadyz answers 200 once an event written to the store can be read
+// back, and 503 otherwise, for readiness probes and for test harnesses
+// waiting for the relay to come up. The probe event is deleted right away and
+// bypasses the relay's hooks, so it is never broadcast, counted or mirrored.
+func handleReadyz(wire *wireServer, metrics *Metrics, writes *gatedStore, db eventstore.Store, cfg *RelayConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		status := newHealthStatus(wire, metrics)
+		storage, err := checkStore(ctx, writes, db, cfg)
+		status.Storage = storage
+		if err != nil {
+			status.Status = "unavailable"
+			status.Error = err.Error()
+			writeJSON(w, http.StatusServiceUnavailable, status)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// checkStore writes, reads and deletes a probe event and collects the
+// storage stats.
+func checkStore(ctx context.Context, writes *gatedStore, db eventstore.Store, cfg *RelayConfig) (*storageStatus, error) {
+	storage := &storageStatus{Backend: cfg.DBBackend}
+	if cfg.Ephemeral {
+		storage.Backend = "memory"
+	}
+
+	probe := nostr.Event{
+		CreatedAt: nostr.Now(),
+		Kind:      nostr.KindTextNote,
+		Tags:      nostr.Tags{},
+		Content:   "readiness probe",
+	}
+	if err := probe.Sign(nostr.GeneratePrivateKey()); err != nil {
+		return storage, err
+	}
+
+	start := time.Now()
+	if err := writes.SaveEvent(ctx, &probe); err != nil {
+		return storage, fmt.Errorf("writing to the store: %w", err)
+	}
+	// with async batched writes the probe is only readable once committed
+	if f, ok := writes.Store.(flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			return storage, fmt.Errorf("committing to the store: %w", err)
+		}
+	}
+	found, err := storeHas(ctx, writes, probe.ID)
+	if err != nil {
+		return storage, fmt.Errorf("reading from the store: %w", err)
+	}
+	if err := writes.DeleteEvent(ctx, &probe); err != nil {
+		return storage, fmt.Errorf("deleting from the store: %w", err)
+	}
+	if !found {
+		return storage, fmt.Errorf("the event written to the store couldn't be read back")
+	}
+	storage.RoundTripMs = time.Since(start).Milliseconds()
+
+	if storage.Events, err = (count.Wrapper{Store: db}).CountEvents(ctx, nostr.Filter{}); err != nil {
+		return storage, fmt.Errorf("counting events: %w", err)
+	}
+	if info, err := os.Stat(cfg.DBPath); err == nil && info.Mode().IsRegular() && !cfg.Ephemeral {
+		storage.SizeBytes = info.Size()
+	}
+	return storage, nil
+}
+
+// storeHas reports whether the store returns the event with id.
+func storeHas(ctx context.Context, store eventstore.Store, id string) (bool, error) {
+	ch, err := store.QueryEvents(ctx, nostr.Filter{IDs: []string{id}})
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for event := range ch {
+		found = found || event.ID == id
+	}
+	return found, nil
+}
@@ -0,0 +1,144 @@
+package testingrelay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// identityNames are the first names of the test identities.
+var identityNames = []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi", "ivan", "judy", "mallory", "niaj", "olivia", "peggy", "rupert", "sybil", "trent", "victor", "walter", "zoe"}
+
+// testIdentity is a provisioned keypair and what was published for it.
+type testIdentity struct {
+	Name    string   `json:"name"`
+	Nsec    string   `json:"nsec"`
+	Npub    string   `json:"npub"`
+	Secret  string   `json:"secret"`
+	Pubkey  string   `json:"pubkey"`
+	Follows []string `json:"follows"`
+}
+
+// identitySecret derives the i-th secret key of seed, so the same seed gives
+// the same identities.
+func identitySecret(seed uint64, i int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("testing-relay identity %d/%d", seed, i)))
+	return hex.EncodeToString(sum[:])
+}
+
+// provisionIdentities makes count identities, each following follows random
+// others, with their kind 0 profiles and kind 3 follow lists.
+func provisionIdentities(count, follows int, seed uint64) ([]testIdentity, []*nostr.Event) {
+	rng := rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))
+	now := nostr.Now()
+
+	identities := make([]testIdentity, count)
+	for i := range identities {
+		secret := identitySecret(seed, i)
+		pubkey, _ := nostr.GetPublicKey(secret)
+		nsec, _ := nip19.EncodePrivateKey(secret)
+		npub, _ := nip19.EncodePublicKey(pubkey)
+		name := identityNames[i%len(identityNames)]
+		if i >= len(identityNames) {
+			name += strconv.Itoa(i / len(identityNames))
+		}
+		identities[i] = testIdentity{Name: name, Nsec: nsec, Npub: npub, Secret: secret, Pubkey: pubkey, Follows: []string{}}
+	}
+
+	var events []*nostr.Event
+	for i := range identities {
+		identity := &identities[i]
+		profile, _ := json.Marshal(map[string]string{
+			"name":         identity.Name,
+			"display_name": identity.Name,
+			"about":        fmt.Sprintf("Test identity %d of %d, seed %d", i+1, count, seed),
+		})
+		events = append(events, &nostr.Event{PubKey: identity.Pubkey, CreatedAt: now, Kind: nostr.KindProfileMetadata, Content: string(profile)})
+
+		contacts := &nostr.Event{PubKey: identity.Pubkey, CreatedAt: now, Kind: nostr.KindFollowList, Tags: nostr.Tags{}}
+		for _, j := range rng.Perm(count) {
+			if len(identity.Follows) == follows {
+				break
+			}
+			if j == i {
+				continue
+			}
+			identity.Follows = append(identity.Follows, identities[j].Pubkey)
+			contacts.Tags = append(contacts.Tags, nostr.Tag{"p", identities[j].Pubkey, "", identities[j].Name})
+		}
+		events = append(events, contacts)
+	}
+
+	for _, event := range events {
+		for _, identity := range identities {
+			if identity.Pubkey == event.PubKey {
+				event.Sign(identity.Secret)
+			}
+		}
+	}
+	return identities, events
+}
+
+// handleIdentities serves POST /admin/identities?count=10&follows=5&seed=...,
+// which provisions test identities with profiles and a follow graph among
+// them, published past the policies, and returns their keys. The same seed
+// gives the same keys and graph.
+func handleIdentities(relay *khatru.Relay, store eventstore.Store, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		count := 10
+		if value := query.Get("count"); value != "" {
+			var err error
+			if count, err = strconv.Atoi(value); err != nil || count < 1 || count > 1000 {
+				http.Error(w, fmt.Sprintf("invalid count %q, expected 1 to 1000", value), http.StatusBadRequest)
+				return
+			}
+		}
+		follows := min(5, count-1)
+		if value := query.Get("follows"); value != "" {
+			var err error
+			if follows, err = strconv.Atoi(value); err != nil || follows < 0 || follows >= count {
+				http.Error(w, fmt.Sprintf("invalid follows %q, expected 0 to %d", value, count-1), http.StatusBadRequest)
+				return
+			}
+		}
+		seed := uint64(time.Now().UnixNano())
+		if value := query.Get("seed"); value != "" {
+			var err error
+			if seed, err = strconv.ParseUint(value, 10, 64); err != nil {
+				http.Error(w, fmt.Sprintf("invalid seed %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+
+		identities, events := provisionIdentities(count, follows, seed)
+		published := 0
+		for _, event := range events {
+			if storeRemoteEvent(r.Context(), relay, store, event, "the admin API", logger) {
+				published++
+			}
+		}
+
+		logger.Info("Provisioned %d test identities following %d each (seed %d) via admin API", count, follows, seed)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"seed":       seed,
+			"published":  published,
+			"identities": identities,
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package testingrelay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// version is reported in the NIP-11 document; release builds set it with
+// -ldflags "-X github.com/gzuuus/testing-relay.version=...".
+var version = "dev"
+
+// setupInfo fills in the NIP-11 information document from the configuration,
+// with the retention the PRUNE_* rules enforce. The name, description, icon
+// and limitation block are built per request, since they can change at
+// runtime.
+func setupInfo(relay *khatru.Relay, live *LiveConfig) {
+	cfg := live.Load()
+
+	relay.Info.Name = cfg.Name
+	relay.Info.Description = cfg.Description
+	relay.Info.PubKey = cfg.PubKey
+	relay.Info.Contact = cfg.Contact
+	relay.Info.Icon = cfg.Icon
+	relay.Info.Banner = cfg.Banner
+	relay.Info.PostingPolicy = cfg.PostingPolicy
+	relay.Info.Retention = cfg.Prune.retention()
+	relay.Info.Software = "https://github.com/gzuuus/testing-relay"
+	relay.Info.Version = version
+
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation,
+		func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			cfg := live.Load()
+			// NIP-86 changes these at runtime through the live config
+			info.Name = cfg.Name
+			info.Description = cfg.Description
+			info.Icon = cfg.Icon
+			info.Limitation = &nip11.RelayLimitationDocument{
+				MaxMessageLength: int(relay.MaxMessageSize),
+				MaxSubscriptions: cfg.MaxSubscriptions,
+				MaxFilters:       cfg.MaxFilters,
+				MaxLimit:         cfg.MaxLimit,
+				MaxContentLength: cfg.MaxContentLength,
+				MaxEventTags:     cfg.MaxEventTags,
+				MinPowDifficulty: cfg.MinPowDifficulty,
+				AuthRequired:     cfg.AuthRequiredRead || cfg.AuthRequiredWrite,
+				PaymentRequired:  cfg.Payment.Enabled(),
+				RestrictedWrites: cfg.ReadOnly || cfg.AuthRequiredWrite || len(cfg.AllowedKinds) > 0 || cfg.whitelistEnabled(),
+			}
+			return info
+		},
+	)
+}
+
+// handleNIP11 serves the NIP-11 document, with the rejections counted so far
+// in a "rejections" field when INFO_REJECTIONS is set. NIP-11 has no such
+// field, so clients that don't know it ignore it.
+func handleNIP11(w http.ResponseWriter, r *http.Request, relay *khatru.Relay, cfg *RelayConfig, metrics *Metrics) {
+	if !cfg.InfoRejections {
+		relay.HandleNIP11(w, r)
+		return
+	}
+
+	buffered := &bufferedResponse{header: w.Header()}
+	relay.HandleNIP11(buffered, r)
+	var info nip11.RelayInformationDocument
+	if err := json.Unmarshal(buffered.body.Bytes(), &info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		nip11.RelayInformationDocument
+		Rejections RejectionCounts `json:"rejections"`
+	}{info, metrics.RejectionCounts()})
+}
+
+// bufferedResponse keeps the body written to it, sharing the headers of the
+// real response.
+type bufferedResponse struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(int)             {}
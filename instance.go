@@ -0,0 +1,315 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// relayInstance is one relay served by the process: the root one configured
+// by the environment, or a virtual one from the config file's relays list.
+// Each has its own store, policies and routes.
+type relayInstance struct {
+	id       string
+	live     *LiveConfig
+	wire     *wireServer
+	writes   *gatedStore
+	mux      *http.ServeMux
+	firehose *Firehose
+	rpc      *relayRPC
+	logger   *Logger
+	closers  []func() error
+	// run before the stores are closed, for the loops still using them
+	stoppers []func() error
+
+	// stops the background loops of the instance
+	cancel context.CancelFunc
+}
+
+// newRelayInstance builds a relay from cfg, which Validate accepted. The
+// recorder and tracing are shared by every instance and may be nil.
+func newRelayInstance(id string, cfg RelayConfig, recorder *Recorder, tracing *Tracing, logger *Logger) (_ *relayInstance, err error) {
+	live := NewLiveConfig(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	inst := &relayInstance{id: id, live: live, logger: logger, cancel: cancel}
+	// a relay that fails to start closes what it opened
+	defer func() {
+		if err != nil {
+			inst.Close()
+		}
+	}()
+
+	relay := khatru.NewRelay()
+	setupInfo(relay, live)
+	relay.ServiceURL = cfg.ServiceURL
+
+	db, err := NewStore(&cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure database: %w", err)
+	}
+	if err := db.Init(); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s database: %w", cfg.DBBackend, err)
+	}
+	for _, backend := range backendStores(db) {
+		tunePostgres(backend, cfg.Postgres, logger)
+		stopCheckpoints, err := tuneSQLite(backend, cfg.SQLite, logger)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to apply sqlite pragmas: %w", err)
+		}
+		inst.stoppers = append(inst.stoppers, stopCheckpoints)
+	}
+	backups, stopBackups := setupBackups(db, cfg.Backup, logger)
+	inst.closers = append(inst.closers, stopBackups)
+	writes := &gatedStore{Store: wrapBackends(db, func(store eventstore.Store) eventstore.Store {
+		return newBatchingStore(guardMapFull(store, logger), cfg.WriteBatch, logger)
+	})}
+	inst.writes = writes
+
+	for _, shard := range cfg.Shards {
+		logger.Info("Keeping kinds %v in %s %s", shard.Kinds, shard.Backend, shard.Path)
+	}
+	if cfg.Ephemeral {
+		logger.Info("Ephemeral mode enabled, events are kept in memory and discarded on exit")
+	}
+	if cfg.ClockOffset != 0 {
+		logger.Info("Clock skew simulation enabled, the relay's clock is off by %ds", cfg.ClockOffset)
+	}
+
+	wire := newWireServer(relay)
+	inst.wire = wire
+	metrics := NewMetrics(wire)
+
+	if cfg.CompactOnStart {
+		compactStore(context.Background(), db, logger)
+	}
+
+	quotas := NewQuotas(cfg.QuotaEvents, cfg.QuotaBytes)
+	if err := quotas.Load(context.Background(), db); err != nil {
+		return nil, fmt.Errorf("failed to count stored events for quotas: %w", err)
+	}
+	stats := NewStats()
+	if err := stats.Load(context.Background(), db); err != nil {
+		return nil, fmt.Errorf("failed to count stored events for stats: %w", err)
+	}
+	expiring := newExpirations()
+	if err := expiring.Load(context.Background(), db); err != nil {
+		return nil, fmt.Errorf("failed to find the expiring events: %w", err)
+	}
+
+	// the cache sits in front of the metrics, which then only time the queries
+	// that reach the database
+	sketches := newCountSketches()
+	store := newCachingStore(metrics.Store(stats.Store(quotas.Store(sketches.Store(expiring.Store(&replacingStore{Store: writes}))))), cfg.QueryCache, metrics)
+	chaos := NewChaos(cfg.Chaos, logger)
+	if cfg.Chaos.Enabled {
+		logger.Info("Chaos mode enabled: %+v", cfg.Chaos)
+	}
+	// only what the relay serves is blackholed, the admin API still sees it all
+	if cfg.Ephemeral {
+		cfg.BlackholePath = ":memory:"
+	}
+	blackhole, err := setupBlackhole(ctx, relay, live, store, cfg.BlackholePath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the blackhole: %w", err)
+	}
+	inst.closers = append(inst.closers, blackhole.Close)
+	attachStore(relay, chaos.Store(blackhole.Store(store)))
+	setupQueryLimit(relay, &cfg)
+	if cfg.QueryCache.Size > 0 {
+		logger.Info("Caching the results of %d filters for %s", cfg.QueryCache.Size, cfg.QueryCache.TTL)
+	}
+	setupNegentropy(relay, cfg.Negentropy)
+	setupSearch(relay, db, logger)
+	if err := setupCount(relay, wire, sketches, cfg.CountMode); err != nil {
+		return nil, fmt.Errorf("invalid count mode: %w", err)
+	}
+
+	relay.RejectEvent = append(relay.RejectEvent,
+		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			return live.Load().ValidateEvent(event)
+		},
+	)
+
+	verifier := newSigVerifier(cfg.SigVerify, metrics)
+	inst.closers = append(inst.closers, verifier.Close)
+	setupValidation(relay, wire, verifier, &cfg, logger)
+
+	whitelist := NewWhitelist(live, cfg.Whitelist, logger)
+	if cfg.Ephemeral {
+		cfg.Payment.Path = ":memory:"
+	}
+	payments, err := OpenPayments(ctx, cfg.Payment, whitelist, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up payments: %w", err)
+	}
+	inst.closers = append(inst.closers, payments.Close)
+	payments.Attach(relay)
+	whitelist.Attach(relay)
+	whitelist.Start(ctx, cfg.ConfigWatch)
+	setupWoT(ctx, whitelist, cfg.WoT, logger)
+
+	if cfg.Ephemeral {
+		cfg.Bans.Path = ":memory:"
+	}
+	bans, err := OpenBans(cfg.Bans)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ban list: %w", err)
+	}
+	inst.closers = append(inst.closers, bans.Close)
+	bans.Attach(relay, blackhole)
+
+	setupAuth(relay, &cfg, logger)
+	setupDMPrivacy(wire, &cfg, logger)
+	setupRateLimits(ctx, relay, cfg.RateLimit, live, logger)
+	setupLimits(relay, wire, Limits{
+		ConnsPerIP:    cfg.MaxConnsPerIP,
+		Subscriptions: cfg.MaxSubscriptions,
+		Filters:       cfg.MaxFilters,
+		FilterLimit:   cfg.MaxLimit,
+	})
+	setupIPPolicy(ctx, wire, cfg.ipPolicy(), logger)
+	setupFilterRules(relay, cfg.FilterRules, logger)
+	setupTimeTravel(relay, live, logger)
+	setupSpam(ctx, relay, blackhole, metrics, cfg.Spam, logger)
+	quotas.Attach(relay)
+	setupExpiration(ctx, relay, store, expiring, cfg.ExpirySweep, cfg.now, logger)
+	setupPruning(ctx, store, cfg.Prune, logger)
+	setupDeletions(relay, store, cfg.RejectDeleted)
+	setupGossip(relay, store, cfg.Gossip, cfg.ServiceURL, logger)
+	setupMirror(ctx, relay, store, cfg.Upstream, logger)
+	inst.closers = append(inst.closers, setupReplication(relay, store, cfg.Replica, logger))
+	leave, err := setupCluster(relay, store, blackhole, cfg.Cluster, cfg.DBPath, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join the cluster: %w", err)
+	}
+	inst.closers = append(inst.closers, leave)
+	setupDispatch(relay, store, blackhole, cfg.Dispatch, logger)
+	inst.closers = append(inst.closers, setupDVM(relay, store, cfg.DVM, logger))
+	setupWritePolicy(relay, blackhole, cfg.WritePolicy, logger)
+	if err := setupWasmPolicy(relay, cfg.PolicyWasm, logger); err != nil {
+		return nil, fmt.Errorf("failed to load WASM policy: %w", err)
+	}
+
+	var scenario Scenario
+	if cfg.ScenarioFile != "" {
+		if scenario, err = LoadScenario(cfg.ScenarioFile); err != nil {
+			return nil, fmt.Errorf("failed to load scenario %s: %w", cfg.ScenarioFile, err)
+		}
+		logger.Info("Scenario mode enabled with %d rules from %s", len(scenario.Rules), cfg.ScenarioFile)
+	}
+	scenarios := NewScenarioEngine(scenario)
+	scenarios.Attach(relay)
+
+	management := NewManagement(relay, store, live, bans, logger)
+	management.Attach(relay)
+
+	firehose := NewFirehose()
+	inst.firehose = firehose
+	firehose.Attach(relay)
+	setupGiftWraps(relay, wire, firehose, whitelist, stats, &cfg, logger)
+	setupBroadcast(ctx, relay, cfg.Downstream, metrics, logger)
+
+	if cfg.Ephemeral && cfg.Audit.Path != "" {
+		cfg.Audit.Path = ":memory:"
+	}
+	audit, err := OpenAudit(cfg.Audit, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	inst.closers = append(inst.closers, audit.Close)
+	// named before the hooks wrapping the policies hide their names
+	policies := policyNames(relay)
+	audit.Attach(relay, policies)
+
+	closeDeadLetter, err := setupWebhooks(relay, cfg.Webhooks, metrics, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the webhook dead-letter file: %w", err)
+	}
+	inst.closers = append(inst.closers, closeDeadLetter)
+	// must come after every RejectEvent policy so all rejections are counted
+	metrics.Attach(relay, policies)
+	attachLogging(relay, logger)
+
+	inst.rpc = &relayRPC{relay: relay, firehose: firehose, live: live, chaos: chaos, checks: cfg.validationChecks(), verifier: verifier, logger: logger, privateDMs: cfg.privateDMs()}
+
+	// chaos may break the messages, so prefixes go first
+	setupPrefixes(wire, cfg.Prefixes, logger)
+	wire.outbound = append(wire.outbound, chaos.Hook)
+	setupLatency(wire, time.Duration(cfg.InjectLatency)*time.Millisecond, time.Duration(cfg.InjectJitter)*time.Millisecond, logger)
+	recorder.Attach(wire)
+	closeTrace, err := setupProtocolTrace(relay, wire, &cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up the protocol trace: %w", err)
+	}
+	inst.closers = append(inst.closers, closeTrace)
+	// wraps the hooks, so it has to come after all of them
+	tracing.Attach(relay, wire)
+	wire.compression = cfg.Compression
+	wire.slowReader = cfg.SlowReader
+	setupThrottle(wire, cfg.Throttle, logger)
+	setupWireLimits(relay, wire, cfg.WebSocket, logger)
+	setupNIP46(relay, wire, cfg.NIP46, logger)
+
+	mux := http.NewServeMux()
+	root := handleRoot(relay, live, wire, management, metrics)
+	mux.Handle("/", root)
+	mux.Handle("/invoice", handleInvoice(payments))
+	mux.Handle("/invoice/{hash}", handleInvoice(payments))
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/stats", requireAdmin(live, handleStats(stats, live)))
+	mux.Handle("/healthz", handleHealthz(wire, metrics))
+	mux.Handle("/readyz", handleReadyz(wire, metrics, writes, db, &cfg))
+	mux.HandleFunc("/dashboard", handleDashboard)
+	mux.Handle("/dashboard/state", requireAdmin(live, handleDashboardState(wire, metrics, live, chaos)))
+	mux.Handle("/relays/{pubkey}", handleRelayHints(store))
+	mux.Handle("/export", requireAdmin(live, handleExport(store)))
+	mux.Handle("/import", requireAdmin(live, handleImport(store, verifier, logger)))
+	mux.Handle("/firehose", requireAdmin(live, handleFirehose(firehose, false)))
+	mux.Handle("/firehose.jsonl", requireAdmin(live, handleFirehose(firehose, true)))
+	mux.Handle("/admin/chaos", requireAdmin(live, handleChaos(chaos)))
+	mux.Handle("/admin/scenario", requireAdmin(live, handleScenario(scenarios, logger)))
+	mux.Handle("/admin/config", requireAdmin(live, handleConfig(live, logger)))
+	mux.Handle("/admin/whitelist/{pubkey}", requireAdmin(live, handleWhitelistEntry(live, logger)))
+	mux.Handle("/admin/kinds/{kind}", requireAdmin(live, handleKindEntry(live, logger)))
+	mux.Handle("/admin/subscriptions", requireAdmin(live, handleSubscriptions(wire)))
+	mux.Handle("/admin/connections/{conn}", requireAdmin(live, handleKillConnection(wire, logger)))
+	mux.Handle("/admin/connections/{conn}/subscriptions/{sub}", requireAdmin(live, handleKillSubscription(wire, logger)))
+	mux.Handle("/admin/rejections", requireAdmin(live, handleRejections(audit)))
+	mux.Handle("/admin/bans", requireAdmin(live, handleBans(bans, logger)))
+	mux.Handle("/admin/quotas", requireAdmin(live, handleQuotas(quotas)))
+	mux.Handle("/admin/quotas/{pubkey}", requireAdmin(live, handleQuotaEntry(quotas, logger)))
+	mux.Handle("/admin/purge", requireAdmin(live, handlePurge(store, logger)))
+	mux.Handle("/admin/fuzz", requireAdmin(live, handleFuzz(relay, store, live, logger)))
+	mux.Handle("/admin/identities", requireAdmin(live, handleIdentities(relay, store, logger)))
+	mux.Handle("/admin/snapshot", requireAdmin(live, handleSnapshot(writes, store, live, logger)))
+	mux.Handle("/admin/restore", requireAdmin(live, handleRestore(store, live, logger)))
+	mux.Handle("/admin/vacuum", requireAdmin(live, handleVacuum(primaryStore(db), logger)))
+	mux.Handle("/admin/backup", requireAdmin(live, handleBackup(backups, logger)))
+	if err := setupBlossom(mux, root, cfg.Blossom, cfg.ServiceURL, logger); err != nil {
+		return nil, fmt.Errorf("failed to set up blossom: %w", err)
+	}
+	inst.mux = mux
+
+	return inst, nil
+}
+
+// Close stops the background loops, then closes the store and the other
+// files of the instance.
+func (inst *relayInstance) Close() {
+	inst.cancel()
+	for _, stop := range inst.stoppers {
+		stop()
+	}
+	if inst.writes != nil {
+		inst.writes.Close()
+	}
+	for _, close := range inst.closers {
+		close()
+	}
+}
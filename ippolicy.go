@@ -0,0 +1,335 @@
+package testingrelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// parseIPRanges parses IPs and CIDRs, an IP being a range of its own.
+func parseIPRanges(list []string) ([]netip.Prefix, error) {
+	ranges := make([]netip.Prefix, 0, len(list))
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", entry)
+			}
+			ranges = append(ranges, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q", entry)
+		}
+		addr = addr.Unmap()
+		ranges = append(ranges, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return ranges, nil
+}
+
+func inRanges(ranges []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ranges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardingHeaders are the headers proxies describe the client's request
+// with.
+var forwardingHeaders = []string{"X-Forwarded-For", "X-Real-IP", "X-Forwarded-Host", "X-Forwarded-Proto"}
+
+// trustProxies resolves the client address of requests coming through the
+// proxies in trusted: the last X-Forwarded-For hop that isn't a trusted
+// proxy, or X-Real-IP, becomes the RemoteAddr and those headers are dropped,
+// so khatru and every hook see the client. Other peers can't spoof their
+// address, nor the host and scheme NIP-98 events are signed for: all their
+// forwarding headers are dropped. Without trusted proxies nobody's headers
+// are believed and the peer address is the client's.
+func trustProxies(trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.ContainsFunc(forwardingHeaders, func(name string) bool { return r.Header.Get(name) != "" }) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host, port, err := net.SplitHostPort(r.RemoteAddr)
+		peer, perr := netip.ParseAddr(host)
+		r = r.WithContext(r.Context())
+		r.Header = r.Header.Clone()
+		if err == nil && perr == nil && inRanges(trusted, peer) {
+			if client, ok := forwardedClient(r.Header, trusted); ok {
+				r.RemoteAddr = net.JoinHostPort(client.String(), port)
+			}
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Del("X-Real-IP")
+		} else {
+			for _, name := range forwardingHeaders {
+				r.Header.Del(name)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient walks X-Forwarded-For from the nearest hop, skipping the
+// trusted proxies, and falls back to X-Real-IP.
+func forwardedClient(header http.Header, trusted []netip.Prefix) (netip.Addr, bool) {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var farthest netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if !inRanges(trusted, addr) {
+			return addr.Unmap(), true
+		}
+		farthest = addr.Unmap()
+	}
+	if farthest.IsValid() {
+		return farthest, true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// IPPolicy decides who may connect by address (IP_*). Allow, if set, lists
+// the only IPs and CIDRs that may connect and Deny those that may not.
+// ConnsPerSubnet caps the connections from one /24 (IPv4) or /48 (IPv6),
+// roughly one network, on top of MAX_CONNECTIONS_PER_IP. TorExits is deny to
+// refuse Tor exit nodes or only to accept nothing else, with the exit list
+// read from TorExitList, a URL or a file of one IP per line, every
+// TorExitRefresh. Refused connections get 403 before the websocket upgrade,
+// or 429 when their subnet is over its cap.
+type IPPolicy struct {
+	Allow          []string      `envconfig:"ALLOW"`
+	Deny           []string      `envconfig:"DENY"`
+	ConnsPerSubnet int           `envconfig:"CONNS_PER_SUBNET"`
+	TorExits       string        `envconfig:"TOR_EXITS"`
+	TorExitList    string        `envconfig:"TOR_EXIT_LIST" default:"https://check.torproject.org/torbulkexitlist"`
+	TorExitRefresh time.Duration `envconfig:"TOR_EXIT_REFRESH" default:"1h"`
+}
+
+func (p IPPolicy) Validate() error {
+	if _, err := parseIPRanges(p.Allow); err != nil {
+		return fmt.Errorf("IP_ALLOW: %w", err)
+	}
+	if _, err := parseIPRanges(p.Deny); err != nil {
+		return fmt.Errorf("IP_DENY: %w", err)
+	}
+	if p.ConnsPerSubnet < 0 {
+		return fmt.Errorf("IP_CONNS_PER_SUBNET must not be negative")
+	}
+	switch p.TorExits {
+	case "", "deny", "only":
+	default:
+		return fmt.Errorf("invalid IP_TOR_EXITS %q, expected deny, only or empty", p.TorExits)
+	}
+	if p.TorExits != "" && p.TorExitList == "" {
+		return fmt.Errorf("IP_TOR_EXITS needs IP_TOR_EXIT_LIST")
+	}
+	return nil
+}
+
+// validateAllowlist checks ALLOWED_IPS and ALLOWED_CIDRS, the allowlist of
+// the whole relay, which adds to IP_ALLOW.
+func validateAllowlist(ips, cidrs []string) error {
+	for _, ip := range ips {
+		if _, err := netip.ParseAddr(strings.TrimSpace(ip)); err != nil {
+			return fmt.Errorf("invalid ALLOWED_IPS entry %q, expected an IP", ip)
+		}
+	}
+	for _, cidr := range cidrs {
+		if _, err := netip.ParsePrefix(strings.TrimSpace(cidr)); err != nil {
+			return fmt.Errorf("invalid ALLOWED_CIDRS entry %q, expected a CIDR", cidr)
+		}
+	}
+	return nil
+}
+
+// ipPolicy returns IP_* with ALLOWED_IPS and ALLOWED_CIDRS added to the
+// allowed addresses.
+func (cfg *RelayConfig) ipPolicy() IPPolicy {
+	policy := cfg.IP
+	policy.Allow = append(append(append([]string(nil), policy.Allow...), cfg.AllowedIPs...), cfg.AllowedCIDRs...)
+	return policy
+}
+
+// ipPolicy enforces IPPolicy.
+type ipPolicy struct {
+	policy IPPolicy
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	wire   *wireServer
+	logger *Logger
+
+	mu  sync.RWMutex
+	tor map[netip.Addr]bool
+}
+
+func setupIPPolicy(ctx context.Context, wire *wireServer, policy IPPolicy, logger *Logger) {
+	if len(policy.Allow) == 0 && len(policy.Deny) == 0 && policy.ConnsPerSubnet == 0 && policy.TorExits == "" {
+		return
+	}
+	// checked by Validate
+	allow, _ := parseIPRanges(policy.Allow)
+	deny, _ := parseIPRanges(policy.Deny)
+	p := &ipPolicy{policy: policy, allow: allow, deny: deny, wire: wire, logger: logger}
+	if policy.TorExits != "" {
+		go p.refreshTorExits(ctx)
+	}
+	wire.rejectConnection = append(wire.rejectConnection, p.RejectConnection)
+}
+
+// RejectConnection refuses the websocket upgrade of r when its address may
+// not connect, with 403 or, for a subnet over its cap, 429.
+func (p *ipPolicy) RejectConnection(r *http.Request) (status int, reason string) {
+	ip := khatru.GetIPFromRequest(r)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return 0, ""
+	}
+	addr = addr.Unmap()
+	if status, reason = p.refusal(addr); status != 0 {
+		p.logger.Debug("Refused connection from %s: %s", ip, reason)
+	}
+	return status, reason
+}
+
+// refusal returns the status and reason addr is refused with, or 0 if it may
+// connect.
+func (p *ipPolicy) refusal(addr netip.Addr) (status int, reason string) {
+	switch {
+	case len(p.allow) > 0 && !inRanges(p.allow, addr):
+		return http.StatusForbidden, "not in IP_ALLOW"
+	case inRanges(p.deny, addr):
+		return http.StatusForbidden, "in IP_DENY"
+	}
+
+	switch p.policy.TorExits {
+	case "deny":
+		if p.isTorExit(addr) {
+			return http.StatusForbidden, "Tor exit node"
+		}
+	case "only":
+		if !p.isTorExit(addr) {
+			return http.StatusForbidden, "not a Tor exit node"
+		}
+	}
+
+	if max := p.policy.ConnsPerSubnet; max > 0 {
+		subnet := ipSubnet(addr)
+		open := 0
+		for _, conn := range p.wire.Conns() {
+			if other, err := netip.ParseAddr(khatru.GetIPFromRequest(conn.request)); err == nil && subnet.Contains(other.Unmap()) {
+				open++
+			}
+		}
+		if open >= max {
+			return http.StatusTooManyRequests, fmt.Sprintf("%d connections open from %s", open, subnet)
+		}
+	}
+	return 0, ""
+}
+
+// ipSubnet is the /24 or /48 addr belongs to.
+func ipSubnet(addr netip.Addr) netip.Prefix {
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+func (p *ipPolicy) isTorExit(addr netip.Addr) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.tor[addr]
+}
+
+func (p *ipPolicy) refreshTorExits(ctx context.Context) {
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, sourceTimeout)
+		exits, err := fetchTorExits(fetchCtx, p.policy.TorExitList)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Error("Failed to refresh the Tor exit list from %s: %v", p.policy.TorExitList, err)
+		} else {
+			p.mu.Lock()
+			p.tor = exits
+			p.mu.Unlock()
+			p.logger.Debug("Loaded %d Tor exit nodes from %s", len(exits), p.policy.TorExitList)
+		}
+		if p.policy.TorExitRefresh <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.policy.TorExitRefresh):
+		}
+	}
+}
+
+// fetchTorExits reads a list of IPs, one per line, from a URL or a file.
+// Lines that aren't IPs, like comments, are skipped.
+func fetchTorExits(ctx context.Context, source string) (map[netip.Addr]bool, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", source, resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, 16<<20)); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+
+	exits := make(map[netip.Addr]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(scanner.Text())); err == nil {
+			exits[addr.Unmap()] = true
+		}
+	}
+	return exits, scanner.Err()
+}
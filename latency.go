@@ -0,0 +1,28 @@
+package testingrelay
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// setupLatency holds back OK, EVENT and EOSE messages by latency plus a random
+// jitter of up to jitter, the way a distant or overloaded relay would. Messages
+// keep their order, so a short draw can still wait on a long one ahead of it.
+func setupLatency(wire *wireServer, latency, jitter time.Duration, logger *Logger) {
+	latency, jitter = max(0, latency), max(0, jitter)
+	if latency == 0 && jitter == 0 {
+		return
+	}
+
+	wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+		switch msg.Label() {
+		case "OK", "EVENT", "EOSE":
+			msg.latency = latency
+			if jitter > 0 {
+				msg.latency += rand.N(jitter)
+			}
+		}
+	})
+
+	logger.Info("Injecting %s latency with up to %s jitter into OK, EVENT and EOSE", latency, jitter)
+}
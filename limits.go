@@ -0,0 +1,62 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Limits bound what a single client may use. Zero means no limit.
+type Limits struct {
+	ConnsPerIP    int
+	Subscriptions int
+	Filters       int
+	FilterLimit   int
+}
+
+// setupLimits enforces limits. Connections past the per-IP maximum are
+// refused with 429 before the websocket upgrade; REQs that would exceed the
+// others are answered with CLOSED.
+func setupLimits(relay *khatru.Relay, wire *wireServer, limits Limits) {
+	if max := limits.ConnsPerIP; max > 0 {
+		relay.RejectConnection = append(relay.RejectConnection, func(r *http.Request) bool {
+			ip := khatru.GetIPFromRequest(r)
+			open := 0
+			for _, conn := range wire.Conns() {
+				if khatru.GetIPFromRequest(conn.request) == ip {
+					open++
+				}
+			}
+			return open >= max
+		})
+	}
+
+	if limits.Subscriptions <= 0 && limits.Filters <= 0 && limits.FilterLimit <= 0 {
+		return
+	}
+
+	relay.RejectFilter = append(relay.RejectFilter, func(ctx context.Context, filter nostr.Filter) (bool, string) {
+		if max := limits.FilterLimit; max > 0 && filter.Limit > max {
+			return true, fmt.Sprintf("invalid: filter limit %d exceeds the maximum of %d", filter.Limit, max)
+		}
+
+		conn := getWireConn(khatru.GetConnection(ctx))
+		if conn == nil {
+			return false, ""
+		}
+
+		// the wire layer has already counted the REQ being checked
+		if max := limits.Subscriptions; max > 0 && len(conn.Subscriptions()) > max {
+			return true, fmt.Sprintf("blocked: too many open subscriptions, the maximum is %d", max)
+		}
+		if max := limits.Filters; max > 0 {
+			if sub, ok := conn.Subscription(subscriptionID(ctx)); ok && len(sub.Filters) > max {
+				return true, fmt.Sprintf("invalid: REQ has %d filters, the maximum is %d", len(sub.Filters), max)
+			}
+		}
+		return false, ""
+	})
+}
@@ -0,0 +1,117 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Listeners are where the relay is served (LISTEN_*). Public is the PORT
+// listener everyone connects to, with TLS if set up. Unix is the path of a
+// Unix socket serving everything, for local tooling. Admin is a separate
+// loopback address for the admin API, metrics, debug endpoints, exports and
+// firehoses, which the other TCP listener then stops serving; the admin
+// token still applies.
+type Listeners struct {
+	Public bool   `envconfig:"PUBLIC" default:"true"`
+	Unix   string `envconfig:"UNIX"`
+	Admin  string `envconfig:"ADMIN"`
+}
+
+func (l Listeners) Validate() error {
+	if !l.Public && l.Unix == "" && l.Admin == "" {
+		return fmt.Errorf("at least one of LISTEN_PUBLIC, LISTEN_UNIX and LISTEN_ADMIN must be set")
+	}
+	if l.Admin == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(l.Admin)
+	if err != nil {
+		return fmt.Errorf("invalid LISTEN_ADMIN: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("LISTEN_ADMIN must listen on localhost")
+	}
+	return nil
+}
+
+// listenerRole is what a listener serves.
+type listenerRole int
+
+const (
+	roleAll listenerRole = iota
+	rolePublic
+	roleAdmin
+)
+
+type listenerRoleKey struct{}
+
+// adminSegments are the path segments of the admin routes, under any
+// virtual relay's path.
+var adminSegments = []string{"admin", "metrics", "debug", "dashboard", "export", "import", "firehose", "firehose.jsonl", "stats"}
+
+func isAdminPath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if contains(adminSegments, segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleRouter serves on each listener the routes of its role. Requests that
+// didn't come through a listener, like on a test server, get everything.
+func roleRouter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, _ := r.Context().Value(listenerRoleKey{}).(listenerRole)
+		admin := isAdminPath(r.URL.Path)
+		if (role == rolePublic && admin) || (role == roleAdmin && !admin) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connRole tags each connection with the role of its listener: the admin
+// one, Unix sockets serving everything, and the public one, which serves
+// everything but the admin routes when there is an admin listener.
+func (r *Relay) connRole(ctx context.Context, c net.Conn) context.Context {
+	role := roleAll
+	switch {
+	case c.LocalAddr().Network() == "unix":
+	case r.adminLis != nil && c.LocalAddr().String() == r.adminLis.Addr().String():
+		role = roleAdmin
+	case r.adminLis != nil:
+		role = rolePublic
+	}
+	return context.WithValue(ctx, listenerRoleKey{}, role)
+}
+
+// listenUnix listens on the socket at path, replacing a stale one left by a
+// relay that didn't shut down.
+func listenUnix(ctx context.Context, path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		os.Remove(path)
+	}
+	return new(net.ListenConfig).Listen(ctx, "unix", path)
+}
+
+// serveListener serves lis in the background, reporting failures on
+// r.failed.
+func (r *Relay) serveListener(lis net.Listener, serve func() error) {
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.logger.Error("Server on %s failed: %v", lis.Addr(), err)
+			select {
+			case r.failed <- err:
+			default:
+			}
+		}
+	}()
+}
@@ -0,0 +1,111 @@
+package testingrelay
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// LiveConfig holds the configuration currently in effect. Updates swap in a
+// modified copy, so readers always get a consistent snapshot without locking.
+type LiveConfig struct {
+	mu      sync.Mutex // serializes updates
+	current atomic.Pointer[RelayConfig]
+}
+
+func NewLiveConfig(cfg RelayConfig) *LiveConfig {
+	live := &LiveConfig{}
+	live.current.Store(&cfg)
+	return live
+}
+
+// Load returns the current configuration. It must be treated as read-only.
+func (l *LiveConfig) Load() *RelayConfig {
+	return l.current.Load()
+}
+
+// Update applies fn to a copy of the current configuration and makes it
+// current, unless fn returns an error.
+func (l *LiveConfig) Update(fn func(cfg *RelayConfig) error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := *l.current.Load()
+	if err := fn(&next); err != nil {
+		return err
+	}
+	l.current.Store(&next)
+	return nil
+}
+
+// Tunables are the settings that can be changed at runtime without a restart.
+type Tunables struct {
+	AllowedKinds     []int      `json:"allowed_kinds"`
+	WhitelistPubkeys []string   `json:"whitelist_pubkeys"`
+	MaxContentLength int        `json:"max_content_length"`
+	MaxEventTags     int        `json:"max_event_tags"`
+	KindLimits       KindLimits `json:"kind_limits"`
+	MinPowDifficulty int        `json:"min_pow_difficulty"`
+	ReadOnly         bool       `json:"read_only"`
+	Blackhole        string     `json:"blackhole"`
+	TimeTravel       int64      `json:"time_travel"`
+}
+
+func (cfg *RelayConfig) Tunables() Tunables {
+	return Tunables{
+		AllowedKinds:     cfg.AllowedKinds,
+		WhitelistPubkeys: cfg.WhitelistPubkeys,
+		MaxContentLength: cfg.MaxContentLength,
+		MaxEventTags:     cfg.MaxEventTags,
+		KindLimits:       cfg.KindLimits,
+		MinPowDifficulty: cfg.MinPowDifficulty,
+		ReadOnly:         cfg.ReadOnly,
+		Blackhole:        cfg.Blackhole,
+		TimeTravel:       cfg.TimeTravel,
+	}
+}
+
+func (cfg *RelayConfig) SetTunables(t Tunables) {
+	cfg.AllowedKinds = t.AllowedKinds
+	cfg.WhitelistPubkeys = t.WhitelistPubkeys
+	cfg.MaxContentLength = t.MaxContentLength
+	cfg.MaxEventTags = t.MaxEventTags
+	cfg.KindLimits = t.KindLimits
+	cfg.MinPowDifficulty = t.MinPowDifficulty
+	cfg.ReadOnly = t.ReadOnly
+	cfg.Blackhole = t.Blackhole
+	cfg.TimeTravel = t.TimeTravel
+}
+
+func (t Tunables) Validate() error {
+	for _, pubkey := range t.WhitelistPubkeys {
+		if !isHexKey(pubkey) {
+			return fmt.Errorf("invalid pubkey %q, expected 64 hex characters", pubkey)
+		}
+	}
+	if t.MaxContentLength < 0 || t.MaxEventTags < 0 || t.MinPowDifficulty < 0 {
+		return fmt.Errorf("size and pow limits must not be negative")
+	}
+	for kind, limit := range t.KindLimits {
+		if limit.MaxContentLength < 0 || limit.MaxEventTags < 0 || limit.EventsPerMin < 0 {
+			return fmt.Errorf("limits for kind %d must not be negative", kind)
+		}
+	}
+	if err := validateBlackhole(t.Blackhole); err != nil {
+		return err
+	}
+	if t.TimeTravel < 0 {
+		return fmt.Errorf("time travel must be a Unix timestamp, or 0 for none")
+	}
+	return nil
+}
+
+// isHexKey reports whether s looks like a hex-encoded 32-byte key or id.
+func isHexKey(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
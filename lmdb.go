@@ -0,0 +1,64 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var errMapFull = errors.New("error: storage is full")
+
+// mapFullStore handles an lmdb map that filled up: writes are refused with a
+// clear message instead of the raw MDB_MAP_FULL error, and the condition is
+// logged once rather than for every event. Deleting events frees pages, so
+// writes resume on their own once something was deleted or the relay was
+// restarted with a bigger LMDB_MAP_SIZE.
+type mapFullStore struct {
+	eventstore.Store
+	logger *Logger
+	full   atomic.Bool
+}
+
+// guardMapFull wraps lmdb stores and returns the others unchanged.
+func guardMapFull(store eventstore.Store, logger *Logger) eventstore.Store {
+	if _, ok := store.(*lmdb.LMDBBackend); !ok {
+		return store
+	}
+	return &mapFullStore{Store: store, logger: logger}
+}
+
+func (s *mapFullStore) check(err error) error {
+	if err == nil || !strings.Contains(err.Error(), "MDB_MAP_FULL") {
+		return err
+	}
+	if !s.full.Swap(true) {
+		s.logger.Error("The LMDB map is full, refusing writes until events are deleted or LMDB_MAP_SIZE is raised")
+	}
+	return errMapFull
+}
+
+func (s *mapFullStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	return count.Wrapper{Store: s.Store}.CountEvents(ctx, filter)
+}
+
+func (s *mapFullStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	return s.check(s.Store.SaveEvent(ctx, event))
+}
+
+func (s *mapFullStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	return s.check(s.Store.ReplaceEvent(ctx, event))
+}
+
+func (s *mapFullStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.check(s.Store.DeleteEvent(ctx, event))
+	if err == nil && s.full.Swap(false) {
+		s.logger.Info("Space was freed in the LMDB map, accepting writes again")
+	}
+	return err
+}
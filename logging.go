@@ -0,0 +1,147 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Logger writes leveled logs as text or JSON lines (LOG_FORMAT). The printf
+// style methods are for plain messages; Log takes slog key/value pairs for
+// anything worth querying, like connection and event ids.
+type Logger struct {
+	slog  *slog.Logger
+	level *slog.LevelVar
+}
+
+func NewLogger(w io.Writer, format, level string) (*Logger, error) {
+	l := &Logger{level: new(slog.LevelVar)}
+	if err := l.SetLevel(level); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: l.level}
+	switch strings.ToLower(format) {
+	case "text":
+		l.slog = slog.New(slog.NewTextHandler(w, opts))
+	case "json":
+		l.slog = slog.New(slog.NewJSONHandler(w, opts))
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+	return l, nil
+}
+
+// With returns a logger that adds args, slog key/value pairs, to every line.
+// It shares the level with l.
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{slog: l.slog.With(args...), level: l.level}
+}
+
+// SetLevel changes the minimum level logged, see NewLogger.
+func (l *Logger) SetLevel(level string) error {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+	l.level.Set(parsed)
+	return nil
+}
+
+// logLevel is LOG_LEVEL, or debug when DEBUG is set, which predates it.
+func (cfg *RelayConfig) logLevel() string {
+	if cfg.Debug {
+		return "debug"
+	}
+	return cfg.LogLevel
+}
+
+func (l *Logger) Info(format string, v ...interface{}) {
+	l.slog.Info(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Debug(format string, v ...interface{}) {
+	if l.slog.Enabled(context.Background(), slog.LevelDebug) {
+		l.slog.Debug(fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *Logger) Error(format string, v ...interface{}) {
+	l.slog.Error(fmt.Sprintf(format, v...))
+}
+
+// Log writes msg with structured attributes, given as slog key/value pairs.
+func (l *Logger) Log(level slog.Level, msg string, args ...any) {
+	l.slog.Log(context.Background(), level, msg, args...)
+}
+
+// StdLogger adapts the logger for libraries that want a *log.Logger.
+func (l *Logger) StdLogger(level slog.Level) *log.Logger {
+	return slog.NewLogLogger(l.slog.Handler(), level)
+}
+
+// connAttrs returns the connection id and remote address of the websocket
+// behind ctx, for structured log lines.
+func connAttrs(ctx context.Context) []any {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return nil
+	}
+
+	attrs := []any{"remote_addr", ws.Request.RemoteAddr}
+	if conn := getWireConn(ws); conn != nil {
+		attrs = append(attrs, "conn_id", conn.ID())
+	}
+	return attrs
+}
+
+func eventAttrs(event *nostr.Event) []any {
+	return []any{"event_id", event.ID, "kind", event.Kind, "pubkey", event.PubKey}
+}
+
+// attachLogging logs connections, stored events and rejections. It wraps the
+// existing RejectEvent and RejectFilter hooks, so it must run after all
+// policies are installed.
+func attachLogging(relay *khatru.Relay, logger *Logger) {
+	relay.Log = logger.StdLogger(slog.LevelWarn)
+
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		logger.Log(slog.LevelInfo, "connection opened", connAttrs(ctx)...)
+	})
+
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		logger.Log(slog.LevelInfo, "connection closed", connAttrs(ctx)...)
+	})
+
+	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
+		logger.Log(slog.LevelDebug, "event saved", append(connAttrs(ctx), eventAttrs(event)...)...)
+	})
+
+	for i, reject := range relay.RejectEvent {
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, event)
+			if rejected {
+				attrs := append(connAttrs(ctx), eventAttrs(event)...)
+				logger.Log(slog.LevelInfo, "event rejected", append(attrs, "reason", msg)...)
+			}
+			return rejected, msg
+		}
+	}
+
+	for i, reject := range relay.RejectFilter {
+		relay.RejectFilter[i] = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			rejected, msg := reject(ctx, filter)
+			if rejected {
+				attrs := append(connAttrs(ctx), "subscription", subscriptionID(ctx), "filter", filter.String())
+				logger.Log(slog.LevelInfo, "subscription rejected", append(attrs, "reason", msg)...)
+			}
+			return rejected, msg
+		}
+	}
+}
@@ -1,144 +1,254 @@
-package main
+package testingrelay
 
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/fiatjaf/eventstore/sqlite3"
 	"github.com/fiatjaf/khatru"
-	"github.com/joho/godotenv"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
 )
 
 type RelayConfig struct {
-	Port             int           `envconfig:"PORT" default:"3334"`
-	DBPath           string        `envconfig:"DB_PATH" default:"./khatru-sqlite.db"`
-	HTTPTimeout      time.Duration `envconfig:"HTTP_TIMEOUT" default:"30s"`
-	Name             string        `envconfig:"NAME" default:"Debug Khatru Relay"`
-	Description      string        `envconfig:"DESCRIPTION" default:"A configurable Nostr relay for debugging and testing"`
-	PubKey           string        `envconfig:"PUBKEY"`
-	AllowedKinds     []int         `envconfig:"ALLOWED_KINDS"`
-	WhitelistPubkeys []string      `envconfig:"WHITELIST_PUBKEYS"`
-	Debug            bool          `envconfig:"DEBUG" default:"false"`
+	Port              int              `envconfig:"PORT" default:"3334"`
+	GRPCPort          int              `envconfig:"GRPC_PORT"`
+	GRPCHost          string           `envconfig:"GRPC_HOST" default:"127.0.0.1"`
+	Listen            Listeners        `envconfig:"LISTEN"`
+	DBBackend         string           `envconfig:"DB_BACKEND" default:"sqlite3"`
+	DBPath            string           `envconfig:"DB_PATH" default:"./khatru-sqlite.db"`
+	DatabaseURL       string           `envconfig:"DATABASE_URL"`
+	LMDBMapSize       int64            `envconfig:"LMDB_MAP_SIZE"`
+	Postgres          PostgresPool     `envconfig:"PG"`
+	Ephemeral         bool             `envconfig:"EPHEMERAL" default:"false"`
+	HTTPTimeout       time.Duration    `envconfig:"HTTP_TIMEOUT" default:"30s"`
+	TrustedProxies    []string         `envconfig:"TRUSTED_PROXIES"`
+	DrainTimeout      time.Duration    `envconfig:"DRAIN_TIMEOUT" default:"10s"`
+	TLS               TLSSettings      `envconfig:"TLS"`
+	Compression       bool             `envconfig:"COMPRESSION" default:"true"`
+	WebSocket         WireLimits       `envconfig:"WS"`
+	SigVerify         SigVerify        `envconfig:"SIG_VERIFY"`
+	SlowReader        SlowReader       `envconfig:"SLOW_READER"`
+	Throttle          Throttle         `envconfig:"THROTTLE"`
+	NIP46             NIP46Settings    `envconfig:"NIP46"`
+	Prefixes          Prefixes         `envconfig:"PREFIXES"`
+	Negentropy        bool             `envconfig:"NEGENTROPY" default:"true"`
+	CountMode         string           `envconfig:"COUNT_MODE" default:"exact"`
+	Name              string           `envconfig:"NAME" default:"Debug Khatru Relay"`
+	Description       string           `envconfig:"DESCRIPTION" default:"A configurable Nostr relay for debugging and testing"`
+	PubKey            string           `envconfig:"PUBKEY"`
+	Contact           string           `envconfig:"CONTACT"`
+	Icon              string           `envconfig:"ICON"`
+	Banner            string           `envconfig:"BANNER"`
+	PostingPolicy     string           `envconfig:"POSTING_POLICY"`
+	Shards            Shards           `ignored:"true"`
+	InfoRejections    bool             `envconfig:"INFO_REJECTIONS"`
+	AllowedKinds      []int            `envconfig:"ALLOWED_KINDS"`
+	WhitelistPubkeys  []string         `envconfig:"WHITELIST_PUBKEYS"`
+	Whitelist         PubkeySources    `envconfig:"WHITELIST"`
+	WoT               WoTSettings      `envconfig:"WOT"`
+	Gossip            Gossip           `envconfig:"GOSSIP"`
+	Bans              BanSettings      `envconfig:"BAN"`
+	Audit             AuditSettings    `envconfig:"AUDIT"`
+	Blossom           BlossomSettings  `envconfig:"BLOSSOM"`
+	Payment           PaySettings      `envconfig:"PAY"`
+	MaxContentLength  int              `envconfig:"MAX_CONTENT_LENGTH"`
+	MaxEventTags      int              `envconfig:"MAX_EVENT_TAGS"`
+	KindLimits        KindLimits       `envconfig:"KIND_POLICY"`
+	MinPowDifficulty  int              `envconfig:"MIN_POW_DIFFICULTY"`
+	ReadOnly          bool             `envconfig:"READ_ONLY"`
+	Blackhole         string           `envconfig:"BLACKHOLE"`
+	BlackholePath     string           `envconfig:"BLACKHOLE_PATH" default:"./blackhole.db"`
+	Validation        EventChecks      `envconfig:"VALIDATION"`
+	MaxFutureSeconds  int              `envconfig:"MAX_FUTURE_SECONDS"`
+	MaxPastSeconds    int              `envconfig:"MAX_PAST_SECONDS"`
+	ClockOffset       int              `envconfig:"CLOCK_OFFSET_SECONDS"`
+	TimeTravel        int64            `envconfig:"TIME_TRAVEL"`
+	MaxConnsPerIP     int              `envconfig:"MAX_CONNECTIONS_PER_IP"`
+	AllowedIPs        []string         `envconfig:"ALLOWED_IPS"`
+	AllowedCIDRs      []string         `envconfig:"ALLOWED_CIDRS"`
+	IP                IPPolicy         `envconfig:"IP"`
+	MaxSubscriptions  int              `envconfig:"MAX_SUBSCRIPTIONS"`
+	MaxFilters        int              `envconfig:"MAX_FILTERS"`
+	MaxLimit          int              `envconfig:"MAX_LIMIT"`
+	QueryCache        QueryCache       `envconfig:"QUERY_CACHE"`
+	FilterRules       FilterRules      `envconfig:"FILTER"`
+	Spam              SpamSettings     `envconfig:"SPAM"`
+	QuotaEvents       int64            `envconfig:"QUOTA_EVENTS"`
+	QuotaBytes        int64            `envconfig:"QUOTA_BYTES"`
+	WriteBatch        WriteBatch       `envconfig:"WRITE_BATCH"`
+	SQLite            SQLiteTuning     `envconfig:"SQLITE"`
+	Backup            BackupSettings   `envconfig:"BACKUP"`
+	Webhooks          Webhooks         `envconfig:"WEBHOOK"`
+	ExpirySweep       time.Duration    `envconfig:"EXPIRATION_SWEEP_INTERVAL" default:"1m"`
+	Prune             PruneSettings    `envconfig:"PRUNE"`
+	CompactOnStart    bool             `envconfig:"COMPACT_ON_START"`
+	RejectDeleted     bool             `envconfig:"REJECT_DELETED_EVENTS" default:"true"`
+	ScenarioFile      string           `envconfig:"SCENARIO_FILE"`
+	WritePolicy       string           `envconfig:"WRITE_POLICY_PLUGIN"`
+	PolicyWasm        string           `envconfig:"POLICY_WASM_PATH"`
+	Upstream          Upstreams        `envconfig:"UPSTREAM"`
+	Replica           Replication      `envconfig:"REPLICA"`
+	Cluster           ClusterSettings  `envconfig:"CLUSTER"`
+	Dispatch          DispatchSettings `envconfig:"DISPATCH"`
+	DVM               DVMSettings      `envconfig:"DVM"`
+	Downstream        Downstreams      `envconfig:"DOWNSTREAM"`
+	ServiceURL        string           `envconfig:"SERVICE_URL"`
+	AuthRequiredWrite bool             `envconfig:"AUTH_REQUIRED_WRITE" default:"false"`
+	AuthRequiredRead  bool             `envconfig:"AUTH_REQUIRED_READ" default:"false"`
+	PrivateDMs        bool             `envconfig:"PRIVATE_DMS" default:"true"`
+	GiftWrap          GiftWrapSettings `envconfig:"GIFT_WRAP"`
+	AdminToken        string           `envconfig:"ADMIN_TOKEN"`
+	AdminPubkeys      []string         `envconfig:"ADMIN_PUBKEYS"`
+	RateLimit         RateLimits       `envconfig:"RATE_LIMIT"`
+	Chaos             ChaosSettings    `envconfig:"CHAOS"`
+	InjectLatency     int              `envconfig:"INJECT_LATENCY_MS"`
+	InjectJitter      int              `envconfig:"INJECT_JITTER_MS"`
+	RecordFile        string           `envconfig:"RECORD_FILE"`
+	TraceProtocol     bool             `envconfig:"TRACE_PROTOCOL"`
+	TraceProtocolDir  string           `envconfig:"TRACE_PROTOCOL_DIR"`
+	TraceFrameSize    int              `envconfig:"TRACE_PROTOCOL_MAX_FRAME" default:"4096"`
+	TraceConnBytes    int64            `envconfig:"TRACE_PROTOCOL_MAX_BYTES" default:"10485760"`
+	Pprof             PprofSettings    `envconfig:"PPROF"`
+	ConfigWatch       time.Duration    `envconfig:"CONFIG_WATCH_INTERVAL" default:"2s"`
+	LogFormat         string           `envconfig:"LOG_FORMAT" default:"text"`
+	LogLevel          string           `envconfig:"LOG_LEVEL" default:"info"`
+	Debug             bool             `envconfig:"DEBUG" default:"false"`
 }
 
-type Logger struct {
-	debug bool
-}
-
-func NewLogger(debug bool) *Logger {
-	return &Logger{debug: debug}
-}
+// ValidateEvent checks if an event meets the relay's requirements
+func (cfg *RelayConfig) ValidateEvent(event *nostr.Event) (reject bool, msg string) {
 
-func (l *Logger) Info(format string, v ...interface{}) {
-	log.Printf("[INFO] "+format, v...)
-}
+	if cfg.ReadOnly {
+		return true, "blocked: relay is read-only"
+	}
 
-func (l *Logger) Debug(format string, v ...interface{}) {
-	if l.debug {
-		log.Printf("[DEBUG] "+format, v...)
+	if len(cfg.AllowedKinds) > 0 && !contains(cfg.AllowedKinds, event.Kind) {
+		return true, fmt.Sprintf("blocked: event kind %d not allowed, allowed kinds: %v", event.Kind, cfg.AllowedKinds)
 	}
-}
 
-func (l *Logger) Error(format string, v ...interface{}) {
-	log.Printf("[ERROR] "+format, v...)
-}
+	maxContentLength, maxEventTags := cfg.MaxContentLength, cfg.MaxEventTags
+	if limit, ok := cfg.KindLimits[event.Kind]; ok {
+		if limit.MaxContentLength > 0 {
+			maxContentLength = limit.MaxContentLength
+		}
+		if limit.MaxEventTags > 0 {
+			maxEventTags = limit.MaxEventTags
+		}
+	}
 
-// ValidateEvent checks if an event meets the relay's requirements
-func (cfg *RelayConfig) ValidateEvent(event *nostr.Event) (reject bool, msg string) {
+	if maxContentLength > 0 && len(event.Content) > maxContentLength {
+		return true, fmt.Sprintf("invalid: content length %d exceeds the maximum of %d", len(event.Content), maxContentLength)
+	}
 
-	if len(cfg.AllowedKinds) > 0 && !contains(cfg.AllowedKinds, event.Kind) {
-		return true, fmt.Sprintf("blocked: event kind %d not allowed, allowed kinds: %v", event.Kind, cfg.AllowedKinds)
+	if maxEventTags > 0 && len(event.Tags) > maxEventTags {
+		return true, fmt.Sprintf("invalid: event has %d tags, the maximum is %d", len(event.Tags), maxEventTags)
 	}
 
-	if len(cfg.WhitelistPubkeys) > 0 && !contains(cfg.WhitelistPubkeys, event.PubKey) {
-		return true, "blocked: pubkey not in whitelist"
+	// only the difficulty committed to in the nonce tag counts, so a lucky
+	// id without one doesn't pass
+	if cfg.MinPowDifficulty > 0 {
+		if work := nip13.CommittedDifficulty(event); work < cfg.MinPowDifficulty {
+			return true, fmt.Sprintf("pow: difficulty %d is below the required %d, mine the id with a nonce tag committing to it", work, cfg.MinPowDifficulty)
+		}
 	}
 
 	return false, ""
 }
 
-func main() {
-	godotenv.Load()
+// Main runs the khatru-relay command with args, the arguments after the
+// program name, and returns its exit code.
+func Main(args []string) int {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return runCommand(args[0], args[1:])
+	}
+	// without a command the relay serves, as it always did
+	return runServe(args)
+}
+
+// runServe runs the relay until SIGINT or SIGTERM.
+func runServe(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file, overridden by RELAY_* env vars")
+	flags.Parse(args)
 
-	var cfg RelayConfig
-	if err := envconfig.Process("RELAY", &cfg); err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	cfg, extra, configFile, err := loadCommandConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 1
 	}
 
-	logger := NewLogger(cfg.Debug)
+	logger, err := NewLogger(os.Stderr, cfg.LogFormat, cfg.logLevel())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure logging: %v\n", err)
+		return 1
+	}
 	logger.Debug("Configuration loaded: %+v", cfg)
 
-	relay := khatru.NewRelay()
-	relay.Info.Name = cfg.Name
-	relay.Info.Description = cfg.Description
-	relay.Info.PubKey = cfg.PubKey
-
-	db := sqlite3.SQLite3Backend{DatabaseURL: cfg.DBPath}
-	if err := db.Init(); err != nil {
-		logger.Error("Failed to initialize database: %v", err)
-		return
+	relay, err := newRelay(cfg, extra, logger)
+	if err != nil {
+		logger.Error("%v", err)
+		return 1
 	}
 
-	relay.StoreEvent = append(relay.StoreEvent, db.SaveEvent)
-	relay.QueryEvents = append(relay.QueryEvents, db.QueryEvents)
-	relay.CountEvents = append(relay.CountEvents, db.CountEvents)
-	relay.DeleteEvent = append(relay.DeleteEvent, db.DeleteEvent)
-
-	relay.RejectEvent = append(relay.RejectEvent,
-		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
-			return cfg.ValidateEvent(event)
-		},
-	)
-
-	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
-		ws := khatru.GetConnection(ctx)
-		logger.Info("New connection from %s", ws.Request.RemoteAddr)
-	})
-
-	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
-		ws := khatru.GetConnection(ctx)
-		logger.Info("Disconnected from %s", ws.Request.RemoteAddr)
-	})
-
-	relay.OnEventSaved = append(relay.OnEventSaved, func(ctx context.Context, event *nostr.Event) {
-		if cfg.Debug {
-			logger.Debug("Event saved - Kind: %d, Pubkey: %s", event.Kind, event.PubKey)
-		}
-	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	mux := http.NewServeMux()
-	mux.Handle("/", handleRoot(relay, &cfg))
+	if err := relay.Start(ctx); err != nil {
+		logger.Error("Failed to listen: %v", err)
+		relay.close()
+		return 1
+	}
+	go watchConfig(ctx, relay.instances, configFile, cfg.ConfigWatch, logger)
 
-	addr := fmt.Sprintf(":%d", cfg.Port)
-	server := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  cfg.HTTPTimeout,
-		WriteTimeout: cfg.HTTPTimeout,
+	select {
+	case <-ctx.Done():
+	case <-relay.failed:
 	}
+	stop() // a second signal kills the process right away
 
-	logger.Info("Starting relay on %s", addr)
-	if err := server.ListenAndServe(); err != nil {
-		logger.Error("Server failed: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	if err := relay.Shutdown(ctx); err != nil {
+		logger.Error("Shutdown didn't finish in time: %v", err)
+		return 1
 	}
+	return 0
 }
 
-// ... rest of the code remains the same ...
-func handleRoot(relay *khatru.Relay, cfg *RelayConfig) http.HandlerFunc {
+// handleRoot serves the websocket, NIP-86 management requests, the NIP-11
+// document and a summary of the relay's settings.
+func handleRoot(relay *khatru.Relay, live *LiveConfig, wire *wireServer, management *Management, metrics *Metrics) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
-			relay.ServeHTTP(w, r)
+			wire.ServeHTTP(w, r)
 			return
 		}
 
+		if r.Header.Get("Content-Type") == "application/nostr+json+rpc" {
+			management.ServeHTTP(w, r)
+			return
+		}
+
+		cfg := live.Load()
+		if cfg.ClockOffset != 0 {
+			w.Header().Set("Date", cfg.now().UTC().Format(http.TimeFormat))
+		}
+
 		switch r.Header.Get("Accept") {
+		case "application/nostr+json":
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept")
+			w.Header().Set("Access-Control-Allow-Methods", "GET")
+			handleNIP11(w, r, relay, cfg, metrics)
+
 		case "application/json":
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
@@ -146,13 +256,27 @@ func handleRoot(relay *khatru.Relay, cfg *RelayConfig) http.HandlerFunc {
 				"description": cfg.Description,
 				"pubkey":      cfg.PubKey,
 				"config": map[string]interface{}{
-					"allowed_kinds":     cfg.AllowedKinds,
-					"whitelist_enabled": len(cfg.WhitelistPubkeys) > 0,
-					"debug_enabled":     cfg.Debug,
+					"allowed_kinds":      cfg.AllowedKinds,
+					"whitelist_enabled":  cfg.whitelistEnabled(),
+					"max_content_length": cfg.MaxContentLength,
+					"max_event_tags":     cfg.MaxEventTags,
+					"min_pow_difficulty": cfg.MinPowDifficulty,
+					"ephemeral":          cfg.Ephemeral,
+					"read_only":          cfg.ReadOnly,
+					"blackhole":          cfg.Blackhole,
+					"auth_required": map[string]bool{
+						"write": cfg.AuthRequiredWrite,
+						"read":  cfg.AuthRequiredRead,
+					},
+					"debug_enabled": cfg.Debug,
 				},
 			})
 
 		default:
+			scheme := "ws"
+			if r.TLS != nil {
+				scheme = "wss"
+			}
 			w.Header().Set("Content-Type", "text/html")
 			fmt.Fprintf(w, `
 				<html>
@@ -173,18 +297,21 @@ func handleRoot(relay *khatru.Relay, cfg *RelayConfig) http.HandlerFunc {
 							<pre>
 Allowed Event Kinds: %v
 Whitelist Enabled: %v
+Ephemeral Storage: %v
+Auth Required (write/read): %v/%v
 Debug Enabled: %v
 							</pre>
 
 							<h2>Connection Information</h2>
-							<p>Connect to this relay using: <code>ws://%s:%d/</code></p>
+							<p>Connect to this relay using: <code>%s://%s:%d/</code></p>
 						</div>
 					</body>
 				</html>
 			`, cfg.Name, cfg.Name, cfg.Description,
-				cfg.AllowedKinds, len(cfg.WhitelistPubkeys) > 0,
+				cfg.AllowedKinds, cfg.whitelistEnabled(),
+				cfg.Ephemeral, cfg.AuthRequiredWrite, cfg.AuthRequiredRead,
 				cfg.Debug,
-				r.Host, cfg.Port)
+				scheme, r.Host, cfg.Port)
 		}
 	}
 }
@@ -197,10 +324,3 @@ func contains[T comparable](slice []T, item T) bool {
 	}
 	return false
 }
-
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-}
@@ -0,0 +1,87 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// kindFileMetadata is the kind of NIP-94 file metadata.
+const kindFileMetadata = 1063
+
+// videoKinds are the kinds of NIP-71 normal and short videos, regular and
+// addressable.
+var videoKinds = []int{21, 22, 34235, 34236}
+
+var mimeType = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/[a-z0-9][a-z0-9!#$&^_.+-]*$`)
+
+// rejectMalformedMedia refuses file metadata without valid url, m and x
+// tags, and videos whose imeta tags lack them.
+func rejectMalformedMedia(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	switch {
+	case event.Kind == kindFileMetadata:
+		fields := make(map[string]string)
+		for _, name := range []string{"url", "m", "x"} {
+			if tag := event.Tags.GetFirst([]string{name, ""}); tag != nil {
+				fields[name] = (*tag)[1]
+			}
+		}
+		if problem := mediaProblem(fields); problem != "" {
+			return true, "invalid: file metadata " + problem
+		}
+
+	case contains(videoKinds, event.Kind):
+		found := 0
+		for i, tag := range event.Tags {
+			if len(tag) == 0 || tag[0] != "imeta" {
+				continue
+			}
+			found++
+			// entries are "name value" strings
+			fields := make(map[string]string)
+			for _, entry := range tag[1:] {
+				if name, value, ok := strings.Cut(entry, " "); ok {
+					if _, seen := fields[name]; !seen {
+						fields[name] = value
+					}
+				}
+			}
+			if problem := mediaProblem(fields); problem != "" {
+				return true, fmt.Sprintf("invalid: video imeta tag %d %s", i, problem)
+			}
+		}
+		if found == 0 {
+			return true, "invalid: video has no imeta tag describing its file"
+		}
+	}
+	return false, ""
+}
+
+// mediaProblem returns what is wrong with the url, m and x of a file, or
+// "" if nothing is.
+func mediaProblem(fields map[string]string) string {
+	switch {
+	case fields["url"] == "":
+		return "needs a url"
+	case !isHTTPURL(fields["url"]):
+		return fmt.Sprintf("url %q must be an http or https URL", fields["url"])
+	case fields["m"] == "":
+		return "needs an m (MIME type)"
+	case !mimeType.MatchString(fields["m"]):
+		return fmt.Sprintf("m %q must be a lowercase MIME type like video/mp4", fields["m"])
+	case fields["x"] == "":
+		return "needs an x (SHA-256 of the file)"
+	case !isHexKey(fields["x"]):
+		return fmt.Sprintf("x %q must be a SHA-256 in 64 hex characters", fields["x"])
+	}
+	return ""
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,324 @@
+package testingrelay
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects Prometheus metrics about connections, event ingestion and
+// storage, served on /metrics.
+type Metrics struct {
+	registry       *prometheus.Registry
+	connections    prometheus.Counter
+	eventsAccepted *prometheus.CounterVec
+	eventsRejected *prometheus.CounterVec
+	queryDuration  prometheus.Histogram
+	dbErrors       *prometheus.CounterVec
+	downstream     *prometheus.CounterVec
+	cacheLookups   *prometheus.CounterVec
+	webhooks       *prometheus.CounterVec
+	spamHits       *prometheus.CounterVec
+	spamVerdicts   *prometheus.CounterVec
+	sigVerify      prometheus.Histogram
+
+	// rejections by reason and by policy, kept apart from the counter for
+	// the dashboard and the status endpoints
+	mu         sync.Mutex
+	rejections map[string]int64
+	byPolicy   map[string]int64
+}
+
+func NewMetrics(wire *wireServer) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		connections: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "relay_connections_total",
+			Help: "Websocket connections opened since startup.",
+		}),
+		eventsAccepted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_events_accepted_total",
+			Help: "Events accepted by the relay.",
+		}, []string{"kind"}),
+		eventsRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_events_rejected_total",
+			Help: "Events rejected by the relay policies, by machine-readable reason prefix.",
+		}, []string{"reason", "kind"}),
+		queryDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "relay_query_duration_seconds",
+			Help:    "Time taken to stream the results of a database query.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_db_errors_total",
+			Help: "Database errors by operation.",
+		}, []string{"operation"}),
+		downstream: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_downstream_publishes_total",
+			Help: "Events forwarded to downstream relays, by relay and result (ok, duplicate, rejected, failed, dropped).",
+		}, []string{"relay", "result"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_query_cache_lookups_total",
+			Help: "Queries looked up in the query cache, by result (hit, miss).",
+		}, []string{"result"}),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_webhook_deliveries_total",
+			Help: "Webhook notifications by URL and result (ok, failed, dropped).",
+		}, []string{"url", "result"}),
+		spamHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_spam_heuristic_hits_total",
+			Help: "Events that tripped a spam heuristic, by heuristic (duplicate, links, symbols, burst).",
+		}, []string{"heuristic"}),
+		spamVerdicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "relay_spam_verdicts_total",
+			Help: "Events tripping spam heuristics, by verdict (accepted, shadowed, rejected).",
+		}, []string{"verdict"}),
+		sigVerify: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "relay_signature_verification_seconds",
+			Help:    "Time taken to verify an event signature.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 2, 14),
+		}),
+		rejections: make(map[string]int64),
+		byPolicy:   make(map[string]int64),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connections,
+		m.eventsAccepted,
+		m.eventsRejected,
+		m.queryDuration,
+		m.dbErrors,
+		m.downstream,
+		m.cacheLookups,
+		m.webhooks,
+		m.spamHits,
+		m.spamVerdicts,
+		m.sigVerify,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "relay_active_connections",
+			Help: "Websocket connections currently open.",
+		}, func() float64 {
+			return float64(len(wire.Conns()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "relay_outbound_queue_depth",
+			Help: "Messages waiting to be written, summed over all connections.",
+		}, func() float64 {
+			total := 0
+			for _, conn := range wire.Conns() {
+				total += conn.QueueDepth()
+			}
+			return float64(total)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "relay_outbound_queue_max_depth",
+			Help: "Messages waiting to be written on the most backed up connection.",
+		}, func() float64 {
+			deepest := 0
+			for _, conn := range wire.Conns() {
+				deepest = max(deepest, conn.QueueDepth())
+			}
+			return float64(deepest)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "relay_slow_reader_overflows_total",
+			Help: "Messages that found a connection's outbound queue full, handled by the SLOW_READER_POLICY.",
+		}, func() float64 {
+			return float64(wire.overflows.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "relay_active_subscriptions",
+			Help: "Subscriptions currently open across all connections.",
+		}, func() float64 {
+			total := 0
+			for _, conn := range wire.Conns() {
+				total += len(conn.Subscriptions())
+			}
+			return float64(total)
+		}),
+	)
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Attach installs the connection and event counters on the relay. It wraps the
+// existing RejectEvent hooks, so it must run after all policies are installed,
+// and counts their rejections under the names in policies, see policyNames.
+func (m *Metrics) Attach(relay *khatru.Relay, policies []string) {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		m.connections.Inc()
+	})
+
+	accepted := func(ctx context.Context, event *nostr.Event) {
+		m.eventsAccepted.WithLabelValues(strconv.Itoa(event.Kind)).Inc()
+	}
+	relay.OnEventSaved = append(relay.OnEventSaved, accepted)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, accepted)
+
+	for i, reject := range relay.RejectEvent {
+		policy := policies[i]
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			rejected, msg := reject(ctx, event)
+			if rejected {
+				reason := rejectionReason(msg)
+				m.eventsRejected.WithLabelValues(reason, strconv.Itoa(event.Kind)).Inc()
+
+				m.mu.Lock()
+				m.rejections[reason]++
+				m.byPolicy[policy]++
+				m.mu.Unlock()
+			}
+			return rejected, msg
+		}
+	}
+}
+
+// DownstreamPublish counts the outcome of forwarding an event to relay.
+func (m *Metrics) DownstreamPublish(relay, result string) {
+	m.downstream.WithLabelValues(relay, result).Inc()
+}
+
+// WebhookDelivery counts the outcome of a webhook notification to url.
+func (m *Metrics) WebhookDelivery(url, result string) {
+	m.webhooks.WithLabelValues(url, result).Inc()
+}
+
+// SpamVerdict counts an event that tripped the spam heuristics hits.
+func (m *Metrics) SpamVerdict(hits []string, verdict string) {
+	for _, heuristic := range hits {
+		m.spamHits.WithLabelValues(heuristic).Inc()
+	}
+	m.spamVerdicts.WithLabelValues(verdict).Inc()
+}
+
+// SignatureVerified records how long a signature verification took.
+func (m *Metrics) SignatureVerified(took time.Duration) {
+	m.sigVerify.Observe(took.Seconds())
+}
+
+// CacheLookup counts a query cache hit or miss.
+func (m *Metrics) CacheLookup(hit bool) {
+	if hit {
+		m.cacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		m.cacheLookups.WithLabelValues("miss").Inc()
+	}
+}
+
+// Rejections returns how many events were rejected for each reason prefix.
+func (m *Metrics) Rejections() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maps.Clone(m.rejections)
+}
+
+// RejectionCounts are the events rejected since startup, by reason prefix
+// and by the policy that rejected them.
+type RejectionCounts struct {
+	Total    int64            `json:"total"`
+	ByReason map[string]int64 `json:"by_reason"`
+	ByPolicy map[string]int64 `json:"by_policy"`
+}
+
+// RejectionCounts returns the rejections counted so far.
+func (m *Metrics) RejectionCounts() RejectionCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := RejectionCounts{ByReason: maps.Clone(m.rejections), ByPolicy: maps.Clone(m.byPolicy)}
+	for _, n := range m.rejections {
+		counts.Total += n
+	}
+	return counts
+}
+
+// rejectionReason extracts the NIP-01 machine-readable prefix of an OK message,
+// defaulting to "blocked" like khatru does for unprefixed messages.
+func rejectionReason(msg string) string {
+	if prefix, _, found := strings.Cut(msg, ": "); found && !strings.Contains(prefix, " ") {
+		return prefix
+	}
+	return "blocked"
+}
+
+// Store wraps an eventstore so query latency and database errors are recorded.
+func (m *Metrics) Store(store eventstore.Store) eventstore.Store {
+	return &instrumentedStore{Store: store, metrics: m}
+}
+
+type instrumentedStore struct {
+	eventstore.Store
+	metrics *Metrics
+}
+
+func (s *instrumentedStore) observeError(operation string, err error) {
+	if err != nil && err != eventstore.ErrDupEvent {
+		s.metrics.dbErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func (s *instrumentedStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.SaveEvent(ctx, event)
+	s.observeError("save", err)
+	return err
+}
+
+func (s *instrumentedStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.ReplaceEvent(ctx, event)
+	s.observeError("replace", err)
+	return err
+}
+
+func (s *instrumentedStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.DeleteEvent(ctx, event)
+	s.observeError("delete", err)
+	return err
+}
+
+func (s *instrumentedStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	total, err := count.Wrapper{Store: s.Store}.CountEvents(ctx, filter)
+	s.observeError("count", err)
+	return total, err
+}
+
+func (s *instrumentedStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	start := time.Now()
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil || ch == nil {
+		s.observeError("query", err)
+		return ch, err
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		defer func() { s.metrics.queryDuration.Observe(time.Since(start).Seconds()) }()
+
+		for event := range ch {
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,109 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Upstreams configures mirroring from remote relays (UPSTREAM_*). Without
+// filters, the latest upstreamLimit events of any kind are fetched and new
+// ones followed.
+type Upstreams struct {
+	Relays  []string   `envconfig:"RELAYS"`
+	Filters filterList `envconfig:"FILTERS"`
+}
+
+const upstreamLimit = 500
+
+// filterList decodes UPSTREAM_FILTERS, a JSON array of REQ filters.
+type filterList []nostr.Filter
+
+func (l *filterList) Decode(value string) error {
+	if err := json.Unmarshal([]byte(value), (*[]nostr.Filter)(l)); err != nil {
+		return fmt.Errorf("expected a JSON array of filters: %w", err)
+	}
+	return nil
+}
+
+// setupMirror subscribes to the upstream relays and stores the events they
+// send, so local clients see a copy of their data. The pool verifies
+// signatures and reconnects dropped relays; the relay's write policies are
+// bypassed. The subscriptions end when ctx is done.
+func setupMirror(ctx context.Context, relay *khatru.Relay, store eventstore.Store, settings Upstreams, logger *Logger) {
+	if len(settings.Relays) == 0 {
+		return
+	}
+
+	filters := settings.Filters
+	if len(filters) == 0 {
+		filters = filterList{{Limit: upstreamLimit}}
+	}
+
+	pool := nostr.NewSimplePool(ctx)
+	for _, filter := range filters {
+		go func() {
+			for ie := range pool.SubscribeMany(ctx, settings.Relays, filter) {
+				mirrorEvent(ctx, relay, store, ie, logger)
+			}
+		}()
+	}
+
+	logger.Info("Mirroring %d filters from %v", len(filters), settings.Relays)
+}
+
+// mirrorEvent stores an upstream event the way khatru stores published ones
+// and passes it on to the local subscriptions it matches.
+func mirrorEvent(ctx context.Context, relay *khatru.Relay, store eventstore.Store, ie nostr.RelayEvent, logger *Logger) {
+	if storeRemoteEvent(ctx, relay, store, ie.Event, ie.Relay.URL, logger) {
+		logger.Debug("Mirrored event %s (kind %d) from %s", ie.Event.ID, ie.Event.Kind, ie.Relay.URL)
+	}
+}
+
+// storeRemoteEvent stores an event fetched from source and broadcasts it,
+// reporting whether it was new. Deletion requests delete the events they
+// name by id, when they have the same author, as khatru does for published
+// ones.
+func storeRemoteEvent(ctx context.Context, relay *khatru.Relay, store eventstore.Store, event *nostr.Event, source string, logger *Logger) bool {
+	var err error
+	switch {
+	case nostr.IsEphemeralKind(event.Kind):
+	case nostr.IsRegularKind(event.Kind):
+		err = store.SaveEvent(ctx, event)
+	default:
+		err = store.ReplaceEvent(ctx, event)
+	}
+	if err == eventstore.ErrDupEvent {
+		return false
+	}
+	if err != nil {
+		logger.Error("Failed to store event %s from %s: %v", event.ID, source, err)
+		return false
+	}
+
+	if event.Kind == nostr.KindDeletion {
+		if ids := event.Tags.GetAll([]string{"e", ""}); len(ids) > 0 {
+			filter := nostr.Filter{Authors: []string{event.PubKey}}
+			for _, tag := range ids {
+				filter.IDs = append(filter.IDs, tag[1])
+			}
+			var targets []*nostr.Event
+			if ch, err := store.QueryEvents(ctx, filter); err == nil {
+				for target := range ch {
+					targets = append(targets, target)
+				}
+			}
+			for _, target := range targets {
+				if err := store.DeleteEvent(ctx, target); err != nil {
+					logger.Error("Failed to delete event %s requested by %s from %s: %v", target.ID, event.ID, source, err)
+				}
+			}
+		}
+	}
+	relay.BroadcastEvent(event)
+	return true
+}
@@ -0,0 +1,67 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+var errScanDone = errors.New("scan done")
+
+// setupNegentropy turns on khatru's NIP-77 support, so sync tools like
+// strfry sync and nak can reconcile event sets with the relay. Negentropy
+// filters go through the same RejectFilter and QueryEvents hooks as REQs, but
+// their context has no subscription id; hooks must use subscriptionID.
+//
+// The sqlite3 and postgres backends cap every query at their query limit, so
+// negentropy queries are paged to cover the whole set. It wraps the existing
+// QueryEvents hooks, so it must run right after attachStore.
+func setupNegentropy(relay *khatru.Relay, enabled bool) {
+	if !enabled {
+		return
+	}
+
+	relay.Negentropy = true
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = negentropyQuery(query)
+	}
+}
+
+func negentropyQuery(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if !eventstore.IsNegentropySession(ctx) {
+			return query(ctx, filter)
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+
+			sent := 0
+			scanQuery(ctx, query, filter, func(events []*nostr.Event) error {
+				for _, event := range events {
+					select {
+					case ch <- event:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if sent++; filter.Limit > 0 && sent >= filter.Limit {
+						return errScanDone
+					}
+				}
+				return nil
+			})
+		}()
+		return ch, nil
+	}
+}
+
+// subscriptionID is khatru.GetSubscriptionID without the panic on contexts
+// that have none, like those of negentropy sessions.
+func subscriptionID(ctx context.Context) (id string) {
+	defer func() { recover() }()
+	return khatru.GetSubscriptionID(ctx)
+}
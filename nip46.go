@@ -0,0 +1,112 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// NIP46Settings tune the handling of NIP-46 remote signing traffic
+// (NIP46_*), kinds 24133 and 24135. Those are ephemeral, so they are never
+// stored. With Priority their EVENT messages go ahead of whatever else is
+// queued for a connection and skip the injected latency. With Trace each
+// request is logged with how long its response took, paired by the pubkeys
+// of the client and the signer alone since the contents stay encrypted.
+type NIP46Settings struct {
+	Priority bool `envconfig:"PRIORITY" default:"true"`
+	Trace    bool `envconfig:"TRACE"`
+}
+
+// nip46Kinds are the kinds of NIP-46 messages.
+var nip46Kinds = []int{24133, 24135}
+
+// nip46Timeout is how long a request waits for its response before it is
+// logged as unanswered.
+const nip46Timeout = time.Minute
+
+// nip46Request is a request waiting for its response.
+type nip46Request struct {
+	id string
+	at time.Time
+}
+
+// nip46Tracer pairs requests with responses: a message from A to B answers
+// the oldest pending one from B to A.
+type nip46Tracer struct {
+	logger *Logger
+
+	mu      sync.Mutex
+	pending map[[2]string][]nip46Request
+}
+
+func setupNIP46(relay *khatru.Relay, wire *wireServer, settings NIP46Settings, logger *Logger) {
+	if settings.Priority {
+		wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+			env := msg.Envelope()
+			if len(env) < 3 || msg.Label() != "EVENT" {
+				return
+			}
+			var event struct {
+				Kind int `json:"kind"`
+			}
+			if json.Unmarshal(env[2], &event) == nil && slices.Contains(nip46Kinds, event.Kind) {
+				msg.urgent = true
+			}
+		})
+	}
+
+	if settings.Trace {
+		t := &nip46Tracer{logger: logger, pending: make(map[[2]string][]nip46Request)}
+		relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, t.observe)
+		logger.Info("Tracing NIP-46 request and response pairs")
+	}
+}
+
+func (t *nip46Tracer) observe(ctx context.Context, event *nostr.Event) {
+	if !slices.Contains(nip46Kinds, event.Kind) {
+		return
+	}
+	p := event.Tags.GetFirst([]string{"p", ""})
+	if p == nil {
+		return
+	}
+	from, to := event.PubKey, (*p)[1]
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+
+	if requests := t.pending[[2]string{to, from}]; len(requests) > 0 {
+		request := requests[0]
+		if len(requests) == 1 {
+			delete(t.pending, [2]string{to, from})
+		} else {
+			t.pending[[2]string{to, from}] = requests[1:]
+		}
+		t.logger.Info("NIP-46: %s answered %s in %s (request %s, response %s)", from, to, now.Sub(request.at).Round(time.Millisecond), request.id, event.ID)
+		return
+	}
+	t.pending[[2]string{from, to}] = append(t.pending[[2]string{from, to}], nip46Request{id: event.ID, at: now})
+	t.logger.Debug("NIP-46: %s asked %s (request %s)", from, to, event.ID)
+}
+
+// expire logs and forgets the requests that waited too long.
+func (t *nip46Tracer) expire(now time.Time) {
+	for pair, requests := range t.pending {
+		for len(requests) > 0 && now.Sub(requests[0].at) > nip46Timeout {
+			t.logger.Info("NIP-46: %s got no answer from %s within %s (request %s)", pair[0], pair[1], nip46Timeout, requests[0].id)
+			requests = requests[1:]
+		}
+		if len(requests) == 0 {
+			delete(t.pending, pair)
+		} else {
+			t.pending[pair] = requests
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package testingrelay
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip96APIPath is where the NIP-96 API is served.
+const nip96APIPath = "/api/v2/media"
+
+// nip96 serves the blobs of a blobStore over NIP-96, with NIP-98
+// authorization. Blobs are downloaded from the Blossom paths.
+type nip96 struct {
+	blobs      *blobStore
+	auth       bool
+	serviceURL string
+	logger     *Logger
+}
+
+// nip94Event describes an uploaded file the way NIP-96 answers uploads and
+// lists, as the unsigned parts of a NIP-94 event.
+type nip94Event struct {
+	Tags      nostr.Tags      `json:"tags"`
+	Content   string          `json:"content"`
+	CreatedAt nostr.Timestamp `json:"created_at"`
+}
+
+func setupNIP96(mux *http.ServeMux, blobs *blobStore, settings BlossomSettings, serviceURL string, logger *Logger) {
+	n := &nip96{blobs: blobs, auth: settings.Auth, serviceURL: serviceURL, logger: logger}
+	mux.Handle("/.well-known/nostr/nip96.json", blossomCORS(n.handleInfo))
+	mux.Handle(nip96APIPath, blossomCORS(n.handleMedia))
+	mux.Handle(nip96APIPath+"/{file}", blossomCORS(n.handleFile))
+	logger.Info("NIP-96 media API enabled at %s", nip96APIPath)
+}
+
+// nip96Error answers with a NIP-96 error.
+func nip96Error(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"status": "error", "message": message})
+}
+
+// handleInfo serves the server's NIP-96 document, with one free plan.
+func (n *nip96) handleInfo(w http.ResponseWriter, r *http.Request) {
+	base := httpBaseURL(n.serviceURL, r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"api_url":        base + nip96APIPath,
+		"download_url":   base,
+		"supported_nips": []int{94, 96, 98},
+		"tos_url":        "",
+		"content_types":  []string{},
+		"plans": map[string]interface{}{
+			"free": map[string]interface{}{
+				"name":                  "Free",
+				"is_nip98_required":     n.auth,
+				"max_byte_size":         n.blobs.maxSize,
+				"file_expiration":       []int{0, 0},
+				"media_transformations": map[string][]string{},
+			},
+		},
+	})
+}
+
+// authorize checks the NIP-98 authorization of r and returns its event, nil
+// when auth is off and r carries none.
+func (n *nip96) authorize(r *http.Request) (*nostr.Event, error) {
+	if !n.auth && r.Header.Get("Authorization") == "" {
+		return nil, nil
+	}
+	return httpAuthEvent(r, requestURL(n.serviceURL, r))
+}
+
+func (n *nip96) event(r *http.Request, hash string, meta *blobMeta) nip94Event {
+	tags := nostr.Tags{
+		{"url", blobURL(n.serviceURL, r, hash, meta.Type)},
+		{"ox", hash},
+		{"x", hash},
+		{"m", meta.Type},
+		{"size", strconv.FormatInt(meta.Size, 10)},
+	}
+	if meta.Alt != "" {
+		tags = append(tags, nostr.Tag{"alt", meta.Alt})
+	}
+	return nip94Event{Tags: tags, Content: meta.Caption, CreatedAt: nostr.Timestamp(meta.Uploaded)}
+}
+
+// handleMedia takes uploads as multipart forms on POST and lists the files
+// of the authorized pubkey on GET, page (from 0) by page of count.
+func (n *nip96) handleMedia(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		n.upload(w, r)
+	case http.MethodGet:
+		n.list(w, r)
+	default:
+		nip96Error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// upload stores the file field of the form, with its caption, alt and
+// content_type fields. A payload tag in the authorization must be the
+// file's hash.
+func (n *nip96) upload(w http.ResponseWriter, r *http.Request) {
+	evt, err := n.authorize(r)
+	if err != nil {
+		nip96Error(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// the form's other fields and boundaries get a megabyte on top
+	r.Body = http.MaxBytesReader(w, r.Body, n.blobs.maxSize+1<<20)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			nip96Error(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("files are limited to %d bytes", n.blobs.maxSize))
+			return
+		}
+		nip96Error(w, http.StatusBadRequest, "invalid multipart form: "+err.Error())
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		nip96Error(w, http.StatusBadRequest, "missing file field")
+		return
+	}
+	defer file.Close()
+
+	upload, err := n.blobs.receive(file)
+	if errors.Is(err, errBlobTooLarge) {
+		nip96Error(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("files are limited to %d bytes", n.blobs.maxSize))
+		return
+	} else if err != nil {
+		nip96Error(w, http.StatusBadRequest, "failed to read the file")
+		return
+	}
+	defer upload.Close()
+
+	var pubkey string
+	if evt != nil {
+		if payload := evt.Tags.GetFirst([]string{"payload", ""}); payload != nil && (*payload)[1] != upload.hash {
+			nip96Error(w, http.StatusUnauthorized, "invalid auth event payload hash")
+			return
+		}
+		pubkey = evt.PubKey
+	}
+
+	contentType := r.FormValue("content_type")
+	if contentType == "" {
+		contentType = header.Header.Get("Content-Type")
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = upload.sniff()
+	}
+	meta, created, err := n.blobs.store(upload, blobMeta{Type: contentType, Caption: r.FormValue("caption"), Alt: r.FormValue("alt")}, pubkey)
+	if err != nil {
+		n.logger.Error("NIP-96: failed to store %s: %v", upload.hash, err)
+		nip96Error(w, http.StatusInternalServerError, "failed to store the file")
+		return
+	}
+
+	n.logger.Debug("NIP-96: stored %s (%d bytes, %s)", upload.hash, meta.Size, meta.Type)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"status":      "success",
+		"message":     "Upload successful.",
+		"nip94_event": n.event(r, upload.hash, meta),
+	})
+}
+
+func (n *nip96) list(w http.ResponseWriter, r *http.Request) {
+	evt, err := n.authorize(r)
+	if err != nil {
+		nip96Error(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	query := r.URL.Query()
+	page, _ := strconv.Atoi(query.Get("page"))
+	count, err := strconv.Atoi(query.Get("count"))
+	if err != nil || count < 1 {
+		count = 10
+	}
+	page, count = max(page, 0), min(count, 100)
+
+	// without auth everyone sees every file
+	found, err := n.blobs.list(func(meta *blobMeta) bool {
+		return evt == nil || slices.Contains(meta.Owners, evt.PubKey)
+	})
+	if err != nil {
+		nip96Error(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	start := len(found)
+	if page <= len(found)/count {
+		start = page * count
+	}
+	files := []nip94Event{}
+	for _, blob := range found[start:min(start+count, len(found))] {
+		files = append(files, n.event(r, blob.hash, blob.meta))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"count": len(files),
+		"total": len(found),
+		"page":  page,
+		"files": files,
+	})
+}
+
+// handleFile serves the file in the path on GET and HEAD and deletes it on
+// DELETE, like the Blossom paths do.
+func (n *nip96) handleFile(w http.ResponseWriter, r *http.Request) {
+	hash, ok := parseBlobPath(r.PathValue("file"))
+	if !ok {
+		nip96Error(w, http.StatusNotFound, "file not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		serveBlob(w, r, n.blobs, hash)
+
+	case http.MethodDelete:
+		var pubkey string
+		if n.auth {
+			evt, err := httpAuthEvent(r, requestURL(n.serviceURL, r))
+			if err != nil {
+				nip96Error(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			pubkey = evt.PubKey
+		}
+
+		err := n.blobs.disown(hash, pubkey)
+		if errors.Is(err, os.ErrNotExist) {
+			nip96Error(w, http.StatusNotFound, "file not found")
+			return
+		} else if errors.Is(err, errNotBlobOwner) {
+			nip96Error(w, http.StatusForbidden, "file was not uploaded by "+pubkey)
+			return
+		} else if err != nil {
+			nip96Error(w, http.StatusInternalServerError, "failed to delete the file")
+			return
+		}
+		n.logger.Debug("NIP-96: deleted %s for %s", hash, pubkey)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "success", "message": "File deleted."})
+
+	default:
+		nip96Error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
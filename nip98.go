@@ -0,0 +1,180 @@
+package testingrelay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// nip98Window is how far the created_at of a NIP-98 event may be from now.
+const nip98Window = 60
+
+// usedAuthEvents are the ids of the NIP-98 events accepted within the window,
+// each of which authorizes a single request.
+var usedAuthEvents = &authReplays{seen: make(map[string]nostr.Timestamp)}
+
+type authReplays struct {
+	mu   sync.Mutex
+	seen map[string]nostr.Timestamp // id -> created_at
+}
+
+// use records evt as used and reports whether it wasn't already. Events
+// leave the set once their created_at is out of the window, when they would
+// be refused anyway.
+func (a *authReplays) use(evt *nostr.Event) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := nostr.Now()
+	for id, createdAt := range a.seen {
+		if createdAt < now-nip98Window {
+			delete(a.seen, id)
+		}
+	}
+	if _, ok := a.seen[evt.ID]; ok {
+		return false
+	}
+	a.seen[evt.ID] = evt.CreatedAt
+	return true
+}
+
+// requestBaseURL mirrors khatru's guess of the URL NIP-98 events must be
+// signed for: SERVICE_URL, or the scheme and host the request came in on.
+// trustProxies drops the X-Forwarded-Host and X-Forwarded-Proto headers of
+// peers that aren't trusted proxies, so only theirs are read.
+func requestBaseURL(serviceURL string, r *http.Request) string {
+	if serviceURL != "" {
+		return serviceURL
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		if host == "localhost" || strings.Contains(host, ":") {
+			proto = "http"
+		} else if _, err := strconv.Atoi(strings.ReplaceAll(host, ".", "")); err == nil {
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+	return proto + "://" + host
+}
+
+// requestURL is the absolute URL of r, query included, that NIP-98 events
+// for plain HTTP requests are signed for.
+func requestURL(serviceURL string, r *http.Request) string {
+	return requestBaseURL(serviceURL, r) + r.URL.RequestURI()
+}
+
+// authEvent decodes the event of an "Authorization: Nostr <base64 event>"
+// header and checks its signature.
+func authEvent(r *http.Request) (*nostr.Event, error) {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Nostr ")
+	if !found {
+		return nil, errors.New("missing auth")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid base64 auth")
+	}
+
+	var evt nostr.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		return nil, errors.New("invalid auth event json")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return nil, errors.New("invalid auth event")
+	}
+	return &evt, nil
+}
+
+// verifyNIP98 checks the authorization of a NIP-86 request carrying payload
+// like verifyHTTPAuth does, with url being the relay's, but always requiring
+// the payload tag. It returns the pubkey that signed it.
+func verifyNIP98(r *http.Request, payload []byte, url string) (pubkey string, err error) {
+	evt, err := httpAuthEvent(r, url)
+	if err != nil {
+		return "", err
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	if evt.Tags.GetFirst([]string{"payload", hex.EncodeToString(payloadHash[:])}) == nil {
+		return "", errors.New("invalid auth event payload hash")
+	}
+
+	return evt.PubKey, nil
+}
+
+// verifyHTTPAuth checks the NIP-98 authorization of a plain HTTP request: a
+// kind 27235 event signed within the last minute for the request's absolute
+// URL, query included, and its method. The body is read to check its hash
+// against the payload tag, which requests with a body must have, and then
+// handed on to the handler. It returns the pubkey that signed the event.
+func verifyHTTPAuth(r *http.Request, serviceURL string) (pubkey string, err error) {
+	evt, err := httpAuthEvent(r, requestURL(serviceURL, r))
+	if err != nil {
+		return "", err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", errors.New("failed to read body")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	payloadTag := evt.Tags.GetFirst([]string{"payload", ""})
+	if payloadTag == nil && len(body) > 0 {
+		return "", errors.New("auth event has no payload tag for the body")
+	}
+	if payloadTag != nil {
+		hash := sha256.Sum256(body)
+		if (*payloadTag)[1] != hex.EncodeToString(hash[:]) {
+			return "", errors.New("invalid auth event payload hash")
+		}
+	}
+
+	return evt.PubKey, nil
+}
+
+// httpAuthEvent is the NIP-98 event authorizing r for url, checked for its
+// kind, created_at, u and method tags but not its payload tag. An event is
+// only accepted once.
+func httpAuthEvent(r *http.Request, url string) (*nostr.Event, error) {
+	evt, err := authEvent(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if evt.Kind != nostr.KindHTTPAuth {
+		return nil, fmt.Errorf("auth event must be of kind %d", nostr.KindHTTPAuth)
+	}
+	if now := nostr.Now(); evt.CreatedAt < now-nip98Window || evt.CreatedAt > now+nip98Window {
+		return nil, errors.New("auth event is too old or in the future")
+	}
+	if uTag := evt.Tags.GetFirst([]string{"u", ""}); uTag == nil || (*uTag)[1] != url {
+		return nil, fmt.Errorf("invalid 'u' tag, expected %s", url)
+	}
+	if methodTag := evt.Tags.GetFirst([]string{"method", ""}); methodTag == nil || !strings.EqualFold((*methodTag)[1], r.Method) {
+		return nil, fmt.Errorf("invalid 'method' tag, expected %s", r.Method)
+	}
+	if !usedAuthEvents.use(evt) {
+		return nil, errors.New("auth event was already used")
+	}
+
+	return evt, nil
+}
@@ -0,0 +1,384 @@
+package testingrelay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+const (
+	// invoiceExpiry is how long an invoice can be paid.
+	invoiceExpiry = time.Hour
+	// invoicePoll is how often pending invoices are checked.
+	invoicePoll = 5 * time.Second
+	// maxPendingInvoices bounds the invoices watched at once.
+	maxPendingInvoices = 1000
+	// maxInvoicesPerIP bounds the unpaid invoices asked for from one IP, so
+	// no one can use up maxPendingInvoices.
+	maxInvoicesPerIP = 5
+)
+
+// PaySettings configure the paid relay mode. With a Backend set, pubkeys that
+// aren't whitelisted have to pay Amount sats at /invoice to publish for
+// Period. Key is the LNbits invoice key or the hex LND invoice macaroon.
+type PaySettings struct {
+	Backend  string        `envconfig:"BACKEND"`
+	URL      string        `envconfig:"URL"`
+	Key      string        `envconfig:"KEY"`
+	Insecure bool          `envconfig:"INSECURE_TLS"`
+	Amount   int64         `envconfig:"AMOUNT" default:"1000"`
+	Period   time.Duration `envconfig:"PERIOD" default:"720h"`
+	Path     string        `envconfig:"PATH" default:"./payments.db"`
+}
+
+func (s PaySettings) Enabled() bool {
+	return s.Backend != ""
+}
+
+func (s PaySettings) Validate() error {
+	if !s.Enabled() {
+		return nil
+	}
+	if s.URL == "" || s.Key == "" {
+		return fmt.Errorf("PAY_BACKEND needs PAY_URL and PAY_KEY")
+	}
+	if s.Amount <= 0 {
+		return fmt.Errorf("PAY_AMOUNT must be positive")
+	}
+	if s.Period <= 0 {
+		return fmt.Errorf("PAY_PERIOD must be positive")
+	}
+	return nil
+}
+
+// errTooManyInvoices refuses invoices past maxPendingInvoices or
+// maxInvoicesPerIP.
+var errTooManyInvoices = errors.New("too many unpaid invoices, pay or let them expire first")
+
+// Invoice is an invoice for access, as returned by /invoice.
+type Invoice struct {
+	Pubkey         string     `json:"pubkey"`
+	PaymentHash    string     `json:"payment_hash"`
+	PaymentRequest string     `json:"payment_request"`
+	Amount         int64      `json:"amount_sats"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	Paid           bool       `json:"paid"`
+	PaidUntil      *time.Time `json:"paid_until,omitempty"`
+
+	ip string // of the request for it
+}
+
+// Payments sells write access. Paying an invoice whitelists the pubkey for
+// the configured period, extending any time it has left. Paid pubkeys are
+// kept in an SQLite file of their own. Invoices are watched until ctx is
+// done.
+type Payments struct {
+	settings  PaySettings
+	node      lightningNode
+	db        *sql.DB
+	whitelist *Whitelist
+	relay     *khatru.Relay
+	logger    *Logger
+	ctx       context.Context
+	watchers  sync.WaitGroup
+
+	mu       sync.Mutex
+	paid     map[string]time.Time // pubkey -> paid until
+	pending  map[string]*Invoice  // by payment hash
+	creating map[*Invoice]bool    // asked of the node, without a hash yet
+}
+
+func OpenPayments(ctx context.Context, settings PaySettings, whitelist *Whitelist, logger *Logger) (*Payments, error) {
+	p := &Payments{
+		settings:  settings,
+		whitelist: whitelist,
+		logger:    logger,
+		ctx:       ctx,
+		paid:      make(map[string]time.Time),
+		pending:   make(map[string]*Invoice),
+		creating:  make(map[*Invoice]bool),
+	}
+	if !settings.Enabled() {
+		return p, nil
+	}
+
+	node, err := newLightningNode(settings)
+	if err != nil {
+		return nil, err
+	}
+	p.node = node
+
+	db, err := sql.Open("sqlite3", settings.Path)
+	if err != nil {
+		return nil, err
+	}
+	// an in-memory database only lives as long as its connection
+	db.SetMaxOpenConns(1)
+	p.db = db
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS paid (
+		pubkey TEXT PRIMARY KEY,
+		until INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating paid table in %s: %w", settings.Path, err)
+	}
+
+	rows, err := db.Query(`SELECT pubkey, until FROM paid WHERE until > ?`, time.Now().Unix())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pubkey string
+		var until int64
+		if err := rows.Scan(&pubkey, &until); err != nil {
+			db.Close()
+			return nil, err
+		}
+		p.paid[pubkey] = time.Unix(until, 0)
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// Close waits for the invoice watchers, which stop once the context of
+// OpenPayments is done, and closes the database.
+func (p *Payments) Close() error {
+	p.watchers.Wait()
+	if p.db == nil {
+		return nil
+	}
+	return p.db.Close()
+}
+
+// Attach makes paid pubkeys whitelisted and tells everyone else where to pay.
+// It must run before Whitelist.Attach so its rejection is the one sent.
+func (p *Payments) Attach(relay *khatru.Relay) {
+	if !p.settings.Enabled() {
+		return
+	}
+	p.relay = relay
+	p.whitelist.Allow(p.Paid)
+
+	relay.Info.Fees = &nip11.RelayFeesDocument{}
+	relay.Info.Fees.Subscription = append(relay.Info.Fees.Subscription, struct {
+		Amount int    `json:"amount"`
+		Unit   string `json:"unit"`
+		Period int    `json:"period"`
+	}{Amount: int(p.settings.Amount), Unit: "sats", Period: int(p.settings.Period.Seconds())})
+	relay.OverwriteRelayInformation = append(relay.OverwriteRelayInformation,
+		func(ctx context.Context, r *http.Request, info nip11.RelayInformationDocument) nip11.RelayInformationDocument {
+			info.PaymentsURL = p.invoiceURL(r)
+			return info
+		},
+	)
+
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if !p.whitelist.Allowed(event.PubKey) {
+			var r *http.Request
+			if ws := khatru.GetConnection(ctx); ws != nil {
+				r = ws.Request
+			}
+			return true, fmt.Sprintf("restricted: payment required, get an invoice at %s?pubkey=%s", p.invoiceURL(r), event.PubKey)
+		}
+		return false, ""
+	})
+}
+
+// invoiceURL is where invoices are handed out: under SERVICE_URL, or on the
+// server r came to. Without either, for events that didn't come over a
+// websocket, it is only the path.
+func (p *Payments) invoiceURL(r *http.Request) string {
+	if r == nil && p.relay.ServiceURL == "" {
+		return "/invoice"
+	}
+	return httpBaseURL(p.relay.ServiceURL, r) + "/invoice"
+}
+
+// Paid reports whether pubkey has paid access left.
+func (p *Payments) Paid(pubkey string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Now().Before(p.paid[pubkey])
+}
+
+// NewInvoice asks the node for an invoice for pubkey, requested from ip, and
+// watches it until it is paid or expires. A pubkey with an unpaid invoice gets
+// that one again. Invoices being created count against the caps too, so
+// parallel requests can't go over them.
+func (p *Payments) NewInvoice(ctx context.Context, pubkey, ip string) (Invoice, error) {
+	invoice := &Invoice{Pubkey: pubkey, Amount: p.settings.Amount, ip: ip}
+
+	p.mu.Lock()
+	fromIP := 0
+	for _, pending := range p.pending {
+		if pending.Paid || !time.Now().Before(pending.ExpiresAt) {
+			continue
+		}
+		if pending.Pubkey == pubkey {
+			p.mu.Unlock()
+			return *pending, nil
+		}
+		if pending.ip == ip {
+			fromIP++
+		}
+	}
+	for creating := range p.creating {
+		if creating.Pubkey == pubkey {
+			p.mu.Unlock()
+			return Invoice{}, errTooManyInvoices
+		}
+		if creating.ip == ip {
+			fromIP++
+		}
+	}
+	if len(p.pending)+len(p.creating) >= maxPendingInvoices || fromIP >= maxInvoicesPerIP {
+		p.mu.Unlock()
+		return Invoice{}, errTooManyInvoices
+	}
+	p.creating[invoice] = true
+	p.mu.Unlock()
+
+	memo := fmt.Sprintf("%s access for %s", p.relay.Info.Name, p.settings.Period)
+	hash, bolt11, err := p.node.CreateInvoice(ctx, p.settings.Amount, memo, invoiceExpiry)
+
+	p.mu.Lock()
+	delete(p.creating, invoice)
+	if err == nil {
+		invoice.PaymentHash = hash
+		invoice.PaymentRequest = bolt11
+		invoice.ExpiresAt = time.Now().Add(invoiceExpiry).Truncate(time.Second)
+		p.pending[hash] = invoice
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	p.watchers.Add(1)
+	go p.watch(invoice)
+	p.logger.Info("Invoice %s created for %s", hash, pubkey)
+	return *invoice, nil
+}
+
+// Invoice returns a snapshot of a pending or recently paid invoice.
+func (p *Payments) Invoice(hash string) (Invoice, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	invoice, ok := p.pending[hash]
+	if !ok {
+		return Invoice{}, false
+	}
+	return *invoice, true
+}
+
+// watch polls the node until the invoice is paid or expires, or the relay
+// shuts down, then keeps it around for status requests until it would have
+// expired.
+func (p *Payments) watch(invoice *Invoice) {
+	defer p.watchers.Done()
+	defer time.AfterFunc(time.Until(invoice.ExpiresAt), func() {
+		p.mu.Lock()
+		delete(p.pending, invoice.PaymentHash)
+		p.mu.Unlock()
+	})
+
+	for time.Now().Before(invoice.ExpiresAt) {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(invoicePoll):
+		}
+
+		ctx, cancel := context.WithTimeout(p.ctx, invoicePoll)
+		paid, err := p.node.InvoicePaid(ctx, invoice.PaymentHash)
+		cancel()
+		if p.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Error("Failed to check invoice %s: %v", invoice.PaymentHash, err)
+			continue
+		}
+		if paid {
+			p.credit(invoice)
+			return
+		}
+	}
+}
+
+// credit extends the pubkey's access by the paid period.
+func (p *Payments) credit(invoice *Invoice) {
+	p.mu.Lock()
+	until := p.paid[invoice.Pubkey]
+	if until.Before(time.Now()) {
+		until = time.Now()
+	}
+	until = until.Add(p.settings.Period).Truncate(time.Second)
+	p.paid[invoice.Pubkey] = until
+	invoice.Paid = true
+	invoice.PaidUntil = &until
+	p.mu.Unlock()
+
+	_, err := p.db.Exec(`INSERT INTO paid (pubkey, until) VALUES (?, ?)
+		ON CONFLICT (pubkey) DO UPDATE SET until = excluded.until`, invoice.Pubkey, until.Unix())
+	if err != nil {
+		p.logger.Error("Failed to save payment of %s: %v", invoice.Pubkey, err)
+	}
+	p.logger.Info("Invoice %s paid, %s may publish until %s", invoice.PaymentHash, invoice.Pubkey, until.Format(time.RFC3339))
+}
+
+// handleInvoice creates an invoice for ?pubkey= (hex or npub) at /invoice and
+// reports whether it was paid at /invoice/{hash}, for clients to poll.
+func handleInvoice(payments *Payments) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !payments.settings.Enabled() {
+			http.Error(w, "payments are not enabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		if hash := r.PathValue("hash"); hash != "" {
+			invoice, ok := payments.Invoice(hash)
+			if !ok {
+				http.Error(w, "unknown or expired invoice", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, invoice)
+			return
+		}
+
+		pubkey, err := parsePubkey(r.URL.Query().Get("pubkey"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// trustProxies has put the client behind any trusted proxy here,
+		// unlike the forwarding headers this can't be spoofed
+		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+		invoice, err := payments.NewInvoice(r.Context(), pubkey, ip)
+		if errors.Is(err, errTooManyInvoices) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, "failed to create invoice: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, invoice)
+	}
+}
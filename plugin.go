@@ -0,0 +1,217 @@
+package testingrelay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// pluginTimeout bounds how long a write policy plugin may take to answer.
+const pluginTimeout = 5 * time.Second
+
+// pluginRequest is the line sent to the plugin for every incoming event, in
+// the same format strfry uses.
+type pluginRequest struct {
+	Type       string       `json:"type"`
+	Event      *nostr.Event `json:"event"`
+	ReceivedAt int64        `json:"receivedAt"`
+	SourceType string       `json:"sourceType"`
+	SourceInfo string       `json:"sourceInfo"`
+}
+
+// pluginReply is the plugin's verdict on one event.
+type pluginReply struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Msg    string `json:"msg"`
+}
+
+// writePolicy runs a strfry-style write policy plugin: a long-running
+// executable that reads one JSON request per line on stdin and answers each
+// with a JSON line on stdout:
+//
+//	{"type": "new", "event": {...}, "receivedAt": 1700000000, "sourceType": "IP4", "sourceInfo": "1.2.3.4"}
+//	{"id": "<event id>", "action": "accept|reject|shadowReject", "msg": "..."}
+//
+// The plugin is started on the first event, restarted when it exits and
+// reloaded when the file changes. If it can't be run or doesn't answer in
+// time the event is rejected.
+type writePolicy struct {
+	path      string
+	blackhole *blackhole
+	logger    *Logger
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	replies chan []byte
+	modTime time.Time
+}
+
+// setupWritePolicy runs the plugin on every event. Shadow rejected events are
+// swallowed by blackhole, so they are answered with OK true but neither
+// stored nor broadcast.
+func setupWritePolicy(relay *khatru.Relay, blackhole *blackhole, path string, logger *Logger) {
+	if path == "" {
+		return
+	}
+
+	p := &writePolicy{path: path, blackhole: blackhole, logger: logger}
+	relay.RejectEvent = append(relay.RejectEvent, p.RejectEvent)
+
+	logger.Info("Write policy plugin enabled: %s", path)
+}
+
+func (p *writePolicy) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	reply, err := p.ask(event, khatru.GetIP(ctx))
+	if err != nil {
+		p.logger.Error("Write policy plugin failed: %v", err)
+		return true, "error: write policy plugin failed"
+	}
+
+	switch reply.Action {
+	case "accept":
+		return false, ""
+	case "reject":
+		if reply.Msg == "" {
+			return true, "blocked: rejected by write policy"
+		}
+		return true, nostr.NormalizeOKMessage(reply.Msg, "blocked")
+	case "shadowReject":
+		p.blackhole.swallow(event.ID)
+		return false, ""
+	default:
+		p.logger.Error("Write policy plugin returned unknown action %q for %s", reply.Action, event.ID)
+		return true, "error: write policy plugin failed"
+	}
+}
+
+// ask sends one event to the plugin and waits for its reply. Requests are
+// serialized since the plugin answers them in order.
+func (p *writePolicy) ask(event *nostr.Event, ip string) (pluginReply, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.ensureRunning(); err != nil {
+		return pluginReply{}, err
+	}
+
+	sourceType := "IP6"
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() != nil {
+		sourceType = "IP4"
+	}
+	line, err := json.Marshal(pluginRequest{
+		Type:       "new",
+		Event:      event,
+		ReceivedAt: time.Now().Unix(),
+		SourceType: sourceType,
+		SourceInfo: ip,
+	})
+	if err != nil {
+		return pluginReply{}, err
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		p.stop()
+		return pluginReply{}, fmt.Errorf("writing to plugin: %w", err)
+	}
+
+	timeout := time.NewTimer(pluginTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case data, ok := <-p.replies:
+			if !ok {
+				p.stop()
+				return pluginReply{}, errors.New("plugin exited")
+			}
+			var reply pluginReply
+			if err := json.Unmarshal(data, &reply); err != nil {
+				p.logger.Error("Write policy plugin sent invalid reply %q: %v", data, err)
+				continue
+			}
+			if reply.ID != event.ID {
+				p.logger.Error("Write policy plugin replied for %s while waiting for %s", reply.ID, event.ID)
+				continue
+			}
+			return reply, nil
+		case <-timeout.C:
+			p.stop()
+			return pluginReply{}, fmt.Errorf("no reply within %s", pluginTimeout)
+		}
+	}
+}
+
+// ensureRunning starts the plugin, or restarts it if the executable changed
+// since it was started.
+func (p *writePolicy) ensureRunning() error {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+
+	if p.cmd != nil {
+		if info.ModTime().Equal(p.modTime) {
+			return nil
+		}
+		p.logger.Info("Write policy plugin %s changed, restarting", p.path)
+		p.stop()
+	}
+
+	cmd := exec.Command(p.path)
+	cmd.Stderr = p.logger.StdLogger(slog.LevelWarn).Writer()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting plugin: %w", err)
+	}
+
+	replies := make(chan []byte)
+	go func() {
+		defer close(replies)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			replies <- append([]byte(nil), scanner.Bytes()...)
+		}
+	}()
+
+	p.cmd, p.stdin, p.replies, p.modTime = cmd, stdin, replies, info.ModTime()
+	return nil
+}
+
+// stop kills the plugin; the next event starts it again.
+func (p *writePolicy) stop() {
+	if p.cmd == nil {
+		return
+	}
+
+	cmd, replies := p.cmd, p.replies
+	p.stdin.Close()
+	cmd.Process.Kill()
+	go func() {
+		// drain so the reader goroutine can finish before Wait closes stdout
+		for range replies {
+		}
+		cmd.Wait()
+	}()
+
+	p.cmd, p.stdin, p.replies = nil, nil, nil
+}
@@ -0,0 +1,62 @@
+package testingrelay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// writeTestPlugin writes a write policy plugin answering every event with
+// action, and msg for rejections, and returns its path.
+func writeTestPlugin(t *testing.T, action, msg string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.sh")
+	script := `#!/bin/sh
+while read -r line; do
+	id=$(printf '%s' "$line" | sed -n 's/.*"id":"\([0-9a-f]*\)".*/\1/p')
+	printf '{"id":"%s","action":"` + action + `","msg":"` + msg + `"}\n' "$id"
+done
+`
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWritePolicy(t *testing.T) {
+	tests := []struct {
+		action   string
+		msg      string
+		accepted bool
+		stored   bool
+	}{
+		{action: "accept", accepted: true, stored: true},
+		{action: "reject", msg: "not today", accepted: false, stored: false},
+		{action: "shadowReject", accepted: true, stored: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			plugin := writeTestPlugin(t, tt.action, tt.msg)
+			_, url := serveTestRelay(t, func(cfg *RelayConfig) { cfg.WritePolicy = plugin })
+			conn := connect(t, url)
+
+			event := signedEvent(t, "", nostr.KindTextNote, "policy", nil)
+			refusal := publish(t, conn, event)
+			if tt.accepted && refusal != "" {
+				t.Fatalf("publish refused: %s", refusal)
+			}
+			if !tt.accepted && !strings.Contains(refusal, "blocked: "+tt.msg) {
+				t.Fatalf("publish got refusal %q, want a blocked rejection", refusal)
+			}
+
+			ids := queryIDs(t, conn, nostr.Filter{IDs: []string{event.ID}})
+			if stored := len(ids) == 1; stored != tt.stored {
+				t.Fatalf("event stored: %v, want %v", stored, tt.stored)
+			}
+		})
+	}
+}
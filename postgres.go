@@ -0,0 +1,55 @@
+package testingrelay
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/postgresql"
+)
+
+// PostgresPool sizes the connection pool of the postgres backend. Postgres
+// accepts 100 connections by default, so MaxOpenConns stays below it, and 0
+// lifts the limit. Zero lifetimes keep connections open for as long as
+// they're used.
+type PostgresPool struct {
+	MaxOpenConns    int           `envconfig:"MAX_OPEN_CONNS" default:"80"`
+	MaxIdleConns    int           `envconfig:"MAX_IDLE_CONNS" default:"2"`
+	ConnMaxLifetime time.Duration `envconfig:"CONN_MAX_LIFETIME"`
+	ConnMaxIdleTime time.Duration `envconfig:"CONN_MAX_IDLE_TIME"`
+}
+
+func (p PostgresPool) Validate() error {
+	if p.MaxOpenConns < 0 || p.MaxIdleConns < 0 || p.ConnMaxLifetime < 0 || p.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("PG_MAX_OPEN_CONNS, PG_MAX_IDLE_CONNS, PG_CONN_MAX_LIFETIME and PG_CONN_MAX_IDLE_TIME must not be negative")
+	}
+	return nil
+}
+
+// tunePostgres applies the pool settings to an initialized postgres store.
+// Initializing the backend already created or migrated its schema, which is
+// idempotent, so every start brings an existing database up to date. Other
+// backends are left alone.
+func tunePostgres(store eventstore.Store, pool PostgresPool, logger *Logger) {
+	backend, ok := store.(*postgresql.PostgresBackend)
+	if !ok {
+		return
+	}
+
+	backend.DB.SetMaxOpenConns(pool.MaxOpenConns)
+	backend.DB.SetMaxIdleConns(pool.MaxIdleConns)
+	backend.DB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	backend.DB.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+	logger.Info("Connected to postgres at %s, schema up to date, up to %d connections", redactURL(backend.DatabaseURL), pool.MaxOpenConns)
+}
+
+// redactURL hides the password of a connection URL for logs. Key=value
+// connection strings are hidden entirely.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return "(connection string)"
+	}
+	return u.Redacted()
+}
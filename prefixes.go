@@ -0,0 +1,94 @@
+package testingrelay
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// standardPrefixes are the machine-readable prefixes of NIP-01 OK and CLOSED
+// messages.
+var standardPrefixes = []string{
+	"duplicate", "pow", "blocked", "rate-limited", "invalid", "restricted",
+	"mute", "error", "auth-required", "unsupported", "payment-required",
+}
+
+// Prefixes maps machine-readable prefixes to the ones sent instead, so
+// clients can be tested against relays that categorize rejections their
+// own way.
+type Prefixes map[string]string
+
+// Decode parses PREFIXES, a comma-separated list of prefix:replacement
+// entries, e.g. "rate-limited:blocked,pow:invalid".
+func (p *Prefixes) Decode(value string) error {
+	prefixes := make(Prefixes)
+	for _, entry := range splitParams([]string{value}) {
+		from, to, found := strings.Cut(entry, ":")
+		if !found {
+			return fmt.Errorf("invalid prefix override %q, expected prefix:replacement", entry)
+		}
+		prefixes[from] = to
+	}
+	*p = prefixes
+	return nil
+}
+
+func (p Prefixes) Validate() error {
+	for from, to := range p {
+		if !contains(standardPrefixes, from) {
+			return fmt.Errorf("invalid PREFIXES entry %s:%s, expected one of %v to be replaced", from, to, standardPrefixes)
+		}
+		for _, prefix := range []string{from, to} {
+			if prefix == "" || strings.ContainsAny(prefix, ": ") {
+				return fmt.Errorf("invalid PREFIXES entry %s:%s, prefixes can't be empty or contain spaces or colons", from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// setupPrefixes makes every OK, CLOSED and NOTICE message sent start with a
+// machine-readable prefix, "error" for those that don't, and applies the
+// overrides. Policies and khatru already prefix their rejections; this
+// covers store errors and the notices khatru sends as they are.
+func setupPrefixes(wire *wireServer, overrides Prefixes, logger *Logger) {
+	wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+		var field int
+		switch msg.Label() {
+		case "OK":
+			field = 3
+		case "CLOSED":
+			field = 2
+		case "NOTICE":
+			field = 1
+		default:
+			return
+		}
+		env := msg.Envelope()
+		var reason string
+		if len(env) <= field || json.Unmarshal(env[field], &reason) != nil {
+			return
+		}
+		// accepted events may come without a message
+		if reason == "" {
+			return
+		}
+
+		prefixed := nostr.NormalizeOKMessage(reason, "error")
+		prefix, rest, _ := strings.Cut(prefixed, ": ")
+		if to, ok := overrides[prefix]; ok {
+			prefixed = to + ": " + rest
+		}
+		if prefixed != reason {
+			env[field], _ = json.Marshal(prefixed)
+			payload, _ := json.Marshal(env)
+			msg.SetPayload(payload)
+		}
+	})
+
+	if len(overrides) > 0 {
+		logger.Info("Overriding machine-readable prefixes: %v", overrides)
+	}
+}
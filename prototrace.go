@@ -0,0 +1,139 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// protocolTrace logs every websocket message in and out verbatim, to the log
+// or to a file per connection in dir. Messages are cut to maxFrame bytes and
+// a connection stops being traced once maxBytes of it were written.
+type protocolTrace struct {
+	dir      string
+	maxFrame int
+	maxBytes int64
+	logger   *Logger
+
+	mu    sync.Mutex
+	conns map[*wireConn]*tracedConn
+}
+
+// tracedConn is what was traced of one connection.
+type tracedConn struct {
+	file    *os.File // nil when tracing to the log
+	written int64
+	capped  bool
+}
+
+// setupProtocolTrace traces the messages of wire when TRACE_PROTOCOL is on,
+// returning the function that closes the open trace files. It must run after
+// the other outbound hooks, so what is traced is what was sent.
+func setupProtocolTrace(relay *khatru.Relay, wire *wireServer, cfg *RelayConfig, logger *Logger) (func() error, error) {
+	if !cfg.TraceProtocol {
+		return func() error { return nil }, nil
+	}
+	if cfg.TraceProtocolDir != "" {
+		if err := os.MkdirAll(cfg.TraceProtocolDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &protocolTrace{
+		dir:      cfg.TraceProtocolDir,
+		maxFrame: cfg.TraceFrameSize,
+		maxBytes: cfg.TraceConnBytes,
+		logger:   logger,
+		conns:    make(map[*wireConn]*tracedConn),
+	}
+	wire.inbound = append(wire.inbound, func(conn *wireConn, msg *wireMessage) {
+		t.trace(conn, recordIn, msg)
+	})
+	wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+		if !msg.drop {
+			t.trace(conn, recordOut, msg)
+		}
+	})
+	relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+		if conn := getWireConn(khatru.GetConnection(ctx)); conn != nil {
+			t.forget(conn)
+		}
+	})
+
+	if t.dir != "" {
+		logger.Info("Tracing websocket messages to a file per connection in %s", t.dir)
+	} else {
+		logger.Info("Tracing websocket messages to the log")
+	}
+	return t.Close, nil
+}
+
+func (t *protocolTrace) trace(conn *wireConn, dir string, msg *wireMessage) {
+	text := string(msg.payload)
+	if msg.opcode != opText {
+		text = fmt.Sprintf("(binary, %d bytes)", len(msg.payload))
+	} else if t.maxFrame > 0 && len(text) > t.maxFrame {
+		text = fmt.Sprintf("%s... (%d more bytes)", text[:t.maxFrame], len(text)-t.maxFrame)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	traced, ok := t.conns[conn]
+	if !ok {
+		traced = &tracedConn{}
+		if t.dir != "" {
+			path := filepath.Join(t.dir, fmt.Sprintf("conn-%d.log", conn.ID()))
+			file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				t.logger.Error("Failed to open protocol trace %s: %v", path, err)
+				traced.capped = true
+			}
+			traced.file = file
+		}
+		t.conns[conn] = traced
+	}
+	if traced.capped {
+		return
+	}
+	if t.maxBytes > 0 && traced.written+int64(len(text)) > t.maxBytes {
+		text = fmt.Sprintf("trace limit of %d bytes reached, not tracing this connection any further", t.maxBytes)
+		traced.capped = true
+	}
+	traced.written += int64(len(text))
+
+	if traced.file == nil {
+		t.logger.Info("Wire conn %d %s: %s", conn.ID(), dir, text)
+		return
+	}
+	fmt.Fprintf(traced.file, "%s %s %s\n", time.Now().UTC().Format(time.RFC3339Nano), dir, text)
+}
+
+// forget closes the trace of a connection that went away.
+func (t *protocolTrace) forget(conn *wireConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if traced, ok := t.conns[conn]; ok && traced.file != nil {
+		traced.file.Close()
+	}
+	delete(t.conns, conn)
+}
+
+func (t *protocolTrace) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for conn, traced := range t.conns {
+		if traced.file != nil {
+			traced.file.Close()
+		}
+		delete(t.conns, conn)
+	}
+	return nil
+}
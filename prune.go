@@ -0,0 +1,275 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip11"
+)
+
+// PruneRule bounds how long events are kept and how many of them each
+// author may keep. Zero fields are unset.
+type PruneRule struct {
+	MaxAge       Duration `json:"max_age" yaml:"max_age"`
+	MaxPerPubkey int      `json:"max_per_pubkey" yaml:"max_per_pubkey"`
+}
+
+// PruneRules maps event kinds to their rules.
+type PruneRules map[int]PruneRule
+
+// Decode parses PRUNE_KINDS, a comma-separated list of
+// kind:max_age[:max_per_pubkey] entries where empty fields are unset, e.g.
+// "1:720h:1000,7:24h,30023::10".
+func (r *PruneRules) Decode(value string) error {
+	rules := make(PruneRules)
+	for _, entry := range splitParams([]string{value}) {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return fmt.Errorf("invalid prune rule %q, expected kind:max_age[:max_per_pubkey]", entry)
+		}
+
+		kind, err := strconv.Atoi(fields[0])
+		if err != nil || kind < 0 {
+			return fmt.Errorf("invalid prune rule %q: %q is not a kind", entry, fields[0])
+		}
+		var rule PruneRule
+		if fields[1] != "" {
+			if err := rule.MaxAge.UnmarshalText([]byte(fields[1])); err != nil || rule.MaxAge < 0 {
+				return fmt.Errorf("invalid prune rule %q: %q is not a duration", entry, fields[1])
+			}
+		}
+		if len(fields) == 3 && fields[2] != "" {
+			if rule.MaxPerPubkey, err = strconv.Atoi(fields[2]); err != nil || rule.MaxPerPubkey < 0 {
+				return fmt.Errorf("invalid prune rule %q: %q is not a number", entry, fields[2])
+			}
+		}
+		rules[kind] = rule
+	}
+	*r = rules
+	return nil
+}
+
+// PruneSettings configure the janitor that deletes old events. The global
+// limits apply to every kind without a rule of its own; MaxDBSize caps the
+// JSON size of all stored events together, dropping the oldest first. Files
+// of the sqlite3 backend don't shrink until they are vacuumed, but the space
+// is reused.
+type PruneSettings struct {
+	Interval     time.Duration `envconfig:"INTERVAL" default:"1h"`
+	DryRun       bool          `envconfig:"DRY_RUN" default:"false"`
+	MaxAge       time.Duration `envconfig:"MAX_AGE"`
+	MaxPerPubkey int           `envconfig:"MAX_PER_PUBKEY"`
+	MaxDBSize    int64         `envconfig:"MAX_DB_SIZE"`
+	Kinds        PruneRules    `envconfig:"KINDS"`
+}
+
+func (s PruneSettings) Enabled() bool {
+	return s.MaxAge > 0 || s.MaxPerPubkey > 0 || s.MaxDBSize > 0 || len(s.Kinds) > 0
+}
+
+// rule returns the limits for kind, with the kind's own fields taking
+// precedence over the global ones. Per-kind counts are kept per kind.
+func (s PruneSettings) rule(kind int) (maxAge time.Duration, maxPerPubkey int, perKind bool) {
+	maxAge, maxPerPubkey = s.MaxAge, s.MaxPerPubkey
+	if rule, ok := s.Kinds[kind]; ok {
+		if rule.MaxAge > 0 {
+			maxAge = time.Duration(rule.MaxAge)
+		}
+		if rule.MaxPerPubkey > 0 {
+			maxPerPubkey, perKind = rule.MaxPerPubkey, true
+		}
+	}
+	return maxAge, maxPerPubkey, perKind
+}
+
+// setupPruning starts the janitor, which applies settings to the whole store
+// every interval until ctx is done.
+func setupPruning(ctx context.Context, store eventstore.Store, settings PruneSettings, logger *Logger) {
+	if !settings.Enabled() || settings.Interval <= 0 {
+		return
+	}
+
+	if settings.DryRun {
+		logger.Info("Pruning every %s in dry-run mode, nothing will be deleted", settings.Interval)
+	} else {
+		logger.Info("Pruning every %s", settings.Interval)
+	}
+
+	ticker := time.NewTicker(settings.Interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			if err := prune(ctx, store, settings, logger); err != nil && ctx.Err() == nil {
+				logger.Error("Pruning failed: %v", err)
+			}
+		}
+	}()
+}
+
+// prune deletes what settings don't keep. Each age limit is a query for the
+// events older than it; count and size limits keep the newest events, so they
+// read every event they apply to, the whole store for the global ones.
+func prune(ctx context.Context, store eventstore.Store, settings PruneSettings, logger *Logger) error {
+	now := time.Now()
+	reasons := make(map[string]int)
+	remove := func(event *nostr.Event, reason string) error {
+		reasons[reason]++
+		if settings.DryRun {
+			logger.Debug("Pruning would delete %s (kind %d by %s): %s", event.ID, event.Kind, event.PubKey, reason)
+			return nil
+		}
+		return store.DeleteEvent(ctx, event)
+	}
+
+	err := pruneAge(ctx, store, settings, now, remove)
+	if err == nil {
+		err = pruneCounts(ctx, store, settings, now, remove)
+	}
+
+	total := 0
+	for _, n := range reasons {
+		total += n
+	}
+	switch {
+	case total == 0:
+		logger.Debug("Pruning found nothing to delete")
+	case settings.DryRun:
+		logger.Info("Pruning would delete %d events: %v", total, reasons)
+	default:
+		logger.Info("Pruning deleted %d events: %v", total, reasons)
+	}
+	return err
+}
+
+// pruneAge deletes the events older than their kind's max age.
+func pruneAge(ctx context.Context, store eventstore.Store, settings PruneSettings, now time.Time, remove func(*nostr.Event, string) error) error {
+	before := func(age time.Duration) *nostr.Timestamp {
+		until := nostr.Timestamp(now.Add(-age).Unix())
+		return &until
+	}
+
+	for _, kind := range slices.Sorted(maps.Keys(settings.Kinds)) {
+		if age := time.Duration(settings.Kinds[kind].MaxAge); age > 0 {
+			err := scanEvents(ctx, store, nostr.Filter{Kinds: []int{kind}, Until: before(age)}, func(events []*nostr.Event) error {
+				for _, event := range events {
+					if err := remove(event, "max_age"); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if settings.MaxAge <= 0 {
+		return nil
+	}
+	return scanEvents(ctx, store, nostr.Filter{Until: before(settings.MaxAge)}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			// kinds with an age of their own were pruned above
+			if settings.Kinds[event.Kind].MaxAge > 0 {
+				continue
+			}
+			if err := remove(event, "max_age"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// pruneCounts deletes the events past the per-pubkey counts and the size
+// budget, keeping the newest ones.
+func pruneCounts(ctx context.Context, store eventstore.Store, settings PruneSettings, now time.Time, remove func(*nostr.Event, string) error) error {
+	var filters []nostr.Filter
+	if settings.MaxPerPubkey > 0 || settings.MaxDBSize > 0 {
+		filters = []nostr.Filter{{}}
+	} else {
+		for _, kind := range slices.Sorted(maps.Keys(settings.Kinds)) {
+			if settings.Kinds[kind].MaxPerPubkey > 0 {
+				filters = append(filters, nostr.Filter{Kinds: []int{kind}})
+			}
+		}
+	}
+
+	type countKey struct {
+		pubkey string
+		kind   int // -1 for the global count
+	}
+	counts := make(map[countKey]int)
+	var kept int64
+
+	for _, filter := range filters {
+		// events come newest first, so counts and the size budget keep the
+		// newest ones
+		err := scanEvents(ctx, store, filter, func(events []*nostr.Event) error {
+			for _, event := range events {
+				maxAge, maxPerPubkey, perKind := settings.rule(event.Kind)
+				// left by a dry run of pruneAge, which reported them
+				if maxAge > 0 && now.Sub(event.CreatedAt.Time()) > maxAge {
+					continue
+				}
+
+				key := countKey{event.PubKey, -1}
+				if perKind {
+					key.kind = event.Kind
+				}
+				counts[key]++
+
+				var reason string
+				switch {
+				case maxPerPubkey > 0 && counts[key] > maxPerPubkey:
+					reason = "max_per_pubkey"
+				case settings.MaxDBSize > 0 && kept+eventSize(event) > settings.MaxDBSize:
+					reason = "max_db_size"
+				default:
+					kept += eventSize(event)
+					continue
+				}
+				if err := remove(event, reason); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retention is the NIP-11 retention the janitor enforces: the max ages, the
+// kinds with their own first. Per-pubkey counts and the size budget have no
+// NIP-11 equivalent, and a dry run enforces nothing.
+func (s PruneSettings) retention() []*nip11.RelayRetentionDocument {
+	if !s.Enabled() || s.Interval <= 0 || s.DryRun {
+		return nil
+	}
+
+	var retention []*nip11.RelayRetentionDocument
+	for _, kind := range slices.Sorted(maps.Keys(s.Kinds)) {
+		if age := time.Duration(s.Kinds[kind].MaxAge); age > 0 {
+			retention = append(retention, &nip11.RelayRetentionDocument{Time: int64(age.Seconds()), Kinds: [][]int{{kind, kind}}})
+		}
+	}
+	if s.MaxAge > 0 {
+		retention = append(retention, &nip11.RelayRetentionDocument{Time: int64(s.MaxAge.Seconds())})
+	}
+	return retention
+}
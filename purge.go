@@ -0,0 +1,143 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// purgeListLimit bounds how many ids a purge lists.
+const purgeListLimit = 1000
+
+// purgeResult is what a purge deleted, or would delete on a dry run.
+type purgeResult struct {
+	DryRun  bool           `json:"dry_run"`
+	Matched int            `json:"matched"`
+	Deleted int            `json:"deleted"`
+	Kinds   map[int]int    `json:"kinds"`
+	Authors map[string]int `json:"authors"`
+	IDs     []string       `json:"ids"`
+}
+
+// errEmptyPurge refuses a purge without any filter, which wipe is for.
+var errEmptyPurge = errors.New("purge needs a kind, pubkey, id, since or until, use wipe to delete everything")
+
+// purgeEvents deletes the stored events matching filter, or only counts
+// them when dryRun is set. It lists the first purgeListLimit ids.
+func purgeEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, dryRun bool) (purgeResult, error) {
+	result := purgeResult{DryRun: dryRun, Kinds: make(map[int]int), Authors: make(map[string]int), IDs: []string{}}
+	if len(filter.Kinds) == 0 && len(filter.Authors) == 0 && len(filter.IDs) == 0 && filter.Since == nil && filter.Until == nil {
+		return result, errEmptyPurge
+	}
+
+	err := scanEvents(ctx, store, filter, func(events []*nostr.Event) error {
+		for _, event := range events {
+			result.Matched++
+			result.Kinds[event.Kind]++
+			result.Authors[event.PubKey]++
+			if len(result.IDs) < purgeListLimit {
+				result.IDs = append(result.IDs, event.ID)
+			}
+			if dryRun {
+				continue
+			}
+			if err := store.DeleteEvent(ctx, event); err != nil {
+				return err
+			}
+			result.Deleted++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// handlePurge deletes the stored events matching the parameters of
+// /export on POST, or only reports them with dry_run=true.
+func handlePurge(store eventstore.Store, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		filter, err := exportFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dryRun := query.Get("dry_run") == "true"
+
+		result, err := purgeEvents(r.Context(), store, filter, dryRun)
+		if errors.Is(err, errEmptyPurge) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logger.Error("Purge failed after %d events: %v", result.Deleted, err)
+			http.Error(w, "purge failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !dryRun {
+			logger.Info("Purged %d events matching %s via admin API", result.Deleted, filter)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func runPurge(args []string) int {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	query := addFilterFlags(flags)
+	dryRun := flags.Bool("dry-run", false, "only report what would be deleted")
+	flags.Parse(args)
+
+	filter, err := exportFilter(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	result, err := purgeEvents(ctx, db, filter, *dryRun)
+	if errors.Is(err, errEmptyPurge) {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *dryRun {
+		fmt.Printf("Would delete %d events from %s\n", result.Matched, storeLocation(cfg))
+	} else {
+		fmt.Printf("Deleted %d events from %s\n", result.Deleted, storeLocation(cfg))
+	}
+	kinds := make([]int, 0, len(result.Kinds))
+	for kind := range result.Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "kind %d\t%d\n", kind, result.Kinds[kind])
+	}
+	w.Flush()
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Purge failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,258 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Usage is how much an author has stored, counting events by their JSON size.
+type Usage struct {
+	Events int64 `json:"events"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Quotas tracks storage per author and rejects events that would take an
+// author past the configured maximums. Usage is counted from the store at
+// startup and kept up to date through Store, so it includes mirrored and
+// imported events too.
+type Quotas struct {
+	maxEvents int64
+	maxBytes  int64
+
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func NewQuotas(maxEvents, maxBytes int64) *Quotas {
+	return &Quotas{maxEvents: maxEvents, maxBytes: maxBytes, usage: make(map[string]Usage)}
+}
+
+func (q *Quotas) Enabled() bool {
+	return q.maxEvents > 0 || q.maxBytes > 0
+}
+
+// Load counts what every author already has in store.
+func (q *Quotas) Load(ctx context.Context, store eventstore.Store) error {
+	if !q.Enabled() {
+		return nil
+	}
+	return scanEvents(ctx, store, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			q.add(event.PubKey, 1, eventSize(event))
+		}
+		return nil
+	})
+}
+
+func (q *Quotas) Attach(relay *khatru.Relay) {
+	if q.Enabled() {
+		relay.RejectEvent = append(relay.RejectEvent, q.RejectEvent)
+	}
+}
+
+func (q *Quotas) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if nostr.IsEphemeralKind(event.Kind) {
+		return false, ""
+	}
+
+	used := q.Usage(event.PubKey)
+	// a replaceable event takes the place of the one it replaces, so only
+	// regular events count against the event quota
+	if q.maxEvents > 0 && nostr.IsRegularKind(event.Kind) && used.Events >= q.maxEvents {
+		return true, fmt.Sprintf("blocked: storage quota of %d events reached", q.maxEvents)
+	}
+	if q.maxBytes > 0 && used.Bytes+eventSize(event) > q.maxBytes {
+		return true, fmt.Sprintf("blocked: storage quota of %d bytes reached, %d used", q.maxBytes, used.Bytes)
+	}
+	return false, ""
+}
+
+// Usage returns what pubkey has stored.
+func (q *Quotas) Usage(pubkey string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage[pubkey]
+}
+
+// All returns the usage of every author with something stored.
+func (q *Quotas) All() map[string]Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	all := make(map[string]Usage, len(q.usage))
+	for pubkey, used := range q.usage {
+		all[pubkey] = used
+	}
+	return all
+}
+
+// Reset forgets what pubkey has stored, giving it its full quota again.
+func (q *Quotas) Reset(pubkey string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usage, pubkey)
+}
+
+func (q *Quotas) add(pubkey string, events, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	used := q.usage[pubkey]
+	used.Events = max(0, used.Events+events)
+	used.Bytes = max(0, used.Bytes+bytes)
+	if used == (Usage{}) {
+		delete(q.usage, pubkey)
+	} else {
+		q.usage[pubkey] = used
+	}
+}
+
+// keyedMutex is a mutex per key, each dropped once nobody holds or waits
+// for it. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function that unlocks it.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		k.mu.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+func eventSize(event *nostr.Event) int64 {
+	return int64(len(event.String()))
+}
+
+// Store wraps an eventstore so writes and deletions update usage.
+func (q *Quotas) Store(store eventstore.Store) eventstore.Store {
+	if !q.Enabled() {
+		return store
+	}
+	return &quotaStore{Store: store, quotas: q}
+}
+
+type quotaStore struct {
+	eventstore.Store
+	quotas *Quotas
+	// replacing serializes the replacements of each author, so one's
+	// before and after don't take in another's changes
+	replacing keyedMutex
+}
+
+func (s *quotaStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if isReplaceable(event.Kind) {
+		return s.ReplaceEvent(ctx, event)
+	}
+	err := s.Store.SaveEvent(ctx, event)
+	if err == nil {
+		s.quotas.add(event.PubKey, 1, eventSize(event))
+	}
+	return err
+}
+
+// ReplaceEvent compares the stored versions before and after, since the
+// store may drop the older ones or keep them and ignore this one.
+func (s *quotaStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	defer s.replacing.Lock(event.PubKey)()
+
+	filter := addressFilter(event)
+	events, bytes := s.measure(ctx, filter)
+	if err := s.Store.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+	afterEvents, afterBytes := s.measure(ctx, filter)
+	s.quotas.add(event.PubKey, afterEvents-events, afterBytes-bytes)
+	return nil
+}
+
+func (s *quotaStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.DeleteEvent(ctx, event)
+	if err == nil {
+		s.quotas.add(event.PubKey, -1, -eventSize(event))
+	}
+	return err
+}
+
+func (s *quotaStore) measure(ctx context.Context, filter nostr.Filter) (events, bytes int64) {
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return 0, 0
+	}
+	for event := range ch {
+		events++
+		bytes += eventSize(event)
+	}
+	return events, bytes
+}
+
+// handleQuotas lists the usage of every author.
+func handleQuotas(quotas *Quotas) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"max_events": quotas.maxEvents,
+			"max_bytes":  quotas.maxBytes,
+			"usage":      quotas.All(),
+		})
+	}
+}
+
+// handleQuotaEntry reads (GET) or resets (DELETE) the usage of the pubkey in
+// the path.
+func handleQuotaEntry(quotas *Quotas, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pubkey := strings.ToLower(r.PathValue("pubkey"))
+		if !isHexKey(pubkey) {
+			http.Error(w, "invalid pubkey, expected 64 hex characters", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, quotas.Usage(pubkey))
+
+		case http.MethodDelete:
+			quotas.Reset(pubkey)
+			logger.Info("Storage usage reset via admin API: %s", pubkey)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// rateLimiter is a set of token buckets, one per key, each holding up to
+// perMin tokens and refilling at perMin tokens per minute. AllowRate takes the
+// rate per call instead, for limits that change at runtime.
+type rateLimiter struct {
+	perMin int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter whose idle buckets are pruned until ctx
+// is done.
+func newRateLimiter(ctx context.Context, perMin int) *rateLimiter {
+	l := &rateLimiter{perMin: perMin, buckets: make(map[string]*tokenBucket)}
+	go l.pruneLoop(ctx)
+	return l
+}
+
+// Allow takes a token from the bucket for key, reporting false if it is empty.
+func (l *rateLimiter) Allow(key string) bool {
+	return l.AllowRate(key, l.perMin)
+}
+
+func (l *rateLimiter) AllowRate(key string, perMin int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(perMin), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(float64(perMin), b.tokens+now.Sub(b.last).Minutes()*float64(perMin))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Available reports whether the bucket for key has a token, without taking
+// it.
+func (l *rateLimiter) Available(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return l.perMin >= 1
+	}
+	return min(float64(l.perMin), b.tokens+time.Since(b.last).Minutes()*float64(l.perMin)) >= 1
+}
+
+// pruneLoop forgets buckets that have been idle long enough to be full again.
+func (l *rateLimiter) pruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) >= time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// RateLimits configures the RATE_LIMIT_* limits, 0 disables a limit.
+type RateLimits struct {
+	EventsPerMin int `envconfig:"EVENTS_PER_MIN"`
+	ReqsPerMin   int `envconfig:"REQS_PER_MIN"`
+}
+
+// rateLimitPolicy enforces RATE_LIMIT_EVENTS_PER_MIN and RATE_LIMIT_REQS_PER_MIN,
+// both per remote IP and per pubkey (the event author, or the NIP-42 authed
+// pubkey for REQs), and the events_per_min of each kind policy the same way.
+type rateLimitPolicy struct {
+	live   *LiveConfig
+	events *rateLimiter
+	reqs   *rateLimiter
+	kinds  *rateLimiter
+
+	// khatru checks each filter of a REQ separately, but with the same
+	// context, so the verdict is remembered per REQ until it's closed
+	mu       sync.Mutex
+	verdicts map[context.Context]string
+}
+
+func setupRateLimits(ctx context.Context, relay *khatru.Relay, settings RateLimits, live *LiveConfig, logger *Logger) {
+	l := &rateLimitPolicy{
+		live:     live,
+		kinds:    newRateLimiter(ctx, 0),
+		verdicts: make(map[context.Context]string),
+	}
+
+	// kind policies can be added at runtime, so this is always installed
+	relay.RejectEvent = append(relay.RejectEvent, l.RejectEvent)
+	if settings.EventsPerMin > 0 {
+		l.events = newRateLimiter(ctx, settings.EventsPerMin)
+	}
+	if settings.ReqsPerMin > 0 {
+		l.reqs = newRateLimiter(ctx, settings.ReqsPerMin)
+		relay.RejectFilter = append(relay.RejectFilter, l.RejectFilter)
+	}
+
+	if l.events != nil || l.reqs != nil {
+		logger.Info("Rate limits per minute - events: %d, reqs: %d", settings.EventsPerMin, settings.ReqsPerMin)
+	}
+}
+
+func (l *rateLimitPolicy) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	ip := khatru.GetIP(ctx)
+
+	if l.events != nil {
+		if ip != "" && !l.events.Allow("ip:"+ip) {
+			return true, fmt.Sprintf("rate-limited: too many events from your IP, the limit is %d per minute", l.events.perMin)
+		}
+		if !l.events.Allow("pubkey:" + event.PubKey) {
+			return true, fmt.Sprintf("rate-limited: too many events from this pubkey, the limit is %d per minute", l.events.perMin)
+		}
+	}
+
+	if perMin := l.live.Load().KindLimits[event.Kind].EventsPerMin; perMin > 0 {
+		prefix := fmt.Sprintf("kind:%d:", event.Kind)
+		if ip != "" && !l.kinds.AllowRate(prefix+"ip:"+ip, perMin) {
+			return true, fmt.Sprintf("rate-limited: too many kind %d events from your IP, the limit is %d per minute", event.Kind, perMin)
+		}
+		if !l.kinds.AllowRate(prefix+"pubkey:"+event.PubKey, perMin) {
+			return true, fmt.Sprintf("rate-limited: too many kind %d events from this pubkey, the limit is %d per minute", event.Kind, perMin)
+		}
+	}
+	return false, ""
+}
+
+func (l *rateLimitPolicy) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	msg, seen := l.verdicts[ctx]
+	if !seen {
+		msg = l.checkReq(ctx)
+		l.verdicts[ctx] = msg
+		context.AfterFunc(ctx, func() {
+			l.mu.Lock()
+			delete(l.verdicts, ctx)
+			l.mu.Unlock()
+		})
+	}
+	return msg != "", msg
+}
+
+func (l *rateLimitPolicy) checkReq(ctx context.Context) string {
+	if ip := khatru.GetIP(ctx); ip != "" && !l.reqs.Allow("ip:"+ip) {
+		return fmt.Sprintf("rate-limited: too many subscriptions from your IP, the limit is %d per minute", l.reqs.perMin)
+	}
+	if pubkey := khatru.GetAuthed(ctx); pubkey != "" && !l.reqs.Allow("pubkey:"+pubkey) {
+		return fmt.Sprintf("rate-limited: too many subscriptions from this pubkey, the limit is %d per minute", l.reqs.perMin)
+	}
+	return ""
+}
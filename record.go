@@ -0,0 +1,344 @@
+package testingrelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Recording directions.
+const (
+	recordIn  = "in"
+	recordOut = "out"
+)
+
+// recordEntry is one line of a session file: a websocket message as the
+// client sent it or as the relay put it on the wire.
+type recordEntry struct {
+	Time    time.Time       `json:"time"`
+	Conn    uint64          `json:"conn"`
+	IP      string          `json:"ip,omitempty"`
+	Dir     string          `json:"dir"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Text    string          `json:"text,omitempty"` // payloads that aren't JSON
+}
+
+// Recorder appends every text message of every connection to a JSON lines
+// session file that `replay` can play back.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// setupRecording records to path, appending to an existing session. The
+// relays served by the process share it.
+func setupRecording(path string, logger *Logger) (*Recorder, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Recording websocket sessions to %s", path)
+	return &Recorder{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Attach records the messages of wire. It must run after the other outbound
+// hooks, so what is recorded is what was sent.
+func (r *Recorder) Attach(wire *wireServer) {
+	if r == nil {
+		return
+	}
+	wire.inbound = append(wire.inbound, func(conn *wireConn, msg *wireMessage) {
+		r.record(conn, recordIn, msg)
+	})
+	wire.outbound = append(wire.outbound, func(conn *wireConn, msg *wireMessage) {
+		if !msg.drop {
+			r.record(conn, recordOut, msg)
+		}
+	})
+}
+
+func (r *Recorder) record(conn *wireConn, dir string, msg *wireMessage) {
+	if msg.opcode != opText {
+		return
+	}
+
+	entry := recordEntry{Time: time.Now(), Conn: conn.ID(), Dir: dir}
+	if conn.request != nil {
+		entry.IP = khatru.GetIPFromRequest(conn.request)
+	}
+	if json.Valid(msg.payload) {
+		entry.Message = json.RawMessage(msg.payload)
+	} else {
+		entry.Text = string(msg.payload)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.enc.Encode(entry)
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// runReplay implements the replay command: it plays back what the clients in
+// a session file sent, with the original timing, and compares what the relay
+// answers now with what it answered then. It returns the exit status, 1 if
+// the answers differ.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	url := flags.String("url", "ws://localhost:3334", "relay to replay against")
+	only := flags.Uint64("conn", 0, "replay only this recorded connection")
+	speed := flags.Float64("speed", 1, "playback speed factor, 0 sends everything at once")
+	wait := flags.Duration("wait", 2*time.Second, "how long to wait for answers after the last message")
+	quiet := flags.Bool("quiet", false, "only print the differences")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay [flags] session.jsonl\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	sessions, err := loadSessions(flags.Arg(0), *only)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load %s: %v\n", flags.Arg(0), err)
+		return 2
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintln(os.Stderr, "No connections to replay")
+		return 2
+	}
+
+	// connections start at their recorded offsets from the first one
+	start := sessions[0].entries[0].Time
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed bool
+	for _, session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			diffs, err := session.replay(*url, start, *speed, *wait, *quiet)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "conn %d: %v\n", session.conn, err)
+				failed = true
+				return
+			}
+			for _, diff := range diffs {
+				fmt.Printf("conn %d: %s\n", session.conn, diff)
+			}
+			failed = failed || len(diffs) > 0
+		}()
+	}
+	wg.Wait()
+
+	if failed {
+		return 1
+	}
+	fmt.Printf("Replayed %d connections, the relay answered the same\n", len(sessions))
+	return 0
+}
+
+// replaySession is what one recorded connection sent and received.
+type replaySession struct {
+	conn    uint64
+	entries []recordEntry
+}
+
+func loadSessions(path string, only uint64) ([]*replaySession, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	byConn := make(map[uint64]*replaySession)
+	var sessions []*replaySession
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if only != 0 && entry.Conn != only {
+			continue
+		}
+
+		session, ok := byConn[entry.Conn]
+		if !ok {
+			session = &replaySession{conn: entry.Conn}
+			byConn[entry.Conn] = session
+			sessions = append(sessions, session)
+		}
+		session.entries = append(session.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].entries[0].Time.Before(sessions[j].entries[0].Time)
+	})
+	return sessions, nil
+}
+
+// replay sends the client's messages and returns how the answers differ
+// from the recorded ones.
+func (s *replaySession) replay(url string, start time.Time, speed float64, wait time.Duration, quiet bool) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := nostr.NewConnection(ctx, url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	var received []string
+	go func() {
+		for {
+			var buf bytes.Buffer
+			if err := conn.ReadMessage(ctx, &buf); err != nil {
+				return
+			}
+			if !quiet {
+				fmt.Printf("conn %d < %s\n", s.conn, buf.Bytes())
+			}
+			mu.Lock()
+			received = append(received, answerKey(buf.Bytes()))
+			mu.Unlock()
+		}
+	}()
+
+	began := time.Now()
+	var expected []string
+	for _, entry := range s.entries {
+		payload := []byte(entry.Text)
+		if entry.Message != nil {
+			payload = entry.Message
+		}
+		if entry.Dir == recordOut {
+			expected = append(expected, answerKey(payload))
+			continue
+		}
+
+		if speed > 0 {
+			offset := time.Duration(float64(entry.Time.Sub(start)) / speed)
+			time.Sleep(time.Until(began.Add(offset)))
+		}
+		if !quiet {
+			fmt.Printf("conn %d > %s\n", s.conn, payload)
+		}
+		if err := conn.WriteMessage(ctx, payload); err != nil {
+			return nil, err
+		}
+	}
+	time.Sleep(wait)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return diffAnswers(expected, received), nil
+}
+
+// answerKey reduces a relay message to what should be the same on every run:
+// the type, the subscription and event ids and whether an event was accepted.
+// Messages, challenges and counts are left out.
+func answerKey(payload []byte) string {
+	var env []json.RawMessage
+	if json.Unmarshal(payload, &env) != nil || len(env) == 0 {
+		return string(payload)
+	}
+	var label string
+	json.Unmarshal(env[0], &label)
+
+	var args []string
+	str := func(i int) string {
+		var s string
+		if i < len(env) {
+			json.Unmarshal(env[i], &s)
+		}
+		return s
+	}
+	switch label {
+	case "OK":
+		args = append(args, str(1))
+		if len(env) > 2 {
+			args = append(args, string(env[2]))
+		}
+	case "EVENT":
+		var event struct {
+			ID string `json:"id"`
+		}
+		if len(env) > 2 {
+			json.Unmarshal(env[2], &event)
+		}
+		args = append(args, str(1), event.ID)
+	case "EOSE", "CLOSED", "COUNT":
+		args = append(args, str(1))
+	}
+	return strings.Join(append([]string{label}, args...), " ")
+}
+
+// diffAnswers lists the answers that went missing and the new ones, ignoring
+// their order.
+func diffAnswers(expected, received []string) []string {
+	counts := make(map[string]int)
+	for _, key := range expected {
+		counts[key]++
+	}
+	for _, key := range received {
+		counts[key]--
+	}
+
+	var diffs []string
+	for _, key := range sortedCounts(counts) {
+		for n := counts[key]; n > 0; n-- {
+			diffs = append(diffs, "missing: "+key)
+		}
+		for n := counts[key]; n < 0; n++ {
+			diffs = append(diffs, "unexpected: "+key)
+		}
+	}
+	return diffs
+}
+
+func sortedCounts(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,225 @@
+// Package testingrelay is a configurable nostr relay for debugging and
+// testing clients. The khatru-relay command serves it, and Go tests can embed
+// it in-process instead of running the binary:
+//
+//	cfg, err := testingrelay.ConfigFromEnv()
+//	cfg.DBBackend = "memory"
+//	cfg.Port = 0 // any free port
+//	relay, err := testingrelay.New(cfg)
+//	err = relay.Start(ctx)
+//	defer relay.Shutdown(context.Background())
+//	conn, err := nostr.RelayConnect(ctx, relay.URL())
+//
+// or mount Relay.Handler on an httptest.Server.
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"google.golang.org/grpc"
+)
+
+// Relay is a running relay process: the root relay, the virtual relays of
+// the config file if any, and the servers in front of them.
+type Relay struct {
+	cfg       RelayConfig
+	logger    *Logger
+	recorder  *Recorder
+	tracing   *Tracing
+	instances []*relayInstance
+	hosts     []string
+	server    *http.Server
+	lis       net.Listener
+	unixLis   net.Listener
+	adminLis  net.Listener
+	rpc       *grpc.Server
+	debug     func() error
+	failed    chan error
+}
+
+// ConfigFromEnv reads the RELAY_* environment variables the way the command
+// does, without loading .env or a config file. Settings that aren't set get
+// their defaults, so it is also the starting point of a configuration filled
+// in by hand.
+func ConfigFromEnv() (RelayConfig, error) {
+	return processEnv(fileOnly{})
+}
+
+// New validates cfg and builds the relay it describes, with its store open,
+// logging to stderr. It doesn't listen until Start.
+func New(cfg RelayConfig) (*Relay, error) {
+	logger, err := NewLogger(os.Stderr, cfg.LogFormat, cfg.logLevel())
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure logging: %w", err)
+	}
+	return newRelay(cfg, fileOnly{}, logger)
+}
+
+// newRelay is New with the virtual relays of the config file's relays list.
+func newRelay(cfg RelayConfig, extra fileOnly, logger *Logger) (_ *Relay, err error) {
+	virtuals, configs, err := checkConfig(cfg, extra)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Relay{cfg: cfg, logger: logger, failed: make(chan error, 1)}
+	// a relay that fails to build closes what it opened
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+
+	if r.recorder, err = setupRecording(cfg.RecordFile, logger); err != nil {
+		return nil, fmt.Errorf("failed to open session recording: %w", err)
+	}
+	if r.tracing, err = setupTracing(context.Background(), logger); err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+
+	root, err := newRelayInstance("", cfg, r.recorder, r.tracing, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the relay: %w", err)
+	}
+	r.instances = append(r.instances, root)
+
+	var routes []virtualRoute
+	for _, v := range virtuals {
+		inst, err := newRelayInstance(v.ID(), configs[v.ID()], r.recorder, r.tracing, logger.With("relay", v.ID()))
+		if err != nil {
+			return nil, fmt.Errorf("relay %s: %w", v.ID(), err)
+		}
+		r.instances = append(r.instances, inst)
+		routes = append(routes, virtualRoute{host: v.Host, path: v.Path, handler: inst.mux})
+		if v.Host != "" && !contains(r.hosts, v.Host) {
+			r.hosts = append(r.hosts, v.Host)
+		}
+		logger.Info("Serving relay %s at %s%s", v.ID(), v.Host, v.Path)
+	}
+	r.debug = setupDebug(root.mux, root.live, root.wire, logger)
+
+	// checked by checkConfig
+	proxies, _ := parseIPRanges(cfg.TrustedProxies)
+	r.server = &http.Server{
+		Handler:      roleRouter(trustProxies(proxies, newVirtualRouter(root.mux, routes))),
+		ReadTimeout:  cfg.HTTPTimeout,
+		WriteTimeout: cfg.HTTPTimeout,
+	}
+	r.server.ConnContext = r.connRole
+	for _, inst := range r.instances {
+		r.server.RegisterOnShutdown(inst.firehose.Close)
+	}
+	return r, nil
+}
+
+// Start listens on the configured port, or on a free one when it is 0, and
+// on the Unix socket and admin address of LISTEN_*, and serves in the
+// background until Shutdown. The gRPC API starts too when its port is set.
+func (r *Relay) Start(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			for _, lis := range []net.Listener{r.lis, r.unixLis, r.adminLis} {
+				if lis != nil {
+					lis.Close()
+				}
+			}
+		}
+	}()
+	if r.cfg.Listen.Public {
+		if r.lis, err = new(net.ListenConfig).Listen(ctx, "tcp", fmt.Sprintf(":%d", r.cfg.Port)); err != nil {
+			return err
+		}
+	}
+	if r.cfg.Listen.Unix != "" {
+		if r.unixLis, err = listenUnix(ctx, r.cfg.Listen.Unix); err != nil {
+			return err
+		}
+	}
+	if r.cfg.Listen.Admin != "" {
+		if r.adminLis, err = new(net.ListenConfig).Listen(ctx, "tcp", r.cfg.Listen.Admin); err != nil {
+			return err
+		}
+	}
+
+	if r.cfg.GRPCPort > 0 {
+		if r.rpc, err = startRPC(r.cfg.GRPCHost, r.cfg.GRPCPort, r.instances, r.logger); err != nil {
+			return fmt.Errorf("failed to start the gRPC API: %w", err)
+		}
+		r.server.RegisterOnShutdown(r.rpc.GracefulStop)
+	}
+
+	if r.lis != nil {
+		if r.cfg.TLS.Enabled() {
+			r.logger.Info("Starting relay on %s with TLS", r.lis.Addr())
+		} else {
+			r.logger.Info("Starting relay on %s", r.lis.Addr())
+		}
+		r.serveListener(r.lis, func() error { return serve(r.server, r.lis, r.cfg.TLS, r.hosts) })
+	}
+	if r.unixLis != nil {
+		r.logger.Info("Serving relay on Unix socket %s", r.cfg.Listen.Unix)
+		r.serveListener(r.unixLis, func() error { return r.server.Serve(r.unixLis) })
+	}
+	if r.adminLis != nil {
+		r.logger.Info("Serving the admin API and metrics on %s", r.adminLis.Addr())
+		r.serveListener(r.adminLis, func() error { return r.server.Serve(r.adminLis) })
+	}
+	return nil
+}
+
+// Handler serves every relay: websockets, NIP-11 documents, the landing page
+// and the other HTTP routes. It lets tests serve the relay with their own
+// server instead of Start, e.g. a throwaway httptest.Server per test case
+// whose URL with the ws scheme is the relay's. Shutdown still closes the
+// websockets and the stores.
+func (r *Relay) Handler() http.Handler {
+	return r.server.Handler
+}
+
+// Addr is the address of the public listener, once started, or nil without
+// one.
+func (r *Relay) Addr() net.Addr {
+	if r.lis == nil {
+		return nil
+	}
+	return r.lis.Addr()
+}
+
+// URL is the websocket URL of the root relay on this machine, once started,
+// or "" without a public listener.
+func (r *Relay) URL() string {
+	if r.lis == nil {
+		return ""
+	}
+	scheme := "ws"
+	if r.cfg.TLS.Enabled() {
+		scheme = "wss"
+	}
+	return fmt.Sprintf("%s://localhost:%d", scheme, r.lis.Addr().(*net.TCPAddr).Port)
+}
+
+// Shutdown drains the connections and closes the stores, see shutdown, and
+// gives up when ctx is done first. The relay can't be started again.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	err := shutdown(ctx, r.server, r.instances, r.logger)
+	r.debug()
+	r.recorder.Close()
+	r.tracing.Shutdown()
+	return err
+}
+
+// close releases what newRelay opened, for a relay that never served.
+func (r *Relay) close() {
+	for _, inst := range r.instances {
+		inst.Close()
+	}
+	if r.debug != nil {
+		r.debug()
+	}
+	r.recorder.Close()
+	r.tracing.Shutdown()
+}
@@ -0,0 +1,183 @@
+package testingrelay
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestRelay builds an ephemeral relay from the environment's config, with
+// configure's changes, that logs only errors. Shutdown is left to the test.
+func newTestRelay(t *testing.T, configure func(cfg *RelayConfig)) *Relay {
+	t.Helper()
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("reading config: %v", err)
+	}
+	cfg.Ephemeral = true
+	cfg.Port, cfg.GRPCPort = 0, 0
+	if configure != nil {
+		configure(&cfg)
+	}
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := newRelay(cfg, fileOnly{}, logger)
+	if err != nil {
+		t.Fatalf("building relay: %v", err)
+	}
+	return relay
+}
+
+// serveTestRelay serves newTestRelay's relay on an httptest.Server, both
+// closed when the test ends, and returns the relay and its websocket URL.
+func serveTestRelay(t *testing.T, configure func(cfg *RelayConfig)) (*Relay, string) {
+	t.Helper()
+
+	relay := newTestRelay(t, configure)
+	srv := httptest.NewServer(relay.Handler())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := relay.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		srv.Close()
+	})
+	return relay, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// connect opens a client connection closed when the test ends.
+func connect(t *testing.T, url string) *nostr.Relay {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// signedEvent signs an event of kind by sk, a new key when it is empty.
+func signedEvent(t *testing.T, sk string, kind int, content string, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+
+	if sk == "" {
+		sk = nostr.GeneratePrivateKey()
+	}
+	return signedAt(t, sk, kind, nostr.Now(), content, tags)
+}
+
+// storedIDs returns the ids of the events in store matching filter.
+func storedIDs(t *testing.T, store eventstore.Store, filter nostr.Filter) []string {
+	t.Helper()
+
+	ch, err := store.QueryEvents(context.Background(), filter)
+	if err != nil {
+		t.Fatalf("querying %v: %v", filter, err)
+	}
+	var ids []string
+	for event := range ch {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+// signedAt is signedEvent created at a given time.
+func signedAt(t *testing.T, sk string, kind int, at nostr.Timestamp, content string, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+
+	event := &nostr.Event{Kind: kind, CreatedAt: at, Tags: tags, Content: content}
+	if err := event.Sign(sk); err != nil {
+		t.Fatalf("signing event: %v", err)
+	}
+	return event
+}
+
+// queryIDs returns the ids of the events conn has for filter.
+func queryIDs(t *testing.T, conn *nostr.Relay, filter nostr.Filter) []string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := conn.QuerySync(ctx, filter)
+	if err != nil {
+		t.Fatalf("querying %v: %v", filter, err)
+	}
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+// publish sends event over conn and returns the reason it was refused, or
+// "" when it was accepted.
+func publish(t *testing.T, conn *nostr.Relay, event *nostr.Event) string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Publish(ctx, *event); err != nil {
+		return strings.TrimPrefix(err.Error(), "msg: ")
+	}
+	return ""
+}
+
+func TestHandlerRoundTrip(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	relay := newTestRelay(t, nil)
+	srv := httptest.NewServer(relay.Handler())
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		t.Fatalf("connecting: %v", err)
+	}
+
+	event := signedEvent(t, "", nostr.KindTextNote, "round trip", nil)
+	if err := conn.Publish(ctx, *event); err != nil {
+		t.Fatalf("publishing: %v", err)
+	}
+	events, err := conn.QuerySync(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != event.ID || events[0].Content != event.Content {
+		t.Fatalf("queried %v, want the published event", events)
+	}
+
+	conn.Close()
+	if err := relay.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	srv.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	// goroutines take a moment to notice their connection or context is gone
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines left running after shutdown, %d before:\n%s", runtime.NumGoroutine(), before, buf[:n])
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envFile is the file the configuration is loaded and reloaded from.
+const envFile = ".env"
+
+// reloadConfig re-reads the config file, if any, and envFile and applies the
+// runtime tunables and admins of every relay and the log level. Other
+// settings, and adding or removing relays, need a restart. Values in envFile
+// override the process environment, so the files are the one place to edit.
+func reloadConfig(instances []*relayInstance, file *ConfigFile, logger *Logger) error {
+	extra, err := file.export()
+	if err != nil {
+		return err
+	}
+	// deployments configured through the config file or the environment
+	// alone have no envFile
+	if err := godotenv.Overload(envFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	root, err := processEnv(extra)
+	if err != nil {
+		return err
+	}
+	_, configs, err := relayConfigs(root, extra)
+	if err != nil {
+		return err
+	}
+	for _, id := range sortedIDs(configs) {
+		next := configs[id]
+		if err := next.Tunables().Validate(); err != nil {
+			return fmt.Errorf("relay %s: %w", relayName(id), err)
+		}
+	}
+	if err := logger.SetLevel(root.logLevel()); err != nil {
+		return err
+	}
+
+	running := make(map[string]bool)
+	for _, inst := range instances {
+		running[inst.id] = true
+		next, ok := configs[inst.id]
+		if !ok {
+			inst.logger.Info("Relay %s is no longer in the config file, it keeps running until a restart", relayName(inst.id))
+			continue
+		}
+		inst.live.Update(func(cfg *RelayConfig) error {
+			cfg.SetTunables(next.Tunables())
+			cfg.AdminToken = next.AdminToken
+			cfg.AdminPubkeys = next.AdminPubkeys
+			cfg.LogLevel = root.LogLevel
+			cfg.Debug = root.Debug
+			return nil
+		})
+		inst.logger.Info("Configuration reloaded: %+v", next.Tunables())
+	}
+	for _, id := range sortedIDs(configs) {
+		if !running[id] {
+			logger.Info("Relay %s was added to the config file, it starts with a restart", id)
+		}
+	}
+	return nil
+}
+
+// watchConfig reloads the configuration on SIGHUP and, if interval is set,
+// whenever envFile or the config file is modified, until ctx is done.
+// Websocket connections are left alone.
+func watchConfig(ctx context.Context, instances []*relayInstance, file *ConfigFile, interval time.Duration, logger *Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	paths := []string{envFile}
+	if file != nil {
+		paths = append(paths, file.path)
+	}
+
+	lastMod := make(map[string]time.Time)
+	for _, path := range paths {
+		lastMod[path] = modTime(path)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP received, reloading configuration")
+		case <-tick:
+			changed := ""
+			for _, path := range paths {
+				if mod := modTime(path); !mod.Equal(lastMod[path]) {
+					lastMod[path] = mod
+					changed = path
+				}
+			}
+			if changed == "" {
+				continue
+			}
+			logger.Info("%s changed, reloading configuration", changed)
+		}
+
+		if err := reloadConfig(instances, file, logger); err != nil {
+			logger.Error("Failed to reload configuration, keeping the current one: %v", err)
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,156 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// errEphemeral is returned when something tries to store an ephemeral event.
+var errEphemeral = errors.New("invalid: ephemeral events are never stored")
+
+// replacingStore keeps exactly one version of every replaceable and
+// addressable event. The backends only look at one previous version when
+// replacing, so duplicates that got in some other way never went away, and
+// they store nothing without an error when the new version is older.
+// Here every stored version is compared, the newest wins with ties going to
+// the lowest id as NIP-01 says, and an outdated version is reported as a
+// duplicate so it is neither stored nor broadcast. Ephemeral events are
+// refused, khatru only ever relays them.
+type replacingStore struct {
+	eventstore.Store
+
+	// serializes replacements so two versions can't both be stored
+	mu sync.Mutex
+}
+
+func (s *replacingStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if nostr.IsEphemeralKind(event.Kind) {
+		return errEphemeral
+	}
+	if isReplaceable(event.Kind) {
+		return s.ReplaceEvent(ctx, event)
+	}
+	return s.Store.SaveEvent(ctx, event)
+}
+
+func (s *replacingStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, err := s.Store.QueryEvents(ctx, addressFilter(event))
+	if err != nil {
+		return fmt.Errorf("failed to query before replacing: %w", err)
+	}
+
+	var older []*nostr.Event
+	for previous := range ch {
+		if !isNewer(event, previous) {
+			// drain the channel so the query finishes before returning
+			for range ch {
+			}
+			return eventstore.ErrDupEvent
+		}
+		older = append(older, previous)
+	}
+
+	for _, previous := range older {
+		if err := s.Store.DeleteEvent(ctx, previous); err != nil {
+			return fmt.Errorf("failed to delete event for replacing: %w", err)
+		}
+	}
+	return s.Store.SaveEvent(ctx, event)
+}
+
+func isReplaceable(kind int) bool {
+	return nostr.IsReplaceableKind(kind) || nostr.IsAddressableKind(kind)
+}
+
+// isNewer reports whether event supersedes previous.
+func isNewer(event, previous *nostr.Event) bool {
+	if event.CreatedAt != previous.CreatedAt {
+		return event.CreatedAt > previous.CreatedAt
+	}
+	return event.ID < previous.ID
+}
+
+// address identifies the slot a replaceable or addressable event occupies.
+func address(event *nostr.Event) string {
+	if nostr.IsAddressableKind(event.Kind) {
+		return fmt.Sprintf("%d:%s:%s", event.Kind, event.PubKey, event.Tags.GetD())
+	}
+	return fmt.Sprintf("%d:%s", event.Kind, event.PubKey)
+}
+
+func addressFilter(event *nostr.Event) nostr.Filter {
+	filter := nostr.Filter{Kinds: []int{event.Kind}, Authors: []string{event.PubKey}}
+	if nostr.IsAddressableKind(event.Kind) {
+		filter.Tags = nostr.TagMap{"d": []string{event.Tags.GetD()}}
+	}
+	return filter
+}
+
+// compactStore deletes what replacingStore keeps out but earlier releases let
+// in: outdated versions of replaceable and addressable events, and ephemeral
+// events. It reads the whole store, so the relay only runs it on start with
+// COMPACT_ON_START; the compact command does it once on a stopped relay.
+func compactStore(ctx context.Context, store eventstore.Store, logger *Logger) {
+	outdated, ephemeral, err := compactEvents(ctx, store)
+	if err != nil {
+		logger.Error("Failed to compact the store: %v", err)
+	}
+	if outdated > 0 {
+		logger.Info("Deleted %d outdated versions of replaceable events", outdated)
+	}
+	if ephemeral > 0 {
+		logger.Info("Deleted %d stored ephemeral events", ephemeral)
+	}
+}
+
+// compactEvents does what compactStore does, returning how many outdated
+// versions and ephemeral events it deleted.
+func compactEvents(ctx context.Context, store eventstore.Store) (outdated, ephemeral int, err error) {
+	newest := make(map[string]*nostr.Event)
+	var deletions []*nostr.Event
+
+	err = scanEvents(ctx, store, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			if nostr.IsEphemeralKind(event.Kind) {
+				deletions = append(deletions, event)
+				ephemeral++
+				continue
+			}
+			if !isReplaceable(event.Kind) {
+				continue
+			}
+			addr := address(event)
+			current, seen := newest[addr]
+			switch {
+			case !seen:
+				newest[addr] = event
+				continue
+			case isNewer(event, current):
+				deletions = append(deletions, current)
+				newest[addr] = event
+			default:
+				deletions = append(deletions, event)
+			}
+			outdated++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to look for events to compact: %w", err)
+	}
+
+	for _, event := range deletions {
+		if err := store.DeleteEvent(ctx, event); err != nil {
+			return outdated, ephemeral, fmt.Errorf("failed to delete event %s: %w", event.ID, err)
+		}
+	}
+	return outdated, ephemeral, nil
+}
@@ -0,0 +1,117 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func newTestSliceStore(t *testing.T) *slicestore.SliceStore {
+	t.Helper()
+
+	store := &slicestore.SliceStore{MaxLimit: scanQueryLimit}
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestReplacingStore(t *testing.T) {
+	sk := nostr.GeneratePrivateKey()
+	older := signedAt(t, sk, nostr.KindProfileMetadata, 1000, "older", nil)
+	newer := signedAt(t, sk, nostr.KindProfileMetadata, 2000, "newer", nil)
+	article := nostr.Tags{{"d", "article"}}
+	lowest := signedAt(t, sk, 30023, 1000, "one", article)
+	highest := signedAt(t, sk, 30023, 1000, "two", article)
+	if highest.ID < lowest.ID {
+		lowest, highest = highest, lowest
+	}
+	ephemeral := signedAt(t, sk, 20000, nostr.Now(), "ephemeral", nil)
+
+	// each event is saved in turn, and want is the only one kept
+	type save struct {
+		event *nostr.Event
+		err   error
+	}
+	tests := []struct {
+		name  string
+		saves []save
+		want  *nostr.Event
+	}{
+		{
+			name:  "newer replaces older",
+			saves: []save{{older, nil}, {newer, nil}, {older, eventstore.ErrDupEvent}},
+			want:  newer,
+		},
+		{
+			name:  "older is a duplicate",
+			saves: []save{{newer, nil}, {older, eventstore.ErrDupEvent}},
+			want:  newer,
+		},
+		{
+			name:  "ties go to the lowest id",
+			saves: []save{{highest, nil}, {lowest, nil}, {highest, eventstore.ErrDupEvent}},
+			want:  lowest,
+		},
+		{
+			name:  "ephemeral events are refused",
+			saves: []save{{ephemeral, errEphemeral}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := &replacingStore{Store: newTestSliceStore(t)}
+
+			var filter nostr.Filter
+			for _, save := range tt.saves {
+				if err := store.SaveEvent(ctx, save.event); !errors.Is(err, save.err) {
+					t.Fatalf("saving %s got %v, want %v", save.event.Content, err, save.err)
+				}
+				filter.IDs = append(filter.IDs, save.event.ID)
+			}
+
+			ids := storedIDs(t, store, filter)
+			if tt.want == nil && len(ids) > 0 {
+				t.Fatalf("stored %v, want nothing", ids)
+			}
+			if tt.want != nil && (len(ids) != 1 || ids[0] != tt.want.ID) {
+				t.Fatalf("stored %v, want only %s", ids, tt.want.ID)
+			}
+		})
+	}
+}
+
+func TestCompactEvents(t *testing.T) {
+	ctx := context.Background()
+	store := newTestSliceStore(t)
+	sk := nostr.GeneratePrivateKey()
+	older := signedAt(t, sk, nostr.KindProfileMetadata, 1000, "older", nil)
+	newer := signedAt(t, sk, nostr.KindProfileMetadata, 2000, "newer", nil)
+	ephemeral := signedAt(t, sk, 20001, 1000, "", nil)
+	note := signedAt(t, sk, nostr.KindTextNote, 1000, "note", nil)
+
+	// saved behind replacingStore's back, as earlier releases let them in
+	for _, event := range []*nostr.Event{older, newer, ephemeral, note} {
+		if err := store.SaveEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outdated, removed, err := compactEvents(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outdated != 1 || removed != 1 {
+		t.Fatalf("compacted %d outdated and %d ephemeral events, want 1 and 1", outdated, removed)
+	}
+	ids := storedIDs(t, store, nostr.Filter{})
+	if len(ids) != 2 || !contains(ids, newer.ID) || !contains(ids, note.ID) {
+		t.Fatalf("kept %v, want %s and %s", ids, newer.ID, note.ID)
+	}
+}
@@ -0,0 +1,219 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip77"
+)
+
+// Replication keeps this relay's events in sync with peer relays
+// (REPLICA_*), e.g. other instances of it forming a test cluster. Every
+// Interval each peer is reconciled over NIP-77 negentropy, or with since
+// polling for peers without it, pulling their events, pushing ours or both
+// (Direction). Filters narrow what is replicated, everything by default.
+// Events are immutable and replaceable ones keep the latest version, so
+// peers converge whatever order they sync in; deletion requests are
+// replicated and applied too. Polling only sees events created since the
+// previous round, a minute of overlap aside.
+type Replication struct {
+	Peers     []string      `envconfig:"PEERS"`
+	Direction string        `envconfig:"DIRECTION" default:"both"`
+	Method    string        `envconfig:"METHOD" default:"negentropy"`
+	Interval  time.Duration `envconfig:"INTERVAL" default:"10s"`
+	Filters   filterList    `envconfig:"FILTERS"`
+}
+
+func (r Replication) Validate() error {
+	switch r.Direction {
+	case "both", "pull", "push":
+	default:
+		return fmt.Errorf("invalid REPLICA_DIRECTION %q, expected both, pull or push", r.Direction)
+	}
+	switch r.Method {
+	case "negentropy", "poll":
+	default:
+		return fmt.Errorf("invalid REPLICA_METHOD %q, expected negentropy or poll", r.Method)
+	}
+	if len(r.Peers) > 0 && r.Interval <= 0 {
+		return fmt.Errorf("REPLICA_INTERVAL must be positive")
+	}
+	return nil
+}
+
+// replicationOverlap is how far back before the previous round polling
+// looks again, for events that arrive with a slightly older created_at.
+const replicationOverlap = time.Minute
+
+// replicaPageSize is how many events a poll asks a peer for at once.
+const replicaPageSize = 500
+
+// replica syncs with one peer.
+type replica struct {
+	settings Replication
+	peer     string
+	relay    *khatru.Relay
+	store    eventstore.Store
+	logger   *Logger
+
+	pulled atomic.Int64
+	cursor nostr.Timestamp
+}
+
+// setupReplication starts syncing with the peers, until the returned
+// function is called.
+func setupReplication(relay *khatru.Relay, store eventstore.Store, settings Replication, logger *Logger) func() error {
+	if len(settings.Peers) == 0 {
+		return func() error { return nil }
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, peer := range settings.Peers {
+		r := &replica{settings: settings, peer: peer, relay: relay, store: store, logger: logger}
+		go r.run(ctx)
+	}
+	logger.Info("Replicating (%s, %s every %s) with %v", settings.Direction, settings.Method, settings.Interval, settings.Peers)
+	return func() error {
+		cancel()
+		return nil
+	}
+}
+
+func (r *replica) run(ctx context.Context) {
+	for {
+		start := time.Now()
+		var err error
+		if r.settings.Method == "poll" {
+			err = r.poll(ctx)
+		} else {
+			err = r.reconcile(ctx)
+		}
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			r.logger.Error("Replication with %s failed: %v", r.peer, err)
+		default:
+			if pulled := r.pulled.Swap(0); pulled > 0 {
+				r.logger.Debug("Replication with %s pulled %d events in %s", r.peer, pulled, time.Since(start).Round(time.Millisecond))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.settings.Interval):
+		}
+	}
+}
+
+func (r *replica) filters() filterList {
+	if len(r.settings.Filters) == 0 {
+		return filterList{{}}
+	}
+	return r.settings.Filters
+}
+
+// reconcile runs a negentropy session per filter.
+func (r *replica) reconcile(ctx context.Context) error {
+	direction := map[string]nip77.Direction{"both": nip77.Both, "pull": nip77.Down, "push": nip77.Up}[r.settings.Direction]
+	for _, filter := range r.filters() {
+		if err := nip77.NegentropySync(ctx, replicaStore{r}, r.peer, filter, direction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poll asks the peer for the events created since the previous round and
+// sends it ours.
+func (r *replica) poll(ctx context.Context) error {
+	start := nostr.Now()
+	peer, err := nostr.RelayConnect(ctx, r.peer)
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	since := r.cursor
+	for _, filter := range r.filters() {
+		if since > 0 {
+			filter.Since = &since
+		}
+		if r.settings.Direction != "push" {
+			if err := r.pull(ctx, peer, filter); err != nil {
+				return err
+			}
+		}
+		if r.settings.Direction != "pull" {
+			err := scanEvents(ctx, r.store, filter, func(events []*nostr.Event) error {
+				for _, event := range events {
+					if err := peer.Publish(ctx, *event); err != nil {
+						r.logger.Debug("Replication: %s refused event %s: %v", r.peer, event.ID, err)
+					}
+				}
+				return ctx.Err()
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	r.cursor = start - nostr.Timestamp(replicationOverlap.Seconds())
+	return nil
+}
+
+// pull pages through the peer's events matching filter, newest first.
+func (r *replica) pull(ctx context.Context, peer *nostr.Relay, filter nostr.Filter) error {
+	filter.Limit = replicaPageSize
+	for {
+		events, err := peer.QuerySync(ctx, filter)
+		if err != nil {
+			return err
+		}
+		oldest := nostr.Now()
+		for _, event := range events {
+			if storeRemoteEvent(ctx, r.relay, r.store, event, r.peer, r.logger) {
+				r.pulled.Add(1)
+			}
+			oldest = min(oldest, event.CreatedAt)
+		}
+		// a full page of one second can't be paged past, the rest of it is
+		// left to negentropy
+		if len(events) < replicaPageSize || (filter.Until != nil && oldest >= *filter.Until) {
+			return nil
+		}
+		filter.Until = &oldest
+	}
+}
+
+// replicaStore is the local side of a negentropy session: events the peer
+// has are stored as mirrored ones, and the whole local set is offered.
+type replicaStore struct {
+	*replica
+}
+
+func (s replicaStore) Publish(ctx context.Context, event nostr.Event) error {
+	if storeRemoteEvent(ctx, s.relay, s.store, &event, s.peer, s.logger) {
+		s.pulled.Add(1)
+	}
+	return nil
+}
+
+func (s replicaStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return s.store.QueryEvents(ctx, filter)
+}
+
+func (s replicaStore) QuerySync(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	var events []*nostr.Event
+	err := scanEvents(ctx, s.store, filter, func(page []*nostr.Event) error {
+		events = append(events, page...)
+		return nil
+	})
+	return events, err
+}
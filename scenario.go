@@ -0,0 +1,291 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Scenario is a script of canned relay behavior, loaded from SCENARIO_FILE or
+// the admin API, that turns the relay into a deterministic mock. Rules are
+// checked in order and the first one that applies wins.
+//
+//	{"rules": [
+//	  {"on": "REQ", "match": {"kinds": [1]}, "events": [...], "eose_delay": "2s"},
+//	  {"on": "REQ", "subscription": "feed", "closed": "rate-limited", "closed_after": "5s"},
+//	  {"on": "EVENT", "nth": 3, "reject": "blocked: third time's the charm"}
+//	]}
+type Scenario struct {
+	Rules []ScenarioRule `json:"rules"`
+}
+
+// ScenarioRule describes how to answer the REQ filters or EVENTs it matches.
+type ScenarioRule struct {
+	// On is "REQ" or "EVENT".
+	On string `json:"on"`
+
+	// Match selects what the rule applies to. For EVENT it is matched against
+	// the event; for REQ every kind, author, id and tag value in it must be
+	// requested by the filter. Empty matches everything.
+	Match nostr.Filter `json:"match"`
+	// Subscription, if set, limits REQ rules to that subscription id.
+	Subscription string `json:"subscription,omitempty"`
+	// Nth, if set, applies the rule only to its nth match (1-based), counting
+	// each REQ filter separately.
+	Nth int `json:"nth,omitempty"`
+
+	// REQ: serve these events instead of the stored ones (or before them with
+	// passthrough), then send EOSE after eose_delay, or answer CLOSED. A
+	// standard prefix alone, like rate-limited, gets a stock message. With
+	// closed_after the subscription is served (the stored events, unless
+	// events, passthrough or eose_delay say otherwise) and CLOSED that long
+	// after the REQ.
+	Events      []nostr.Event `json:"events,omitempty"`
+	Passthrough bool          `json:"passthrough,omitempty"`
+	EOSEDelay   Duration      `json:"eose_delay,omitempty"`
+	Closed      string        `json:"closed,omitempty"`
+	ClosedAfter Duration      `json:"closed_after,omitempty"`
+
+	// EVENT: refuse the event with this OK message.
+	Reject string `json:"reject,omitempty"`
+}
+
+func (r ScenarioRule) Validate() error {
+	switch r.On {
+	case "REQ":
+		if r.Reject != "" {
+			return fmt.Errorf("reject only applies to EVENT rules")
+		}
+	case "EVENT":
+		if len(r.Events) > 0 || r.Passthrough || r.EOSEDelay != 0 || r.Closed != "" || r.ClosedAfter != 0 {
+			return fmt.Errorf("events, passthrough, eose_delay, closed and closed_after only apply to REQ rules")
+		}
+		if r.Reject == "" {
+			return fmt.Errorf("EVENT rules need a reject message")
+		}
+	default:
+		return fmt.Errorf("on must be REQ or EVENT, got %q", r.On)
+	}
+	if r.Nth < 0 || r.EOSEDelay < 0 || r.ClosedAfter < 0 {
+		return fmt.Errorf("nth, eose_delay and closed_after must not be negative")
+	}
+	if r.ClosedAfter > 0 && r.Closed == "" {
+		return fmt.Errorf("closed_after needs a closed reason")
+	}
+	return nil
+}
+
+func (s Scenario) Validate() error {
+	for i, rule := range s.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// LoadScenario reads a scenario from a JSON file.
+func LoadScenario(path string) (Scenario, error) {
+	var scenario Scenario
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return scenario, err
+	}
+	if err := json.Unmarshal(data, &scenario); err != nil {
+		return scenario, fmt.Errorf("invalid scenario file: %w", err)
+	}
+	return scenario, scenario.Validate()
+}
+
+// coveredBy reports whether a REQ filter asks for everything the rule's match
+// names.
+func (r *ScenarioRule) coveredBy(filter nostr.Filter) bool {
+	for _, kind := range r.Match.Kinds {
+		if !contains(filter.Kinds, kind) {
+			return false
+		}
+	}
+	for _, author := range r.Match.Authors {
+		if !contains(filter.Authors, author) {
+			return false
+		}
+	}
+	for _, id := range r.Match.IDs {
+		if !contains(filter.IDs, id) {
+			return false
+		}
+	}
+	for name, values := range r.Match.Tags {
+		for _, value := range values {
+			if !contains(filter.Tags[name], value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// activeScenario is a loaded scenario with its match counters.
+type activeScenario struct {
+	Scenario
+	hits []atomic.Int64
+}
+
+// ScenarioEngine applies the current scenario through khatru hooks.
+type ScenarioEngine struct {
+	current atomic.Pointer[activeScenario]
+
+	// khatru checks a REQ filter and then queries it with the same context;
+	// the rule picked by the check is handed over to the query here
+	mu      sync.Mutex
+	pending map[context.Context]*ScenarioRule
+}
+
+func NewScenarioEngine(scenario Scenario) *ScenarioEngine {
+	e := &ScenarioEngine{pending: make(map[context.Context]*ScenarioRule)}
+	e.Load(scenario)
+	return e
+}
+
+// Load replaces the running scenario and resets its counters.
+func (e *ScenarioEngine) Load(scenario Scenario) {
+	e.current.Store(&activeScenario{
+		Scenario: scenario,
+		hits:     make([]atomic.Int64, len(scenario.Rules)),
+	})
+}
+
+func (e *ScenarioEngine) Scenario() Scenario {
+	return e.current.Load().Scenario
+}
+
+// pick returns the first rule for this message type that matches and whose
+// nth condition holds, counting a hit on every rule that matches.
+func (e *ScenarioEngine) pick(on string, matches func(rule *ScenarioRule) bool) *ScenarioRule {
+	active := e.current.Load()
+
+	var picked *ScenarioRule
+	for i := range active.Rules {
+		rule := &active.Rules[i]
+		if rule.On != on || !matches(rule) {
+			continue
+		}
+		hit := active.hits[i].Add(1)
+		if picked == nil && (rule.Nth == 0 || hit == int64(rule.Nth)) {
+			picked = rule
+		}
+	}
+	return picked
+}
+
+// Attach installs the scenario hooks. It wraps the existing QueryEvents hooks,
+// so it must run after every other query wrapper.
+func (e *ScenarioEngine) Attach(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, e.RejectEvent)
+	relay.RejectFilter = append(relay.RejectFilter, e.RejectFilter)
+
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = e.wrapQuery(query)
+	}
+}
+
+func (e *ScenarioEngine) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	rule := e.pick("EVENT", func(rule *ScenarioRule) bool {
+		return rule.Match.Matches(event)
+	})
+	if rule == nil {
+		return false, ""
+	}
+	return true, rule.Reject
+}
+
+func (e *ScenarioEngine) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	subscription := subscriptionID(ctx)
+	rule := e.pick("REQ", func(rule *ScenarioRule) bool {
+		return (rule.Subscription == "" || rule.Subscription == subscription) && rule.coveredBy(filter)
+	})
+	if rule == nil {
+		return false, ""
+	}
+	if rule.Closed != "" && rule.ClosedAfter == 0 {
+		return true, closedReason(rule.Closed)
+	}
+	if rule.ClosedAfter > 0 {
+		if conn := getWireConn(khatru.GetConnection(ctx)); conn != nil {
+			reason := closedReason(rule.Closed)
+			time.AfterFunc(time.Duration(rule.ClosedAfter), func() {
+				conn.KillSubscription(subscription, reason)
+			})
+		}
+		if len(rule.Events) == 0 && !rule.Passthrough && rule.EOSEDelay == 0 {
+			return false, ""
+		}
+	}
+
+	e.mu.Lock()
+	e.pending[ctx] = rule
+	e.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		e.mu.Lock()
+		delete(e.pending, ctx)
+		e.mu.Unlock()
+	})
+	return false, ""
+}
+
+func (e *ScenarioEngine) wrapQuery(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		e.mu.Lock()
+		rule := e.pending[ctx]
+		delete(e.pending, ctx)
+		e.mu.Unlock()
+
+		if rule == nil {
+			return query(ctx, filter)
+		}
+
+		var stored chan *nostr.Event
+		if rule.Passthrough {
+			var err error
+			if stored, err = query(ctx, filter); err != nil {
+				return nil, err
+			}
+		}
+
+		ch := make(chan *nostr.Event)
+		go func() {
+			defer close(ch)
+
+			for i := range rule.Events {
+				select {
+				case ch <- &rule.Events[i]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if stored != nil {
+				for event := range stored {
+					select {
+					case ch <- event:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			// EOSE goes out once every query channel is closed
+			select {
+			case <-time.After(time.Duration(rule.EOSEDelay)):
+			case <-ctx.Done():
+			}
+		}()
+		return ch, nil
+	}
+}
@@ -0,0 +1,259 @@
+package testingrelay
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// searchCandidates caps how many full-text matches are considered per query.
+// The matches are fetched back by id, so it stays under the sqlite3 backend's
+// default query limit.
+const searchCandidates = 100
+
+var searchDDLs = []string{
+	`CREATE VIRTUAL TABLE event_fts USING fts5(content, content='event', content_rowid='rowid')`,
+	`CREATE TRIGGER event_fts_insert AFTER INSERT ON event BEGIN
+       INSERT INTO event_fts(rowid, content) VALUES (new.rowid, new.content);
+     END`,
+	`CREATE TRIGGER event_fts_delete AFTER DELETE ON event BEGIN
+       INSERT INTO event_fts(event_fts, rowid, content) VALUES ('delete', old.rowid, old.content);
+     END`,
+	`INSERT INTO event_fts(event_fts) VALUES ('rebuild')`,
+}
+
+// setupSearch serves NIP-50 search filters from an SQLite FTS5 index over event
+// content, ranked by relevance, and advertises NIP-50. FTS5 must be compiled
+// in (go build -tags sqlite_fts5); without it a warning is logged at startup
+// and, like on other backends, the store's own substring search is kept and
+// NIP-50 isn't advertised. With shards every store has its own index, and
+// needs to be sqlite3. It wraps the existing QueryEvents hooks, so it must
+// run right after attachStore and setupNegentropy.
+func setupSearch(relay *khatru.Relay, store eventstore.Store, logger *Logger) {
+	var backends []*sqlite3.SQLite3Backend
+	for _, store := range backendStores(store) {
+		if backend, ok := store.(*sqlite3.SQLite3Backend); ok {
+			backends = append(backends, backend)
+		}
+	}
+	switch {
+	case len(backends) == 0:
+		return
+	case len(backends) < len(backendStores(store)):
+		logger.Info("Full-text search needs every shard on sqlite3, falling back to substring search")
+		return
+	}
+
+	if !hasFTS5(backends[0]) {
+		logger.Error("Full-text search needs SQLite FTS5, which this binary was built without (go build -tags sqlite_fts5); falling back to substring search and not advertising NIP-50")
+		return
+	}
+	for _, backend := range backends {
+		if err := initSearchIndex(backend); err != nil {
+			logger.Error("Full-text search unavailable, falling back to substring search: %v", err)
+			return
+		}
+	}
+
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = searchQuery(backends, query)
+	}
+	relay.Info.AddSupportedNIP(50)
+}
+
+// hasFTS5 reports whether the SQLite library backend runs on has FTS5
+// compiled in.
+func hasFTS5(backend *sqlite3.SQLite3Backend) bool {
+	var used bool
+	err := backend.DB.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used)
+	return err == nil && used
+}
+
+// initSearchIndex creates the index and its sync triggers on first use,
+// indexing the events already stored.
+func initSearchIndex(backend *sqlite3.SQLite3Backend) error {
+	var exists int
+	err := backend.DB.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'event_fts'`).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	tx, err := backend.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, ddl := range searchDDLs {
+		if _, err := tx.Exec(ddl); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// searchQuery answers filters with a search term from the indexes and passes
+// everything else to query. Matching ids are looked up through query so the
+// rest of the filter still applies.
+func searchQuery(backends []*sqlite3.SQLite3Backend, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Search == "" {
+			return query(ctx, filter)
+		}
+
+		terms := searchTerms(filter.Search)
+		if terms == "" {
+			filter.Search = ""
+			return query(ctx, filter)
+		}
+
+		var matches []searchMatch
+		for _, backend := range backends {
+			found, err := searchIDs(ctx, backend, terms, filter)
+			if err != nil {
+				return nil, fmt.Errorf("search failed: %w", err)
+			}
+			matches = append(matches, found...)
+		}
+		// the best of every index, which rank alike
+		slices.SortStableFunc(matches, func(a, b searchMatch) int { return cmp.Compare(a.rank, b.rank) })
+		ranked := make([]string, 0, min(len(matches), searchCandidates))
+		for _, match := range matches[:min(len(matches), searchCandidates)] {
+			ranked = append(ranked, match.id)
+		}
+
+		limit := filter.Limit
+		filter.Search = ""
+		filter.IDs = ranked
+		filter.Limit = len(ranked)
+
+		ch := make(chan *nostr.Event)
+		if len(ranked) == 0 {
+			close(ch)
+			return ch, nil
+		}
+
+		found, err := query(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			defer close(ch)
+
+			matches := make(map[string]*nostr.Event, len(ranked))
+			for event := range found {
+				matches[event.ID] = event
+			}
+
+			sent := 0
+			for _, id := range ranked {
+				event, ok := matches[id]
+				if !ok {
+					continue
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+				if sent++; limit > 0 && sent >= limit {
+					return
+				}
+			}
+		}()
+		return ch, nil
+	}
+}
+
+// searchMatch is a match of the index, the lower the rank the better.
+type searchMatch struct {
+	id   string
+	rank float64
+}
+
+// searchIDs returns the best matches of the events filter allows, its
+// conditions applied before the candidates are cut.
+func searchIDs(ctx context.Context, backend *sqlite3.SQLite3Backend, terms string, filter nostr.Filter) ([]searchMatch, error) {
+	q := `SELECT e.id, rank FROM event_fts JOIN event e ON e.rowid = event_fts.rowid WHERE event_fts MATCH ?`
+	args := []any{terms}
+	in := func(column string, n int) {
+		q += ` AND e.` + column + ` IN (?` + strings.Repeat(`,?`, n-1) + `)`
+	}
+	if len(filter.IDs) > 0 {
+		in("id", len(filter.IDs))
+		for _, id := range filter.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(filter.Authors) > 0 {
+		in("pubkey", len(filter.Authors))
+		for _, author := range filter.Authors {
+			args = append(args, author)
+		}
+	}
+	if len(filter.Kinds) > 0 {
+		in("kind", len(filter.Kinds))
+		for _, kind := range filter.Kinds {
+			args = append(args, kind)
+		}
+	}
+	// like the sqlite3 backend, tag values are matched against the tags column
+	// and checked again when the candidates are fetched
+	for _, values := range filter.Tags {
+		if len(values) == 0 {
+			continue
+		}
+		q += ` AND (e.tags LIKE ? ESCAPE '\'` + strings.Repeat(` OR e.tags LIKE ? ESCAPE '\'`, len(values)-1) + `)`
+		for _, value := range values {
+			args = append(args, `%`+strings.ReplaceAll(value, `%`, `\%`)+`%`)
+		}
+	}
+	if filter.Since != nil {
+		q += ` AND e.created_at >= ?`
+		args = append(args, *filter.Since)
+	}
+	if filter.Until != nil {
+		q += ` AND e.created_at <= ?`
+		args = append(args, *filter.Until)
+	}
+	q += ` ORDER BY rank LIMIT ?`
+	args = append(args, searchCandidates)
+
+	rows, err := backend.DB.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []searchMatch
+	for rows.Next() {
+		var match searchMatch
+		if err := rows.Scan(&match.id, &match.rank); err != nil {
+			return nil, err
+		}
+		matches = append(matches, match)
+	}
+	return matches, rows.Err()
+}
+
+// searchTerms turns a NIP-50 search string into an FTS5 query matching all of
+// its words. Words are quoted so they can't be read as FTS5 syntax, and
+// key:value extensions are dropped since none are supported.
+func searchTerms(search string) string {
+	var terms []string
+	for _, word := range strings.Fields(search) {
+		if strings.Contains(word, ":") {
+			continue
+		}
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
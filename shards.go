@@ -0,0 +1,283 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/wrappers/count"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Shard keeps some kinds in a store of their own, to isolate heavy kinds
+// from the rest. Shards can only be set in the config file, with kinds listed
+// like in NIP-11 retention policies, as kinds or [first, last] ranges:
+//
+//	shards:
+//	  - {kinds: [30023], backend: lmdb, path: ./articles}
+//	  - {kinds: [[1000, 9999], 42], backend: sqlite3, path: ./chat.db}
+//
+// Events of the other kinds stay in DB_BACKEND at DB_PATH. Queries go to
+// every store holding some of their kinds and their results are merged.
+type Shard struct {
+	Kinds   []any  `yaml:"kinds"`
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path"`
+}
+
+// Shards are the shards of a relay, none by default.
+type Shards []Shard
+
+// kindRange is an inclusive range of kinds.
+type kindRange [2]int
+
+// ranges reads the kinds of the shard.
+func (s Shard) ranges() ([]kindRange, error) {
+	var ranges []kindRange
+	for _, entry := range s.Kinds {
+		switch value := entry.(type) {
+		case int:
+			ranges = append(ranges, kindRange{value, value})
+		case []any:
+			if len(value) != 2 {
+				return nil, fmt.Errorf("invalid kind range %v, expected [first, last]", value)
+			}
+			first, ok1 := value[0].(int)
+			last, ok2 := value[1].(int)
+			if !ok1 || !ok2 || first > last {
+				return nil, fmt.Errorf("invalid kind range %v, expected [first, last]", value)
+			}
+			ranges = append(ranges, kindRange{first, last})
+		default:
+			return nil, fmt.Errorf("invalid kinds entry %v, expected a kind or a [first, last] range", entry)
+		}
+	}
+	return ranges, nil
+}
+
+func (s Shards) Validate() error {
+	var taken []kindRange
+	for i, shard := range s {
+		ranges, err := shard.ranges()
+		if err != nil {
+			return fmt.Errorf("shards[%d]: %w", i, err)
+		}
+		if len(ranges) == 0 {
+			return fmt.Errorf("shards[%d]: needs kinds", i)
+		}
+		if shard.Path == "" && shard.Backend != "memory" {
+			return fmt.Errorf("shards[%d]: needs a path", i)
+		}
+		for _, r := range ranges {
+			for _, other := range taken {
+				if r[0] <= other[1] && other[0] <= r[1] {
+					return fmt.Errorf("shards[%d]: kinds %d-%d are already in another shard", i, r[0], r[1])
+				}
+			}
+		}
+		taken = append(taken, ranges...)
+	}
+	return nil
+}
+
+// storeShard is an open shard.
+type storeShard struct {
+	eventstore.Store
+	ranges []kindRange
+}
+
+func (s storeShard) holds(kind int) bool {
+	return slices.ContainsFunc(s.ranges, func(r kindRange) bool { return r[0] <= kind && kind <= r[1] })
+}
+
+// shardedStore routes events to the store of the shard holding their kind,
+// the primary store if none does.
+type shardedStore struct {
+	primary eventstore.Store
+	shards  []storeShard
+}
+
+// newShardedStore opens the shards of cfg, with the backends of NewStore,
+// around primary.
+func newShardedStore(primary eventstore.Store, cfg *RelayConfig) (eventstore.Store, error) {
+	s := &shardedStore{primary: primary}
+	for i, shard := range cfg.Shards {
+		ranges, err := shard.ranges()
+		if err != nil {
+			return nil, fmt.Errorf("shards[%d]: %w", i, err)
+		}
+		shardCfg := *cfg
+		shardCfg.DBBackend, shardCfg.DBPath, shardCfg.Shards = shard.Backend, shard.Path, nil
+		if shardCfg.DBBackend == "" {
+			shardCfg.DBBackend = cfg.DBBackend
+		}
+		store, err := NewStore(&shardCfg)
+		if err != nil {
+			return nil, fmt.Errorf("shards[%d]: %w", i, err)
+		}
+		s.shards = append(s.shards, storeShard{Store: store, ranges: ranges})
+	}
+	return s, nil
+}
+
+// primaryStore is the store holding the kinds of no shard.
+func primaryStore(store eventstore.Store) eventstore.Store {
+	if sharded, ok := store.(*shardedStore); ok {
+		return sharded.primary
+	}
+	return store
+}
+
+// backendStores are the stores behind store: the primary one and those of
+// the shards, or store alone when it isn't sharded.
+func backendStores(store eventstore.Store) []eventstore.Store {
+	sharded, ok := store.(*shardedStore)
+	if !ok {
+		return []eventstore.Store{store}
+	}
+	stores := []eventstore.Store{sharded.primary}
+	for _, shard := range sharded.shards {
+		stores = append(stores, shard.Store)
+	}
+	return stores
+}
+
+// wrapBackends applies wrap to each store behind store, so wrappers that only
+// apply to some backends see the backend of every shard.
+func wrapBackends(store eventstore.Store, wrap func(eventstore.Store) eventstore.Store) eventstore.Store {
+	sharded, ok := store.(*shardedStore)
+	if !ok {
+		return wrap(store)
+	}
+	wrapped := &shardedStore{primary: wrap(sharded.primary)}
+	for _, shard := range sharded.shards {
+		wrapped.shards = append(wrapped.shards, storeShard{Store: wrap(shard.Store), ranges: shard.ranges})
+	}
+	return wrapped
+}
+
+func (s *shardedStore) Init() error {
+	if err := s.primary.Init(); err != nil {
+		return err
+	}
+	for i, shard := range s.shards {
+		if err := shard.Init(); err != nil {
+			return fmt.Errorf("shards[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Close() {
+	s.primary.Close()
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+}
+
+// Flush flushes the primary store and the shards that hold writes back.
+func (s *shardedStore) Flush(ctx context.Context) error {
+	for _, store := range backendStores(s) {
+		if f, ok := store.(flusher); ok {
+			if err := f.Flush(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) route(kind int) eventstore.Store {
+	for _, shard := range s.shards {
+		if shard.holds(kind) {
+			return shard.Store
+		}
+	}
+	return s.primary
+}
+
+// targets are the stores that may hold events matching filter.
+func (s *shardedStore) targets(filter nostr.Filter) []eventstore.Store {
+	if len(filter.Kinds) == 0 {
+		targets := []eventstore.Store{s.primary}
+		for _, shard := range s.shards {
+			targets = append(targets, shard.Store)
+		}
+		return targets
+	}
+	var targets []eventstore.Store
+	for _, kind := range filter.Kinds {
+		if store := s.route(kind); !slices.Contains(targets, store) {
+			targets = append(targets, store)
+		}
+	}
+	return targets
+}
+
+func (s *shardedStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	return s.route(event.Kind).SaveEvent(ctx, event)
+}
+
+func (s *shardedStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	return s.route(event.Kind).ReplaceEvent(ctx, event)
+}
+
+func (s *shardedStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	return s.route(event.Kind).DeleteEvent(ctx, event)
+}
+
+// QueryEvents asks every target and merges their results newest first, cut
+// to the filter's limit.
+func (s *shardedStore) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	targets := s.targets(filter)
+	if len(targets) == 1 {
+		return targets[0].QueryEvents(ctx, filter)
+	}
+
+	var events []*nostr.Event
+	for _, store := range targets {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for event := range ch {
+			events = append(events, event)
+		}
+	}
+	slices.SortFunc(events, func(a, b *nostr.Event) int {
+		if a.CreatedAt != b.CreatedAt {
+			return int(b.CreatedAt - a.CreatedAt)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *shardedStore) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	var total int64
+	for _, store := range s.targets(filter) {
+		n, err := (count.Wrapper{Store: store}).CountEvents(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
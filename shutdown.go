@@ -0,0 +1,123 @@
+package testingrelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// shutdownReason is sent in the CLOSED message of every subscription still open
+// when the relay shuts down.
+const shutdownReason = "error: relay is shutting down"
+
+var errStoreClosed = errors.New("error: relay is shutting down")
+
+// gatedStore lets shutdown wait for the writes in progress before closing the
+// store underneath, and fails the writes that come after.
+type gatedStore struct {
+	eventstore.Store
+	mu     sync.RWMutex
+	closed bool
+}
+
+func (s *gatedStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	return s.Store.SaveEvent(ctx, event)
+}
+
+func (s *gatedStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	return s.Store.ReplaceEvent(ctx, event)
+}
+
+func (s *gatedStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	return s.Store.DeleteEvent(ctx, event)
+}
+
+// Hold runs fn with writes held back, after the batched ones are committed,
+// so what fn reads is the store at a single moment. Writes wait rather than
+// fail.
+func (s *gatedStore) Hold(ctx context.Context, fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errStoreClosed
+	}
+	if f, ok := s.Store.(flusher); ok {
+		if err := f.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return fn()
+}
+
+// Close waits for the writes in progress and closes the store, which for
+// sqlite3 checkpoints its write-ahead log. Closing twice is a no-op.
+func (s *gatedStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.Store.Close()
+	}
+}
+
+// shutdown stops accepting connections, ends every open subscription with
+// CLOSED and closes the websockets with a going-away frame, then closes the
+// stores of every relay. It gives up when ctx is done before that.
+func shutdown(ctx context.Context, server *http.Server, instances []*relayInstance, logger *Logger) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		logger.Info("Shutting down, draining connections for up to %s", time.Until(deadline).Round(time.Second))
+	} else {
+		logger.Info("Shutting down, draining connections")
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("HTTP requests still running at shutdown: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for _, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := inst.wire.Shutdown(ctx, shutdownReason); err != nil {
+				inst.logger.Error("Websockets still open at shutdown: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	closed := make(chan struct{})
+	go func() {
+		for _, inst := range instances {
+			inst.Close()
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		logger.Info("Shutdown complete")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("store writes still running: %w", ctx.Err())
+	}
+}
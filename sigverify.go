@@ -0,0 +1,140 @@
+package testingrelay
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SigVerify sets how the relay verifies signatures (SIG_VERIFY_*): websocket
+// EVENTs, gRPC publishes and imports hand them to a pool of Workers
+// goroutines, one per CPU by default, and their time shows up in the
+// relay_signature_verification_seconds metric. Skip turns the signature check
+// off and verifies nothing, for synthetic load tests like `bench -unsigned`.
+type SigVerify struct {
+	Workers int  `envconfig:"WORKERS"`
+	Skip    bool `envconfig:"SKIP"`
+}
+
+func (s SigVerify) Validate() error {
+	if s.Workers < 0 {
+		return fmt.Errorf("SIG_VERIFY_WORKERS must not be negative")
+	}
+	return nil
+}
+
+// sigJob is one event waiting for a worker.
+type sigJob struct {
+	event *nostr.Event
+	ok    *bool
+	done  *sync.WaitGroup
+}
+
+// sigVerifier verifies signatures on a fixed pool of workers. A nil one
+// verifies in the caller's goroutine.
+type sigVerifier struct {
+	skip    bool
+	metrics *Metrics
+
+	mu     sync.RWMutex // held by senders, so Close doesn't close jobs under them
+	jobs   chan sigJob
+	closed bool
+}
+
+// newSigVerifier starts the workers. metrics may be nil.
+func newSigVerifier(settings SigVerify, metrics *Metrics) *sigVerifier {
+	v := &sigVerifier{skip: settings.Skip, metrics: metrics}
+	if settings.Skip {
+		return v
+	}
+	workers := settings.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	// buffered, so an event doesn't wait for a worker to be free to be queued
+	v.jobs = make(chan sigJob, workers)
+	for range workers {
+		go v.work()
+	}
+	return v
+}
+
+// work verifies jobs until Close, finishing those already queued.
+func (v *sigVerifier) work() {
+	for job := range v.jobs {
+		*job.ok = v.check(job.event)
+		job.done.Done()
+	}
+}
+
+func (v *sigVerifier) check(event *nostr.Event) bool {
+	start := time.Now()
+	ok, _ := event.CheckSignature()
+	if v != nil && v.metrics != nil {
+		v.metrics.SignatureVerified(time.Since(start))
+	}
+	return ok
+}
+
+// verify reports whether event is validly signed, always true when skipping.
+func (v *sigVerifier) verify(event *nostr.Event) bool {
+	return v.verifyAll([]*nostr.Event{event})[0]
+}
+
+// verifyAlways is verify, but checks the signature even when skipping, for
+// the events that always need one.
+func (v *sigVerifier) verifyAlways(event *nostr.Event) bool {
+	if v == nil || v.skip {
+		return v.check(event)
+	}
+	return v.verify(event)
+}
+
+// verifyAll verifies events in parallel and reports each one's validity.
+// Once the pool is closed the caller verifies them itself.
+func (v *sigVerifier) verifyAll(events []*nostr.Event) []bool {
+	valid := make([]bool, len(events))
+	switch {
+	case v == nil:
+		for i, event := range events {
+			valid[i] = v.check(event)
+		}
+	case v.skip:
+		for i := range valid {
+			valid[i] = true
+		}
+	default:
+		var done sync.WaitGroup
+		done.Add(len(events))
+		v.mu.RLock()
+		for i, event := range events {
+			if v.closed {
+				valid[i] = v.check(event)
+				done.Done()
+				continue
+			}
+			v.jobs <- sigJob{event: event, ok: &valid[i], done: &done}
+		}
+		v.mu.RUnlock()
+		done.Wait()
+	}
+	return valid
+}
+
+// Close stops the workers once the queued jobs are done. Callers verifying
+// afterwards do it themselves.
+func (v *sigVerifier) Close() error {
+	if v.jobs == nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if !v.closed {
+		v.closed = true
+		close(v.jobs)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+package testingrelay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// A snapshot is a gzipped tarball of snapshot.json (snapshotMeta),
+// tunables.json (the runtime settings, as on /admin/config) and
+// events.jsonl (the stored events, as exported), in that order so a restore
+// can stream the events.
+const (
+	snapshotMetaFile     = "snapshot.json"
+	snapshotTunablesFile = "tunables.json"
+	snapshotEventsFile   = "events.jsonl"
+)
+
+// snapshotMeta describes a snapshot.
+type snapshotMeta struct {
+	Version   string    `json:"version"`
+	Relay     string    `json:"relay"`
+	Backend   string    `json:"backend"`
+	Events    int       `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// restoreResult is what a restore did.
+type restoreResult struct {
+	Snapshot snapshotMeta `json:"snapshot"`
+	Wiped    int          `json:"wiped"`
+	Imported importResult `json:"imported"`
+	Tunables *Tunables    `json:"tunables,omitempty"`
+}
+
+// writeSnapshot writes a snapshot of the events in store and of cfg to w.
+// The events are exported to a temporary file first, since a tar entry
+// needs its size up front, with writes held back meanwhile when writes isn't
+// nil, so a slow download doesn't hold them up.
+func writeSnapshot(ctx context.Context, store eventstore.Store, writes *gatedStore, cfg *RelayConfig, w io.Writer) (snapshotMeta, error) {
+	meta := snapshotMeta{Version: version, Relay: cfg.Name, Backend: cfg.DBBackend, CreatedAt: time.Now().UTC()}
+	if cfg.Ephemeral {
+		meta.Backend = "memory"
+	}
+
+	events, err := os.CreateTemp("", "relay-snapshot-*.jsonl")
+	if err != nil {
+		return meta, err
+	}
+	defer os.Remove(events.Name())
+	defer events.Close()
+	export := func() error {
+		enc := json.NewEncoder(events)
+		return scanEvents(ctx, store, nostr.Filter{}, func(page []*nostr.Event) error {
+			for _, event := range page {
+				if err := enc.Encode(event); err != nil {
+					return err
+				}
+				meta.Events++
+			}
+			return nil
+		})
+	}
+	if writes != nil {
+		err = writes.Hold(ctx, export)
+	} else {
+		err = export()
+	}
+	if err != nil {
+		return meta, fmt.Errorf("exporting events: %w", err)
+	}
+	size, err := events.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return meta, err
+	}
+	if _, err := events.Seek(0, io.SeekStart); err != nil {
+		return meta, err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, entry := range []struct {
+		name  string
+		value any
+	}{
+		{snapshotMetaFile, meta},
+		{snapshotTunablesFile, cfg.Tunables()},
+	} {
+		data, err := json.MarshalIndent(entry.value, "", "  ")
+		if err != nil {
+			return meta, err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0o644, Size: int64(len(data)), ModTime: meta.CreatedAt}); err != nil {
+			return meta, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return meta, err
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotEventsFile, Mode: 0o644, Size: size, ModTime: meta.CreatedAt}); err != nil {
+		return meta, err
+	}
+	if _, err := io.Copy(tw, events); err != nil {
+		return meta, err
+	}
+	if err := tw.Close(); err != nil {
+		return meta, err
+	}
+	return meta, zw.Close()
+}
+
+// restoreSnapshot replaces the events in store with those of the snapshot
+// read from r, and applies its tunables with apply unless it is nil.
+func restoreSnapshot(ctx context.Context, store eventstore.Store, r io.Reader, apply func(tunables []byte) (Tunables, error)) (restoreResult, error) {
+	var result restoreResult
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return result, fmt.Errorf("not a snapshot: %w", err)
+	}
+	tr := tar.NewReader(zr)
+
+	seen := make(map[string]bool)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("reading the snapshot: %w", err)
+		}
+		seen[header.Name] = true
+
+		switch header.Name {
+		case snapshotMetaFile:
+			if err := json.NewDecoder(tr).Decode(&result.Snapshot); err != nil {
+				return result, fmt.Errorf("reading %s: %w", snapshotMetaFile, err)
+			}
+
+		case snapshotTunablesFile:
+			if apply == nil {
+				continue
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return result, fmt.Errorf("reading %s: %w", snapshotTunablesFile, err)
+			}
+			tunables, err := apply(data)
+			if err != nil {
+				return result, fmt.Errorf("applying %s: %w", snapshotTunablesFile, err)
+			}
+			result.Tunables = &tunables
+
+		case snapshotEventsFile:
+			if !seen[snapshotMetaFile] {
+				return result, fmt.Errorf("not a snapshot: %s comes before %s", snapshotEventsFile, snapshotMetaFile)
+			}
+			if result.Wiped, err = wipeEvents(ctx, store); err != nil {
+				return result, fmt.Errorf("deleting the current events: %w", err)
+			}
+			if result.Imported, err = importEvents(ctx, store, tr, nil); err != nil {
+				return result, fmt.Errorf("importing events: %w", err)
+			}
+		}
+	}
+	if !seen[snapshotEventsFile] {
+		return result, fmt.Errorf("not a snapshot: no %s", snapshotEventsFile)
+	}
+	return result, nil
+}
+
+// handleSnapshot serves a snapshot of the relay as a download. Writes wait
+// while the events are read, so the snapshot is consistent.
+func handleSnapshot(writes *gatedStore, store eventstore.Store, live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := fmt.Sprintf("relay-snapshot-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		meta, err := writeSnapshot(r.Context(), store, writes, live.Load(), w)
+		if err != nil {
+			// nothing is written before the events are exported, so most
+			// failures can still be answered
+			logger.Error("Snapshot failed: %v", err)
+			http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Snapshot of %d events taken via admin API", meta.Events)
+	}
+}
+
+// handleRestore replaces the stored events and the tunables with those of
+// the snapshot in the POST body. Events published meanwhile may survive it,
+// so clients should be quiet during a restore.
+func handleRestore(store eventstore.Store, live *LiveConfig, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := restoreSnapshot(r.Context(), store, r.Body, func(tunables []byte) (Tunables, error) {
+			return patchTunables(live, tunables)
+		})
+		if err != nil {
+			logger.Error("Restore failed: %v", err)
+			http.Error(w, "restore failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("Restored a snapshot of %d events from %s via admin API", result.Imported.Imported, result.Snapshot.CreatedAt.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func runSnapshot(args []string) int {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	output := flags.String("o", "", "file to write, stdout if empty")
+	flags.Parse(args)
+
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer out.Close()
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	meta, err := writeSnapshot(ctx, db, nil, &cfg, out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Snapshot failed: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Snapshot of %d events from %s\n", meta.Events, storeLocation(cfg))
+	return 0
+}
+
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	store := addStoreFlags(flags)
+	yes := flags.Bool("yes", false, "confirm replacing every stored event")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s restore [flags] snapshot.tar.gz\n\nReplaces the stored events with the snapshot's. Its tunables are only applied by\nPOST /admin/restore, since the command can't change the relay's configuration.\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if !*yes {
+		fmt.Fprintln(os.Stderr, "restore deletes every stored event first, run it with -yes to confirm")
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	db, cfg, err := store.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	result, err := restoreSnapshot(ctx, &replacingStore{Store: db}, file, nil)
+	for _, msg := range result.Imported.Errors {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Restore failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Restored %d events into %s (%d deleted, %d invalid)\n", result.Imported.Imported, storeLocation(cfg), result.Wiped, result.Imported.Invalid)
+	return 0
+}
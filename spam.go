@@ -0,0 +1,213 @@
+package testingrelay
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SpamSettings configure the spam scorer (SPAM_*), which adds up the weights
+// of the heuristics an event trips: its content was already seen within
+// DuplicateWindow, it has more than MaxLinks links, more than MaxSymbolRatio
+// of its content is links and emoji, or its author published more than
+// BurstPerMin events in the last minute. Events scoring RejectScore or more
+// are rejected; events scoring ShadowScore or more are answered OK true but
+// never stored or served. A threshold of 0 is off, and only Kinds (all kinds
+// if empty) are scored.
+type SpamSettings struct {
+	RejectScore     float64       `envconfig:"REJECT_SCORE"`
+	ShadowScore     float64       `envconfig:"SHADOW_SCORE"`
+	Kinds           []int         `envconfig:"KINDS" default:"1"`
+	DuplicateWindow time.Duration `envconfig:"DUPLICATE_WINDOW" default:"1h"`
+	DuplicateWeight float64       `envconfig:"DUPLICATE_WEIGHT" default:"1"`
+	MaxLinks        int           `envconfig:"MAX_LINKS" default:"3"`
+	LinksWeight     float64       `envconfig:"LINKS_WEIGHT" default:"1"`
+	MaxSymbolRatio  float64       `envconfig:"MAX_SYMBOL_RATIO" default:"0.5"`
+	SymbolWeight    float64       `envconfig:"SYMBOL_WEIGHT" default:"1"`
+	BurstPerMin     int           `envconfig:"BURST_PER_MIN" default:"20"`
+	BurstWeight     float64       `envconfig:"BURST_WEIGHT" default:"1"`
+}
+
+func (s SpamSettings) Validate() error {
+	if s.RejectScore < 0 || s.ShadowScore < 0 {
+		return fmt.Errorf("SPAM_REJECT_SCORE and SPAM_SHADOW_SCORE must not be negative")
+	}
+	if s.DuplicateWindow < 0 || s.MaxLinks < 0 || s.BurstPerMin < 0 {
+		return fmt.Errorf("SPAM_DUPLICATE_WINDOW, SPAM_MAX_LINKS and SPAM_BURST_PER_MIN must not be negative")
+	}
+	if s.MaxSymbolRatio < 0 || s.MaxSymbolRatio > 1 {
+		return fmt.Errorf("invalid SPAM_MAX_SYMBOL_RATIO %v, expected a ratio between 0 and 1", s.MaxSymbolRatio)
+	}
+	return nil
+}
+
+func (s SpamSettings) enabled() bool {
+	return s.RejectScore > 0 || s.ShadowScore > 0
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// spamScorer scores events against SpamSettings. Only the events the relay
+// accepted count towards duplicates and bursts, so they are recorded once
+// saved, not when scored: an event another policy refuses, or a retry of
+// one, isn't held against its author. The content hashes it saw are
+// forgotten once they are older than the duplicate window.
+type spamScorer struct {
+	settings  SpamSettings
+	blackhole *blackhole
+	metrics   *Metrics
+	logger    *Logger
+	bursts    *rateLimiter
+
+	mu     sync.Mutex
+	seen   map[[32]byte]time.Time
+	pruned time.Time
+}
+
+func setupSpam(ctx context.Context, relay *khatru.Relay, blackhole *blackhole, metrics *Metrics, settings SpamSettings, logger *Logger) {
+	if !settings.enabled() {
+		return
+	}
+	s := &spamScorer{
+		settings:  settings,
+		blackhole: blackhole,
+		metrics:   metrics,
+		logger:    logger,
+		seen:      make(map[[32]byte]time.Time),
+		pruned:    time.Now(),
+	}
+	if settings.BurstPerMin > 0 {
+		s.bursts = newRateLimiter(ctx, settings.BurstPerMin)
+	}
+	relay.RejectEvent = append(relay.RejectEvent, s.RejectEvent)
+	relay.OnEventSaved = append(relay.OnEventSaved, s.record)
+	relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, s.record)
+	logger.Info("Spam filtering enabled: %+v", settings)
+}
+
+func (s *spamScorer) scored(kind int) bool {
+	return len(s.settings.Kinds) == 0 || contains(s.settings.Kinds, kind)
+}
+
+func (s *spamScorer) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if !s.scored(event.Kind) {
+		return false, ""
+	}
+
+	score, hits := s.score(event)
+	switch {
+	case s.settings.RejectScore > 0 && score >= s.settings.RejectScore:
+		s.metrics.SpamVerdict(hits, "rejected")
+		return true, fmt.Sprintf("blocked: looks like spam (%s)", strings.Join(hits, ", "))
+	case s.settings.ShadowScore > 0 && score >= s.settings.ShadowScore:
+		s.metrics.SpamVerdict(hits, "shadowed")
+		s.blackhole.swallow(event.ID)
+		s.logger.Debug("Spam: shadow-accepted event %s scoring %.2f (%s)", event.ID, score, strings.Join(hits, ", "))
+	case len(hits) > 0:
+		s.metrics.SpamVerdict(hits, "accepted")
+	}
+	return false, ""
+}
+
+// score adds up the weights of the heuristics event trips: duplicate, links,
+// symbols and burst.
+func (s *spamScorer) score(event *nostr.Event) (score float64, hits []string) {
+	hit := func(heuristic string, weight float64) {
+		score += weight
+		hits = append(hits, heuristic)
+	}
+
+	if s.settings.DuplicateWindow > 0 && s.duplicate(event.Content) {
+		hit("duplicate", s.settings.DuplicateWeight)
+	}
+	links := linkPattern.FindAllString(event.Content, -1)
+	if s.settings.MaxLinks > 0 && len(links) > s.settings.MaxLinks {
+		hit("links", s.settings.LinksWeight)
+	}
+	if s.settings.MaxSymbolRatio > 0 && symbolRatio(event.Content, links) > s.settings.MaxSymbolRatio {
+		hit("symbols", s.settings.SymbolWeight)
+	}
+	if s.bursts != nil && !s.bursts.Available(event.PubKey) {
+		hit("burst", s.settings.BurstWeight)
+	}
+	return score, hits
+}
+
+// record counts an accepted event towards its author's burst and remembers
+// its content for the duplicate window.
+func (s *spamScorer) record(ctx context.Context, event *nostr.Event) {
+	if !s.scored(event.Kind) {
+		return
+	}
+	if s.bursts != nil {
+		s.bursts.Allow(event.PubKey)
+	}
+	hash, ok := contentHash(event.Content)
+	if s.settings.DuplicateWindow <= 0 || !ok {
+		return
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.pruned) > s.settings.DuplicateWindow {
+		for h, at := range s.seen {
+			if now.Sub(at) > s.settings.DuplicateWindow {
+				delete(s.seen, h)
+			}
+		}
+		s.pruned = now
+	}
+	s.seen[hash] = now
+}
+
+// duplicate reports whether content, ignoring case and spacing, was recorded
+// within the duplicate window.
+func (s *spamScorer) duplicate(content string) bool {
+	hash, ok := contentHash(content)
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.seen[hash]
+	return ok && time.Since(at) <= s.settings.DuplicateWindow
+}
+
+// contentHash hashes content ignoring case and spacing, reporting false when
+// there is nothing to hash.
+func contentHash(content string) ([32]byte, bool) {
+	content = strings.Join(strings.Fields(strings.ToLower(content)), " ")
+	if content == "" {
+		return [32]byte{}, false
+	}
+	return sha256.Sum256([]byte(content)), true
+}
+
+// symbolRatio is the share of the characters of content that are in links
+// or are emoji and other symbols.
+func symbolRatio(content string, links []string) float64 {
+	total := len([]rune(content))
+	if total == 0 {
+		return 0
+	}
+	symbols := 0
+	for _, link := range links {
+		symbols += len([]rune(link))
+	}
+	for _, r := range linkPattern.ReplaceAllString(content, "") {
+		if unicode.Is(unicode.So, r) || unicode.Is(unicode.Sk, r) {
+			symbols++
+		}
+	}
+	return float64(symbols) / float64(total)
+}
@@ -0,0 +1,32 @@
+package testingrelay
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestSpamCountsAcceptedEvents(t *testing.T) {
+	_, url := serveTestRelay(t, func(cfg *RelayConfig) {
+		cfg.Spam = SpamSettings{RejectScore: 1, Kinds: []int{nostr.KindTextNote}, DuplicateWindow: time.Hour, DuplicateWeight: 1}
+	})
+	conn := connect(t, url)
+
+	expired := nostr.Tags{{"expiration", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)}}
+	for _, step := range []struct {
+		tags    nostr.Tags
+		refusal string
+	}{
+		// refused by a later policy, so not held against the author
+		{tags: expired, refusal: "invalid: event has expired"},
+		{},
+		{refusal: "blocked: looks like spam (duplicate)"},
+	} {
+		event := signedEvent(t, "", nostr.KindTextNote, "buy now", step.tags)
+		if refusal := publish(t, conn, event); refusal != step.refusal {
+			t.Fatalf("got refusal %q, want %q", refusal, step.refusal)
+		}
+	}
+}
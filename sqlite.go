@@ -0,0 +1,216 @@
+package testingrelay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	sqlite3driver "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteTuning sets the sqlite3 pragmas, for experimenting with storage
+// performance. Empty and zero values keep SQLite's defaults; CacheSize and
+// MmapSize take the pragmas' own units, so a negative cache size is in KiB.
+// With a CheckpointInterval the write-ahead log is checkpointed in the
+// background with CheckpointMode (passive, full, restart or truncate).
+type SQLiteTuning struct {
+	JournalMode        string        `envconfig:"JOURNAL_MODE"`
+	Synchronous        string        `envconfig:"SYNCHRONOUS"`
+	CacheSize          int           `envconfig:"CACHE_SIZE"`
+	MmapSize           int64         `envconfig:"MMAP_SIZE"`
+	BusyTimeout        time.Duration `envconfig:"BUSY_TIMEOUT"`
+	CheckpointInterval time.Duration `envconfig:"CHECKPOINT_INTERVAL"`
+	CheckpointMode     string        `envconfig:"CHECKPOINT_MODE" default:"passive"`
+}
+
+func (t SQLiteTuning) Validate() error {
+	check := func(name, value string, allowed ...string) error {
+		if value != "" && !slices.Contains(allowed, strings.ToLower(value)) {
+			return fmt.Errorf("invalid SQLITE_%s %q, expected one of %s", name, value, strings.Join(allowed, ", "))
+		}
+		return nil
+	}
+	if err := check("JOURNAL_MODE", t.JournalMode, "delete", "truncate", "persist", "memory", "wal", "off"); err != nil {
+		return err
+	}
+	if err := check("SYNCHRONOUS", t.Synchronous, "off", "normal", "full", "extra"); err != nil {
+		return err
+	}
+	if err := check("CHECKPOINT_MODE", t.CheckpointMode, "passive", "full", "restart", "truncate"); err != nil {
+		return err
+	}
+	if t.MmapSize < 0 || t.BusyTimeout < 0 || t.CheckpointInterval < 0 {
+		return fmt.Errorf("SQLITE_MMAP_SIZE, SQLITE_BUSY_TIMEOUT and SQLITE_CHECKPOINT_INTERVAL must not be negative")
+	}
+	return nil
+}
+
+// pragmas returns the statements run on every new connection.
+func (t SQLiteTuning) pragmas() []string {
+	var pragmas []string
+	if t.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", t.BusyTimeout.Milliseconds()))
+	}
+	if t.JournalMode != "" {
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+t.JournalMode)
+	}
+	if t.Synchronous != "" {
+		pragmas = append(pragmas, "PRAGMA synchronous = "+t.Synchronous)
+	}
+	if t.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", t.CacheSize))
+	}
+	if t.MmapSize > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", t.MmapSize))
+	}
+	return pragmas
+}
+
+// tuneSQLite applies the pragmas to an initialized sqlite3 store and starts
+// the checkpointer. Most pragmas only last for a connection, so the backend's
+// connection pool is swapped for one that runs them on every connection it
+// opens, except for in-memory databases, which live and die with their
+// connection. The returned function stops the checkpointer and waits for a
+// checkpoint in progress, so it must run before the store is closed; other
+// backends are left alone.
+func tuneSQLite(store eventstore.Store, tuning SQLiteTuning, logger *Logger) (stop func() error, err error) {
+	stop = func() error { return nil }
+	backend, ok := store.(*sqlite3.SQLite3Backend)
+	if !ok {
+		return stop, nil
+	}
+
+	if pragmas := tuning.pragmas(); len(pragmas) > 0 && isMemoryDSN(backend.DatabaseURL) {
+		logger.Info("Ignoring the SQLite pragmas for the in-memory database %s", backend.DatabaseURL)
+	} else if len(pragmas) > 0 {
+		connector := &sqliteConnector{
+			dsn: backend.DatabaseURL,
+			driver: &sqlite3driver.SQLiteDriver{
+				ConnectHook: func(conn *sqlite3driver.SQLiteConn) error {
+					for _, pragma := range pragmas {
+						if _, err := conn.Exec(pragma, nil); err != nil {
+							return fmt.Errorf("%s: %w", pragma, err)
+						}
+					}
+					return nil
+				},
+			},
+		}
+		tuned := sql.OpenDB(connector)
+		if err := tuned.Ping(); err != nil {
+			tuned.Close()
+			return stop, err
+		}
+		backend.DB.DB.Close()
+		backend.DB.DB = tuned
+		logger.Info("SQLite pragmas: %s", strings.Join(pragmas, "; "))
+	}
+
+	if tuning.CheckpointInterval > 0 {
+		ticker := time.NewTicker(tuning.CheckpointInterval)
+		done, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for {
+				select {
+				case <-ticker.C:
+					checkpointWAL(backend, tuning.CheckpointMode, logger)
+				case <-done:
+					return
+				}
+			}
+		}()
+		stop = func() error {
+			ticker.Stop()
+			close(done)
+			<-stopped
+			return nil
+		}
+		logger.Info("Checkpointing the write-ahead log every %s (%s)", tuning.CheckpointInterval, tuning.CheckpointMode)
+	}
+	return stop, nil
+}
+
+// isMemoryDSN reports whether dsn opens an in-memory sqlite3 database.
+func isMemoryDSN(dsn string) bool {
+	return dsn == ":memory:" || strings.HasPrefix(dsn, "file::memory:") || strings.Contains(dsn, "mode=memory")
+}
+
+// sqliteConnector opens connections through a driver with a connect hook.
+type sqliteConnector struct {
+	dsn    string
+	driver *sqlite3driver.SQLiteDriver
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+func checkpointWAL(backend *sqlite3.SQLite3Backend, mode string, logger *Logger) {
+	var busy, log, checkpointed int
+	err := backend.DB.QueryRow("PRAGMA wal_checkpoint("+strings.ToUpper(mode)+")").Scan(&busy, &log, &checkpointed)
+	if err != nil {
+		logger.Error("WAL checkpoint failed: %v", err)
+		return
+	}
+	// log is -1 when the database isn't in WAL mode
+	if log >= 0 {
+		logger.Debug("WAL checkpoint: %d of %d frames checkpointed, busy=%d", checkpointed, log, busy)
+	}
+}
+
+// handleVacuum rebuilds the sqlite3 database file (POST), which gives the
+// space of deleted events back to the filesystem, and reports the file size
+// before and after.
+func handleVacuum(store eventstore.Store, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		backend, ok := store.(*sqlite3.SQLite3Backend)
+		if !ok {
+			http.Error(w, "vacuum is only available with the sqlite3 backend", http.StatusNotImplemented)
+			return
+		}
+
+		before := fileSize(backend.DatabaseURL)
+		start := time.Now()
+		backend.Lock()
+		_, err := backend.DB.ExecContext(r.Context(), "VACUUM")
+		backend.Unlock()
+		if err != nil {
+			logger.Error("Vacuum failed: %v", err)
+			http.Error(w, "vacuum failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		after := fileSize(backend.DatabaseURL)
+		logger.Info("Database vacuumed via admin API in %s, %d bytes to %d", time.Since(start).Truncate(time.Millisecond), before, after)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"size_before": before,
+			"size_after":  after,
+			"duration_ms": time.Since(start).Milliseconds(),
+		})
+	}
+}
+
+// fileSize returns the size of the file at path, or 0 when it can't be read.
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
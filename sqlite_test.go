@@ -0,0 +1,39 @@
+package testingrelay
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestTuneSQLiteInMemory(t *testing.T) {
+	logger, err := NewLogger(io.Discard, "text", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &sqlite3.SQLite3Backend{DatabaseURL: ":memory:"}
+	if err := backend.Init(); err != nil {
+		t.Fatal(err)
+	}
+	stop, err := tuneSQLite(backend, SQLiteTuning{BusyTimeout: time.Second, CheckpointInterval: time.Millisecond}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the tables Init created are still there
+	note := signedEvent(t, "", nostr.KindTextNote, "in memory", nil)
+	if err := backend.SaveEvent(context.Background(), note); err != nil {
+		t.Fatal(err)
+	}
+	if ids := storedIDs(t, backend, nostr.Filter{IDs: []string{note.ID}}); len(ids) != 1 {
+		t.Fatalf("stored %v, want %s", ids, note.ID)
+	}
+
+	// the checkpointer is done once stopped, so the store can be closed
+	stop()
+	backend.Close()
+}
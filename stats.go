@@ -0,0 +1,262 @@
+package testingrelay
+
+import (
+	"cmp"
+	"context"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Stats counts the stored events by kind, author and day of creation, with
+// their JSON size. Like Quotas it counts the store once at startup and is
+// kept up to date through Store, so /stats never scans the database.
+type Stats struct {
+	mu      sync.Mutex
+	total   Usage
+	kinds   map[int]Usage
+	authors map[string]Usage
+	days    map[string]int64
+}
+
+func NewStats() *Stats {
+	return &Stats{kinds: make(map[int]Usage), authors: make(map[string]Usage), days: make(map[string]int64)}
+}
+
+// Load counts what is already in store.
+func (s *Stats) Load(ctx context.Context, store eventstore.Store) error {
+	return scanEvents(ctx, store, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			s.add(event, 1)
+		}
+		return nil
+	})
+}
+
+// add counts event once more, or once less with a sign of -1.
+func (s *Stats) add(event *nostr.Event, sign int64) {
+	size := sign * eventSize(event)
+	day := event.CreatedAt.Time().UTC().Format(time.DateOnly)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total.Events = max(0, s.total.Events+sign)
+	s.total.Bytes = max(0, s.total.Bytes+size)
+	addUsage(s.kinds, event.Kind, sign, size)
+	addUsage(s.authors, event.PubKey, sign, size)
+	if s.days[day] += sign; s.days[day] <= 0 {
+		delete(s.days, day)
+	}
+}
+
+func addUsage[K comparable](usage map[K]Usage, key K, events, bytes int64) {
+	used := usage[key]
+	used.Events = max(0, used.Events+events)
+	used.Bytes = max(0, used.Bytes+bytes)
+	if used.Events == 0 {
+		delete(usage, key)
+	} else {
+		usage[key] = used
+	}
+}
+
+// Stored reports whether pubkey has any events stored.
+func (s *Stats) Stored(pubkey string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.authors[pubkey]
+	return ok
+}
+
+// authorUsage is what one author has stored.
+type authorUsage struct {
+	Pubkey string `json:"pubkey"`
+	Usage
+}
+
+// statsReport is what /stats answers.
+type statsReport struct {
+	Events     int64            `json:"events"`
+	Bytes      int64            `json:"bytes"`
+	Authors    int              `json:"authors"`
+	SizeBytes  int64            `json:"db_size_bytes,omitempty"`
+	Kinds      map[int]Usage    `json:"kinds"`
+	TopAuthors []authorUsage    `json:"top_authors"`
+	Days       map[string]int64 `json:"days"`
+}
+
+// Report returns the totals with the top authors by events and the days
+// events were created on, the latest days of them if days is above 0.
+func (s *Stats) Report(top, days int) statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := statsReport{
+		Events:     s.total.Events,
+		Bytes:      s.total.Bytes,
+		Authors:    len(s.authors),
+		Kinds:      make(map[int]Usage, len(s.kinds)),
+		TopAuthors: make([]authorUsage, 0, len(s.authors)),
+		Days:       make(map[string]int64),
+	}
+	for kind, used := range s.kinds {
+		report.Kinds[kind] = used
+	}
+	for pubkey, used := range s.authors {
+		report.TopAuthors = append(report.TopAuthors, authorUsage{Pubkey: pubkey, Usage: used})
+	}
+	slices.SortFunc(report.TopAuthors, func(a, b authorUsage) int {
+		return cmp.Or(cmp.Compare(b.Events, a.Events), cmp.Compare(b.Bytes, a.Bytes), cmp.Compare(a.Pubkey, b.Pubkey))
+	})
+	report.TopAuthors = report.TopAuthors[:min(top, len(report.TopAuthors))]
+
+	dates := make([]string, 0, len(s.days))
+	for day := range s.days {
+		dates = append(dates, day)
+	}
+	slices.Sort(dates)
+	if days > 0 && len(dates) > days {
+		dates = dates[len(dates)-days:]
+	}
+	for _, day := range dates {
+		report.Days[day] = s.days[day]
+	}
+	return report
+}
+
+// Store wraps an eventstore so writes and deletions update the counts.
+func (s *Stats) Store(store eventstore.Store) eventstore.Store {
+	return &statsStore{Store: store, stats: s}
+}
+
+type statsStore struct {
+	eventstore.Store
+	stats *Stats
+	// replacing serializes the replacements of each author, as in
+	// quotaStore
+	replacing keyedMutex
+}
+
+func (s *statsStore) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if isReplaceable(event.Kind) {
+		return s.ReplaceEvent(ctx, event)
+	}
+	err := s.Store.SaveEvent(ctx, event)
+	if err == nil {
+		s.stats.add(event, 1)
+	}
+	return err
+}
+
+// ReplaceEvent compares the stored versions before and after, like
+// quotaStore does, since their sizes and days differ.
+func (s *statsStore) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	defer s.replacing.Lock(event.PubKey)()
+
+	filter := addressFilter(event)
+	before := s.versions(ctx, filter)
+	if err := s.Store.ReplaceEvent(ctx, event); err != nil {
+		return err
+	}
+	after := s.versions(ctx, filter)
+	for id, version := range before {
+		if _, ok := after[id]; !ok {
+			s.stats.add(version, -1)
+		}
+	}
+	for id, version := range after {
+		if _, ok := before[id]; !ok {
+			s.stats.add(version, 1)
+		}
+	}
+	return nil
+}
+
+func (s *statsStore) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	err := s.Store.DeleteEvent(ctx, event)
+	if err == nil {
+		s.stats.add(event, -1)
+	}
+	return err
+}
+
+func (s *statsStore) versions(ctx context.Context, filter nostr.Filter) map[string]*nostr.Event {
+	versions := make(map[string]*nostr.Event)
+	ch, err := s.Store.QueryEvents(ctx, filter)
+	if err != nil {
+		return versions
+	}
+	for event := range ch {
+		versions[event.ID] = event
+	}
+	return versions
+}
+
+// storeSize returns the size on disk of the stores of cfg, shards
+// included, or 0 for postgres and ephemeral relays.
+func storeSize(cfg *RelayConfig) int64 {
+	if cfg.Ephemeral {
+		return 0
+	}
+	var size int64
+	for _, store := range append([]Shard{{Backend: cfg.DBBackend, Path: cfg.DBPath}}, cfg.Shards...) {
+		if store.Backend == "" {
+			store.Backend = cfg.DBBackend
+		}
+		if store.Backend == "postgres" || store.Path == "" {
+			continue
+		}
+		// lmdb and badger keep a directory
+		filepath.WalkDir(store.Path, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				size += fileSize(path)
+			}
+			return nil
+		})
+		if store.Backend == "sqlite3" {
+			size += fileSize(store.Path + "-wal")
+		}
+	}
+	return size
+}
+
+// handleStats reports the stored events by kind, the top authors (top=20)
+// and the events per day of creation (the latest days=N, all by default),
+// with the size of the database. It is an admin route, as the top authors
+// are per-pubkey usage like /admin/quotas.
+func handleStats(stats *Stats, live *LiveConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		top := 20
+		if value := r.URL.Query().Get("top"); value != "" {
+			var err error
+			if top, err = strconv.Atoi(value); err != nil || top < 0 {
+				http.Error(w, "invalid top, expected a count", http.StatusBadRequest)
+				return
+			}
+		}
+		days := 0
+		if value := r.URL.Query().Get("days"); value != "" {
+			var err error
+			if days, err = strconv.Atoi(value); err != nil || days < 0 {
+				http.Error(w, "invalid days, expected a count", http.StatusBadRequest)
+				return
+			}
+		}
+
+		report := stats.Report(top, days)
+		report.SizeBytes = storeSize(live.Load())
+		writeJSON(w, http.StatusOK, report)
+	}
+}
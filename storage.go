@@ -0,0 +1,207 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/badger"
+	"github.com/fiatjaf/eventstore/lmdb"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/fiatjaf/eventstore/sqlite3"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// scanPageSize stays under the query limit of every backend.
+const scanPageSize = 100
+
+// scanQueryLimit caps the queries of the sqlite3, postgres and memory
+// backends, raised from their defaults so that scans can list every event
+// sharing a timestamp. lmdb and badger lift their own cap for negentropy
+// sessions, which scans are.
+const scanQueryLimit = 1 << 20
+
+// defaultQueryLimits are the limits REQs got from the backends before their
+// caps were raised, still applied to REQs asking for more or for no limit.
+var defaultQueryLimits = map[string]int{"sqlite3": 100, "postgres": 100, "memory": 500}
+
+// NewStore returns the eventstore implementation selected by DB_BACKEND.
+// DB_PATH is interpreted by each backend: a file for sqlite3, a directory for
+// lmdb and badger, and a connection URL for postgres. Ephemeral mode always
+// uses the in-memory store so nothing is written to disk. LMDB_MAP_SIZE caps
+// the size of an lmdb database, 0 leaving the backend's default of 256GiB.
+// With shards the kinds they hold go to stores of their own, see Shard.
+func NewStore(cfg *RelayConfig) (eventstore.Store, error) {
+	if len(cfg.Shards) > 0 {
+		primary := *cfg
+		primary.Shards = nil
+		store, err := NewStore(&primary)
+		if err != nil {
+			return nil, err
+		}
+		return newShardedStore(store, cfg)
+	}
+	if cfg.Ephemeral {
+		return &slicestore.SliceStore{MaxLimit: scanQueryLimit}, nil
+	}
+
+	switch cfg.DBBackend {
+	case "sqlite3":
+		return &sqlite3.SQLite3Backend{DatabaseURL: cfg.DBPath, QueryLimit: scanQueryLimit}, nil
+	case "lmdb":
+		if cfg.LMDBMapSize < 0 {
+			return nil, fmt.Errorf("LMDB_MAP_SIZE must not be negative")
+		}
+		return &lmdb.LMDBBackend{Path: cfg.DBPath, MapSize: cfg.LMDBMapSize}, nil
+	case "badger":
+		return &badger.BadgerBackend{Path: cfg.DBPath}, nil
+	case "postgres":
+		return &postgresql.PostgresBackend{DatabaseURL: cfg.DBPath, QueryLimit: scanQueryLimit}, nil
+	case "memory":
+		return &slicestore.SliceStore{MaxLimit: scanQueryLimit}, nil
+	default:
+		return nil, fmt.Errorf("unknown database backend %q, expected one of sqlite3, lmdb, badger, postgres, memory", cfg.DBBackend)
+	}
+}
+
+// attachStore wires the store into the relay's persistence hooks.
+func attachStore(relay *khatru.Relay, store eventstore.Store) {
+	relay.StoreEvent = append(relay.StoreEvent, store.SaveEvent)
+	relay.ReplaceEvent = append(relay.ReplaceEvent, store.ReplaceEvent)
+	relay.QueryEvents = append(relay.QueryEvents, store.QueryEvents)
+	relay.DeleteEvent = append(relay.DeleteEvent, store.DeleteEvent)
+
+	if counter, ok := store.(eventstore.Counter); ok {
+		relay.CountEvents = append(relay.CountEvents, counter.CountEvents)
+	}
+}
+
+// setupQueryLimit keeps the limits REQs get from the backends whose caps
+// NewStore raised.
+func setupQueryLimit(relay *khatru.Relay, cfg *RelayConfig) {
+	backend := cfg.DBBackend
+	if cfg.Ephemeral {
+		backend = "memory"
+	}
+	max, ok := defaultQueryLimits[backend]
+	if !ok {
+		return
+	}
+	relay.OverwriteFilter = append(relay.OverwriteFilter, func(ctx context.Context, filter *nostr.Filter) {
+		if !filter.LimitZero && (filter.Limit == 0 || filter.Limit > max) {
+			filter.Limit = max
+		}
+	})
+}
+
+// scanEvents calls fn with every stored event matching filter, a page at a time
+// and newest first. Backends cap how many events a query returns, so it pages
+// backwards by created_at, listing a timestamp shared by more than a page of
+// events at once.
+func scanEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, fn func(events []*nostr.Event) error) error {
+	return scanQuery(ctx, store.QueryEvents, filter, fn)
+}
+
+// scanQuery is scanEvents over a QueryEvents function.
+func scanQuery(ctx context.Context, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter, fn func(events []*nostr.Event) error) error {
+	ctx = eventstore.SetNegentropy(ctx)
+	filter.Limit = scanPageSize
+
+	// ids already seen at the oldest timestamp, which the next page repeats
+	seen := make(map[string]bool)
+	var oldest nostr.Timestamp
+	for {
+		events, err := collectQuery(ctx, query, filter)
+		if err != nil {
+			return err
+		}
+
+		var page []*nostr.Event
+		for _, event := range events {
+			if seen[event.ID] {
+				continue
+			}
+			if oldest == 0 || event.CreatedAt < oldest {
+				oldest = event.CreatedAt
+				clear(seen)
+			}
+			seen[event.ID] = true
+			page = append(page, event)
+		}
+
+		if len(page) > 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+			filter.Until = &oldest
+			continue
+		}
+		if len(events) < filter.Limit || ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// a full page of events already seen: more than a page of them
+		// share the oldest timestamp, listed on their own before moving on
+		crowded, err := eventsAt(ctx, query, filter, oldest)
+		if err != nil {
+			return err
+		}
+		page = slices.DeleteFunc(crowded, func(event *nostr.Event) bool { return seen[event.ID] })
+		if len(page) > 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+		until := oldest - 1
+		filter.Until = &until
+		oldest = until
+		clear(seen)
+	}
+}
+
+// eventsAt lists the events matching filter created at one timestamp,
+// raising the limit until the query returns fewer events than asked for.
+func eventsAt(ctx context.Context, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter, at nostr.Timestamp) ([]*nostr.Event, error) {
+	filter.Since, filter.Until = &at, &at
+	for limit := scanPageSize * 10; ; limit *= 10 {
+		filter.Limit = min(limit, scanQueryLimit)
+		events, err := collectQuery(ctx, query, filter)
+		if err != nil || len(events) < filter.Limit {
+			return events, err
+		}
+		if filter.Limit == scanQueryLimit {
+			return nil, fmt.Errorf("more than %d events created at %d", scanQueryLimit, at)
+		}
+	}
+}
+
+// collectQuery runs a query and reads all of its events.
+func collectQuery(ctx context.Context, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter) ([]*nostr.Event, error) {
+	ch, err := query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var events []*nostr.Event
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// wipeEvents deletes every stored event and returns how many it deleted.
+func wipeEvents(ctx context.Context, store eventstore.Store) (int, error) {
+	deleted := 0
+	err := scanEvents(ctx, store, nostr.Filter{}, func(events []*nostr.Event) error {
+		for _, event := range events {
+			if err := store.DeleteEvent(ctx, event); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
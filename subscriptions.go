@@ -0,0 +1,169 @@
+package testingrelay
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// inspectedConn is a live connection as listed on /admin/subscriptions.
+type inspectedConn struct {
+	ID            uint64             `json:"id"`
+	RemoteAddr    string             `json:"remote_addr"`
+	IP            string             `json:"ip"`
+	UserAgent     string             `json:"user_agent"`
+	Authed        string             `json:"authed,omitempty"`
+	ConnectedAt   time.Time          `json:"connected_at"`
+	QueueDepth    int                `json:"queue_depth"`
+	Subscriptions []wireSubscription `json:"subscriptions"`
+}
+
+// handleSubscriptions lists every live connection with its open subscriptions,
+// their filters exactly as the client sent them and how many events each one
+// was delivered. The pubkey and ip parameters narrow it down to the
+// connections authenticated as a pubkey or coming from an address.
+func handleSubscriptions(wire *wireServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var pubkey string
+		if value := r.URL.Query().Get("pubkey"); value != "" {
+			var err error
+			if pubkey, err = parsePubkey(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		ip := r.URL.Query().Get("ip")
+
+		conns := []inspectedConn{}
+		for _, conn := range wire.Conns() {
+			inspected := inspectedConn{
+				ID:            conn.ID(),
+				RemoteAddr:    conn.request.RemoteAddr,
+				UserAgent:     conn.request.UserAgent(),
+				Authed:        conn.Authed(),
+				ConnectedAt:   conn.connectedAt,
+				QueueDepth:    conn.QueueDepth(),
+				Subscriptions: conn.Subscriptions(),
+			}
+			if ctx := conn.Context(); ctx != nil {
+				inspected.IP = khatru.GetIP(ctx)
+			}
+			if (pubkey != "" && inspected.Authed != pubkey) || (ip != "" && inspected.IP != ip) {
+				continue
+			}
+			sort.Slice(inspected.Subscriptions, func(i, j int) bool {
+				return inspected.Subscriptions[i].OpenedAt.Before(inspected.Subscriptions[j].OpenedAt)
+			})
+			conns = append(conns, inspected)
+		}
+		sort.Slice(conns, func(i, j int) bool {
+			return conns[i].ID < conns[j].ID
+		})
+
+		writeJSON(w, http.StatusOK, conns)
+	}
+}
+
+const (
+	killedConnReason = "closed by the relay admin"
+	killedSubReason  = "error: subscription closed by the relay admin"
+)
+
+// closedMessages are the messages of the standard CLOSED reason prefixes,
+// for when only the prefix is given.
+var closedMessages = map[string]string{
+	"auth-required": "this subscription needs authentication",
+	"rate-limited":  "slow down, too many subscriptions",
+	"error":         "subscription closed by the relay",
+	"duplicate":     "a subscription with this id is already open",
+	"restricted":    "not allowed to read this",
+	"blocked":       "not allowed to read this",
+	"invalid":       "invalid filter",
+	"unsupported":   "this filter is not supported",
+}
+
+// closedReason expands a bare standard prefix like rate-limited into a full
+// CLOSED reason and leaves anything else alone.
+func closedReason(reason string) string {
+	if message, ok := closedMessages[reason]; ok {
+		return reason + ": " + message
+	}
+	return reason
+}
+
+// handleKillConnection closes the connection with the id in the path (DELETE),
+// with the close reason given as reason, or drops it without a close
+// handshake with abort=true.
+func handleKillConnection(wire *wireServer, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		conn, ok := lookupConn(w, r, wire)
+		if !ok {
+			return
+		}
+
+		if abort, _ := strconv.ParseBool(r.URL.Query().Get("abort")); abort {
+			conn.Abort()
+			logger.Info("Aborted connection %d via admin API", conn.ID())
+		} else {
+			reason := r.URL.Query().Get("reason")
+			if reason == "" {
+				reason = killedConnReason
+			}
+			conn.Disconnect(closeNormal, reason)
+			logger.Info("Closed connection %d via admin API: %s", conn.ID(), reason)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleKillSubscription ends the subscription in the path with CLOSED
+// (DELETE), with reason as the CLOSED message.
+func handleKillSubscription(wire *wireServer, logger *Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		conn, ok := lookupConn(w, r, wire)
+		if !ok {
+			return
+		}
+
+		id := r.PathValue("sub")
+		reason := closedReason(r.URL.Query().Get("reason"))
+		if reason == "" {
+			reason = killedSubReason
+		}
+		if !conn.KillSubscription(id, reason) {
+			http.Error(w, "no open subscription "+strconv.Quote(id), http.StatusNotFound)
+			return
+		}
+		logger.Info("Closed subscription %q of connection %d via admin API: %s", id, conn.ID(), reason)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func lookupConn(w http.ResponseWriter, r *http.Request, wire *wireServer) (*wireConn, bool) {
+	id, err := strconv.ParseUint(r.PathValue("conn"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return nil, false
+	}
+	conn, ok := wire.Conn(id)
+	if !ok {
+		http.Error(w, "no connection "+r.PathValue("conn"), http.StatusNotFound)
+	}
+	return conn, ok
+}
@@ -0,0 +1,65 @@
+package testingrelay
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Throttle shapes outbound websocket traffic (THROTTLE_*) to simulate a
+// constrained link: BytesPerSec is shared by every connection of the relay
+// and ConnBytesPerSec applies to each connection on its own. 0 leaves a limit
+// off. Messages are written whole, so a message bigger than a second's worth
+// goes out in one piece and the ones after it wait longer.
+type Throttle struct {
+	BytesPerSec     int `envconfig:"BYTES_PER_SEC"`
+	ConnBytesPerSec int `envconfig:"CONN_BYTES_PER_SEC"`
+}
+
+func (t Throttle) Validate() error {
+	if t.BytesPerSec < 0 || t.ConnBytesPerSec < 0 {
+		return fmt.Errorf("THROTTLE_BYTES_PER_SEC and THROTTLE_CONN_BYTES_PER_SEC must not be negative")
+	}
+	return nil
+}
+
+// byteLimiter spaces out writes so they average rate bytes per second. A nil
+// limiter doesn't limit.
+type byteLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+func newByteLimiter(rate int) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: float64(rate)}
+}
+
+// reserve books n bytes and returns how long to wait before writing them.
+func (l *byteLimiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	return wait
+}
+
+func setupThrottle(wire *wireServer, settings Throttle, logger *Logger) {
+	if settings.BytesPerSec == 0 && settings.ConnBytesPerSec == 0 {
+		return
+	}
+	wire.throttle = newByteLimiter(settings.BytesPerSec)
+	wire.connThrottle = settings.ConnBytesPerSec
+	logger.Info("Throttling outbound traffic to %d bytes/s in total and %d bytes/s per connection (0 is unlimited)", settings.BytesPerSec, settings.ConnBytesPerSec)
+}
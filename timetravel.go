@@ -0,0 +1,54 @@
+package testingrelay
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// timeTravelHeader sets the time travel point of one connection, a Unix
+// timestamp or 0 to turn it off, overriding TIME_TRAVEL.
+const timeTravelHeader = "X-Time-Travel"
+
+// setupTimeTravel answers REQs as if it were the time travel point:
+// stored events created after it are left out, until is capped to it and
+// live events, all newer, aren't delivered. COUNTs aren't affected.
+func setupTimeTravel(relay *khatru.Relay, live *LiveConfig, logger *Logger) {
+	relay.OverwriteFilter = append(relay.OverwriteFilter, func(ctx context.Context, filter *nostr.Filter) {
+		ws := khatru.GetConnection(ctx)
+		if ws == nil {
+			return
+		}
+		if at, ok := timeTravelPoint(ws.Request, live); ok && (filter.Until == nil || *filter.Until > at) {
+			filter.Until = &at
+		}
+	})
+	relay.PreventBroadcast = append(relay.PreventBroadcast, func(ws *khatru.WebSocket, event *nostr.Event) bool {
+		if ws == nil {
+			return false
+		}
+		at, ok := timeTravelPoint(ws.Request, live)
+		return ok && event.CreatedAt > at
+	})
+
+	if at := live.Load().TimeTravel; at > 0 {
+		logger.Info("Time travel: answering REQs as of %s", nostr.Timestamp(at).Time().UTC())
+	}
+}
+
+// timeTravelPoint returns the time the connection of r travels to, if any.
+// Invalid headers are ignored.
+func timeTravelPoint(r *http.Request, live *LiveConfig) (nostr.Timestamp, bool) {
+	at := live.Load().TimeTravel
+	if r != nil {
+		if value := r.Header.Get(timeTravelHeader); value != "" {
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+				at = n
+			}
+		}
+	}
+	return nostr.Timestamp(at), at > 0
+}
@@ -0,0 +1,61 @@
+package testingrelay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSSettings lets the relay serve wss:// itself, either with a certificate
+// and key from disk or with Let's Encrypt certificates for Domain.
+type TLSSettings struct {
+	Cert     string `envconfig:"CERT"`
+	Key      string `envconfig:"KEY"`
+	Domain   string `envconfig:"DOMAIN"`
+	Email    string `envconfig:"EMAIL"`
+	CacheDir string `envconfig:"CACHE_DIR" default:"./autocert"`
+}
+
+func (s TLSSettings) Enabled() bool {
+	return s.Cert != "" || s.Domain != ""
+}
+
+func (s TLSSettings) Validate() error {
+	if (s.Cert == "") != (s.Key == "") {
+		return fmt.Errorf("TLS_CERT and TLS_KEY must be set together")
+	}
+	if s.Cert != "" && s.Domain != "" {
+		return fmt.Errorf("TLS_DOMAIN can't be combined with TLS_CERT")
+	}
+	return nil
+}
+
+// serve serves plain HTTP on lis, or HTTPS when TLS is configured. Domain
+// certificates are obtained through the TLS-ALPN-01 challenge, so the relay
+// must be reachable on port 443 under that name. Hosts are the other names
+// certificates are obtained for, those of the virtual relays.
+//
+// HTTP/2 is left out: websockets need HTTP/1.1 to hijack the connection.
+func serve(server *http.Server, lis net.Listener, settings TLSSettings, hosts []string) error {
+	if !settings.Enabled() {
+		return server.Serve(lis)
+	}
+
+	server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	if settings.Cert != "" {
+		return server.ServeTLS(lis, settings.Cert, settings.Key)
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(settings.CacheDir),
+		HostPolicy: autocert.HostWhitelist(append([]string{settings.Domain}, hosts...)...),
+		Email:      settings.Email,
+	}
+	server.TLSConfig = manager.TLSConfig()
+	server.TLSConfig.NextProtos = []string{"http/1.1", "acme-tls/1"}
+	return server.ServeTLS(lis, "", "")
+}
@@ -0,0 +1,484 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceTimeout ends the traces whose OK or EOSE never went out, like when the
+// client disconnected first.
+const traceTimeout = time.Minute
+
+// maxFilterAttribute bounds the filters recorded on REQ spans.
+const maxFilterAttribute = 1024
+
+type traceKey struct {
+	conn *wireConn // nil for events added without a client
+	id   string    // event or subscription id
+}
+
+// eventTrace follows an event from the wire to its OK. Its spans are the
+// reject hooks, the store and the broadcast to subscribers.
+type eventTrace struct {
+	ctx        context.Context // carries the root span
+	span       trace.Span
+	started    time.Time
+	broadcast  time.Time // when storing finished, zero until then
+	recipients int
+}
+
+// reqTrace follows a REQ until its EOSE or CLOSED.
+type reqTrace struct {
+	ctx     context.Context
+	span    trace.Span
+	started time.Time
+	events  int
+}
+
+// Tracing exports OpenTelemetry spans for event ingestion and queries over
+// OTLP/HTTP. The exporter reads the standard OTEL_EXPORTER_OTLP_* variables
+// and the resource OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+type Tracing struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+
+	mu     sync.Mutex
+	events map[traceKey]*eventTrace
+	byID   map[string]*eventTrace
+	reqs   map[traceKey]*reqTrace
+
+	done    chan struct{}
+	closing sync.Once
+}
+
+// setupTracing returns nil unless OTEL_EXPORTER_OTLP_ENDPOINT (or the traces
+// specific variable) is set.
+func setupTracing(ctx context.Context, logger *Logger) (*Tracing, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("khatru-relay"), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+
+	logger.Info("Exporting traces to %s", endpoint)
+	t := &Tracing{
+		provider: provider,
+		tracer:   provider.Tracer("khatru-relay"),
+		events:   make(map[traceKey]*eventTrace),
+		byID:     make(map[string]*eventTrace),
+		reqs:     make(map[traceKey]*reqTrace),
+		done:     make(chan struct{}),
+	}
+	go t.sweep()
+	return t, nil
+}
+
+// Shutdown stops the sweep and flushes the spans not exported yet.
+func (t *Tracing) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+	t.closing.Do(func() { close(t.done) })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return t.provider.Shutdown(ctx)
+}
+
+// Attach wraps the reject, store, filter and query hooks in spans and
+// follows the messages on the wire. It must run after every other hook is
+// installed.
+func (t *Tracing) Attach(relay *khatru.Relay, wire *wireServer) {
+	if t == nil {
+		return
+	}
+
+	for i, reject := range relay.RejectEvent {
+		name := "reject " + hookName(reject)
+		last := i == len(relay.RejectEvent)-1
+		relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+			et := t.eventTrace(ctx, event)
+			_, span := t.tracer.Start(et.ctx, name)
+			reject, msg := reject(ctx, event)
+			if reject {
+				span.SetStatus(codes.Error, msg)
+			}
+			span.End()
+			// ephemeral events go straight to the subscribers
+			if last && !reject {
+				t.stored(et)
+			}
+			return reject, msg
+		}
+	}
+	t.wrapStore(relay.StoreEvent, "store")
+	t.wrapStore(relay.ReplaceEvent, "replace")
+
+	for i, reject := range relay.RejectFilter {
+		name := "reject_filter " + hookName(reject)
+		relay.RejectFilter[i] = func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			rt := t.reqTrace(ctx)
+			if rt == nil {
+				return reject(ctx, filter)
+			}
+			_, span := t.tracer.Start(rt.ctx, name)
+			reject, msg := reject(ctx, filter)
+			if reject {
+				span.SetStatus(codes.Error, msg)
+			}
+			span.End()
+			return reject, msg
+		}
+	}
+	for i, query := range relay.QueryEvents {
+		relay.QueryEvents[i] = func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+			rt := t.reqTrace(ctx)
+			if rt == nil {
+				return query(ctx, filter)
+			}
+			return t.traceQuery(ctx, rt, query, filter)
+		}
+	}
+
+	wire.inbound = append(wire.inbound, t.inbound)
+	wire.outbound = append(wire.outbound, t.outbound)
+}
+
+func (t *Tracing) wrapStore(hooks []func(ctx context.Context, event *nostr.Event) error, name string) {
+	for i, store := range hooks {
+		hooks[i] = func(ctx context.Context, event *nostr.Event) error {
+			et := t.eventTrace(ctx, event)
+			_, span := t.tracer.Start(et.ctx, name)
+			err := store(ctx, event)
+			switch {
+			case err == eventstore.ErrDupEvent:
+				span.SetAttributes(attribute.Bool("nostr.duplicate", true))
+			case err != nil:
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
+			t.stored(et)
+			return err
+		}
+	}
+}
+
+// traceQuery runs the query in a span that lasts until its results are all
+// handed over.
+func (t *Tracing) traceQuery(ctx context.Context, rt *reqTrace, query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error), filter nostr.Filter) (chan *nostr.Event, error) {
+	_, span := t.tracer.Start(rt.ctx, "query", trace.WithAttributes(attribute.String("nostr.filter", filter.String())))
+	ch, err := query(ctx, filter)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return ch, err
+	}
+	if ch == nil {
+		span.End()
+		return nil, nil
+	}
+
+	out := make(chan *nostr.Event)
+	go func() {
+		defer close(out)
+		count := 0
+		for event := range ch {
+			out <- event
+			count++
+		}
+		span.SetAttributes(attribute.Int("nostr.events", count))
+		span.End()
+	}()
+	return out, nil
+}
+
+// eventTrace returns the trace of an event being added. Events added without
+// a client, like mirrored or imported ones, start their trace here and end it
+// when AddEvent returns.
+func (t *Tracing) eventTrace(ctx context.Context, event *nostr.Event) *eventTrace {
+	key := traceKey{conn: getWireConn(khatru.GetConnection(ctx)), id: event.ID}
+
+	t.mu.Lock()
+	et, ok := t.events[key]
+	if !ok {
+		et = t.startEvent(key, event.ID, event.Kind, event.PubKey)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		context.AfterFunc(ctx, func() {
+			t.endEvent(key, true, "")
+		})
+	}
+	return et
+}
+
+// startEvent must be called with t.mu held.
+func (t *Tracing) startEvent(key traceKey, id string, kind int, pubkey string) *eventTrace {
+	ctx, span := t.tracer.Start(context.Background(), "EVENT",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("nostr.event.id", id),
+			attribute.Int("nostr.event.kind", kind),
+			attribute.String("nostr.event.pubkey", pubkey),
+		),
+	)
+	et := &eventTrace{ctx: ctx, span: span, started: time.Now()}
+	t.events[key] = et
+	t.byID[id] = et
+	return et
+}
+
+// stored marks the start of the broadcast.
+func (t *Tracing) stored(et *eventTrace) {
+	t.mu.Lock()
+	et.broadcast = time.Now()
+	t.mu.Unlock()
+}
+
+func (t *Tracing) endEvent(key traceKey, ok bool, reason string) {
+	t.mu.Lock()
+	et, found := t.events[key]
+	if !found {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.events, key)
+	if t.byID[key.id] == et {
+		delete(t.byID, key.id)
+	}
+	broadcast, recipients := et.broadcast, et.recipients
+	t.mu.Unlock()
+
+	if !broadcast.IsZero() {
+		_, span := t.tracer.Start(et.ctx, "broadcast",
+			trace.WithTimestamp(broadcast),
+			trace.WithAttributes(attribute.Int("nostr.recipients", recipients)),
+		)
+		span.End()
+	}
+	et.span.SetAttributes(attribute.Bool("nostr.ok", ok))
+	if !ok {
+		et.span.SetStatus(codes.Error, reason)
+	}
+	et.span.End()
+}
+
+func (t *Tracing) reqTrace(ctx context.Context) *reqTrace {
+	conn := getWireConn(khatru.GetConnection(ctx))
+	if conn == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reqs[traceKey{conn: conn, id: khatru.GetSubscriptionID(ctx)}]
+}
+
+func (t *Tracing) startReq(key traceKey, filters []json.RawMessage) {
+	var raw []string
+	for _, filter := range filters {
+		raw = append(raw, string(filter))
+	}
+	summary := strings.Join(raw, ",")
+	if len(summary) > maxFilterAttribute {
+		summary = summary[:maxFilterAttribute] + "..."
+	}
+
+	ctx, span := t.tracer.Start(context.Background(), "REQ",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("nostr.subscription", key.id),
+			attribute.Int("nostr.filters", len(filters)),
+			attribute.String("nostr.filter", summary),
+		),
+	)
+
+	t.endReq(key, "replaced by a new REQ")
+	t.mu.Lock()
+	t.reqs[key] = &reqTrace{ctx: ctx, span: span, started: time.Now()}
+	t.mu.Unlock()
+}
+
+// endReq ends the subscription's trace, as an error if reason isn't empty.
+func (t *Tracing) endReq(key traceKey, reason string) {
+	t.mu.Lock()
+	rt, found := t.reqs[key]
+	delete(t.reqs, key)
+	var events int
+	if found {
+		events = rt.events
+	}
+	t.mu.Unlock()
+	if !found {
+		return
+	}
+
+	rt.span.SetAttributes(attribute.Int("nostr.events", events))
+	if reason != "" {
+		rt.span.SetStatus(codes.Error, reason)
+	}
+	rt.span.End()
+}
+
+func (t *Tracing) inbound(conn *wireConn, msg *wireMessage) {
+	env := msg.Envelope()
+	if len(env) < 2 {
+		return
+	}
+
+	switch msg.Label() {
+	case "EVENT":
+		var event struct {
+			ID     string `json:"id"`
+			Kind   int    `json:"kind"`
+			PubKey string `json:"pubkey"`
+		}
+		if json.Unmarshal(env[1], &event) != nil {
+			return
+		}
+		t.mu.Lock()
+		t.startEvent(traceKey{conn: conn, id: event.ID}, event.ID, event.Kind, event.PubKey)
+		t.mu.Unlock()
+
+	case "REQ":
+		var id string
+		if json.Unmarshal(env[1], &id) == nil {
+			t.startReq(traceKey{conn: conn, id: id}, env[2:])
+		}
+
+	case "CLOSE":
+		var id string
+		if json.Unmarshal(env[1], &id) == nil {
+			t.endReq(traceKey{conn: conn, id: id}, "closed by the client before EOSE")
+		}
+	}
+}
+
+func (t *Tracing) outbound(conn *wireConn, msg *wireMessage) {
+	env := msg.Envelope()
+	if len(env) < 2 {
+		return
+	}
+	var id string
+	json.Unmarshal(env[1], &id)
+
+	switch msg.Label() {
+	case "OK":
+		var ok bool
+		var reason string
+		if len(env) > 3 {
+			json.Unmarshal(env[2], &ok)
+			json.Unmarshal(env[3], &reason)
+		}
+		t.endEvent(traceKey{conn: conn, id: id}, ok, reason)
+
+	case "EVENT":
+		var event struct {
+			ID string `json:"id"`
+		}
+		if len(env) > 2 {
+			json.Unmarshal(env[2], &event)
+		}
+		t.mu.Lock()
+		if rt, ok := t.reqs[traceKey{conn: conn, id: id}]; ok {
+			rt.events++
+		}
+		if et, ok := t.byID[event.ID]; ok && !et.broadcast.IsZero() {
+			et.recipients++
+		}
+		t.mu.Unlock()
+
+	case "EOSE":
+		t.endReq(traceKey{conn: conn, id: id}, "")
+
+	case "CLOSED":
+		var reason string
+		if len(env) > 2 {
+			json.Unmarshal(env[2], &reason)
+		}
+		t.endReq(traceKey{conn: conn, id: id}, reason)
+	}
+}
+
+// sweep ends the traces left open for longer than traceTimeout.
+func (t *Tracing) sweep() {
+	ticker := time.NewTicker(traceTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+
+		cutoff := time.Now().Add(-traceTimeout)
+
+		var events, reqs []traceKey
+		t.mu.Lock()
+		for key, et := range t.events {
+			if et.started.Before(cutoff) {
+				events = append(events, key)
+			}
+		}
+		for key, rt := range t.reqs {
+			if rt.started.Before(cutoff) {
+				reqs = append(reqs, key)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, key := range events {
+			t.endEvent(key, false, "no OK was sent")
+		}
+		for _, key := range reqs {
+			t.endReq(key, "no EOSE was sent")
+		}
+	}
+}
+
+// hookName names a hook after the function implementing it.
+func hookName(fn any) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return strings.TrimSuffix(strings.TrimPrefix(name, "github.com/gzuuus/testing-relay."), "-fm")
+}
+
+// policyNames names the RejectEvent policies installed so far, by index. The
+// hooks wrapping them keep their place, so the names stay valid after that.
+func policyNames(relay *khatru.Relay) []string {
+	names := make([]string, len(relay.RejectEvent))
+	for i, reject := range relay.RejectEvent {
+		names[i] = hookName(reject)
+	}
+	return names
+}
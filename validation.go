@@ -0,0 +1,236 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// EventChecks set how strictly events are checked. Mode sets the
+// defaults: strict runs every check, lenient (the default) only verifies ids
+// and signatures, like most relays, and off accepts events whatever their id,
+// signature, timestamp or tags. Each check can be turned on or off on its own
+// too, and then Mode doesn't apply to it. The created_at check applies
+// MAX_FUTURE_SECONDS and MAX_PAST_SECONDS, or defaults when they aren't set.
+// The media check holds NIP-94 file metadata and NIP-71 videos to their
+// url, m and x tags.
+type EventChecks struct {
+	Mode      string `envconfig:"MODE" default:"lenient"`
+	Signature *bool  `envconfig:"SIGNATURE"`
+	ID        *bool  `envconfig:"ID"`
+	CreatedAt *bool  `envconfig:"CREATED_AT"`
+	Tags      *bool  `envconfig:"TAGS"`
+	Media     *bool  `envconfig:"MEDIA"`
+}
+
+func (s EventChecks) Validate() error {
+	switch s.Mode {
+	case "strict", "lenient", "off":
+		return nil
+	default:
+		return fmt.Errorf("invalid VALIDATION_MODE %q, expected strict, lenient or off", s.Mode)
+	}
+}
+
+// validationChecks are the checks in effect, with the overrides applied.
+type validationChecks struct {
+	Signature bool
+	ID        bool
+	CreatedAt bool
+	Tags      bool
+	Media     bool
+}
+
+func (s EventChecks) checks() validationChecks {
+	checks := validationChecks{
+		Signature: s.Mode != "off",
+		ID:        s.Mode != "off",
+		CreatedAt: s.Mode == "strict",
+		Tags:      s.Mode == "strict",
+		Media:     s.Mode == "strict",
+	}
+	override := func(check *bool, value *bool) {
+		if value != nil {
+			*check = *value
+		}
+	}
+	override(&checks.Signature, s.Signature)
+	override(&checks.ID, s.ID)
+	override(&checks.CreatedAt, s.CreatedAt)
+	override(&checks.Tags, s.Tags)
+	override(&checks.Media, s.Media)
+	return checks
+}
+
+// validationChecks are the checks in effect, the signature check being off
+// when SIG_VERIFY_SKIP is set.
+func (cfg *RelayConfig) validationChecks() validationChecks {
+	checks := cfg.Validation.checks()
+	if cfg.SigVerify.Skip {
+		checks.Signature = false
+	}
+	return checks
+}
+
+// setupValidation installs the created_at and tag checks, and takes the
+// websocket EVENTs from khatru.
+func setupValidation(relay *khatru.Relay, wire *wireServer, verifier *sigVerifier, cfg *RelayConfig, logger *Logger) {
+	checks := cfg.validationChecks()
+	if window := cfg.createdAtWindow(checks.CreatedAt); window.enabled() {
+		relay.RejectEvent = append(relay.RejectEvent, window.RejectEvent)
+	}
+	if checks.Tags {
+		relay.RejectEvent = append(relay.RejectEvent, rejectMalformedTags)
+	}
+	if checks.Media {
+		relay.RejectEvent = append(relay.RejectEvent, rejectMalformedMedia)
+	}
+	events := &wireEvents{relay: relay, checks: checks, verifier: verifier}
+	wire.inbound = append(wire.inbound, events.inbound)
+
+	if checks != (validationChecks{Signature: true, ID: true}) {
+		logger.Info("Event validation: %+v", checks)
+	}
+}
+
+// rejectMalformedTags refuses tags without a name and e, p and a tags whose
+// value isn't an event id, a pubkey or an address.
+func rejectMalformedTags(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	for i, tag := range event.Tags {
+		if len(tag) == 0 || tag[0] == "" {
+			return true, fmt.Sprintf("invalid: tag %d has no name", i)
+		}
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "e", "p":
+			if !isHexKey(tag[1]) {
+				return true, fmt.Sprintf("invalid: %s tag %d must hold 64 hex characters", tag[0], i)
+			}
+		case "a":
+			if !isAddress(tag[1]) {
+				return true, fmt.Sprintf("invalid: a tag %d must hold kind:pubkey:d-tag", i)
+			}
+		}
+	}
+	return false, ""
+}
+
+func isAddress(value string) bool {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || !isHexKey(parts[1]) {
+		return false
+	}
+	kind, err := strconv.Atoi(parts[0])
+	return err == nil && kind >= 0
+}
+
+// wireEvents handles the websocket EVENTs instead of khatru, which checks
+// every id and signature inline and can't be told not to, and applies
+// deletion requests before any policy runs. They are published the way gRPC
+// publishes them, their signature verified on the sigVerifier pool.
+// Deletions and NIP-70 protected events always need a valid id and
+// signature, whatever the checks.
+type wireEvents struct {
+	relay    *khatru.Relay
+	checks   validationChecks
+	verifier *sigVerifier
+}
+
+func (e *wireEvents) inbound(conn *wireConn, msg *wireMessage) {
+	env := msg.Envelope()
+	ctx := conn.Context()
+	if msg.Label() != "EVENT" || len(env) < 2 || ctx == nil {
+		return
+	}
+	var event nostr.Event
+	if json.Unmarshal(env[1], &event) != nil {
+		return
+	}
+
+	msg.drop = true
+	// like khatru, each message is handled in a goroutine of its own
+	go func() {
+		ok := nostr.OKEnvelope{EventID: event.ID}
+		if err := e.handle(ctx, &event); err != nil {
+			ok.Reason = err.Error()
+			if strings.HasPrefix(ok.Reason, "auth-required:") {
+				khatru.RequestAuth(ctx)
+			}
+		} else {
+			ok.OK = true
+		}
+		if ws := khatru.GetConnection(ctx); ws != nil {
+			ws.WriteJSON(ok)
+		}
+	}()
+}
+
+func (e *wireEvents) handle(ctx context.Context, event *nostr.Event) error {
+	protected := isProtected(event)
+	strict := protected || event.Kind == nostr.KindDeletion
+	if (e.checks.ID || strict) && !event.CheckID() {
+		return errors.New("invalid: id is computed incorrectly")
+	}
+	verify := e.verifier.verify
+	if strict {
+		verify = e.verifier.verifyAlways
+	}
+	if (e.checks.Signature || strict) && !verify(event) {
+		return errors.New("invalid: signature is invalid")
+	}
+
+	if protected {
+		switch authed := khatru.GetAuthed(ctx); authed {
+		case "":
+			return errors.New("auth-required: must be published by event author")
+		case event.PubKey:
+		default:
+			return errors.New("blocked: must be published by event author")
+		}
+	}
+	return publishEvent(ctx, e.relay, event)
+}
+
+// isProtected reports whether event carries the NIP-70 "-" tag.
+func isProtected(event *nostr.Event) bool {
+	return slices.ContainsFunc(event.Tags, func(tag nostr.Tag) bool { return len(tag) == 1 && tag[0] == "-" })
+}
+
+// publishEvent adds a checked event as khatru does an EVENT: it goes through
+// the policies and is stored, a deletion request then deletes its targets, and
+// accepted events are broadcast. Unlike khatru's, deletion requests only
+// delete anything once the policies have accepted them, and one refused for
+// its targets is not stored.
+func publishEvent(ctx context.Context, relay *khatru.Relay, event *nostr.Event) error {
+	var targets []*nostr.Event
+	if event.Kind == nostr.KindDeletion {
+		var err error
+		if targets, err = deletionTargets(ctx, relay, event); err != nil {
+			return err
+		}
+	}
+	skipBroadcast, err := relay.AddEvent(ctx, event)
+	if err == nil {
+		err = deleteTargets(ctx, relay, targets)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, overwrite := range relay.OverwriteResponseEvent {
+		overwrite(ctx, event)
+	}
+	if !skipBroadcast {
+		relay.BroadcastEvent(event)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package testingrelay
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// forged is a valid event whose signature is another event's.
+func forged(t *testing.T, sk string, kind int, tags nostr.Tags) *nostr.Event {
+	t.Helper()
+
+	event := signedEvent(t, sk, kind, "forged", tags)
+	event.Sig = signedEvent(t, sk, kind, "other", tags).Sig
+	return event
+}
+
+func TestEventChecksModes(t *testing.T) {
+	on, off := true, false
+	tests := []struct {
+		name     string
+		settings EventChecks
+		want     validationChecks
+	}{
+		{
+			name:     "strict",
+			settings: EventChecks{Mode: "strict"},
+			want:     validationChecks{Signature: true, ID: true, CreatedAt: true, Tags: true, Media: true},
+		},
+		{
+			name:     "lenient",
+			settings: EventChecks{Mode: "lenient"},
+			want:     validationChecks{Signature: true, ID: true},
+		},
+		{
+			name:     "off",
+			settings: EventChecks{Mode: "off"},
+			want:     validationChecks{},
+		},
+		{
+			name:     "overrides",
+			settings: EventChecks{Mode: "lenient", Signature: &off, Tags: &on},
+			want:     validationChecks{ID: true, Tags: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.settings.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.settings.checks(); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if err := (EventChecks{Mode: "paranoid"}).Validate(); err == nil {
+		t.Fatal("unknown mode accepted")
+	}
+}
+
+func TestWebsocketEventChecks(t *testing.T) {
+	badID := signedEvent(t, "", nostr.KindTextNote, "signed", nil)
+	badID.Content = "tampered"
+	// wrongID keeps the signature valid, as it covers the content, not the id
+	wrongID := func(event *nostr.Event) *nostr.Event {
+		event.ID = strings.Repeat("f", 64)
+		return event
+	}
+	idOff := func(cfg *RelayConfig) {
+		off := false
+		cfg.Validation.ID = &off
+		cfg.SigVerify.Workers = 2
+	}
+	tests := []struct {
+		name      string
+		configure func(cfg *RelayConfig)
+		event     *nostr.Event
+		refusal   string
+	}{
+		{
+			name:  "valid",
+			event: signedEvent(t, "", nostr.KindTextNote, "valid", nil),
+		},
+		{
+			name:    "bad signature",
+			event:   forged(t, "", nostr.KindTextNote, nil),
+			refusal: "invalid: signature is invalid",
+		},
+		{
+			name:    "bad id",
+			event:   badID,
+			refusal: "invalid: id is computed incorrectly",
+		},
+		{
+			name:      "id check off",
+			configure: idOff,
+			event:     wrongID(signedEvent(t, "", nostr.KindTextNote, "wrong id", nil)),
+		},
+		{
+			name:      "id check off, bad signature",
+			configure: idOff,
+			event:     wrongID(forged(t, "", nostr.KindTextNote, nil)),
+			refusal:   "invalid: signature is invalid",
+		},
+		{
+			name:      "verification skipped",
+			configure: func(cfg *RelayConfig) { cfg.SigVerify.Skip = true },
+			event:     forged(t, "", nostr.KindTextNote, nil),
+		},
+		{
+			name: "signature check off",
+			configure: func(cfg *RelayConfig) {
+				off := false
+				cfg.Validation.Signature = &off
+			},
+			event: forged(t, "", nostr.KindTextNote, nil),
+		},
+		{
+			name:      "deletions always verified",
+			configure: func(cfg *RelayConfig) { cfg.SigVerify.Skip = true },
+			event:     forged(t, "", nostr.KindDeletion, nostr.Tags{{"e", strings.Repeat("0", 64)}}),
+			refusal:   "invalid: signature is invalid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay, url := serveTestRelay(t, tt.configure)
+			conn := connect(t, url)
+
+			if refusal := publish(t, conn, tt.event); refusal != tt.refusal {
+				t.Fatalf("got refusal %q, want %q", refusal, tt.refusal)
+			}
+			// read from the store, as the client drops events with a bad signature
+			ids := storedIDs(t, relay.instances[0].writes, nostr.Filter{IDs: []string{tt.event.ID}})
+			if stored := len(ids) == 1; stored != (tt.refusal == "") {
+				t.Fatalf("event stored: %v, refusal %q", stored, tt.refusal)
+			}
+		})
+	}
+}
+
+func TestWebsocketProtectedEvents(t *testing.T) {
+	_, url := serveTestRelay(t, nil)
+	conn := connect(t, url)
+
+	event := signedEvent(t, "", nostr.KindTextNote, "protected", nostr.Tags{{"-"}})
+	if refusal := publish(t, conn, event); !strings.HasPrefix(refusal, "auth-required:") {
+		t.Fatalf("got refusal %q, want auth-required", refusal)
+	}
+}
+
+func TestWebsocketSignaturesOnPool(t *testing.T) {
+	_, url := serveTestRelay(t, nil)
+	conn := connect(t, url)
+	if refusal := publish(t, conn, signedEvent(t, "", nostr.KindTextNote, "pooled", nil)); refusal != "" {
+		t.Fatalf("publishing: %s", refusal)
+	}
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws") + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "relay_signature_verification_seconds_count 1\n") {
+		t.Fatalf("the websocket EVENT was not timed by the verifier pool:\n%s", body)
+	}
+}
@@ -0,0 +1,328 @@
+package testingrelay
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// processWide are the settings shared by every relay of the process, which a
+// relays entry can't set.
+var processWide = []string{
+	"port", "grpc_port", "listen", "tls", "http_timeout", "trusted_proxies", "drain_timeout", "record_file", "pprof",
+	"config_watch_interval", "log_format", "log_level", "debug",
+}
+
+// VirtualRelay is an entry of the config file's relays list: another relay
+// served by the process under its own hostname, path or both. The rest of the
+// entry holds settings like the top level of the file does, and they override
+// it. The DB, ban and payment files default to the root relay's with the
+// relay's id added, and the service URL to the root one with its host and
+// path, so each relay keeps its own events.
+//
+//	relays:
+//	  - path: /paid
+//	    pay: {backend: lnbits, url: https://legend.lnbits.com, key: ...}
+//	  - host: dms.localhost
+//	    allowed_kinds: [4, 1059]
+//	    auth_required_read: true
+type VirtualRelay struct {
+	Host string
+	Path string
+
+	vars  map[string]string // RELAY_* env vars the entry sets
+	extra fileOnly
+}
+
+// ID names the relay in logs and in the file names derived for it.
+func (v VirtualRelay) ID() string {
+	id := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' {
+			return r
+		}
+		return '-'
+	}, v.Host+v.Path)
+	return strings.Trim(id, "-")
+}
+
+func parseVirtualRelays(entries []map[string]any) ([]VirtualRelay, error) {
+	relays := make([]VirtualRelay, 0, len(entries))
+	ids := make(map[string]bool)
+	for i, entry := range entries {
+		var v VirtualRelay
+		if host, ok := entry["host"]; ok {
+			v.Host = strings.ToLower(fmt.Sprint(host))
+		}
+		if path, ok := entry["path"]; ok {
+			v.Path = fmt.Sprint(path)
+		}
+		switch {
+		case v.Host == "" && v.Path == "":
+			return nil, fmt.Errorf("relays[%d]: needs a host or a path", i)
+		case v.Path != "" && (!strings.HasPrefix(v.Path, "/") || strings.HasSuffix(v.Path, "/")):
+			return nil, fmt.Errorf("relays[%d]: path %q must start with / and not end with one", i, v.Path)
+		case ids[v.ID()]:
+			return nil, fmt.Errorf("relays[%d]: %s%s is already served", i, v.Host, v.Path)
+		}
+		ids[v.ID()] = true
+
+		// the settings without env vars are decoded like the top level ones
+		data, err := yaml.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("relays[%d]: %w", i, err)
+		}
+		if err := yaml.Unmarshal(data, &v.extra); err != nil {
+			return nil, fmt.Errorf("relays[%d]: %w", i, err)
+		}
+		if len(v.extra.Relays) > 0 {
+			return nil, fmt.Errorf("relays[%d]: relays can't be nested", i)
+		}
+
+		tree := make(map[string]any, len(entry))
+		for key, value := range entry {
+			tree[key] = value
+		}
+		for _, key := range []string{"host", "path", "kind_limits", "prune_kinds", "shards"} {
+			delete(tree, key)
+		}
+		for _, key := range processWide {
+			if _, ok := tree[key]; ok {
+				return nil, fmt.Errorf("relays[%d]: %s is shared by all relays and can only be set at the top level", i, key)
+			}
+		}
+		v.vars = make(map[string]string)
+		if err := flattenConfig("RELAY", tree, v.vars); err != nil {
+			return nil, fmt.Errorf("relays[%d]: %w", i, err)
+		}
+		relays = append(relays, v)
+	}
+	return relays, nil
+}
+
+// config returns the relay's configuration: the environment and the top level
+// of the file, as in base, overridden by the entry.
+func (v VirtualRelay) config(root RelayConfig, base fileOnly) (RelayConfig, error) {
+	extra := base
+	if v.extra.KindLimits != nil {
+		extra.KindLimits = v.extra.KindLimits
+	}
+	if v.extra.PruneKinds != nil {
+		extra.PruneKinds = v.extra.PruneKinds
+	}
+	if v.extra.Shards != nil {
+		extra.Shards = v.extra.Shards
+	}
+
+	restore := overlayEnv(v.vars)
+	cfg, err := processEnv(extra)
+	restore()
+	if err != nil {
+		return cfg, fmt.Errorf("relay %s: %w", v.ID(), err)
+	}
+
+	_, ownDB := v.vars["RELAY_DB_PATH"]
+	if _, ok := v.vars["RELAY_DATABASE_URL"]; ok && cfg.DBBackend == "postgres" {
+		ownDB = true
+	}
+	if !ownDB {
+		if cfg.DBBackend == "postgres" && !cfg.Ephemeral {
+			return cfg, fmt.Errorf("relay %s: postgres needs a database_url of its own", v.ID())
+		}
+		cfg.DBPath = suffixPath(cfg.DBPath, v.ID())
+	}
+	// shards inherited from the top level get files of their own too
+	if v.extra.Shards == nil && len(cfg.Shards) > 0 {
+		shards := make(Shards, len(cfg.Shards))
+		for i, shard := range cfg.Shards {
+			if shard.Backend == "postgres" && !cfg.Ephemeral {
+				return cfg, fmt.Errorf("relay %s: a postgres shard needs a shards list of its own", v.ID())
+			}
+			shard.Path = suffixPath(shard.Path, v.ID())
+			shards[i] = shard
+		}
+		cfg.Shards = shards
+	}
+	if _, ok := v.vars["RELAY_BAN_PATH"]; !ok {
+		cfg.Bans.Path = suffixPath(cfg.Bans.Path, v.ID())
+	}
+	if _, ok := v.vars["RELAY_BLACKHOLE_PATH"]; !ok {
+		cfg.BlackholePath = suffixPath(cfg.BlackholePath, v.ID())
+	}
+	if _, ok := v.vars["RELAY_PAY_PATH"]; !ok {
+		cfg.Payment.Path = suffixPath(cfg.Payment.Path, v.ID())
+	}
+	if _, ok := v.vars["RELAY_AUDIT_PATH"]; !ok {
+		cfg.Audit.Path = suffixPath(cfg.Audit.Path, v.ID())
+	}
+	if _, ok := v.vars["RELAY_BLOSSOM_DIR"]; !ok {
+		cfg.Blossom.Dir = suffixPath(cfg.Blossom.Dir, v.ID())
+	}
+	if _, ok := v.vars["RELAY_SERVICE_URL"]; !ok && root.ServiceURL != "" {
+		u, err := url.Parse(root.ServiceURL)
+		if err != nil {
+			return cfg, fmt.Errorf("relay %s: invalid SERVICE_URL: %w", v.ID(), err)
+		}
+		if v.Host != "" {
+			u.Host = v.Host
+			if port := u.Port(); port != "" {
+				u.Host = net.JoinHostPort(v.Host, port)
+			}
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + v.Path
+		cfg.ServiceURL = u.String()
+	}
+	return cfg, nil
+}
+
+// suffixPath adds id to the file name in path, before the extension.
+func suffixPath(path, id string) string {
+	if path == "" || path == ":memory:" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + id + ext
+}
+
+// overlayEnv sets vars in the environment and returns a function restoring
+// what was there before.
+func overlayEnv(vars map[string]string) (restore func()) {
+	previous := make(map[string]*string, len(vars))
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// relayConfigs returns the relays entries of the config file and the
+// configuration of every relay, keyed by id, with the root relay's as "".
+func relayConfigs(root RelayConfig, extra fileOnly) ([]VirtualRelay, map[string]RelayConfig, error) {
+	virtuals, err := parseVirtualRelays(extra.Relays)
+	if err != nil {
+		return nil, nil, err
+	}
+	extra.Relays = nil
+
+	configs := map[string]RelayConfig{"": root}
+	for _, v := range virtuals {
+		cfg, err := v.config(root, extra)
+		if err != nil {
+			return nil, nil, err
+		}
+		configs[v.ID()] = cfg
+	}
+	if err := checkDBPaths(configs); err != nil {
+		return nil, nil, err
+	}
+	return virtuals, configs, nil
+}
+
+// checkDBPaths fails if two relays would write to the same database.
+func checkDBPaths(configs map[string]RelayConfig) error {
+	owners := make(map[string]string)
+	for _, id := range sortedIDs(configs) {
+		cfg := configs[id]
+		if cfg.Ephemeral || cfg.DBBackend == "memory" {
+			continue
+		}
+		key := cfg.DBBackend + " " + cfg.DBPath
+		if owner, ok := owners[key]; ok {
+			return fmt.Errorf("relays %s and %s share the database %s", relayName(owner), relayName(id), cfg.DBPath)
+		}
+		owners[key] = id
+	}
+	return nil
+}
+
+// relayName is id for logs, where the root relay has none.
+func relayName(id string) string {
+	if id == "" {
+		return "root"
+	}
+	return id
+}
+
+func sortedIDs(configs map[string]RelayConfig) []string {
+	ids := make([]string, 0, len(configs))
+	for id := range configs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// virtualRoute sends the requests for a host, a path prefix or both to a relay.
+type virtualRoute struct {
+	host    string
+	path    string
+	handler http.Handler
+}
+
+// virtualRouter picks the relay for each request by the Host header, which
+// over TLS is the name the client asked for with SNI, and the path. Routes
+// with both a host and a path win over the others, then the longest path.
+// Anything unmatched goes to the root relay.
+type virtualRouter struct {
+	routes   []virtualRoute
+	fallback http.Handler
+}
+
+func newVirtualRouter(fallback http.Handler, routes []virtualRoute) *virtualRouter {
+	sort.SliceStable(routes, func(i, j int) bool {
+		if (routes[i].host != "") != (routes[j].host != "") {
+			return routes[i].host != ""
+		}
+		return len(routes[i].path) > len(routes[j].path)
+	})
+	return &virtualRouter{routes: routes, fallback: fallback}
+}
+
+func (vr *virtualRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for _, route := range vr.routes {
+		if route.host != "" && route.host != host {
+			continue
+		}
+		if route.path == "" {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, route.path)
+		if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+			continue
+		}
+		if rest == "" {
+			rest = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = rest
+		r2.URL.RawPath = ""
+		route.handler.ServeHTTP(w, r2)
+		return
+	}
+	vr.fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,222 @@
+package testingrelay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// wasmTimeout bounds how long a policy check may run. A check running out of
+// time is aborted, failing closed, and the module is instantiated again for
+// the next one.
+const wasmTimeout = time.Second
+
+// wasmInput is the JSON document handed to the module for every check. Only
+// one of Event and Filter is set.
+type wasmInput struct {
+	Event  *nostr.Event  `json:"event,omitempty"`
+	Filter *nostr.Filter `json:"filter,omitempty"`
+	IP     string        `json:"ip"`
+	Authed string        `json:"authed,omitempty"`
+}
+
+// wasmPolicy runs RejectEvent and RejectFilter policies compiled to
+// WebAssembly. The module must export its memory and:
+//
+//	alloc(size i32) i32                    reserves size bytes for the input
+//	reject_event(ptr i32, len i32) i64     optional, called for every event
+//	reject_filter(ptr i32, len i32) i64    optional, called for every filter
+//	free(ptr i32, len i32)                 optional, releases input and reply
+//
+// The input is a JSON wasmInput. The reject functions return 0 to accept, or
+// the pointer and length of a rejection message packed as ptr<<32 | len.
+// Reactor modules get _initialize run once at load; WASI is available, with
+// stdout and stderr going to the log.
+type wasmPolicy struct {
+	path     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	logger   *Logger
+
+	// module instances aren't safe for concurrent use
+	mu     sync.Mutex
+	module api.Module
+}
+
+func setupWasmPolicy(relay *khatru.Relay, path string, logger *Logger) error {
+	if path == "" {
+		return nil
+	}
+
+	p, err := loadWasmPolicy(path, logger)
+	if err != nil {
+		return err
+	}
+
+	var hooks []string
+	if p.module.ExportedFunction("reject_event") != nil {
+		relay.RejectEvent = append(relay.RejectEvent, p.RejectEvent)
+		hooks = append(hooks, "reject_event")
+	}
+	if p.module.ExportedFunction("reject_filter") != nil {
+		relay.RejectFilter = append(relay.RejectFilter, p.RejectFilter)
+		hooks = append(hooks, "reject_filter")
+	}
+	if len(hooks) == 0 {
+		return fmt.Errorf("%s exports neither reject_event nor reject_filter", path)
+	}
+
+	logger.Info("WASM policy enabled from %s with %v", path, hooks)
+	return nil
+}
+
+func loadWasmPolicy(path string, logger *Logger) (*wasmPolicy, error) {
+	ctx := context.Background()
+
+	binary, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// closing on context done is what lets a check time out
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, binary)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("compiling %s: %w", path, err)
+	}
+
+	output := logger.StdLogger(slog.LevelInfo).Writer()
+	p := &wasmPolicy{
+		path:     path,
+		runtime:  runtime,
+		compiled: compiled,
+		config: wazero.NewModuleConfig().
+			WithName("policy").
+			WithStdout(output).
+			WithStderr(output).
+			WithStartFunctions("_initialize"),
+		logger: logger,
+	}
+	if err := p.instantiate(); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+	if p.module.Memory() == nil || p.module.ExportedFunction("alloc") == nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("%s must export memory and alloc", path)
+	}
+	return p, nil
+}
+
+// instantiate starts a new instance of the module, replacing one closed by a
+// check that timed out.
+func (p *wasmPolicy) instantiate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), wasmTimeout)
+	defer cancel()
+
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, p.config)
+	if err != nil {
+		return fmt.Errorf("instantiating %s: %w", p.path, err)
+	}
+	p.module = module
+	return nil
+}
+
+func (p *wasmPolicy) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	return p.check(ctx, "reject_event", wasmInput{Event: event})
+}
+
+func (p *wasmPolicy) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	return p.check(ctx, "reject_filter", wasmInput{Filter: &filter})
+}
+
+func (p *wasmPolicy) check(ctx context.Context, name string, input wasmInput) (reject bool, msg string) {
+	input.IP = khatru.GetIP(ctx)
+	input.Authed = khatru.GetAuthed(ctx)
+
+	reply, err := p.call(ctx, name, input)
+	if err != nil {
+		p.logger.Error("WASM policy %s failed: %v", name, err)
+		return true, "error: policy check failed"
+	}
+	if reply == "" {
+		return false, ""
+	}
+	return true, nostr.NormalizeOKMessage(reply, "blocked")
+}
+
+// call runs one of the module's reject functions and returns the rejection
+// message, empty if accepted.
+func (p *wasmPolicy) call(ctx context.Context, name string, input wasmInput) (string, error) {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.module.IsClosed() {
+		p.logger.Info("WASM policy %s timed out earlier, instantiating it again", p.path)
+		if err := p.instantiate(); err != nil {
+			return "", err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, wasmTimeout)
+	defer cancel()
+
+	memory := p.module.Memory()
+	free := p.module.ExportedFunction("free")
+
+	results, err := p.module.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(results[0])
+	if !memory.Write(ptr, data) {
+		return "", errors.New("alloc returned memory out of range")
+	}
+	if free != nil {
+		defer free.Call(ctx, uint64(ptr), uint64(len(data)))
+	}
+
+	results, err = p.module.ExportedFunction(name).Call(ctx, uint64(ptr), uint64(len(data)))
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("%s: no answer within %s", name, wasmTimeout)
+	} else if err != nil {
+		return "", err
+	}
+	if results[0] == 0 {
+		return "", nil
+	}
+
+	replyPtr, replyLen := uint32(results[0]>>32), uint32(results[0])
+	reply, ok := memory.Read(replyPtr, replyLen)
+	if !ok {
+		return "", errors.New("reply out of memory range")
+	}
+	// copy before freeing, the slice is a view into module memory
+	msg := string(reply)
+	if free != nil {
+		free.Call(ctx, uint64(replyPtr), uint64(replyLen))
+	}
+	if msg == "" {
+		msg = "blocked: rejected by policy"
+	}
+	return msg, nil
+}
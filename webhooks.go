@@ -0,0 +1,262 @@
+package testingrelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Webhooks configures the notifications POSTed to URLs (WEBHOOK_*) as relay
+// activity happens. Events lists what is sent: event.saved, event.rejected,
+// connection.open and connection.close, all of them when empty. Kinds and
+// Pubkeys narrow the event notifications down to some kinds and authors.
+// With a Secret every body is signed with HMAC-SHA256 in the
+// X-Relay-Signature header. Failed deliveries are retried like downstream
+// publishes, and the ones that still fail are appended to the DeadLetter
+// JSONL file, or logged when there is none.
+type Webhooks struct {
+	URLs       []string      `envconfig:"URLS"`
+	Events     []string      `envconfig:"EVENTS"`
+	Kinds      []int         `envconfig:"KINDS"`
+	Pubkeys    []string      `envconfig:"PUBKEYS"`
+	Secret     string        `envconfig:"SECRET"`
+	Retries    int           `envconfig:"RETRIES" default:"5"`
+	Backoff    time.Duration `envconfig:"BACKOFF" default:"1s"`
+	DeadLetter string        `envconfig:"DEAD_LETTER"`
+}
+
+var webhookTypes = []string{"event.saved", "event.rejected", "connection.open", "connection.close"}
+
+func (w Webhooks) Validate() error {
+	for _, typ := range w.Events {
+		if !contains(webhookTypes, typ) {
+			return fmt.Errorf("invalid WEBHOOK_EVENTS entry %q, expected one of %v", typ, webhookTypes)
+		}
+	}
+	for _, pubkey := range w.Pubkeys {
+		if !isHexKey(pubkey) {
+			return fmt.Errorf("invalid WEBHOOK_PUBKEYS entry %q, expected 64 hex characters", pubkey)
+		}
+	}
+	if w.Retries < 0 || w.Backoff < 0 {
+		return fmt.Errorf("WEBHOOK_RETRIES and WEBHOOK_BACKOFF must not be negative")
+	}
+	return nil
+}
+
+const (
+	// webhookQueueSize bounds how many notifications may wait for each URL;
+	// more are dead-lettered right away.
+	webhookQueueSize = 1024
+
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookPayload is the JSON body of a notification.
+type webhookPayload struct {
+	Type   string       `json:"type"`
+	Time   int64        `json:"time"`
+	Event  *nostr.Event `json:"event,omitempty"`
+	Reason string       `json:"reason,omitempty"`
+	IP     string       `json:"ip,omitempty"`
+	Authed string       `json:"authed,omitempty"`
+}
+
+// deadLetter is a line of the dead-letter file.
+type deadLetter struct {
+	URL      string          `json:"url"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Time     int64           `json:"time"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type webhooks struct {
+	settings Webhooks
+	client   *http.Client
+	metrics  *Metrics
+	logger   *Logger
+	queues   map[string]chan []byte
+
+	mu         sync.Mutex
+	deadLetter *os.File
+}
+
+// setupWebhooks sends the notifications. It must come after every RejectEvent
+// policy so all rejections are seen. The returned function closes the
+// dead-letter file.
+func setupWebhooks(relay *khatru.Relay, settings Webhooks, metrics *Metrics, logger *Logger) (closeDeadLetter func() error, err error) {
+	closeDeadLetter = func() error { return nil }
+	if len(settings.URLs) == 0 {
+		return closeDeadLetter, nil
+	}
+
+	h := &webhooks{
+		settings: settings,
+		client:   &http.Client{Timeout: webhookTimeout},
+		metrics:  metrics,
+		logger:   logger,
+		queues:   make(map[string]chan []byte),
+	}
+	if settings.DeadLetter != "" {
+		if h.deadLetter, err = os.OpenFile(settings.DeadLetter, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644); err != nil {
+			return closeDeadLetter, err
+		}
+		closeDeadLetter = h.deadLetter.Close
+	}
+	for _, url := range settings.URLs {
+		queue := make(chan []byte, webhookQueueSize)
+		h.queues[url] = queue
+		go h.deliverLoop(url, queue)
+	}
+
+	if h.wants("event.saved") {
+		saved := func(ctx context.Context, event *nostr.Event) {
+			h.notifyEvent(ctx, "event.saved", event, "")
+		}
+		relay.OnEventSaved = append(relay.OnEventSaved, saved)
+		relay.OnEphemeralEvent = append(relay.OnEphemeralEvent, saved)
+	}
+	if h.wants("event.rejected") {
+		for i, reject := range relay.RejectEvent {
+			relay.RejectEvent[i] = func(ctx context.Context, event *nostr.Event) (bool, string) {
+				rejected, msg := reject(ctx, event)
+				if rejected {
+					h.notifyEvent(ctx, "event.rejected", event, msg)
+				}
+				return rejected, msg
+			}
+		}
+	}
+	if h.wants("connection.open") {
+		relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+			h.notify(webhookPayload{Type: "connection.open", IP: khatru.GetIP(ctx)})
+		})
+	}
+	if h.wants("connection.close") {
+		relay.OnDisconnect = append(relay.OnDisconnect, func(ctx context.Context) {
+			h.notify(webhookPayload{Type: "connection.close", IP: khatru.GetIP(ctx), Authed: khatru.GetAuthed(ctx)})
+		})
+	}
+
+	logger.Info("Sending webhooks to %v", settings.URLs)
+	return closeDeadLetter, nil
+}
+
+func (h *webhooks) wants(typ string) bool {
+	return len(h.settings.Events) == 0 || contains(h.settings.Events, typ)
+}
+
+func (h *webhooks) notifyEvent(ctx context.Context, typ string, event *nostr.Event, reason string) {
+	if len(h.settings.Kinds) > 0 && !contains(h.settings.Kinds, event.Kind) {
+		return
+	}
+	if len(h.settings.Pubkeys) > 0 && !contains(h.settings.Pubkeys, event.PubKey) {
+		return
+	}
+	h.notify(webhookPayload{Type: typ, Event: event, Reason: reason, IP: khatru.GetIP(ctx), Authed: khatru.GetAuthed(ctx)})
+}
+
+func (h *webhooks) notify(payload webhookPayload) {
+	payload.Time = time.Now().Unix()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		h.logger.Error("Failed to encode %s webhook: %v", payload.Type, err)
+		return
+	}
+
+	for url, queue := range h.queues {
+		select {
+		case queue <- body:
+		default:
+			h.metrics.WebhookDelivery(url, "dropped")
+			h.dead(url, body, 0, fmt.Errorf("queue full"))
+		}
+	}
+}
+
+func (h *webhooks) deliverLoop(url string, queue chan []byte) {
+	for body := range queue {
+		attempts, err := h.deliver(url, body)
+		if err != nil {
+			h.metrics.WebhookDelivery(url, "failed")
+			h.dead(url, body, attempts, err)
+		} else {
+			h.metrics.WebhookDelivery(url, "ok")
+		}
+	}
+}
+
+// deliver POSTs body to url, retrying with exponential backoff while the
+// receiver can't be reached or answers 429 or 5xx. It returns how many
+// attempts were made.
+func (h *webhooks) deliver(url string, body []byte) (int, error) {
+	backoff := h.settings.Backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := h.post(url, body)
+		if err == nil || !retry || attempt > h.settings.Retries {
+			return attempt, err
+		}
+
+		h.logger.Debug("Webhook to %s failed, retrying in %s: %v", url, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, downstreamMaxBackoff)
+	}
+}
+
+func (h *webhooks) post(url string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "khatru-relay/"+version)
+	if h.settings.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.settings.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Relay-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("status %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+}
+
+// dead records a notification that couldn't be delivered.
+func (h *webhooks) dead(url string, body []byte, attempts int, err error) {
+	if h.deadLetter == nil {
+		h.logger.Error("Webhook to %s dropped after %d attempts: %v", url, attempts, err)
+		return
+	}
+
+	line, _ := json.Marshal(deadLetter{URL: url, Error: err.Error(), Attempts: attempts, Time: time.Now().Unix(), Payload: body})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, werr := h.deadLetter.Write(append(line, '\n')); werr != nil {
+		h.logger.Error("Failed to write the webhook dead letter for %s: %v", url, werr)
+	}
+}
@@ -0,0 +1,286 @@
+package testingrelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// sourceTimeout bounds one refresh of a remote whitelist source.
+const sourceTimeout = 5 * time.Minute
+
+// PubkeySources are the places whitelisted pubkeys are loaded from on top
+// of WHITELIST_PUBKEYS. File is checked for changes on the config watch
+// interval, URL and the followers are fetched again every Refresh. Files and
+// URLs hold one hex or npub key per line (# starts a comment) or a JSON array
+// of them. FollowsOf whitelists everyone whose kind 3 contact list on
+// FollowsRelays includes one of those pubkeys.
+type PubkeySources struct {
+	File          string        `envconfig:"FILE"`
+	URL           string        `envconfig:"URL"`
+	FollowsOf     []string      `envconfig:"FOLLOWS_OF"`
+	FollowsRelays []string      `envconfig:"FOLLOWS_RELAYS"`
+	Refresh       time.Duration `envconfig:"REFRESH" default:"5m"`
+}
+
+func (s PubkeySources) Configured() bool {
+	return s.File != "" || s.URL != "" || len(s.FollowsOf) > 0
+}
+
+func (s PubkeySources) Validate() error {
+	if len(s.FollowsOf) > 0 && len(s.FollowsRelays) == 0 {
+		return fmt.Errorf("WHITELIST_FOLLOWS_OF needs WHITELIST_FOLLOWS_RELAYS to look the contact lists up")
+	}
+	if (s.URL != "" || len(s.FollowsOf) > 0) && s.Refresh <= 0 {
+		return fmt.Errorf("WHITELIST_REFRESH must be positive")
+	}
+	return nil
+}
+
+// whitelistEnabled reports whether publishing is restricted to whitelisted
+// pubkeys from any source.
+func (cfg *RelayConfig) whitelistEnabled() bool {
+	return len(cfg.WhitelistPubkeys) > 0 || cfg.Whitelist.Configured() || len(cfg.WoT.Seeds) > 0 || cfg.Payment.Enabled()
+}
+
+// Whitelist decides who may publish: nobody is restricted unless the static
+// list or a source is set, and then a pubkey has to be in one of them. A
+// source that fails to load keeps its last good list.
+type Whitelist struct {
+	live    *LiveConfig
+	sources PubkeySources
+	logger  *Logger
+	tracked bool // a source was added with Track or Allow
+	checks  []func(pubkey string) bool
+
+	mu   sync.RWMutex
+	sets map[string]map[string]bool // by source
+}
+
+func NewWhitelist(live *LiveConfig, sources PubkeySources, logger *Logger) *Whitelist {
+	return &Whitelist{live: live, sources: sources, logger: logger, sets: make(map[string]map[string]bool)}
+}
+
+func (w *Whitelist) Enabled() bool {
+	return len(w.live.Load().WhitelistPubkeys) > 0 || w.sources.Configured() || w.tracked
+}
+
+func (w *Whitelist) Allowed(pubkey string) bool {
+	if contains(w.live.Load().WhitelistPubkeys, pubkey) {
+		return true
+	}
+
+	w.mu.RLock()
+	for _, set := range w.sets {
+		if set[pubkey] {
+			w.mu.RUnlock()
+			return true
+		}
+	}
+	w.mu.RUnlock()
+
+	for _, check := range w.checks {
+		if check(pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Whitelist) Attach(relay *khatru.Relay) {
+	relay.RejectEvent = append(relay.RejectEvent, func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+		if w.Enabled() && !w.Allowed(event.PubKey) {
+			return true, "blocked: pubkey not in whitelist"
+		}
+		return false, ""
+	})
+}
+
+// Start loads every source and keeps them up to date in the background,
+// until ctx is done.
+func (w *Whitelist) Start(ctx context.Context, watchInterval time.Duration) {
+	if w.sources.File != "" {
+		go w.watchFile(ctx, watchInterval)
+	}
+	if w.sources.URL != "" {
+		go w.refresh(ctx, "url", w.sources.Refresh, w.fetchURL)
+	}
+	if len(w.sources.FollowsOf) > 0 {
+		go w.refresh(ctx, "follows", w.sources.Refresh, w.fetchFollowers)
+	}
+}
+
+// Track adds a source that fetch loads every interval until ctx is done. It
+// must be called before the relay starts serving.
+func (w *Whitelist) Track(ctx context.Context, source string, interval time.Duration, fetch func(ctx context.Context) ([]string, error)) {
+	w.tracked = true
+	go w.refresh(ctx, source, interval, fetch)
+}
+
+// Allow adds a check that whitelists pubkeys outside the lists, like those
+// that paid. It must be called before the relay starts serving.
+func (w *Whitelist) Allow(check func(pubkey string) bool) {
+	w.tracked = true
+	w.checks = append(w.checks, check)
+}
+
+func (w *Whitelist) set(source string, pubkeys []string) {
+	set := make(map[string]bool, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		set[pubkey] = true
+	}
+
+	w.mu.Lock()
+	w.sets[source] = set
+	w.mu.Unlock()
+	w.logger.Info("Whitelist %s source loaded with %d pubkeys", source, len(set))
+}
+
+func (w *Whitelist) watchFile(ctx context.Context, interval time.Duration) {
+	var lastMod time.Time
+	for first := true; ; first = false {
+		if mod := modTime(w.sources.File); first || !mod.Equal(lastMod) {
+			lastMod = mod
+			if pubkeys, err := readWhitelistFile(w.sources.File); err != nil {
+				w.logger.Error("Failed to load whitelist file %s: %v", w.sources.File, err)
+			} else {
+				w.set("file", pubkeys)
+			}
+		}
+		if interval <= 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (w *Whitelist) refresh(ctx context.Context, source string, interval time.Duration, fetch func(ctx context.Context) ([]string, error)) {
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, sourceTimeout)
+		pubkeys, err := fetch(fetchCtx)
+		cancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			w.logger.Error("Failed to refresh whitelist %s source: %v", source, err)
+		default:
+			w.set(source, pubkeys)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (w *Whitelist) fetchURL(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.sources.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", w.sources.URL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parsePubkeyList(data)
+}
+
+// fetchFollowers returns the authors of the contact lists that include one
+// of the FollowsOf pubkeys.
+func (w *Whitelist) fetchFollowers(ctx context.Context) ([]string, error) {
+	pool := nostr.NewSimplePool(ctx)
+	filter := nostr.Filter{Kinds: []int{3}, Tags: nostr.TagMap{"p": w.sources.FollowsOf}}
+
+	var followers []string
+	for ie := range pool.FetchMany(ctx, w.sources.FollowsRelays, filter) {
+		followers = append(followers, ie.Event.PubKey)
+	}
+	if len(followers) == 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return followers, nil
+}
+
+func readWhitelistFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePubkeyList(data)
+}
+
+// parsePubkeyList reads a JSON array of keys or one key per line, skipping
+// blank lines and # comments.
+func parsePubkeyList(data []byte) ([]string, error) {
+	var entries []string
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+	}
+	return parsePubkeys(entries)
+}
+
+// parsePubkey accepts a pubkey as hex or npub and returns it as lowercase hex.
+func parsePubkey(s string) (string, error) {
+	if strings.HasPrefix(s, "npub1") {
+		prefix, value, err := nip19.Decode(s)
+		if err != nil || prefix != "npub" {
+			return "", fmt.Errorf("invalid npub %q", s)
+		}
+		return value.(string), nil
+	}
+	if s = strings.ToLower(s); !isHexKey(s) {
+		return "", fmt.Errorf("invalid pubkey %q, expected 64 hex characters or an npub", s)
+	}
+	return s, nil
+}
+
+func parsePubkeys(list []string) ([]string, error) {
+	pubkeys := make([]string, 0, len(list))
+	for _, s := range list {
+		pubkey, err := parsePubkey(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+	return pubkeys, nil
+}
@@ -0,0 +1,901 @@
+package testingrelay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+)
+
+// websocket opcodes, RFC 6455 section 5.2
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// close status codes, RFC 6455 section 7.4.1
+const (
+	closeNormal    = 1000
+	closeGoingAway = 1001
+	// a client that broke the relay's rules
+	closePolicyViolation = 1008
+	closeMessageTooBig   = 1009
+)
+
+type wireConnKey struct{}
+
+// wireMessage is a complete websocket message written by the relay, after
+// reassembling any fragmented frames.
+type wireMessage struct {
+	opcode  byte
+	payload []byte
+	raw     []byte // frames exactly as written, nil once the payload is rewritten
+
+	// set by outbound hooks. A delay holds back everything queued behind the
+	// message too, while latency counts from when it was queued, so steady
+	// traffic arrives late without slowing down. Urgent messages go ahead of
+	// the others queued and ignore both.
+	delay   time.Duration
+	latency time.Duration
+	drop    bool
+	urgent  bool
+	queued  time.Time
+
+	envelope []json.RawMessage
+	parsed   bool
+}
+
+// Label returns the nostr message type ("EVENT", "OK", "EOSE", ...), or an
+// empty string for control frames and payloads that aren't nostr envelopes.
+func (m *wireMessage) Label() string {
+	env := m.Envelope()
+	if len(env) == 0 {
+		return ""
+	}
+	var label string
+	json.Unmarshal(env[0], &label)
+	return label
+}
+
+// Envelope returns the message decoded as a JSON array.
+func (m *wireMessage) Envelope() []json.RawMessage {
+	if !m.parsed {
+		m.parsed = true
+		if m.opcode == opText {
+			json.Unmarshal(m.payload, &m.envelope)
+		}
+	}
+	return m.envelope
+}
+
+// SetPayload replaces the message contents; it will be re-encoded as a
+// single unfragmented frame.
+func (m *wireMessage) SetPayload(payload []byte) {
+	m.payload = payload
+	m.raw = nil
+	m.parsed = false
+	m.envelope = nil
+}
+
+func (m *wireMessage) bytes() []byte {
+	if m.raw != nil {
+		return m.raw
+	}
+	return encodeFrame(m.opcode, m.payload)
+}
+
+// outboundHook inspects each data message before it is queued for writing.
+type outboundHook func(conn *wireConn, msg *wireMessage)
+
+// inboundHook inspects each data message received from the client before
+// khatru reads it. Setting drop keeps it from khatru, every hook still sees it.
+type inboundHook func(conn *wireConn, msg *wireMessage)
+
+// wireSubscription is a REQ the client currently has open.
+type wireSubscription struct {
+	ID            string            `json:"id"`
+	Filters       []json.RawMessage `json:"filters"`
+	OpenedAt      time.Time         `json:"opened_at"`
+	Delivered     uint64            `json:"delivered"`
+	LastDelivered *time.Time        `json:"last_delivered,omitempty"`
+}
+
+// wireConn wraps the hijacked connection of a websocket so the relay can
+// observe and tamper with messages on the wire. Writes from the websocket
+// library are parsed into messages, passed through the outbound hooks and
+// handed to a writer goroutine that honours per-message delays in order.
+// Reads are parsed too, so inbound hooks see what the client sent and can
+// keep messages from khatru.
+type wireConn struct {
+	net.Conn
+	id          uint64
+	server      *wireServer
+	request     *http.Request
+	reader      io.Reader
+	connectedAt time.Time
+
+	// khatru's context for the connection, set once it is established
+	khatruCtx atomic.Value
+
+	mu        sync.Mutex
+	upgraded  bool
+	pending   []byte
+	current   *wireMessage
+	writeErr  atomic.Pointer[error]
+	queue     chan *wireMessage
+	urgent    chan *wireMessage
+	closing   chan struct{}
+	drained   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	throttle  *byteLimiter
+
+	// the reading state, only touched by the reading goroutine: the bytes
+	// read but not framed yet, the frames and payload of the message being
+	// received, and the frames khatru can read
+	inRaw        []byte
+	inFrames     []byte
+	inMessage    []byte
+	inOpcode     byte
+	inCompressed bool
+	inReady      []byte
+	readErr      error
+
+	// permessage-deflate, negotiated during the upgrade
+	deflate bool
+
+	subsMu sync.Mutex
+	subs   map[string]*wireSubscription
+	// subscriptions closed by the relay that khatru still serves
+	killed map[string]bool
+}
+
+// attach binds the hijacked connection and starts the writer.
+func (c *wireConn) attach(conn net.Conn, reader io.Reader) {
+	c.Conn = conn
+	c.reader = reader
+	c.connectedAt = time.Now()
+	c.queue = make(chan *wireMessage, c.server.slowReader.QueueSize)
+	c.urgent = make(chan *wireMessage, c.server.slowReader.QueueSize)
+	c.throttle = newByteLimiter(c.server.connThrottle)
+	c.closing = make(chan struct{})
+	c.drained = make(chan struct{})
+	c.subs = make(map[string]*wireSubscription)
+	c.killed = make(map[string]bool)
+	c.server.add(c)
+	go c.writeLoop()
+}
+
+// Read hands the websocket library the client's frames once each message is
+// complete and went through the inbound hooks, compressed messages inflated
+// since the library doesn't know the extension was negotiated.
+func (c *wireConn) Read(p []byte) (int, error) {
+	if max := c.server.readBuffer; max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(c.inReady) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		buf := make([]byte, len(p))
+		n, err := c.reader.Read(buf)
+		c.inRaw = append(c.inRaw, buf[:n]...)
+		c.readErr = err
+		if err := c.readFrames(); err != nil {
+			c.readErr = err
+		}
+	}
+
+	n := copy(p, c.inReady)
+	c.inReady = c.inReady[n:]
+	if len(c.inReady) == 0 {
+		c.inReady = nil
+	}
+	return n, nil
+}
+
+// readFrames reassembles the messages in the frames read so far, runs the
+// inbound hooks on them and moves those not dropped to c.inReady. Control
+// frames go through right away. A message growing past MaxMessageSize, as
+// declared by its frame headers or once inflated, closes the connection with
+// 1009 before the rest of it is buffered.
+func (c *wireConn) readFrames() error {
+	defer func() {
+		if len(c.inRaw) == 0 {
+			c.inRaw = nil
+		}
+	}()
+
+	max := c.server.relay.MaxMessageSize
+	for {
+		compressed := c.deflate && len(c.inRaw) > 0 && c.inRaw[0]&rsv1 != 0
+		if length, size := frameHeader(c.inRaw); size > 0 && max > 0 && c.inRaw[0]&0x0F < opClose {
+			if length > uint64(max) || int64(len(c.inMessage))+int64(length) > max {
+				return c.tooBig(fmt.Errorf("%w: over %d bytes", errMessageTooBig, max))
+			}
+		}
+		fin, opcode, payload, n := parseFrame(c.inRaw)
+		if n == 0 {
+			return nil
+		}
+		raw := c.inRaw[:n]
+		c.inRaw = c.inRaw[n:]
+		if opcode >= opClose {
+			c.inReady = append(c.inReady, raw...)
+			continue
+		}
+
+		// only the first frame of a message says whether it is compressed
+		if opcode != opContinuation {
+			c.inCompressed = compressed
+			c.inOpcode = opcode
+		}
+		c.inFrames = append(c.inFrames, raw...)
+		c.inMessage = append(c.inMessage, payload...)
+		if !fin {
+			continue
+		}
+
+		frames, message := c.inFrames, c.inMessage
+		c.inFrames, c.inMessage = nil, nil
+		if c.inCompressed {
+			var err error
+			if message, err = inflateMessage(message, max); err != nil {
+				if errors.Is(err, errMessageTooBig) {
+					return c.tooBig(err)
+				}
+				return err
+			}
+			frames = buildFrame(0x80|c.inOpcode, message, true)
+		}
+
+		msg := &wireMessage{opcode: c.inOpcode, payload: message}
+		c.trackInbound(msg)
+		for _, hook := range c.server.inbound {
+			hook(c, msg)
+		}
+		if !msg.drop {
+			c.inReady = append(c.inReady, frames...)
+		}
+	}
+}
+
+// tooBig closes the connection with 1009 and returns err, which ends the read.
+func (c *wireConn) tooBig(err error) error {
+	c.inRaw, c.inFrames, c.inMessage = nil, nil, nil
+	c.Disconnect(closeMessageTooBig, err.Error())
+	return err
+}
+
+func (c *wireConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closing:
+		return 0, net.ErrClosed
+	default:
+	}
+	if err := c.writeErr.Load(); err != nil {
+		return 0, *err
+	}
+
+	c.pending = append(c.pending, p...)
+
+	// the HTTP upgrade response goes out untouched
+	if !c.upgraded {
+		end := bytes.Index(c.pending, []byte("\r\n\r\n"))
+		if end == -1 {
+			return len(p), nil
+		}
+		c.upgraded = true
+		response := append([]byte(nil), c.pending[:end]...)
+		if c.deflate && bytes.HasPrefix(response, []byte("HTTP/1.1 101")) {
+			response = append(response, "\r\nSec-WebSocket-Extensions: "+permessageDeflate...)
+		}
+		c.enqueue(&wireMessage{raw: append(response, "\r\n\r\n"...)})
+		c.pending = c.pending[end+4:]
+	}
+
+	for {
+		fin, opcode, payload, n := parseFrame(c.pending)
+		if n == 0 {
+			break
+		}
+		raw := append([]byte(nil), c.pending[:n]...)
+		c.pending = c.pending[n:]
+
+		// control frames may be interleaved with fragments and pass straight through
+		if opcode >= opClose {
+			c.enqueue(&wireMessage{opcode: opcode, payload: payload, raw: raw})
+			continue
+		}
+
+		if c.current == nil {
+			c.current = &wireMessage{opcode: opcode}
+		}
+		c.current.payload = append(c.current.payload, payload...)
+		c.current.raw = append(c.current.raw, raw...)
+		if !fin {
+			continue
+		}
+
+		msg := c.current
+		c.current = nil
+		if c.isKilled(msg) {
+			continue
+		}
+		for _, hook := range c.server.outbound {
+			hook(c, msg)
+		}
+		if !msg.drop {
+			c.trackOutbound(msg)
+			c.enqueue(msg)
+		}
+	}
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+
+	return len(p), nil
+}
+
+// trackInbound keeps the set of open subscriptions up to date with REQ and CLOSE.
+func (c *wireConn) trackInbound(msg *wireMessage) {
+	env := msg.Envelope()
+	if len(env) < 2 {
+		return
+	}
+	var id string
+	if json.Unmarshal(env[1], &id) != nil {
+		return
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	switch msg.Label() {
+	case "REQ":
+		c.subs[id] = &wireSubscription{ID: id, Filters: env[2:], OpenedAt: time.Now()}
+		delete(c.killed, id)
+	case "CLOSE":
+		delete(c.subs, id)
+		delete(c.killed, id)
+	}
+}
+
+// isKilled reports whether msg belongs to a subscription KillSubscription
+// closed.
+func (c *wireConn) isKilled(msg *wireMessage) bool {
+	label := msg.Label()
+	if label != "EVENT" && label != "EOSE" {
+		return false
+	}
+	var id string
+	if env := msg.Envelope(); len(env) < 2 || json.Unmarshal(env[1], &id) != nil {
+		return false
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	return c.killed[id]
+}
+
+// trackOutbound counts deliveries and forgets subscriptions the relay CLOSED.
+func (c *wireConn) trackOutbound(msg *wireMessage) {
+	env := msg.Envelope()
+	if len(env) < 2 {
+		return
+	}
+	label := msg.Label()
+	if label != "EVENT" && label != "CLOSED" {
+		return
+	}
+	var id string
+	if json.Unmarshal(env[1], &id) != nil {
+		return
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	if label == "CLOSED" {
+		delete(c.subs, id)
+	} else if sub, ok := c.subs[id]; ok {
+		sub.Delivered++
+		now := time.Now()
+		sub.LastDelivered = &now
+	}
+}
+
+// ID returns the connection's sequence number, unique for the process lifetime.
+func (c *wireConn) ID() uint64 {
+	return c.id
+}
+
+// Context returns the context khatru handles the connection's EVENTs with,
+// or nil before the connection is established.
+func (c *wireConn) Context() context.Context {
+	ctx, _ := c.khatruCtx.Load().(context.Context)
+	return ctx
+}
+
+// Authed returns the pubkey the client authenticated as with NIP-42, if any.
+func (c *wireConn) Authed() string {
+	if ctx := c.Context(); ctx != nil {
+		return khatru.GetAuthed(ctx)
+	}
+	return ""
+}
+
+// Subscription returns a snapshot of the open subscription with the given id.
+func (c *wireConn) Subscription(id string) (wireSubscription, bool) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	sub, ok := c.subs[id]
+	if !ok {
+		return wireSubscription{}, false
+	}
+	return *sub, true
+}
+
+// Subscriptions returns a snapshot of the subscriptions open on this connection.
+func (c *wireConn) Subscriptions() []wireSubscription {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	subs := make([]wireSubscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, *sub)
+	}
+	return subs
+}
+
+// Inject queues an extra text message ahead of whatever is being processed.
+// It must only be called from within an outbound hook.
+func (c *wireConn) Inject(payload []byte) {
+	c.enqueue(&wireMessage{opcode: opText, payload: payload})
+}
+
+// Send queues a text message from outside the outbound hooks.
+func (c *wireConn) Send(payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enqueue(&wireMessage{opcode: opText, payload: payload})
+}
+
+// Shutdown ends every open subscription with CLOSED, sends a going-away close
+// frame and closes the connection once they are written.
+func (c *wireConn) Shutdown(reason string) {
+	c.mu.Lock()
+	for _, sub := range c.Subscriptions() {
+		payload, _ := json.Marshal([]string{"CLOSED", sub.ID, reason})
+		c.enqueue(&wireMessage{opcode: opText, payload: payload})
+	}
+	c.enqueue(&wireMessage{opcode: opClose, payload: binary.BigEndian.AppendUint16(nil, closeGoingAway)})
+	c.mu.Unlock()
+
+	c.Close()
+}
+
+// Disconnect sends a close frame with code and reason, cut to the 123 bytes a
+// close frame has room for, and closes the connection once it is written.
+func (c *wireConn) Disconnect(code uint16, reason string) {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.mu.Lock()
+	c.enqueue(&wireMessage{opcode: opClose, payload: append(binary.BigEndian.AppendUint16(nil, code), reason...)})
+	c.mu.Unlock()
+
+	c.Close()
+}
+
+// KillSubscription ends an open subscription with CLOSED as if the relay had
+// given up on it, and reports whether it was open. khatru isn't told, so
+// what it still sends for the subscription is dropped on the wire until the
+// client sends CLOSE or reuses the id; in that case live events matching the
+// old filters may still show up under it.
+func (c *wireConn) KillSubscription(id, reason string) bool {
+	c.subsMu.Lock()
+	_, ok := c.subs[id]
+	if ok {
+		delete(c.subs, id)
+		c.killed[id] = true
+	}
+	c.subsMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	payload, _ := json.Marshal([]string{"CLOSED", id, reason})
+	c.Send(payload)
+	return true
+}
+
+// Abort drops the underlying connection without a close handshake, the way a
+// crashing relay or a flaky network would.
+func (c *wireConn) Abort() {
+	c.Conn.Close()
+}
+
+func (c *wireConn) enqueue(msg *wireMessage) {
+	msg.queued = time.Now()
+	if msg.urgent {
+		select {
+		case c.urgent <- msg:
+		case <-c.closing:
+		case <-c.drained:
+		}
+		return
+	}
+	if msg.opcode == opText || msg.opcode == opBinary {
+		select {
+		case c.queue <- msg:
+			return
+		default:
+			if !c.overflow(msg) {
+				return
+			}
+		}
+	}
+	select {
+	case c.queue <- msg:
+	case <-c.closing:
+	case <-c.drained:
+	}
+}
+
+func (c *wireConn) writeLoop() {
+	defer close(c.drained)
+
+	for {
+		var msg *wireMessage
+		select {
+		case msg = <-c.urgent:
+		default:
+			select {
+			case msg = <-c.urgent:
+			case msg = <-c.queue:
+			case <-c.closing:
+				c.flush()
+				return
+			}
+		}
+
+		var wait time.Duration
+		if !msg.urgent {
+			wait = msg.delay
+			if msg.latency > 0 {
+				wait += max(0, time.Until(msg.queued.Add(msg.latency)))
+			}
+		}
+		frame := c.frame(msg)
+		wait = max(wait, c.throttle.reserve(len(frame)), c.server.throttle.reserve(len(frame)))
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.closing:
+			}
+		}
+		if _, err := c.Conn.Write(frame); err != nil {
+			// surface the error on the next write and make the reader notice too
+			c.writeErr.Store(&err)
+			c.Conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes what is already queued, urgent messages first, ignoring
+// delays.
+func (c *wireConn) flush() {
+	for _, queue := range []chan *wireMessage{c.urgent, c.queue} {
+		for drained := false; !drained; {
+			select {
+			case msg := <-queue:
+				if _, err := c.Conn.Write(c.frame(msg)); err != nil {
+					return
+				}
+			default:
+				drained = true
+			}
+		}
+	}
+}
+
+// frame returns msg as it goes on the wire, compressing data messages when
+// permessage-deflate was negotiated.
+func (c *wireConn) frame(msg *wireMessage) []byte {
+	if msg.opcode != opText && msg.opcode != opBinary {
+		return msg.bytes()
+	}
+	switch {
+	case c.deflate:
+		return fragmentFrames(msg.opcode, rsv1, deflateMessage(msg.payload), c.server.fragment)
+	case c.server.fragment != 0:
+		return fragmentFrames(msg.opcode, 0, msg.payload, c.server.fragment)
+	}
+	return msg.bytes()
+}
+
+func (c *wireConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.server.remove(c)
+		close(c.closing)
+		select {
+		case <-c.drained:
+		case <-time.After(time.Second):
+		}
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// frameHeader decodes the header of the websocket frame at the start of buf,
+// returning the payload length it declares and the header's size, masking key
+// included, or 0 if the header is still incomplete.
+func frameHeader(buf []byte) (length uint64, size int) {
+	if len(buf) < 2 {
+		return 0, 0
+	}
+	length = uint64(buf[1] & 0x7F)
+	size = 2
+
+	switch length {
+	case 126:
+		if len(buf) < size+2 {
+			return 0, 0
+		}
+		length = uint64(binary.BigEndian.Uint16(buf[size:]))
+		size += 2
+	case 127:
+		if len(buf) < size+8 {
+			return 0, 0
+		}
+		length = binary.BigEndian.Uint64(buf[size:])
+		size += 8
+	}
+
+	if buf[1]&0x80 != 0 {
+		if len(buf) < size+4 {
+			return 0, 0
+		}
+		size += 4
+	}
+	return length, size
+}
+
+// parseFrame decodes the websocket frame at the start of buf, returning the
+// number of bytes it occupies or 0 if the frame is still incomplete.
+func parseFrame(buf []byte) (fin bool, opcode byte, payload []byte, n int) {
+	length, pos := frameHeader(buf)
+	if pos == 0 || uint64(len(buf)-pos) < length {
+		return false, 0, nil, 0
+	}
+	fin = buf[0]&0x80 != 0
+	opcode = buf[0] & 0x0F
+	end := pos + int(length)
+
+	var mask []byte
+	if buf[1]&0x80 != 0 {
+		mask = buf[pos-4 : pos]
+	}
+
+	payload = append([]byte(nil), buf[pos:end]...)
+	if mask != nil {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, end
+}
+
+// encodeFrame builds a single unmasked server frame.
+func encodeFrame(opcode byte, payload []byte) []byte {
+	return buildFrame(0x80|opcode, payload, false)
+}
+
+// buildFrame builds a frame with the given first byte (flags and opcode). A
+// masked frame, as clients send, gets an all-zero key so the payload is left
+// as is.
+func buildFrame(first byte, payload []byte, masked bool) []byte {
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, first)
+
+	var mask byte
+	if masked {
+		mask = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		frame = append(frame, mask|byte(l))
+	case l <= 0xFFFF:
+		frame = append(frame, mask|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(l))
+	default:
+		frame = append(frame, mask|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	if masked {
+		frame = append(frame, 0, 0, 0, 0)
+	}
+
+	return append(frame, payload...)
+}
+
+// wireResponseWriter hands the websocket library a wireConn when it hijacks
+// the HTTP connection.
+type wireResponseWriter struct {
+	http.ResponseWriter
+	conn *wireConn
+}
+
+func (w *wireResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// keep reading through the hijacked buffer in case the client already sent something
+	w.conn.attach(conn, brw.Reader)
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// wireServer upgrades websocket requests over wireConns and keeps track of
+// the live ones. Hooks must be installed before it starts serving.
+type wireServer struct {
+	relay    *khatru.Relay
+	outbound []outboundHook
+	inbound  []inboundHook
+	// rejectConnection refuses websocket upgrades with a status of its
+	// choosing, where khatru's RejectConnection always answers 429
+	rejectConnection []func(r *http.Request) (status int, reason string)
+
+	// compression enables permessage-deflate for clients that offer it
+	compression bool
+	// readBuffer caps each read from the socket, 0 for no cap
+	readBuffer int
+	// fragment is the outbound frame size, 0 to keep the library's framing
+	// and -1 for a single frame per message
+	fragment   int
+	slowReader SlowReader
+	overflows  atomic.Uint64
+
+	// throttle is shared by all connections, connThrottle is the rate of each
+	throttle     *byteLimiter
+	connThrottle int
+
+	mu    sync.Mutex
+	conns map[*wireConn]struct{}
+}
+
+// wireConnIDs numbers the connections of every relay served by the process,
+// so ids stay unique in logs and session recordings.
+var wireConnIDs atomic.Uint64
+
+func newWireServer(relay *khatru.Relay) *wireServer {
+	relay.OnConnect = append(relay.OnConnect, func(ctx context.Context) {
+		if conn := getWireConn(khatru.GetConnection(ctx)); conn != nil {
+			conn.khatruCtx.Store(ctx)
+		}
+	})
+	return &wireServer{relay: relay, conns: make(map[*wireConn]struct{})}
+}
+
+// ServeHTTP runs khatru's websocket handler over a wireConn, unless
+// rejectConnection refuses the upgrade. The connection is stored in the
+// request context so it can be recovered later from khatru's connection with
+// getWireConn.
+func (s *wireServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, reject := range s.rejectConnection {
+		if status, reason := reject(r); status != 0 {
+			http.Error(w, reason, status)
+			return
+		}
+	}
+
+	conn := &wireConn{
+		id:      wireConnIDs.Add(1),
+		server:  s,
+		deflate: s.compression && offersDeflate(r.Header),
+	}
+	r = r.WithContext(context.WithValue(r.Context(), wireConnKey{}, conn))
+	conn.request = r
+
+	s.relay.HandleWebsocket(&wireResponseWriter{ResponseWriter: w, conn: conn}, r)
+}
+
+// Conn returns the connected websocket with the given id.
+func (s *wireServer) Conn(id uint64) (*wireConn, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		if conn.id == id {
+			return conn, true
+		}
+	}
+	return nil, false
+}
+
+// Conns returns the currently connected websockets.
+func (s *wireServer) Conns() []*wireConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := make([]*wireConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Shutdown shuts down every connected websocket as in wireConn.Shutdown,
+// returning ctx's error if they aren't all closed before it is done.
+func (s *wireServer) Shutdown(ctx context.Context, reason string) error {
+	var wg sync.WaitGroup
+	for _, conn := range s.Conns() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Shutdown(reason)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *wireServer) add(conn *wireConn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+}
+
+func (s *wireServer) remove(conn *wireConn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// getWireConn returns the wire connection behind a khatru websocket, if any.
+func getWireConn(ws *khatru.WebSocket) *wireConn {
+	if ws == nil || ws.Request == nil {
+		return nil
+	}
+	conn, _ := ws.Request.Context().Value(wireConnKey{}).(*wireConn)
+	return conn
+}
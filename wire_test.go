@@ -0,0 +1,78 @@
+package testingrelay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWireMessageTooBig(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+	}{
+		{
+			name:   "one frame",
+			frames: [][]byte{buildFrame(0x80|opText, make([]byte, 2000), true)},
+		},
+		{
+			// no frame is over the limit, the message they add up to is
+			name: "fragments",
+			frames: [][]byte{
+				buildFrame(opText, make([]byte, 600), true),
+				buildFrame(opContinuation, make([]byte, 600), true),
+				buildFrame(0x80|opContinuation, make([]byte, 600), true),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, url := serveTestRelay(t, func(cfg *RelayConfig) {
+				cfg.WebSocket.MaxMessageSize = 1000
+				cfg.Compression = false
+			})
+			conn, err := net.Dial("tcp", strings.TrimPrefix(url, "ws://"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			req, _ := http.NewRequest(http.MethodGet, "http"+strings.TrimPrefix(url, "ws"), nil)
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			r := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(r, req)
+			if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("upgrade: %v, %v", resp, err)
+			}
+
+			for _, frame := range tt.frames {
+				// the relay may hang up before the last fragment
+				conn.Write(frame)
+			}
+
+			// the close frame is the first thing the relay sends
+			header := make([]byte, 4)
+			if _, err := io.ReadFull(r, header); err != nil {
+				t.Fatalf("reading the close frame: %v", err)
+			}
+			if opcode := header[0] & 0x0F; opcode != opClose {
+				t.Fatalf("got opcode %#x, want a close frame", opcode)
+			}
+			if code := binary.BigEndian.Uint16(header[2:]); code != closeMessageTooBig {
+				t.Fatalf("got close code %d, want %d", code, closeMessageTooBig)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package testingrelay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// wotBatch is how many authors are asked for their contact lists at once.
+const wotBatch = 500
+
+// WoTSettings configure the web-of-trust policy: only the seeds and the
+// pubkeys within Depth follows of them may publish. Depth 1 trusts whom the
+// seeds follow, 2 also whom those follow, and so on. Contact lists (kind 3)
+// are fetched from Relays every Refresh.
+type WoTSettings struct {
+	Seeds   []string      `envconfig:"SEEDS"`
+	Depth   int           `envconfig:"DEPTH" default:"2"`
+	Relays  []string      `envconfig:"RELAYS"`
+	Refresh time.Duration `envconfig:"REFRESH" default:"1h"`
+}
+
+func (s WoTSettings) Validate() error {
+	if len(s.Seeds) == 0 {
+		return nil
+	}
+	if len(s.Relays) == 0 {
+		return fmt.Errorf("WOT_SEEDS needs WOT_RELAYS to fetch contact lists from")
+	}
+	if s.Depth < 0 {
+		return fmt.Errorf("WOT_DEPTH must not be negative")
+	}
+	if s.Refresh <= 0 {
+		return fmt.Errorf("WOT_REFRESH must be positive")
+	}
+	return nil
+}
+
+// setupWoT makes the web of trust a whitelist source. Until it is computed
+// for the first time nobody outside the other whitelist sources is accepted.
+func setupWoT(ctx context.Context, whitelist *Whitelist, settings WoTSettings, logger *Logger) {
+	if len(settings.Seeds) == 0 {
+		return
+	}
+
+	whitelist.Track(ctx, "wot", settings.Refresh, settings.trusted)
+	logger.Info("Web of trust enabled with %d seeds and depth %d from %v", len(settings.Seeds), settings.Depth, settings.Relays)
+}
+
+// trusted walks the follow graph breadth first from the seeds.
+func (s WoTSettings) trusted(ctx context.Context) ([]string, error) {
+	pool := nostr.NewSimplePool(ctx)
+
+	trusted := make(map[string]bool)
+	for _, seed := range s.Seeds {
+		trusted[seed] = true
+	}
+
+	frontier := s.Seeds
+	for hop := 0; hop < s.Depth && len(frontier) > 0; hop++ {
+		var next []string
+		for start := 0; start < len(frontier); start += wotBatch {
+			authors := frontier[start:min(start+wotBatch, len(frontier))]
+			lists := fetchContactLists(ctx, pool, s.Relays, authors)
+			// a partial graph would drop trusted pubkeys until the next refresh
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			for _, list := range lists {
+				for _, tag := range list.Tags {
+					if len(tag) >= 2 && tag[0] == "p" && isHexKey(tag[1]) && !trusted[tag[1]] {
+						trusted[tag[1]] = true
+						next = append(next, tag[1])
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+
+	pubkeys := make([]string, 0, len(trusted))
+	for pubkey := range trusted {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	return pubkeys, nil
+}
+
+// fetchContactLists returns the newest contact list of each author found on
+// any of the relays.
+func fetchContactLists(ctx context.Context, pool *nostr.SimplePool, relays, authors []string) map[string]*nostr.Event {
+	filter := nostr.Filter{Kinds: []int{3}, Authors: authors, Limit: len(authors)}
+
+	lists := make(map[string]*nostr.Event)
+	for ie := range pool.FetchMany(ctx, relays, filter) {
+		if current, ok := lists[ie.Event.PubKey]; !ok || isNewer(ie.Event, current) {
+			lists[ie.Event.PubKey] = ie.Event
+		}
+	}
+	return lists
+}